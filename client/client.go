@@ -0,0 +1,485 @@
+// Package client drives a running htManager over its REST API, as described by /api/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var NotFoundError = errors.New("not found")
+
+// ResponseError is an error returned by htManager, it matches NotFoundError for a 404 status.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+	// ReasonCode is the MQTT v5 reason code returned by the broker, if the error came from it.
+	ReasonCode *byte
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("htManager returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("htManager returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *ResponseError) Is(target error) bool {
+	return target == NotFoundError && e.StatusCode == http.StatusNotFound
+}
+
+// ApplyTemplateRequest lists the devices to apply a template to with their variables, devices matching Selector
+// are also included using Variables.
+type ApplyTemplateRequest struct {
+	Devices   map[string]map[string]string `json:"devices"`
+	Selector  *DeviceSelector              `json:"selector,omitempty"`
+	Variables map[string]string            `json:"variables,omitempty"`
+}
+
+type Client interface {
+	// GetDevices returns the devices matching the query and the number of matching devices before the offset and
+	// limit are applied.
+	GetDevices(query DeviceQuery) ([]DeviceInfo, int, error)
+	GetBrokers() ([]BrokerStatus, error)
+	RemoveDevice(deviceId string) error
+	GetDeviceInfo(deviceId string) (*DeviceInfo, error)
+	GetDeviceDiag(deviceId string) (*DeviceDiag, error)
+	GetDeviceStatus(deviceId string) (string, error)
+	GetDeviceProfile(deviceId string) (string, error)
+	SetDeviceProfile(deviceId string, profile string) error
+	RebootDevice(deviceId string) error
+	UpdateDevice(deviceId string, version string) error
+	GetDeviceCommands(deviceId string) ([]Command, error)
+	GetAvailableVersions(deviceId string) ([]string, error)
+	GetDeviceTopics(deviceId string) (*TopicsInfo, error)
+	GetDeviceTopicValues(deviceId string) (*TopicsValues, error)
+	GetDeviceMetadata(deviceId string) (*DeviceMetadata, error)
+	SetDeviceMetadata(deviceId string, metadata DeviceMetadata) error
+	GetJobs() ([]Job, error)
+	GetJob(jobId string) (*Job, error)
+	StartJob(request JobRequest) (*Job, error)
+	GetSchedules() ([]Schedule, error)
+	GetSchedule(scheduleId string) (*Schedule, error)
+	CreateSchedule(schedule Schedule) (*Schedule, error)
+	UpdateSchedule(schedule Schedule) (*Schedule, error)
+	DeleteSchedule(scheduleId string) error
+	// GetScheduleHistory returns the runs of the schedule, or of every schedule if scheduleId is empty.
+	GetScheduleHistory(scheduleId string) ([]ScheduleRun, error)
+	GetTemplates() ([]Template, error)
+	GetTemplate(name string) (*Template, error)
+	SaveTemplate(template Template) error
+	DeleteTemplate(name string) error
+	RenderTemplate(name string, deviceId string, variables map[string]string) (string, error)
+	ApplyTemplate(name string, request ApplyTemplateRequest) ([]DeviceResult, error)
+	// Backup writes a gzipped tar archive of the devices' profiles and metadata.
+	Backup(w io.Writer) error
+	Restore(r io.Reader, selector DeviceSelector) ([]DeviceResult, error)
+	// UploadFirmware adds an OTA file, named homething.<device type>.[app1.|app2.]<version>.ota, to the updates.
+	UploadFirmware(name string, r io.Reader) error
+	// WatchEvents passes the device events with the ids and types, all of them if empty, to handle until ctx is
+	// done, the stream ends or handle returns an error.
+	WatchEvents(ctx context.Context, ids []string, types []string, handle func(event Event) error) error
+}
+
+type client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+// NewClient returns a client of the htManager at baseURL, e.g. http://localhost:8080. The default HTTP client is
+// used if httpClient is nil.
+func NewClient(baseURL string, httpClient *http.Client) (Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid htManager URL %q: %w", baseURL, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid htManager URL %q: scheme must be http or https", baseURL)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &client{baseURL: base, httpClient: httpClient}, nil
+}
+
+// apiPath joins the path segments under /api, they are escaped when the request is sent.
+func apiPath(segments ...string) string {
+	return "/api/" + strings.Join(segments, "/")
+}
+
+// do sends the request and returns the response if its status is successful, the caller closes its body.
+func (c *client) do(method string, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	return c.doContext(context.Background(), method, path, query, contentType, body)
+}
+
+func (c *client) doContext(ctx context.Context, method string, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	requestURL := *c.baseURL
+	requestURL.Path += path
+	requestURL.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	responseError := &ResponseError{StatusCode: response.StatusCode}
+	errorResponse := struct {
+		Error      string `json:"error"`
+		ReasonCode *byte  `json:"reasonCode"`
+	}{}
+	if data, err := io.ReadAll(response.Body); err == nil && json.Unmarshal(data, &errorResponse) == nil {
+		responseError.Message = errorResponse.Error
+		responseError.ReasonCode = errorResponse.ReasonCode
+	}
+	return nil, responseError
+}
+
+// call sends the request and decodes the JSON response into result, if it isn't nil.
+func (c *client) call(method string, path string, query url.Values, contentType string, body io.Reader, result any) error {
+	response, err := c.do(method, path, query, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response to %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func (c *client) get(path string, query url.Values, result any) error {
+	return c.call(http.MethodGet, path, query, "", nil, result)
+}
+
+func (c *client) send(method string, path string, request any, result any) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return c.call(method, path, nil, "application/json", bytes.NewReader(data), result)
+}
+
+// selectorValues encodes the selector as the query parameters the API takes.
+func selectorValues(selector DeviceSelector) url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"broker":     selector.Broker,
+		"deviceType": selector.DeviceType,
+		"version":    selector.Version,
+		"capability": selector.Capability,
+		"group":      selector.Group,
+		"location":   selector.Location,
+		"owner":      selector.Owner,
+		"search":     selector.Search,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if len(selector.Ids) > 0 {
+		values.Set("id", strings.Join(selector.Ids, ","))
+	}
+	if len(selector.Tags) > 0 {
+		values.Set("tag", strings.Join(selector.Tags, ","))
+	}
+	if selector.Namespace != nil {
+		values.Set("namespace", *selector.Namespace)
+	}
+	if selector.Online != nil {
+		values.Set("online", strconv.FormatBool(*selector.Online))
+	}
+	return values
+}
+
+func queryValues(query DeviceQuery) url.Values {
+	values := selectorValues(query.Selector)
+	if query.Sort != "" {
+		sort := query.Sort
+		if query.Descending {
+			sort = "-" + sort
+		}
+		values.Set("sort", sort)
+	}
+	if query.Offset > 0 {
+		values.Set("offset", strconv.Itoa(query.Offset))
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	return values
+}
+
+func (c *client) GetDevices(query DeviceQuery) ([]DeviceInfo, int, error) {
+	response, err := c.do(http.MethodGet, apiPath("devices"), queryValues(query), "", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	deviceList := make([]DeviceInfo, 0)
+	if err := json.NewDecoder(response.Body).Decode(&deviceList); err != nil {
+		return nil, 0, fmt.Errorf("invalid device list: %w", err)
+	}
+	total, err := strconv.Atoi(response.Header.Get("X-Total-Count"))
+	if err != nil {
+		total = len(deviceList)
+	}
+	return deviceList, total, nil
+}
+
+func (c *client) GetBrokers() ([]BrokerStatus, error) {
+	brokers := make([]BrokerStatus, 0)
+	return brokers, c.get(apiPath("brokers"), nil, &brokers)
+}
+
+func (c *client) RemoveDevice(deviceId string) error {
+	return c.call(http.MethodDelete, apiPath("devices", deviceId), nil, "", nil, nil)
+}
+
+func (c *client) GetDeviceInfo(deviceId string) (*DeviceInfo, error) {
+	info := &DeviceInfo{}
+	if err := c.get(apiPath("devices", deviceId, "info"), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *client) GetDeviceDiag(deviceId string) (*DeviceDiag, error) {
+	diag := &DeviceDiag{}
+	if err := c.get(apiPath("devices", deviceId, "diag"), nil, diag); err != nil {
+		return nil, err
+	}
+	return diag, nil
+}
+
+func (c *client) GetDeviceStatus(deviceId string) (string, error) {
+	status := struct {
+		Status string `json:"status"`
+	}{}
+	err := c.get(apiPath("devices", deviceId, "status"), nil, &status)
+	return status.Status, err
+}
+
+func (c *client) GetDeviceProfile(deviceId string) (string, error) {
+	profile := struct {
+		Profile string `json:"profile"`
+	}{}
+	err := c.get(apiPath("devices", deviceId, "profile"), nil, &profile)
+	return profile.Profile, err
+}
+
+func (c *client) SetDeviceProfile(deviceId string, profile string) error {
+	return c.call(http.MethodPost, apiPath("devices", deviceId, "profile"), nil, "text/plain", strings.NewReader(profile), nil)
+}
+
+func (c *client) sendCommand(deviceId string, form url.Values) error {
+	return c.call(http.MethodPost, apiPath("devices", deviceId, "command"), nil, "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()), nil)
+}
+
+func (c *client) RebootDevice(deviceId string) error {
+	return c.sendCommand(deviceId, url.Values{"command": {RestartCommand}})
+}
+
+func (c *client) UpdateDevice(deviceId string, version string) error {
+	return c.sendCommand(deviceId, url.Values{"command": {UpdateCommand}, "version": {version}})
+}
+
+func (c *client) GetDeviceCommands(deviceId string) ([]Command, error) {
+	commands := make([]Command, 0)
+	return commands, c.get(apiPath("devices", deviceId, "commands"), nil, &commands)
+}
+
+func (c *client) GetAvailableVersions(deviceId string) ([]string, error) {
+	versions := struct {
+		Versions []string `json:"versions"`
+	}{}
+	err := c.get(apiPath("devices", deviceId, "update", "versions"), nil, &versions)
+	return versions.Versions, err
+}
+
+func (c *client) GetDeviceTopics(deviceId string) (*TopicsInfo, error) {
+	topics := &TopicsInfo{}
+	if err := c.get(apiPath("devices", deviceId, "topics"), nil, topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+func (c *client) GetDeviceTopicValues(deviceId string) (*TopicsValues, error) {
+	values := struct {
+		Values *TopicsValues `json:"values"`
+	}{}
+	if err := c.get(apiPath("devices", deviceId, "topics", "values"), nil, &values); err != nil {
+		return nil, err
+	}
+	return values.Values, nil
+}
+
+func (c *client) GetDeviceMetadata(deviceId string) (*DeviceMetadata, error) {
+	metadata := &DeviceMetadata{}
+	if err := c.get(apiPath("devices", deviceId, "metadata"), nil, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (c *client) SetDeviceMetadata(deviceId string, metadata DeviceMetadata) error {
+	return c.send(http.MethodPut, apiPath("devices", deviceId, "metadata"), metadata, nil)
+}
+
+func (c *client) GetJobs() ([]Job, error) {
+	response := struct {
+		Jobs []Job `json:"jobs"`
+	}{}
+	err := c.get(apiPath("jobs"), nil, &response)
+	return response.Jobs, err
+}
+
+func (c *client) GetJob(jobId string) (*Job, error) {
+	job := &Job{}
+	if err := c.get(apiPath("jobs", jobId), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (c *client) StartJob(request JobRequest) (*Job, error) {
+	job := &Job{}
+	if err := c.send(http.MethodPost, apiPath("jobs"), request, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (c *client) GetSchedules() ([]Schedule, error) {
+	response := struct {
+		Schedules []Schedule `json:"schedules"`
+	}{}
+	err := c.get(apiPath("schedules"), nil, &response)
+	return response.Schedules, err
+}
+
+func (c *client) GetSchedule(scheduleId string) (*Schedule, error) {
+	schedule := &Schedule{}
+	if err := c.get(apiPath("schedules", scheduleId), nil, schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+func (c *client) CreateSchedule(schedule Schedule) (*Schedule, error) {
+	created := &Schedule{}
+	if err := c.send(http.MethodPost, apiPath("schedules"), schedule, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *client) UpdateSchedule(schedule Schedule) (*Schedule, error) {
+	updated := &Schedule{}
+	if err := c.send(http.MethodPut, apiPath("schedules", schedule.Id), schedule, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (c *client) DeleteSchedule(scheduleId string) error {
+	return c.call(http.MethodDelete, apiPath("schedules", scheduleId), nil, "", nil, nil)
+}
+
+func (c *client) GetScheduleHistory(scheduleId string) ([]ScheduleRun, error) {
+	path := apiPath("schedules", "history")
+	if scheduleId != "" {
+		path = apiPath("schedules", scheduleId, "history")
+	}
+	response := struct {
+		History []ScheduleRun `json:"history"`
+	}{}
+	err := c.get(path, nil, &response)
+	return response.History, err
+}
+
+func (c *client) GetTemplates() ([]Template, error) {
+	response := struct {
+		Templates []Template `json:"templates"`
+	}{}
+	err := c.get(apiPath("templates"), nil, &response)
+	return response.Templates, err
+}
+
+func (c *client) GetTemplate(name string) (*Template, error) {
+	template := &Template{}
+	if err := c.get(apiPath("templates", name), nil, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func (c *client) SaveTemplate(template Template) error {
+	return c.send(http.MethodPut, apiPath("templates", template.Name), template, nil)
+}
+
+func (c *client) DeleteTemplate(name string) error {
+	return c.call(http.MethodDelete, apiPath("templates", name), nil, "", nil, nil)
+}
+
+func (c *client) RenderTemplate(name string, deviceId string, variables map[string]string) (string, error) {
+	request := struct {
+		DeviceId  string            `json:"deviceId"`
+		Variables map[string]string `json:"variables"`
+	}{DeviceId: deviceId, Variables: variables}
+	profile := struct {
+		Profile string `json:"profile"`
+	}{}
+	err := c.send(http.MethodPost, apiPath("templates", name, "render"), request, &profile)
+	return profile.Profile, err
+}
+
+func (c *client) ApplyTemplate(name string, request ApplyTemplateRequest) ([]DeviceResult, error) {
+	response := struct {
+		Results []DeviceResult `json:"results"`
+	}{}
+	err := c.send(http.MethodPost, apiPath("templates", name, "apply"), request, &response)
+	return response.Results, err
+}
+
+func (c *client) Backup(w io.Writer) error {
+	response, err := c.do(http.MethodGet, apiPath("backup"), nil, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+func (c *client) Restore(r io.Reader, selector DeviceSelector) ([]DeviceResult, error) {
+	response := struct {
+		Results []DeviceResult `json:"results"`
+	}{}
+	err := c.call(http.MethodPost, apiPath("restore"), selectorValues(selector), "application/gzip", r, &response)
+	return response.Results, err
+}
+
+func (c *client) UploadFirmware(name string, r io.Reader) error {
+	return c.call(http.MethodPut, apiPath("firmware", name), nil, "application/octet-stream", r, nil)
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordedRequest struct {
+	method      string
+	path        string
+	query       string
+	contentType string
+	body        string
+}
+
+func newTestClient(t *testing.T, status int, response string, header http.Header) (Client, *recordedRequest) {
+	t.Helper()
+	recorded := &recordedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*recorded = recordedRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery,
+			contentType: r.Header.Get("Content-Type"), body: string(body)}
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	c, err := NewClient(server.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, recorded
+}
+
+func TestClient_Requests(t *testing.T) {
+	online := true
+	tests := []struct {
+		name     string
+		response string
+		call     func(c Client) error
+		want     recordedRequest
+	}{
+		{
+			name:     "Devices query",
+			response: `[]`,
+			call: func(c Client) error {
+				_, _, err := c.GetDevices(DeviceQuery{
+					Selector: DeviceSelector{Ids: []string{"a", "b"}, Online: &online, Group: "kitchen"},
+					Sort:     "lastSeen", Descending: true, Limit: 10,
+				})
+				return err
+			},
+			want: recordedRequest{method: "GET", path: "/api/devices", query: "group=kitchen&id=a%2Cb&limit=10&online=true&sort=-lastSeen"},
+		},
+		{
+			name:     "Namespaced device",
+			response: `{"id": "lab:a1b2c3"}`,
+			call: func(c Client) error {
+				_, err := c.GetDeviceInfo("lab:a1b2c3")
+				return err
+			},
+			want: recordedRequest{method: "GET", path: "/api/devices/lab:a1b2c3/info"},
+		},
+		{
+			name:     "Update",
+			response: `{"status": "device update sent"}`,
+			call:     func(c Client) error { return c.UpdateDevice("a1b2c3", "v1.2.0") },
+			want: recordedRequest{method: "POST", path: "/api/devices/a1b2c3/command",
+				contentType: "application/x-www-form-urlencoded", body: "command=update&version=v1.2.0"},
+		},
+		{
+			name:     "Profile",
+			response: `{"profile": "p"}`,
+			call:     func(c Client) error { return c.SetDeviceProfile("a1b2c3", "p") },
+			want:     recordedRequest{method: "POST", path: "/api/devices/a1b2c3/profile", contentType: "text/plain", body: "p"},
+		},
+		{
+			name:     "Metadata",
+			response: `{"group": "kitchen"}`,
+			call: func(c Client) error {
+				return c.SetDeviceMetadata("a1b2c3", DeviceMetadata{Group: "kitchen"})
+			},
+			want: recordedRequest{method: "PUT", path: "/api/devices/a1b2c3/metadata", contentType: "application/json",
+				body: `{"group":"kitchen"}`},
+		},
+		{
+			name:     "All schedules history",
+			response: `{"history": []}`,
+			call: func(c Client) error {
+				_, err := c.GetScheduleHistory("")
+				return err
+			},
+			want: recordedRequest{method: "GET", path: "/api/schedules/history"},
+		},
+		{
+			name:     "Firmware",
+			response: `{"name": "homething.esp32.v1.2.0.ota"}`,
+			call: func(c Client) error {
+				return c.UploadFirmware("homething.esp32.v1.2.0.ota", strings.NewReader("firmware"))
+			},
+			want: recordedRequest{method: "PUT", path: "/api/firmware/homething.esp32.v1.2.0.ota",
+				contentType: "application/octet-stream", body: "firmware"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, got := newTestClient(t, http.StatusOK, tt.response, nil)
+			if err := tt.call(c); err != nil {
+				t.Fatalf("call error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("request = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_GetDevices(t *testing.T) {
+	c, _ := newTestClient(t, http.StatusOK, `[{"id": "a1b2c3"}, {"id": "d4e5f6"}]`,
+		http.Header{"X-Total-Count": {"12"}})
+	deviceList, total, err := c.GetDevices(DeviceQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetDevices() error = %v", err)
+	}
+	if len(deviceList) != 2 || deviceList[1].Id != "d4e5f6" || total != 12 {
+		t.Errorf("GetDevices() = %v, %d", deviceList, total)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	reasonCode := byte(0x87)
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		notFound bool
+		want     ResponseError
+	}{
+		{
+			name:     "Not found",
+			status:   http.StatusNotFound,
+			notFound: true,
+			want:     ResponseError{StatusCode: http.StatusNotFound},
+		},
+		{
+			name:     "Broker error",
+			status:   http.StatusInternalServerError,
+			response: `{"error": "not authorized", "reasonCode": 135}`,
+			want:     ResponseError{StatusCode: http.StatusInternalServerError, Message: "not authorized", ReasonCode: &reasonCode},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t, tt.status, tt.response, nil)
+			err := c.RebootDevice("a1b2c3")
+			var responseError *ResponseError
+			if !errors.As(err, &responseError) {
+				t.Fatalf("RebootDevice() error = %v, want a ResponseError", err)
+			}
+			if errors.Is(err, NotFoundError) != tt.notFound {
+				t.Errorf("errors.Is(NotFoundError) = %v, want %v", !tt.notFound, tt.notFound)
+			}
+			if responseError.StatusCode != tt.want.StatusCode || responseError.Message != tt.want.Message ||
+				(responseError.ReasonCode == nil) != (tt.want.ReasonCode == nil) ||
+				(tt.want.ReasonCode != nil && *responseError.ReasonCode != *tt.want.ReasonCode) {
+				t.Errorf("RebootDevice() error = %+v, want %+v", responseError, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient("localhost:8080", nil); err == nil {
+		t.Errorf("NewClient() without scheme succeeded")
+	}
+	if _, err := NewClient("http://localhost:8080", nil); err != nil {
+		t.Errorf("NewClient() error = %v", err)
+	}
+}
+
+func TestClient_WatchEvents(t *testing.T) {
+	stream := "event: gap\ndata: {}\n\n" +
+		": keepalive\n\n" +
+		"id: 7\nevent: value\ndata: {\"seq\":7,\"id\":\"a1b2c3\",\"type\":\"value\",\"data\":{\"topic_path\":[\"temp\",\"\"],\"value\":\"21\"}}\n\n"
+	c, got := newTestClient(t, http.StatusOK, stream, http.Header{"Content-Type": {"text/event-stream"}})
+	events := make([]Event, 0)
+	err := c.WatchEvents(context.Background(), []string{"a1b2c3"}, []string{"value"}, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WatchEvents() error = %v", err)
+	}
+	if got.query != "id=a1b2c3&type=value" {
+		t.Errorf("query = %s", got.query)
+	}
+	if len(events) != 2 || events[0].Type != GapEvent || events[1].Seq != 7 || events[1].Id != "a1b2c3" {
+		t.Fatalf("events = %+v", events)
+	}
+	value := ValueUpdate{}
+	if err := json.Unmarshal(events[1].Data, &value); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ValueUpdate{TopicPath: []string{"temp", ""}, Value: "21"}); !reflect.DeepEqual(value, want) {
+		t.Errorf("value = %+v, want %+v", value, want)
+	}
+}
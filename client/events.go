@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// GapEvent is sent first when the server no longer had all the events after the one the stream resumed from.
+	GapEvent = "gap"
+	// ValueEvent is a device publishing a topic value, its data is a ValueUpdate.
+	ValueEvent = "value"
+)
+
+// Event is a device event, Data is decoded according to Type, e.g. into a ValueUpdate for "value" events.
+type Event struct {
+	Seq  uint64          `json:"seq"`
+	Id   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (c *client) WatchEvents(ctx context.Context, ids []string, types []string, handle func(event Event) error) error {
+	query := url.Values{}
+	if len(ids) > 0 {
+		query.Set("id", strings.Join(ids, ","))
+	}
+	if len(types) > 0 {
+		query.Set("type", strings.Join(types, ","))
+	}
+	response, err := c.doContext(ctx, http.MethodGet, apiPath("events"), query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	scanner := bufio.NewScanner(response.Body)
+	eventType := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			event := Event{}
+			if err := json.Unmarshal([]byte(value), &event); err != nil {
+				return fmt.Errorf("invalid event: %w", err)
+			}
+			if event.Type == "" {
+				event.Type = eventType
+			}
+			if err := handle(event); err != nil {
+				return err
+			}
+		case "":
+			// A blank line ends an event, a line starting with ':' is a comment.
+			eventType = ""
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"time"
+)
+
+// The types below are those of the components in /api/openapi.json, the client doesn't depend on the server's
+// packages. TestTypes_OpenAPI keeps their fields in line with the document.
+
+// Commands sent to devices.
+const (
+	RestartCommand    = "restart"
+	UpdateCommand     = "update"
+	SetProfileCommand = "setprofile"
+	SetTopicCommand   = "settopic"
+)
+
+// States of a Command.
+const (
+	CommandPending      = "pending"
+	CommandAcknowledged = "acknowledged"
+	CommandTimedOut     = "timedOut"
+)
+
+type DeviceInfo struct {
+	Id           string          `json:"id"`
+	Namespace    string          `json:"namespace,omitempty"`
+	Broker       string          `json:"broker,omitempty"`
+	LastSeen     *time.Time      `json:"lastSeen,omitempty"`
+	Description  string          `json:"description"`
+	IPAddr       string          `json:"ip_addr"`
+	Version      string          `json:"version"`
+	DeviceType   string          `json:"deviceType"`
+	Memory       uint            `json:"memory"`
+	Capabilities []string        `json:"capabilities"`
+	Metadata     *DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// DeviceMetadata is information about a device kept by htManager rather than reported by the device.
+type DeviceMetadata struct {
+	Tags     []string `json:"tags,omitempty"`
+	Group    string   `json:"group,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Notes    string   `json:"notes,omitempty"`
+	Owner    string   `json:"owner,omitempty"`
+}
+
+type DeviceDiag struct {
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	Uptime   uint       `json:"uptime"`
+	MemInfo  struct {
+		Free uint `json:"free"`
+		Low  uint `json:"low"`
+	} `json:"mem"`
+	TaskInfo []struct {
+		Name         string `json:"name"`
+		StackMinLeft uint   `json:"stackMinLeft"`
+	} `json:"tasks,omitempty"`
+}
+
+// DeviceSelector picks a set of devices, fields left empty match every device.
+type DeviceSelector struct {
+	Ids        []string `json:"ids,omitempty"`
+	Namespace  *string  `json:"namespace,omitempty"`
+	Broker     string   `json:"broker,omitempty"`
+	DeviceType string   `json:"deviceType,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Capability string   `json:"capability,omitempty"`
+	Online     *bool    `json:"online,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Group      string   `json:"group,omitempty"`
+	Location   string   `json:"location,omitempty"`
+	Owner      string   `json:"owner,omitempty"`
+	// Search is matched case-insensitively against the id, description and IP address.
+	Search string `json:"search,omitempty"`
+}
+
+// DeviceQuery selects, sorts and pages the device list, it is sent as query parameters.
+type DeviceQuery struct {
+	Selector DeviceSelector
+	// Sort is the name of a DeviceInfo field.
+	Sort       string
+	Descending bool
+	Offset     int
+	// Limit is the maximum number of devices returned, 0 means no limit.
+	Limit int
+}
+
+// DeviceResult is the outcome of an operation applied to one of a set of devices.
+type DeviceResult struct {
+	Id    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// BrokerStatus is the health of the connection to an MQTT broker.
+type BrokerStatus struct {
+	Label     string `json:"label"`
+	Connected bool   `json:"connected"`
+	Devices   int    `json:"devices"`
+	Offline   int    `json:"offline"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Command is a command sent to a device and whether the device has acted on it.
+type Command struct {
+	Id       string    `json:"id"`
+	DeviceId string    `json:"deviceId"`
+	Name     string    `json:"command"`
+	State    string    `json:"state"`
+	Sent     time.Time `json:"sent"`
+	// Acknowledged is when the device was seen acting on the command, and AcknowledgedBy how.
+	Acknowledged   *time.Time `json:"acknowledged,omitempty"`
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+}
+
+// TopicDescription maps the names of a topic's elements to their type.
+type TopicDescription struct {
+	Pub map[string]int `json:"pub"`
+	Sub map[string]int `json:"sub"`
+}
+
+type TopicsInfo struct {
+	Topics map[string]TopicDescription `json:"topics"`
+}
+
+// TopicsValues holds the last values published by a device, by topic and element.
+type TopicsValues map[string]map[string]any
+
+// ValueUpdate is the data of a "value" event.
+type ValueUpdate struct {
+	TopicPath []string `json:"topic_path"`
+	Value     string   `json:"value"`
+}
+
+// JobCommand is an action run against a device, the fields used depend on the command.
+type JobCommand struct {
+	Command string `json:"command"`
+	Version string `json:"version,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// JobRequest runs the command against the devices matching the selector.
+type JobRequest struct {
+	Selector DeviceSelector `json:"selector"`
+	// All must be set to run the job on every device, an empty selector is rejected otherwise.
+	All bool `json:"all,omitempty"`
+	JobCommand
+}
+
+type DeviceJobResult struct {
+	Id       string     `json:"id"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type Job struct {
+	Id       string            `json:"id"`
+	Command  JobCommand        `json:"command"`
+	Selector DeviceSelector    `json:"selector"`
+	State    string            `json:"state"`
+	Created  time.Time         `json:"created"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Results  []DeviceJobResult `json:"results"`
+}
+
+// Schedule starts a job at a time, or repeatedly following a cron expression.
+type Schedule struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	Cron     string     `json:"cron,omitempty"`
+	At       *time.Time `json:"at,omitempty"`
+	TimeZone string     `json:"timeZone,omitempty"`
+	Enabled  bool       `json:"enabled"`
+	Job      JobRequest `json:"job"`
+	NextRun  *time.Time `json:"nextRun,omitempty"`
+}
+
+// ScheduleRun records a job started by a schedule and its outcome once the job has completed.
+type ScheduleRun struct {
+	ScheduleId string     `json:"scheduleId"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	JobId      string     `json:"jobId,omitempty"`
+	Succeeded  int        `json:"succeeded"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"`
+	// Missed is set when htManager wasn't running at the time of a one-off schedule, no job was started.
+	Missed bool `json:"missed,omitempty"`
+}
+
+// Template is a device profile with variables, rendered for each device it is applied to.
+type Template struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Variables   map[string]string `json:"variables"`
+	Profile     string            `json:"profile"`
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schema is the part of an OpenAPI schema the types are checked against.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	AllOf                []*schema          `json:"allOf"`
+}
+
+type schemaChecker struct {
+	t       *testing.T
+	schemas map[string]*schema
+}
+
+// resolve follows the reference and merges allOf into a single object schema.
+func (c *schemaChecker) resolve(s *schema) *schema {
+	if s.Ref != "" {
+		return c.resolve(c.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")])
+	}
+	if len(s.AllOf) == 0 {
+		return s
+	}
+	merged := &schema{Type: "object", Properties: map[string]*schema{}}
+	for _, part := range s.AllOf {
+		part = c.resolve(part)
+		for name, property := range part.Properties {
+			merged.Properties[name] = property
+		}
+		merged.Required = append(merged.Required, part.Required...)
+	}
+	return merged
+}
+
+// jsonFields returns the fields encoded by encoding/json, by name, with those of embedded structs.
+func jsonFields(typ reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for _, field := range reflect.VisibleFields(typ) {
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" || (field.Anonymous && tag == "") {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func (c *schemaChecker) check(path string, s *schema, typ reflect.Type) {
+	s = c.resolve(s)
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	kinds := map[string][]reflect.Kind{
+		"string":  {reflect.String},
+		"integer": {reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint64},
+		"number":  {reflect.Float64, reflect.Int, reflect.Uint},
+		"boolean": {reflect.Bool},
+		"array":   {reflect.Slice},
+		"object":  {reflect.Struct, reflect.Map},
+	}
+	switch {
+	case s.Type == "" || typ.Kind() == reflect.Interface:
+		// Any value.
+	case typ == reflect.TypeOf(time.Time{}):
+		if s.Type != "string" || s.Format != "date-time" {
+			c.t.Errorf("%s is a time, the schema a %s %s", path, s.Type, s.Format)
+		}
+	case !slices.Contains(kinds[s.Type], typ.Kind()):
+		c.t.Errorf("%s is a %s, the schema a %s", path, typ, s.Type)
+	case typ.Kind() == reflect.Slice && s.Items != nil:
+		c.check(path+"[]", s.Items, typ.Elem())
+	case typ.Kind() == reflect.Map && s.AdditionalProperties != nil:
+		c.check(path+"{}", s.AdditionalProperties, typ.Elem())
+	case typ.Kind() == reflect.Struct:
+		fields := jsonFields(typ)
+		for name, field := range fields {
+			property, ok := s.Properties[name]
+			if !ok {
+				c.t.Errorf("%s.%s is not in the schema", path, name)
+				continue
+			}
+			c.check(path+"."+name, property, field.Type)
+		}
+		for name := range s.Properties {
+			if _, ok := fields[name]; !ok {
+				c.t.Errorf("%s.%s is in the schema but not in %s", path, name, typ)
+			}
+		}
+		for _, name := range s.Required {
+			if field, ok := fields[name]; ok && strings.Contains(field.Tag.Get("json"), ",omitempty") {
+				c.t.Errorf("%s.%s is required but omitted when empty", path, name)
+			}
+		}
+	}
+}
+
+func TestTypes_OpenAPI(t *testing.T) {
+	data, err := os.ReadFile("../internal/web/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := struct {
+		Components struct {
+			Schemas map[string]*schema `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatalf("invalid openapi.json: %s", err)
+	}
+	checker := &schemaChecker{t: t, schemas: document.Components.Schemas}
+	for name, value := range map[string]any{
+		"DeviceInfo":           DeviceInfo{},
+		"DeviceMetadata":       DeviceMetadata{},
+		"DeviceDiag":           DeviceDiag{},
+		"DeviceSelector":       DeviceSelector{},
+		"DeviceResult":         DeviceResult{},
+		"BrokerStatus":         BrokerStatus{},
+		"Command":              Command{},
+		"TopicDescription":     TopicDescription{},
+		"TopicsInfo":           TopicsInfo{},
+		"JobCommand":           JobCommand{},
+		"JobRequest":           JobRequest{},
+		"DeviceJobResult":      DeviceJobResult{},
+		"Job":                  Job{},
+		"Schedule":             Schedule{},
+		"ScheduleRun":          ScheduleRun{},
+		"Template":             Template{},
+		"ApplyTemplateRequest": ApplyTemplateRequest{},
+		"DeviceTopicValues": struct {
+			Values TopicsValues `json:"values"`
+		}{},
+	} {
+		s, ok := checker.schemas[name]
+		if !ok {
+			t.Errorf("no %s schema", name)
+			continue
+		}
+		checker.check(name, s, reflect.TypeOf(value))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"htManager/internal/simulator"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var mqttHost string
+var mqttPort int
+var configPath string
+var deviceCount int
+var diagInterval time.Duration
+
+func main() {
+	flag.StringVar(&mqttHost, "host", "localhost", "hostname of the MQTT server to connect to.")
+	flag.IntVar(&mqttPort, "port", 1883, "Port number of the MQTT server to connect to.")
+	flag.StringVar(&configPath, "config", "", "YAML file describing the fleet to simulate.")
+	flag.IntVar(&deviceCount, "count", 5, "Number of devices to simulate when no config is given.")
+	flag.DurationVar(&diagInterval, "diag-interval", 0, "Interval between diag messages, overrides the config.")
+	flag.Parse()
+
+	config := simulator.DefaultFleetConfig(deviceCount)
+	if configPath != "" {
+		var err error
+		if config, err = simulator.LoadFleetConfig(configPath); err != nil {
+			log.Fatalf("Failed to load fleet config: %s", err)
+		}
+	}
+	if diagInterval > 0 {
+		config.DiagInterval = diagInterval
+	}
+
+	fleet, err := simulator.NewFleet(config, simulator.NewMQTTConnectionFactory(fmt.Sprintf("tcp://%s:%d", mqttHost, mqttPort)))
+	if err != nil {
+		log.Fatalf("Invalid fleet config: %s", err)
+	}
+	if err := fleet.Start(); err != nil {
+		log.Fatalf("Failed to start fleet: %s", err)
+	}
+	log.Printf("Simulating %d devices\n", len(fleet.Devices))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Println("Stopping simulated devices")
+	fleet.Stop()
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/devices"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	DeviceNotFoundError = errors.New("device not found")
+	NoProfileError      = errors.New("no profile in backup")
+)
+
+var unsafeNameRegExp = regexp.MustCompile("[^A-Za-z0-9_.-]+")
+
+// DeviceBackup is the content of each YAML file stored in a backup archive.
+type DeviceBackup struct {
+	Info    devices.DeviceInfo `yaml:"info"`
+	Profile string             `yaml:"profile"`
+}
+
+// Export writes a tar.gz archive containing the info and profile of every known device.
+func Export(d devices.Devices, w io.Writer) error {
+	backups := make([]DeviceBackup, 0)
+	for _, info := range d.GetDevices() {
+		backup := DeviceBackup{Info: info}
+		if profile := d.GetDeviceProfile(info.Id); profile != nil {
+			backup.Profile = *profile
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Info.Id < backups[j].Info.Id
+	})
+	return writeArchive(w, backups, time.Now())
+}
+
+// Restore re-applies the profiles found in the archive to the known devices matching the selector.
+func Restore(d devices.Devices, r io.Reader, selector devices.DeviceSelector) ([]devices.DeviceResult, error) {
+	backups, err := readArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]devices.DeviceResult, 0, len(backups))
+	for _, backup := range backups {
+		info := d.GetDeviceInfo(backup.Info.Id)
+		// Devices that are no longer known are only reported when they could have been selected.
+		if info == nil {
+			if !selector.IsEmpty() && !slices.Contains(selector.Ids, backup.Info.Id) {
+				continue
+			}
+		} else if !selector.Matches(info) {
+			continue
+		}
+		result := devices.DeviceResult{Id: backup.Info.Id}
+		if err := restoreDevice(d, info, backup); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func restoreDevice(d devices.Devices, info *devices.DeviceInfo, backup DeviceBackup) error {
+	if info == nil {
+		return DeviceNotFoundError
+	}
+	if backup.Profile == "" {
+		return NoProfileError
+	}
+	_, err := d.SetDeviceProfile(backup.Info.Id, backup.Profile)
+	return err
+}
+
+func backupFileName(info devices.DeviceInfo) string {
+	// Ids of devices in a named namespace contain a ':', which isn't allowed in file names everywhere.
+	name := unsafeNameRegExp.ReplaceAllString(info.Id, "_")
+	if description := strings.Trim(unsafeNameRegExp.ReplaceAllString(info.Description, "_"), "_"); description != "" {
+		name += "-" + description
+	}
+	return name + ".yaml"
+}
+
+func writeArchive(w io.Writer, backups []DeviceBackup, modTime time.Time) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, backup := range backups {
+		data, err := yaml.Marshal(&backup)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    backupFileName(backup.Info),
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func readArchive(r io.Reader) ([]DeviceBackup, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	backups := make([]DeviceBackup, 0)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, ".yaml") {
+			continue
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		backup := DeviceBackup{}
+		if err := yaml.Unmarshal(data, &backup); err != nil {
+			return nil, fmt.Errorf("%s: %s", header.Name, err)
+		}
+		if backup.Info.Id == "" {
+			return nil, fmt.Errorf("%s: missing device id", header.Name)
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"htManager/internal/devices"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeDevices implements the parts of devices.Devices used by Restore.
+type fakeDevices struct {
+	devices.Devices
+	infos    []devices.DeviceInfo
+	profiles map[string]string
+}
+
+func (f *fakeDevices) GetDeviceInfo(deviceId string) *devices.DeviceInfo {
+	for idx := range f.infos {
+		if f.infos[idx].Id == deviceId {
+			info := f.infos[idx]
+			return &info
+		}
+	}
+	return nil
+}
+
+func (f *fakeDevices) SetDeviceProfile(deviceId string, profile string) (string, error) {
+	if deviceId == "broken" {
+		return "", errors.New("broker timeout")
+	}
+	f.profiles[deviceId] = profile
+	return "setprofile-" + deviceId, nil
+}
+
+func Test_archiveRoundTrip(t *testing.T) {
+	backups := []DeviceBackup{
+		{
+			Info: devices.DeviceInfo{
+				Id:           "0123abcd",
+				Description:  "Hall sensor",
+				Version:      "v1.0.0",
+				DeviceType:   "esp8266",
+				Capabilities: []string{"flash1MB"},
+			},
+			Profile: "dht22:\n- name: hall\n  pin: 4\n",
+		},
+		{
+			Info:    devices.DeviceInfo{Id: "4567ef00", Capabilities: []string{}},
+			Profile: "",
+		},
+	}
+	buffer := bytes.Buffer{}
+	if err := writeArchive(&buffer, backups, time.Now()); err != nil {
+		t.Fatalf("writeArchive() error = %v", err)
+	}
+	got, err := readArchive(&buffer)
+	if err != nil {
+		t.Fatalf("readArchive() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, backups) {
+		t.Errorf("readArchive() = %v, want %v", got, backups)
+	}
+}
+
+func Test_backupFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		info devices.DeviceInfo
+		want string
+	}{
+		{name: "No description", info: devices.DeviceInfo{Id: "0123abcd"}, want: "0123abcd.yaml"},
+		{name: "Description", info: devices.DeviceInfo{Id: "0123abcd", Description: "Hall sensor"}, want: "0123abcd-Hall_sensor.yaml"},
+		{name: "Path in description", info: devices.DeviceInfo{Id: "0123abcd", Description: "../etc/"}, want: "0123abcd-.._etc.yaml"},
+		{name: "Namespace", info: devices.DeviceInfo{Id: "lab:0123abcd", Description: "Hall"}, want: "lab_0123abcd-Hall.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backupFileName(tt.info); got != tt.want {
+				t.Errorf("backupFileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	backups := []DeviceBackup{
+		{Info: devices.DeviceInfo{Id: "hall", DeviceType: "esp8266"}, Profile: "hall: {}\n"},
+		{Info: devices.DeviceInfo{Id: "attic", DeviceType: "esp32"}, Profile: "attic: {}\n"},
+		{Info: devices.DeviceInfo{Id: "cellar", DeviceType: "esp32"}},
+		{Info: devices.DeviceInfo{Id: "broken", DeviceType: "esp32"}, Profile: "broken: {}\n"},
+		{Info: devices.DeviceInfo{Id: "gone", DeviceType: "esp32"}, Profile: "gone: {}\n"},
+	}
+	archive := bytes.Buffer{}
+	if err := writeArchive(&archive, backups, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		selector     devices.DeviceSelector
+		wantResults  []devices.DeviceResult
+		wantProfiles map[string]string
+	}{
+		{
+			name:     "Every device",
+			selector: devices.DeviceSelector{},
+			wantResults: []devices.DeviceResult{
+				{Id: "attic"},
+				{Id: "broken", Error: "broker timeout"},
+				{Id: "cellar", Error: NoProfileError.Error()},
+				{Id: "gone", Error: DeviceNotFoundError.Error()},
+				{Id: "hall"},
+			},
+			wantProfiles: map[string]string{"hall": "hall: {}\n", "attic": "attic: {}\n"},
+		},
+		{
+			name:         "Ids",
+			selector:     devices.DeviceSelector{Ids: []string{"hall", "gone", "unknown"}},
+			wantResults:  []devices.DeviceResult{{Id: "gone", Error: DeviceNotFoundError.Error()}, {Id: "hall"}},
+			wantProfiles: map[string]string{"hall": "hall: {}\n"},
+		},
+		{
+			// Devices no longer known can't match a selector on their info, they aren't reported.
+			name:         "Device type",
+			selector:     devices.DeviceSelector{DeviceType: "esp32"},
+			wantResults:  []devices.DeviceResult{{Id: "attic"}, {Id: "broken", Error: "broker timeout"}, {Id: "cellar", Error: NoProfileError.Error()}},
+			wantProfiles: map[string]string{"attic": "attic: {}\n"},
+		},
+		{
+			name:         "No match",
+			selector:     devices.DeviceSelector{DeviceType: "rp2040"},
+			wantResults:  []devices.DeviceResult{},
+			wantProfiles: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDevices{profiles: map[string]string{}}
+			for _, backup := range backups {
+				if backup.Info.Id != "gone" {
+					fake.infos = append(fake.infos, backup.Info)
+				}
+			}
+			results, err := Restore(fake, bytes.NewReader(archive.Bytes()), tt.selector)
+			if err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			sort.Slice(results, func(i, j int) bool {
+				return results[i].Id < results[j].Id
+			})
+			if !reflect.DeepEqual(results, tt.wantResults) {
+				t.Errorf("Restore() = %+v, want %+v", results, tt.wantResults)
+			}
+			if !reflect.DeepEqual(fake.profiles, tt.wantProfiles) {
+				t.Errorf("profiles set = %v, want %v", fake.profiles, tt.wantProfiles)
+			}
+		})
+	}
+}
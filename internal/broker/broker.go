@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"fmt"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/devices"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Config is the configuration of the embedded MQTT broker.
+type Config struct {
+	// Address is the address the broker listens on for MQTT clients, e.g. :1883.
+	Address string
+	// Users maps user names to passwords, if empty any client can connect.
+	Users map[string]string
+}
+
+// Broker is an MQTT 3.1.1 broker running inside htManager, the devices manager connects to it in-process.
+type Broker struct {
+	server *mqtt.Server
+}
+
+// LoadUsers reads a YAML file mapping user names to passwords.
+func LoadUsers(path string) (map[string]string, error) {
+	users := map[string]string{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// NewBroker starts a broker listening on config.Address.
+func NewBroker(config Config) (*Broker, error) {
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+	if err := server.AddHook(new(auth.Hook), &auth.Options{Ledger: newLedger(config.Users)}); err != nil {
+		return nil, err
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: config.Address})); err != nil {
+		return nil, err
+	}
+	if err := server.Serve(); err != nil {
+		return nil, fmt.Errorf("failed to start MQTT broker: %w", err)
+	}
+	return &Broker{server: server}, nil
+}
+
+// newLedger allows authenticated clients to publish and subscribe to any topic.
+func newLedger(users map[string]string) *auth.Ledger {
+	ledger := &auth.Ledger{ACL: auth.ACLRules{{}}}
+	if len(users) == 0 {
+		ledger.Auth = auth.AuthRules{{Allow: true}}
+		return ledger
+	}
+	ledger.Users = auth.Users{}
+	for username, password := range users {
+		ledger.Users[username] = auth.UserRule{Username: auth.RString(username), Password: auth.RString(password)}
+	}
+	return ledger
+}
+
+// Transport returns a transport connected directly to the broker, without going through the network.
+func (b *Broker) Transport() devices.Transport {
+	return &inlineTransport{server: b.server, subscriptions: map[string]int{}}
+}
+
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
+
+type inlineTransport struct {
+	server        *mqtt.Server
+	lock          sync.Mutex
+	nextId        int
+	subscriptions map[string]int
+}
+
+// SetWill does nothing, the connection can't be lost without the broker stopping too.
+func (t *inlineTransport) SetWill(topic string, qos byte, retained bool, payload []byte) {
+}
+
+func (t *inlineTransport) Connect(onConnect func()) error {
+	onConnect()
+	return nil
+}
+
+func (t *inlineTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return t.server.Publish(topic, payload, retained, qos)
+}
+
+// Subscribe replaces the handler of an earlier subscription to the same topic, as a network client's would be.
+func (t *inlineTransport) Subscribe(topic string, qos byte, handler devices.MessageHandler) error {
+	t.lock.Lock()
+	t.nextId++
+	id := t.nextId
+	previousId, subscribed := t.subscriptions[topic]
+	t.subscriptions[topic] = id
+	t.lock.Unlock()
+	if subscribed {
+		if err := t.server.Unsubscribe(topic, previousId); err != nil {
+			return err
+		}
+	}
+	return t.server.Subscribe(topic, id, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handler(devices.Message{Topic: pk.TopicName, Payload: pk.Payload, Retained: pk.FixedHeader.Retain})
+	})
+}
+
+func (t *inlineTransport) Unsubscribe(topic string) error {
+	t.lock.Lock()
+	id, ok := t.subscriptions[topic]
+	delete(t.subscriptions, topic)
+	t.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.server.Unsubscribe(topic, id)
+}
+
+// IsConnected is always true, the transport doesn't use the network.
+func (t *inlineTransport) IsConnected() bool {
+	return true
+}
+
+func (t *inlineTransport) Disconnect() {
+	t.lock.Lock()
+	subscriptions := t.subscriptions
+	t.subscriptions = map[string]int{}
+	t.lock.Unlock()
+	for topic, id := range subscriptions {
+		t.server.Unsubscribe(topic, id)
+	}
+}
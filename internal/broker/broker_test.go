@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"htManager/internal/devices"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func connectClient(address string, username string, password string) (paho.Client, error) {
+	opts := paho.NewClientOptions()
+	opts.AddBroker("tcp://" + address)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetConnectRetry(false)
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	token.WaitTimeout(5 * time.Second)
+	return client, token.Error()
+}
+
+func TestBroker_Auth(t *testing.T) {
+	address := freeAddress(t)
+	broker, err := NewBroker(Config{Address: address, Users: map[string]string{"device": "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{name: "Valid user", username: "device", password: "secret"},
+		{name: "Wrong password", username: "device", password: "wrong", wantErr: true},
+		{name: "Unknown user", username: "other", password: "secret", wantErr: true},
+		{name: "Anonymous", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := connectClient(address, tt.username, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			client.Disconnect(0)
+		})
+	}
+}
+
+func TestBroker_Devices(t *testing.T) {
+	address := freeAddress(t)
+	broker, err := NewBroker(Config{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	client, err := connectClient(address, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+	// Published before the devices manager connects, it must be delivered as a retained message.
+	info := `{"ip":"10.0.0.2","description":"Hall","device":"esp32","mem":80,"version":"v1.0.0","capabilities":""}`
+	client.Publish("homething/a1b2/device/info", 0, true, info).WaitTimeout(5 * time.Second)
+
+	metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := devices.NewDevices(broker.Transport(), metadata, devices.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for d.GetDeviceInfo("a1b2") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info := d.GetDeviceInfo("a1b2"); info == nil || info.Description != "Hall" {
+		t.Fatalf("GetDeviceInfo() = %+v, want retained device", info)
+	}
+
+	commands := make(chan string, 1)
+	client.Subscribe("homething/a1b2/device/ctrl", 0, func(client paho.Client, message paho.Message) {
+		commands <- string(message.Payload())
+	}).WaitTimeout(5 * time.Second)
+	if _, err := d.RebootDevice("a1b2"); err != nil {
+		t.Fatalf("RebootDevice() error = %v", err)
+	}
+	select {
+	case command := <-commands:
+		if command != "restart" {
+			t.Errorf("command = %q, want restart", command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("command not received by client")
+	}
+}
+
+func TestBroker_MQTTv5(t *testing.T) {
+	address := freeAddress(t)
+	broker, err := NewBroker(Config{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	device := devices.NewMQTTv5Transport(devices.MQTTConfig{URL: "tcp://" + address, ClientId: "device"})
+	if err := device.Connect(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	defer device.Disconnect()
+	info := `{"ip":"10.0.0.2","description":"Hall","device":"esp32","mem":80,"version":"v1.0.0","capabilities":""}`
+	if err := device.Publish("homething/a1b2/device/info", 1, true, []byte(info)); err != nil {
+		t.Fatal(err)
+	}
+	// The device replies to every command on its response topic.
+	commands := make(chan devices.Message, 1)
+	err = device.Subscribe("homething/a1b2/device/ctrl", 1, func(message devices.Message) {
+		commands <- message
+		go device.(devices.PropertiesPublisher).PublishWithProperties(message.Properties.ResponseTopic, 1, false, []byte("ok"),
+			devices.PublishProperties{CorrelationData: message.Properties.CorrelationData})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := devices.NewMQTTv5Transport(devices.MQTTConfig{URL: "tcp://" + address, ClientId: "htManager"})
+	config := devices.DefaultConfig()
+	config.UserProperties = map[string]string{"site": "home"}
+	d, err := devices.NewDevices(transport, metadata, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+	responses := make(chan devices.DeviceUpdateEvent, 1)
+	d.RegisterUpdateNotificationClient(responseClient(responses))
+	deadline := time.Now().Add(5 * time.Second)
+	for d.GetDeviceInfo("a1b2") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := d.UpdateDevice("a1b2", "v1.1.0"); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	select {
+	case command := <-commands:
+		if string(command.Payload) != "update v1.1.0" || command.Properties == nil || command.Properties.MessageExpiry == 0 {
+			t.Fatalf("command = %q %+v, want update with expiry", command.Payload, command.Properties)
+		}
+		properties := command.Properties.UserProperties
+		if properties["site"] != "home" || properties["command-id"] != string(command.Properties.CorrelationData) {
+			t.Errorf("user properties = %v, want site and command-id", properties)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("command not received by device")
+	}
+	select {
+	case event := <-responses:
+		if response, ok := event.Data.(devices.CommandResponse); !ok || event.Id != "a1b2" || response.Payload != "ok" {
+			t.Errorf("event = %+v, want response from a1b2", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("response not received")
+	}
+}
+
+// slowSubscribeTransport subscribes after a delay, so that the messages a broker has queued for the session arrive
+// before htManager has subscribed again.
+type slowSubscribeTransport struct {
+	devices.Transport
+}
+
+func (t slowSubscribeTransport) SetDefaultHandler(handler devices.MessageHandler) {
+	t.Transport.(devices.DefaultHandlerSetter).SetDefaultHandler(handler)
+}
+
+func (t slowSubscribeTransport) Subscribe(topic string, qos byte, handler devices.MessageHandler) error {
+	time.Sleep(200 * time.Millisecond)
+	return t.Transport.Subscribe(topic, qos, handler)
+}
+
+func TestBroker_PersistentSession(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("MQTT v%d", version), func(t *testing.T) {
+			address := freeAddress(t)
+			broker, err := NewBroker(Config{Address: address})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer broker.Close()
+			metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			device, err := connectClient(address, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer device.Disconnect(0)
+			info := `{"ip":"10.0.0.2","description":"Hall","device":"esp32","mem":80,"version":"v1.0.0","capabilities":""}`
+			device.Publish("homething/c3d4/device/info", 1, true, info).WaitTimeout(5 * time.Second)
+
+			config := devices.DefaultConfig()
+			config.QoS.Subscribe = 1
+			mqttConfig := devices.MQTTConfig{URL: "tcp://" + address, ClientId: "htManager", PersistentSession: true,
+				ProtocolVersion: version}
+			connect := func(deviceId string) devices.Devices {
+				transport, err := devices.NewTransport(mqttConfig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				d, err := devices.NewDevices(slowSubscribeTransport{transport}, metadata, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				deadline := time.Now().Add(5 * time.Second)
+				for d.GetDeviceInfo(deviceId) == nil && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return d
+			}
+			// The retained info shows that the session's subscription has been made.
+			connect("c3d4").Close()
+
+			// The broker queues the message for htManager's session, and sends it as soon as htManager is back.
+			device.Publish("homething/a1b2/device/info", 1, false, info).WaitTimeout(5 * time.Second)
+			d := connect("a1b2")
+			defer d.Close()
+			if d.GetDeviceInfo("a1b2") == nil {
+				t.Errorf("device info queued for the session not received")
+			}
+		})
+	}
+}
+
+func TestInlineTransport_Resubscribe(t *testing.T) {
+	broker, err := NewBroker(Config{Address: freeAddress(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	transport := broker.Transport()
+	first := make(chan devices.Message, 10)
+	second := make(chan devices.Message, 10)
+	if err := transport.Subscribe("homething/#", 0, func(message devices.Message) { first <- message }); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Subscribe("homething/#", 0, func(message devices.Message) { second <- message }); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Publish("homething/a1b2/device/ctrl", 0, false, []byte("restart")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-second:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received by the new subscription")
+	}
+	// Give a duplicate delivery time to arrive.
+	time.Sleep(100 * time.Millisecond)
+	if len(first) != 0 || len(second) != 0 {
+		t.Errorf("deliveries to the old and new subscriptions = %d, %d extra, want none", len(first), len(second))
+	}
+}
+
+type responseClient chan devices.DeviceUpdateEvent
+
+func (c responseClient) DeviceUpdated(event devices.DeviceUpdateEvent) {
+	if event.Type == devices.ResponseMessage {
+		c <- event
+	}
+}
@@ -0,0 +1,188 @@
+// Package cli implements the htManager subcommands, which drive a running htManager through its API.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"htManager/client"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+)
+
+const DefaultServer = "http://localhost:8080"
+
+// Output formats.
+const (
+	TableOutput = "table"
+	JSONOutput  = "json"
+)
+
+var UsageError = errors.New("usage")
+
+const usage = `Usage:
+  htManager [server flags]                 run the server
+  htManager devices list [flags]           list the devices
+  htManager device <id> info               show a device's info
+  htManager device <id> reboot             restart a device
+  htManager device <id> update -version V  update a device's firmware
+  htManager device <id> commands           list the last commands sent to a device
+  htManager device <id> profile get        print a device's profile
+  htManager device <id> profile set [file] send a profile, read from stdin without a file
+  htManager device <id> topics watch       print a device's topic values as they change
+  htManager firmware upload <file>...      add OTA files to the server's updates
+
+Every command takes -server, -token, -output (table or json) and -config, the YAML file giving their defaults.`
+
+var commands = []string{"devices", "device", "firmware"}
+
+// Config holds the defaults of the command flags, read from the config file.
+type Config struct {
+	Server string `yaml:"server"`
+	// Token is sent as a bearer token, for a server behind an authenticating proxy.
+	Token  string `yaml:"token,omitempty"`
+	Output string `yaml:"output,omitempty"`
+}
+
+// DefaultConfigPath returns the path of the config file used when -config isn't given.
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "htManager", "cli.yaml")
+}
+
+// LoadConfig reads the config file, a missing file gives the defaults unless required is set.
+func LoadConfig(path string, required bool) (Config, error) {
+	config := Config{Server: DefaultServer, Output: TableOutput}
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// IsCommand reports whether the first argument is a subcommand rather than a server flag.
+func IsCommand(name string) bool {
+	return slices.Contains(commands, name)
+}
+
+// Run runs the subcommand given by args, without the program name.
+func Run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w:\n%s", UsageError, usage)
+	}
+	command := &command{stdin: stdin, stdout: stdout}
+	var err error
+	switch args[0] {
+	case "devices":
+		err = command.devices(args[1:])
+	case "device":
+		err = command.device(args[1:])
+	case "firmware":
+		err = command.firmware(args[1:])
+	default:
+		err = fmt.Errorf("%w: unknown command %q", UsageError, args[0])
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if errors.Is(err, UsageError) {
+		return fmt.Errorf("%w\n%s", err, usage)
+	}
+	return err
+}
+
+type command struct {
+	stdin  io.Reader
+	stdout io.Writer
+	flags  *flag.FlagSet
+	// The common flags.
+	configPath string
+	server     string
+	token      string
+	output     string
+	client     client.Client
+}
+
+// newFlags returns the flag set of a subcommand with the common flags.
+func (c *command) newFlags(name string) *flag.FlagSet {
+	c.flags = flag.NewFlagSet("htManager "+name, flag.ContinueOnError)
+	c.flags.SetOutput(c.stdout)
+	c.flags.StringVar(&c.configPath, "config", DefaultConfigPath(), "YAML file giving the server, token and output defaults.")
+	c.flags.StringVar(&c.server, "server", "", "URL of the htManager server, "+DefaultServer+" by default.")
+	c.flags.StringVar(&c.token, "token", "", "Bearer token sent to the server.")
+	c.flags.StringVar(&c.output, "output", "", "Output format, table or json.")
+	return c.flags
+}
+
+// parse parses the flags of the subcommand, applies the config file and connects the client.
+func (c *command) parse(args []string) error {
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	explicit := false
+	c.flags.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+	config, err := LoadConfig(c.configPath, explicit)
+	if err != nil {
+		return err
+	}
+	if c.server == "" {
+		c.server = config.Server
+	}
+	if c.token == "" {
+		c.token = config.Token
+	}
+	if c.output == "" {
+		c.output = config.Output
+	}
+	if c.output != TableOutput && c.output != JSONOutput {
+		return fmt.Errorf("%w: invalid output %q, expected table or json", UsageError, c.output)
+	}
+	httpClient := http.DefaultClient
+	if c.token != "" {
+		httpClient = &http.Client{Transport: &tokenTransport{token: c.token, base: http.DefaultTransport}}
+	}
+	c.client, err = client.NewClient(c.server, httpClient)
+	return err
+}
+
+// print writes the value as JSON, or as a table with the rows given by table.
+func (c *command) print(value any, table func(w io.Writer)) error {
+	if c.output == JSONOutput {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(request)
+}
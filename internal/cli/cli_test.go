@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeServer struct {
+	requests []string
+	bodies   []string
+	tokens   []string
+}
+
+// newFakeServer answers the API requests with canned responses, by method and path.
+func newFakeServer(t *testing.T, responses map[string]string) (*fakeServer, string) {
+	t.Helper()
+	fake := &fakeServer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.URL.Path
+		if r.URL.RawQuery != "" {
+			request += "?" + r.URL.RawQuery
+		}
+		body, _ := io.ReadAll(r.Body)
+		fake.requests = append(fake.requests, request)
+		fake.bodies = append(fake.bodies, string(body))
+		fake.tokens = append(fake.tokens, r.Header.Get("Authorization"))
+		response, ok := responses[request]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/api/devices" {
+			w.Header().Set("X-Total-Count", "3")
+		}
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func TestRun(t *testing.T) {
+	responses := map[string]string{
+		"GET /api/devices?group=kitchen&limit=2": `[
+			{"id": "a1b2c3", "description": "Kitchen light", "deviceType": "esp32", "version": "v1.1.0", "ip_addr": "10.0.0.2"},
+			{"id": "d4e5f6", "description": "Kitchen fan", "deviceType": "esp8266", "version": "v1.0.0", "ip_addr": "10.0.0.3"}
+		]`,
+		"POST /api/devices/a1b2c3/command": `{"status": "device update sent"}`,
+		"GET /api/devices/a1b2c3/profile":  `{"profile": "{\"name\":\"light\"}"}`,
+		"POST /api/devices/a1b2c3/profile": `{"profile": "{}"}`,
+	}
+	tests := []struct {
+		name         string
+		args         []string
+		stdin        string
+		wantErr      error
+		wantRequests []string
+		wantBodies   []string
+		wantOutput   string
+	}{
+		{
+			name:         "List table",
+			args:         []string{"devices", "list", "-group", "kitchen", "-limit", "2"},
+			wantRequests: []string{"GET /api/devices?group=kitchen&limit=2"},
+			wantOutput: "ID      DESCRIPTION    TYPE     VERSION  IP        LAST SEEN\n" +
+				"a1b2c3  Kitchen light  esp32    v1.1.0   10.0.0.2  -\n" +
+				"d4e5f6  Kitchen fan    esp8266  v1.0.0   10.0.0.3  -\n" +
+				"2 of 3 devices\n",
+		},
+		{
+			name:         "Update",
+			args:         []string{"device", "a1b2c3", "update", "--version", "v1.2.0", "-output", "json"},
+			wantRequests: []string{"POST /api/devices/a1b2c3/command"},
+			wantBodies:   []string{"command=update&version=v1.2.0"},
+			wantOutput:   "{\n  \"id\": \"a1b2c3\",\n  \"command\": \"update\",\n  \"status\": \"sent\"\n}\n",
+		},
+		{
+			name:         "Get profile",
+			args:         []string{"device", "a1b2c3", "profile", "get"},
+			wantRequests: []string{"GET /api/devices/a1b2c3/profile"},
+			wantOutput:   "{\"name\":\"light\"}\n",
+		},
+		{
+			name:         "Set profile from stdin",
+			args:         []string{"device", "a1b2c3", "profile", "set"},
+			stdin:        `{"name":"lamp"}`,
+			wantRequests: []string{"POST /api/devices/a1b2c3/profile"},
+			wantBodies:   []string{`{"name":"lamp"}`},
+			wantOutput:   "profile sent to a1b2c3\n",
+		},
+		{
+			name:    "Update without version",
+			args:    []string{"device", "a1b2c3", "update"},
+			wantErr: UsageError,
+		},
+		{
+			name:    "Unknown device command",
+			args:    []string{"device", "a1b2c3", "explode"},
+			wantErr: UsageError,
+		},
+		{
+			name:    "Invalid output",
+			args:    []string{"devices", "list", "-output", "xml"},
+			wantErr: UsageError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, url := newFakeServer(t, responses)
+			config := filepath.Join(t.TempDir(), "cli.yaml")
+			if err := os.WriteFile(config, []byte("server: "+url+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			stdout := &bytes.Buffer{}
+			err := Run(append(tt.args, "-config", config), strings.NewReader(tt.stdin), stdout)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if strings.Join(fake.requests, "\n") != strings.Join(tt.wantRequests, "\n") {
+				t.Errorf("requests = %v, want %v", fake.requests, tt.wantRequests)
+			}
+			if tt.wantBodies != nil && strings.Join(fake.bodies, "\n") != strings.Join(tt.wantBodies, "\n") {
+				t.Errorf("bodies = %v, want %v", fake.bodies, tt.wantBodies)
+			}
+			if tt.wantErr == nil && stdout.String() != tt.wantOutput {
+				t.Errorf("output =\n%s\nwant\n%s", stdout.String(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestRun_Config(t *testing.T) {
+	fake, url := newFakeServer(t, map[string]string{"GET /api/devices": `[]`})
+	config := filepath.Join(t.TempDir(), "cli.yaml")
+	if err := os.WriteFile(config, []byte("server: http://unused:8080\ntoken: secret\noutput: json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	// Flags override the config file.
+	if err := Run([]string{"devices", "list", "-config", config, "-server", url}, nil, stdout); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(fake.tokens) != 1 || fake.tokens[0] != "Bearer secret" {
+		t.Errorf("tokens = %v", fake.tokens)
+	}
+	if stdout.String() != "[]\n" {
+		t.Errorf("output = %q", stdout.String())
+	}
+
+	if err := Run([]string{"devices", "list", "-config", filepath.Join(t.TempDir(), "missing.yaml")}, nil, stdout); err == nil {
+		t.Errorf("Run() with a missing -config succeeded")
+	}
+}
+
+func TestFirmwareUpload(t *testing.T) {
+	fake, url := newFakeServer(t, map[string]string{
+		"PUT /api/firmware/homething.esp32.v1.2.0.ota": `{"name": "homething.esp32.v1.2.0.ota"}`,
+	})
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "homething.esp32.v1.2.0.ota")
+	if err := os.WriteFile(valid, []byte("firmware"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	err := Run([]string{"firmware", "upload", "-server", url, "-config", "", valid, filepath.Join(dir, "missing.ota")}, nil, stdout)
+	if err == nil || err.Error() != "1 of 2 uploads failed" {
+		t.Errorf("Run() error = %v", err)
+	}
+	if len(fake.bodies) != 1 || fake.bodies[0] != "firmware" {
+		t.Errorf("bodies = %v", fake.bodies)
+	}
+	if !strings.HasPrefix(stdout.String(), "homething.esp32.v1.2.0.ota  uploaded\nmissing.ota") {
+		t.Errorf("output = %q", stdout.String())
+	}
+}
@@ -0,0 +1,340 @@
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"htManager/client"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandResult is printed once a command was sent to a device.
+type CommandResult struct {
+	Id      string `json:"id"`
+	Command string `json:"command"`
+	Status  string `json:"status"`
+}
+
+// TopicValue is a device topic's value, topic is the topic path relative to the device.
+type TopicValue struct {
+	Topic string `json:"topic"`
+	Value any    `json:"value"`
+	Time  string `json:"time,omitempty"`
+}
+
+// FirmwareResult is printed for each uploaded OTA file.
+type FirmwareResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+func (c *command) devices(args []string) error {
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("%w: expected devices list", UsageError)
+	}
+	flags := c.newFlags("devices list")
+	ids := flags.String("id", "", "Comma separated device ids.")
+	selector := client.DeviceSelector{}
+	flags.StringVar(&selector.Broker, "broker", "", "Broker label.")
+	flags.StringVar(&selector.DeviceType, "type", "", "Device type.")
+	flags.StringVar(&selector.Version, "version", "", "Firmware version.")
+	flags.StringVar(&selector.Capability, "capability", "", "Capability.")
+	tags := flags.String("tag", "", "Comma separated tags.")
+	flags.StringVar(&selector.Group, "group", "", "Group.")
+	flags.StringVar(&selector.Location, "location", "", "Location.")
+	flags.StringVar(&selector.Owner, "owner", "", "Owner.")
+	flags.StringVar(&selector.Search, "search", "", "Text searched in the id, description and IP address.")
+	online := flags.String("online", "", "true for online devices only, false for offline ones.")
+	sortField := flags.String("sort", "", "Field to sort by, prefixed with - for descending order.")
+	query := client.DeviceQuery{}
+	flags.IntVar(&query.Offset, "offset", 0, "Number of devices to skip.")
+	flags.IntVar(&query.Limit, "limit", 0, "Maximum number of devices.")
+	if err := c.parse(args[1:]); err != nil {
+		return err
+	}
+	if *ids != "" {
+		selector.Ids = strings.Split(*ids, ",")
+	}
+	if *tags != "" {
+		selector.Tags = strings.Split(*tags, ",")
+	}
+	if *online != "" {
+		value, err := strconv.ParseBool(*online)
+		if err != nil {
+			return fmt.Errorf("%w: invalid online %q", UsageError, *online)
+		}
+		selector.Online = &value
+	}
+	query.Selector = selector
+	query.Sort = strings.TrimPrefix(*sortField, "-")
+	query.Descending = strings.HasPrefix(*sortField, "-")
+
+	deviceList, total, err := c.client.GetDevices(query)
+	if err != nil {
+		return err
+	}
+	return c.print(deviceList, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tDESCRIPTION\tTYPE\tVERSION\tIP\tLAST SEEN")
+		for _, info := range deviceList {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Id, info.Description, info.DeviceType, info.Version,
+				info.IPAddr, formatTime(info.LastSeen))
+		}
+		if total > len(deviceList) {
+			fmt.Fprintf(w, "%d of %d devices\n", len(deviceList), total)
+		}
+	})
+}
+
+func (c *command) device(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("%w: expected device <id> <command>", UsageError)
+	}
+	deviceId, action := args[0], args[1]
+	switch action {
+	case "info":
+		return c.deviceInfo(deviceId, args[2:])
+	case "reboot":
+		c.newFlags("device reboot")
+		if err := c.parse(args[2:]); err != nil {
+			return err
+		}
+		if err := c.client.RebootDevice(deviceId); err != nil {
+			return err
+		}
+		return c.printResult(CommandResult{Id: deviceId, Command: "restart", Status: "sent"})
+	case "update":
+		flags := c.newFlags("device update")
+		version := flags.String("version", "", "Firmware version to update to.")
+		if err := c.parse(args[2:]); err != nil {
+			return err
+		}
+		if *version == "" {
+			return fmt.Errorf("%w: update needs -version", UsageError)
+		}
+		if err := c.client.UpdateDevice(deviceId, *version); err != nil {
+			return err
+		}
+		return c.printResult(CommandResult{Id: deviceId, Command: "update", Status: "sent"})
+	case "commands":
+		return c.deviceCommands(deviceId, args[2:])
+	case "profile":
+		return c.profile(deviceId, args[2:])
+	case "topics":
+		if len(args) < 3 || args[2] != "watch" {
+			return fmt.Errorf("%w: expected device <id> topics watch", UsageError)
+		}
+		return c.watchTopics(deviceId, args[3:])
+	default:
+		return fmt.Errorf("%w: unknown device command %q", UsageError, action)
+	}
+}
+
+func (c *command) printResult(result CommandResult) error {
+	return c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s %s to %s\n", result.Command, result.Status, result.Id)
+	})
+}
+
+func (c *command) deviceInfo(deviceId string, args []string) error {
+	c.newFlags("device info")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	info, err := c.client.GetDeviceInfo(deviceId)
+	if err != nil {
+		return err
+	}
+	return c.print(info, func(w io.Writer) {
+		fmt.Fprintf(w, "Id\t%s\n", info.Id)
+		fmt.Fprintf(w, "Description\t%s\n", info.Description)
+		fmt.Fprintf(w, "Type\t%s\n", info.DeviceType)
+		fmt.Fprintf(w, "Version\t%s\n", info.Version)
+		fmt.Fprintf(w, "IP\t%s\n", info.IPAddr)
+		fmt.Fprintf(w, "Memory\t%d\n", info.Memory)
+		fmt.Fprintf(w, "Capabilities\t%s\n", strings.Join(info.Capabilities, ", "))
+		fmt.Fprintf(w, "Last seen\t%s\n", formatTime(info.LastSeen))
+	})
+}
+
+func (c *command) deviceCommands(deviceId string, args []string) error {
+	c.newFlags("device commands")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	commands, err := c.client.GetDeviceCommands(deviceId)
+	if err != nil {
+		return err
+	}
+	return c.print(commands, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tCOMMAND\tSTATE\tSENT\tACKNOWLEDGED")
+		for _, command := range commands {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", command.Id, command.Name, command.State,
+				formatTime(&command.Sent), formatTime(command.Acknowledged))
+		}
+	})
+}
+
+func (c *command) profile(deviceId string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: expected device <id> profile get|set", UsageError)
+	}
+	switch args[0] {
+	case "get":
+		c.newFlags("device profile get")
+		if err := c.parse(args[1:]); err != nil {
+			return err
+		}
+		profile, err := c.client.GetDeviceProfile(deviceId)
+		if err != nil {
+			return err
+		}
+		// The profile is printed as is whatever the output, so that it can be edited and set again.
+		_, err = fmt.Fprintln(c.stdout, profile)
+		return err
+	case "set":
+		flags := c.newFlags("device profile set")
+		if err := c.parse(args[1:]); err != nil {
+			return err
+		}
+		var profile []byte
+		var err error
+		if flags.NArg() > 0 {
+			profile, err = os.ReadFile(flags.Arg(0))
+		} else {
+			profile, err = io.ReadAll(c.stdin)
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.client.SetDeviceProfile(deviceId, string(profile)); err != nil {
+			return err
+		}
+		return c.printResult(CommandResult{Id: deviceId, Command: "profile", Status: "sent"})
+	default:
+		return fmt.Errorf("%w: unknown profile command %q", UsageError, args[0])
+	}
+}
+
+// watchTopics prints the device's topic values, then each value as it changes until interrupted.
+func (c *command) watchTopics(deviceId string, args []string) error {
+	c.newFlags("device topics watch")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	values, err := c.client.GetDeviceTopicValues(deviceId)
+	if err != nil {
+		return err
+	}
+	if values != nil {
+		current := make([]TopicValue, 0)
+		for primaryTopic, topicValues := range *values {
+			for topic, value := range topicValues {
+				current = append(current, TopicValue{Topic: topicName([]string{primaryTopic, topic}), Value: value})
+			}
+		}
+		slices.SortFunc(current, func(a, b TopicValue) int {
+			return cmp.Compare(a.Topic, b.Topic)
+		})
+		for _, value := range current {
+			if err := c.printValue(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = c.client.WatchEvents(ctx, []string{deviceId}, []string{client.ValueEvent}, func(event client.Event) error {
+		if event.Type != client.ValueEvent {
+			return nil
+		}
+		update := client.ValueUpdate{}
+		if err := json.Unmarshal(event.Data, &update); err != nil {
+			return err
+		}
+		return c.printValue(TopicValue{Topic: topicName(update.TopicPath), Value: update.Value,
+			Time: time.Now().Format(time.RFC3339)})
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// printValue prints a topic value on its own line, as a JSON object per line with the json output.
+func (c *command) printValue(value TopicValue) error {
+	if c.output == JSONOutput {
+		return json.NewEncoder(c.stdout).Encode(value)
+	}
+	prefix := ""
+	if value.Time != "" {
+		prefix = value.Time + " "
+	}
+	_, err := fmt.Fprintf(c.stdout, "%s%s = %v\n", prefix, value.Topic, value.Value)
+	return err
+}
+
+// topicName joins a topic path, whose second element is empty for a topic without sub topics.
+func topicName(path []string) string {
+	return strings.TrimSuffix(strings.Join(path, "/"), "/")
+}
+
+func (c *command) firmware(args []string) error {
+	if len(args) == 0 || args[0] != "upload" {
+		return fmt.Errorf("%w: expected firmware upload <file>...", UsageError)
+	}
+	flags := c.newFlags("firmware upload")
+	if err := c.parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("%w: expected firmware upload <file>...", UsageError)
+	}
+	results := make([]FirmwareResult, 0, flags.NArg())
+	failed := 0
+	for _, path := range flags.Args() {
+		result := FirmwareResult{Name: filepath.Base(path)}
+		if err := c.uploadFirmware(path); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		results = append(results, result)
+	}
+	err := c.print(results, func(w io.Writer) {
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(w, "%s\tfailed: %s\n", result.Name, result.Error)
+			} else {
+				fmt.Fprintf(w, "%s\tuploaded\n", result.Name)
+			}
+		}
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d uploads failed", failed, len(results))
+	}
+	return err
+}
+
+func (c *command) uploadFirmware(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.client.UploadFirmware(filepath.Base(path), file)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,335 @@
+package devices
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultResponseTopic  = "htmanager/responses"
+	DefaultUpdateExpiry   = time.Hour
+	DefaultCommandTimeout = 10 * time.Minute
+
+	commandIdProperty = "command-id"
+	// commandHistory is the number of commands kept for each device.
+	commandHistory = 10
+)
+
+type CommandState string
+
+const (
+	CommandPending      CommandState = "pending"
+	CommandAcknowledged CommandState = "acknowledged"
+	CommandTimedOut     CommandState = "timedOut"
+)
+
+// Ways a device shows it has acted on a command.
+const (
+	AckStatus   = "status"
+	AckUptime   = "uptime"
+	AckProfile  = "profile"
+	AckTopic    = "ack"
+	AckResponse = "response"
+
+	// infoEvent is a device publishing its info, which shows whether an update changed its version.
+	infoEvent = "info"
+)
+
+// Command is a ctrl command sent to a device and whether the device has acted on it.
+type Command struct {
+	Id       string       `json:"id"`
+	DeviceId string       `json:"deviceId"`
+	Name     string       `json:"command"`
+	State    CommandState `json:"state"`
+	Sent     time.Time    `json:"sent"`
+	// Acknowledged is when the device was seen acting on the command, and AcknowledgedBy how.
+	Acknowledged   *time.Time `json:"acknowledged,omitempty"`
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+}
+
+// CommandResponse is a device's reply to a ctrl command, sent to the response topic over MQTT v5.
+type CommandResponse struct {
+	CommandId string `json:"commandId"`
+	Command   string `json:"command"`
+	Payload   string `json:"payload"`
+}
+
+type trackedCommand struct {
+	Command
+	timer *time.Timer
+	// version is the device's version when an update was sent, profile the profile sent by setprofile.
+	version string
+	profile string
+	// offline is set when the device goes offline after the command was sent, and restartedBy to the event which
+	// showed it restarting.
+	offline     bool
+	restartedBy string
+}
+
+func newCommandId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// commandName returns the name of the command without its arguments.
+func commandName(command []byte) string {
+	name, _, _ := strings.Cut(string(command), " ")
+	name, _, _ = strings.Cut(name, "\x00")
+	return name
+}
+
+// acknowledgedBy returns how a device event shows that the device has acted on the command, or "" if it doesn't.
+// A restart is acknowledged once the device comes back online or its uptime resets, an update once it has
+// also changed version, and a setprofile once the device publishes the profile sent.
+func (c *trackedCommand) acknowledgedBy(event string, version string, profile string) string {
+	switch c.Name {
+	case "restart", "update":
+		// A status only shows a restart when the device went offline after the command was sent.
+		if c.restartedBy == "" && (event == AckUptime || (event == AckStatus && c.offline)) {
+			c.restartedBy = event
+		}
+		if c.restartedBy != "" && (c.Name == "restart" || version != c.version) {
+			return c.restartedBy
+		}
+	case "setprofile":
+		if event == AckProfile && profile == c.profile {
+			return AckProfile
+		}
+	}
+	return ""
+}
+
+func (d *devices) GetDeviceCommands(deviceId string) []Command {
+	d.commandLock.Lock()
+	defer d.commandLock.Unlock()
+	commands := make([]Command, 0, len(d.commands[deviceId]))
+	for _, command := range d.commands[deviceId] {
+		commands = append(commands, command.Command)
+	}
+	return commands
+}
+
+// trackCommand records a command before it is published, so that the device's reaction can't be missed. A device is
+// only sent one update at a time, as a second one would interrupt the download of the first. Without a command
+// timeout an update which is never acknowledged would block the device's updates forever, so it doesn't count.
+func (d *devices) trackCommand(commandId string, deviceId string, command []byte) error {
+	tracked := &trackedCommand{Command: Command{
+		Id:       commandId,
+		DeviceId: deviceId,
+		Name:     commandName(command),
+		State:    CommandPending,
+		Sent:     time.Now(),
+	}}
+	switch tracked.Name {
+	case "update":
+		tracked.version = d.deviceVersion(deviceId)
+	case "setprofile":
+		_, payload, _ := bytes.Cut(command, []byte{0})
+		tracked.profile, _ = decodeProfile(payload)
+	}
+	d.commandLock.Lock()
+	defer d.commandLock.Unlock()
+	if tracked.Name == "update" && d.config.CommandTimeout > 0 {
+		for _, previous := range d.commands[deviceId] {
+			if previous.Name == "update" && previous.State == CommandPending {
+				return fmt.Errorf("%w: command %s sent at %s", UpdatePendingError, previous.Id,
+					previous.Sent.Format(time.RFC3339))
+			}
+		}
+	}
+	commands := append(d.commands[deviceId], tracked)
+	if len(commands) > commandHistory {
+		for _, old := range commands[:len(commands)-commandHistory] {
+			old.stop()
+		}
+		commands = commands[len(commands)-commandHistory:]
+	}
+	d.commands[deviceId] = commands
+	if d.config.CommandTimeout > 0 {
+		tracked.timer = time.AfterFunc(d.config.CommandTimeout, func() {
+			d.timeoutCommand(deviceId, commandId)
+		})
+	}
+	return nil
+}
+
+// commandSent notifies the clients of a command once it is published.
+func (d *devices) commandSent(deviceId string, commandId string) {
+	d.commandLock.Lock()
+	tracked := d.findCommand(deviceId, commandId)
+	var command Command
+	if tracked != nil {
+		command = tracked.Command
+	}
+	d.commandLock.Unlock()
+	// The device may already have acknowledged it, which has been notified.
+	if tracked != nil && command.State == CommandPending {
+		d.sendUpdateMessage(deviceId, CommandUpdateMessage, command)
+	}
+}
+
+// untrackCommand forgets a command which couldn't be published.
+func (d *devices) untrackCommand(deviceId string, commandId string) {
+	d.commandLock.Lock()
+	defer d.commandLock.Unlock()
+	commands := d.commands[deviceId]
+	for idx, command := range commands {
+		if command.Id == commandId {
+			command.stop()
+			d.commands[deviceId] = append(commands[:idx:idx], commands[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (d *devices) removeCommands(deviceId string) {
+	d.commandLock.Lock()
+	defer d.commandLock.Unlock()
+	for _, command := range d.commands[deviceId] {
+		command.stop()
+	}
+	delete(d.commands, deviceId)
+}
+
+// findCommand must be called with commandLock held.
+func (d *devices) findCommand(deviceId string, commandId string) *trackedCommand {
+	for _, command := range d.commands[deviceId] {
+		if command.Id == commandId {
+			return command
+		}
+	}
+	return nil
+}
+
+// acknowledgeCommands acknowledges the device's pending commands that event shows it has acted on, profile is
+// the profile published with AckProfile.
+func (d *devices) acknowledgeCommands(deviceId string, event string, profile string) {
+	version := d.deviceVersion(deviceId)
+	d.acknowledge(deviceId, func(command *trackedCommand) string {
+		return command.acknowledgedBy(event, version, profile)
+	})
+}
+
+// deviceOffline records that the device went offline after its pending commands were sent.
+func (d *devices) deviceOffline(deviceId string) {
+	d.commandLock.Lock()
+	defer d.commandLock.Unlock()
+	for _, command := range d.commands[deviceId] {
+		if command.State == CommandPending {
+			command.offline = true
+		}
+	}
+}
+
+func (d *devices) deviceVersion(deviceId string) string {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	return d.info[deviceId].Version
+}
+
+// acknowledge marks the device's pending commands for which acknowledgedBy returns an event as acknowledged by
+// it, and notifies the clients.
+func (d *devices) acknowledge(deviceId string, acknowledgedBy func(command *trackedCommand) string) {
+	now := time.Now()
+	acknowledged := make([]Command, 0)
+	d.commandLock.Lock()
+	for _, command := range d.commands[deviceId] {
+		if command.State != CommandPending {
+			continue
+		}
+		if event := acknowledgedBy(command); event != "" {
+			command.stop()
+			command.State = CommandAcknowledged
+			command.Acknowledged = &now
+			command.AcknowledgedBy = event
+			acknowledged = append(acknowledged, command.Command)
+		}
+	}
+	d.commandLock.Unlock()
+	for _, command := range acknowledged {
+		d.sendUpdateMessage(deviceId, CommandUpdateMessage, command)
+	}
+}
+
+func (d *devices) timeoutCommand(deviceId string, commandId string) {
+	d.commandLock.Lock()
+	command := d.findCommand(deviceId, commandId)
+	if command == nil || command.State != CommandPending {
+		d.commandLock.Unlock()
+		return
+	}
+	command.State = CommandTimedOut
+	timedOut := command.Command
+	d.commandLock.Unlock()
+	d.sendUpdateMessage(deviceId, CommandUpdateMessage, timedOut)
+}
+
+func (c *trackedCommand) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// handleAckMessage handles device/ack, which firmware can publish with the id or the name of a command it has
+// acted on. A name acknowledges the oldest pending command of that name.
+func (d *devices) handleAckMessage(deviceId string, payload []byte) {
+	ack := strings.TrimSpace(string(payload))
+	found := false
+	d.acknowledge(deviceId, func(command *trackedCommand) string {
+		if found || (command.Id != ack && command.Name != ack) {
+			return ""
+		}
+		found = true
+		return AckTopic
+	})
+}
+
+func (d *devices) subscribeResponses() {
+	if _, ok := d.transport.(PropertiesPublisher); !ok || d.config.ResponseTopic == "" {
+		return
+	}
+	if err := d.transport.Subscribe(d.config.ResponseTopic, d.config.QoS.Subscribe, d.handleResponse); err != nil {
+		log.Printf("Failed to subscribe to %s: %s\n", d.config.ResponseTopic, err)
+	}
+}
+
+func (d *devices) handleResponse(msg Message) {
+	if msg.Properties == nil || len(msg.Properties.CorrelationData) == 0 {
+		return
+	}
+	commandId := string(msg.Properties.CorrelationData)
+	found := false
+	var deviceId, name string
+	d.commandLock.Lock()
+	for _, commands := range d.commands {
+		for _, command := range commands {
+			if command.Id == commandId {
+				found, deviceId, name = true, command.DeviceId, command.Name
+			}
+		}
+	}
+	d.commandLock.Unlock()
+	if !found {
+		// A reply to another htManager instance or to a command that is no longer tracked.
+		return
+	}
+	d.acknowledge(deviceId, func(tracked *trackedCommand) string {
+		if tracked.Id != commandId {
+			return ""
+		}
+		return AckResponse
+	})
+	d.sendUpdateMessage(deviceId, ResponseMessage, CommandResponse{
+		CommandId: commandId,
+		Command:   name,
+		Payload:   string(msg.Payload),
+	})
+}
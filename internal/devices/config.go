@@ -0,0 +1,74 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var InvalidQoSError = errors.New("invalid QoS, must be 0, 1 or 2")
+
+// QoSConfig sets the MQTT QoS used for each class of message.
+type QoSConfig struct {
+	// Subscribe is the QoS of the subscriptions to the devices' topics.
+	Subscribe byte `yaml:"subscribe"`
+	// Commands is the QoS of ctrl commands and topic values sent to devices.
+	Commands byte `yaml:"commands"`
+	// Retained is the QoS of the retained messages htManager publishes: the removal of a device's retained
+	// topics and htManager's own status and summary.
+	Retained byte `yaml:"retained"`
+}
+
+// DefaultQoS makes sure commands and retained message changes reach the broker.
+func DefaultQoS() QoSConfig {
+	return QoSConfig{Subscribe: 0, Commands: 1, Retained: 1}
+}
+
+func (q QoSConfig) validate() error {
+	for name, qos := range map[string]byte{"subscribe": q.Subscribe, "commands": q.Commands, "retained": q.Retained} {
+		if qos > 2 {
+			return fmt.Errorf("%w: %s %d", InvalidQoSError, name, qos)
+		}
+	}
+	return nil
+}
+
+// Config is the configuration of the devices manager.
+type Config struct {
+	Namespaces []Namespace `yaml:"namespaces"`
+	QoS        QoSConfig   `yaml:"qos"`
+	// StatusTopic is where htManager publishes whether it is online, using a last will for when it goes away.
+	// Disabled if empty.
+	StatusTopic string `yaml:"statusTopic"`
+	// SummaryTopic is where a Summary is published every SummaryInterval. Disabled if empty.
+	SummaryTopic    string        `yaml:"summaryTopic"`
+	SummaryInterval time.Duration `yaml:"summaryInterval"`
+	// CommandTimeout is how long a device has to act on a ctrl command before it is reported as timed out. Commands
+	// don't time out if 0, and then a pending update doesn't prevent sending another one.
+	CommandTimeout time.Duration `yaml:"commandTimeout"`
+	// ResponseTopic is where devices reply to ctrl commands sent over MQTT v5. Disabled if empty.
+	ResponseTopic string `yaml:"responseTopic"`
+	// UpdateExpiry is how long an update command is kept for an offline device over MQTT v5, forever if 0.
+	UpdateExpiry time.Duration `yaml:"updateExpiry"`
+	// UserProperties are added to every ctrl command sent over MQTT v5, along with its command-id.
+	UserProperties map[string]string `yaml:"userProperties"`
+	// Version is htManager's version, reported in the summary.
+	Version string `yaml:"-"`
+	// Broker is the label of the broker in multi-broker mode, it tells apart the metrics of devices with the same id
+	// on different brokers.
+	Broker string `yaml:"-"`
+}
+
+// DefaultConfig manages the devices publishing under homething/.
+func DefaultConfig() Config {
+	return Config{
+		Namespaces:      []Namespace{{Prefix: DefaultTopicPrefix}},
+		QoS:             DefaultQoS(),
+		StatusTopic:     DefaultStatusTopic,
+		SummaryTopic:    DefaultSummaryTopic,
+		SummaryInterval: DefaultSummaryInterval,
+		CommandTimeout:  DefaultCommandTimeout,
+		ResponseTopic:   DefaultResponseTopic,
+		UpdateExpiry:    DefaultUpdateExpiry,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log"
+	"slices"
 	"strings"
 	"time"
 )
@@ -62,90 +63,125 @@ const InvalidTopicType = -1
 var (
 	InvalidPubTopicError        = errors.New("invalid pub topic")
 	InvalidTypeForPubTopicError = errors.New("invalid topic type for pub topic")
+	InvalidSubTopicError        = errors.New("invalid sub topic")
 	memoryGaugeVec              = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "homething",
 		Name:      "memory",
 		Help:      "Amount of memory available in the device",
-	}, []string{"id", "description", "type"})
+	}, []string{"broker", "id", "description", "type"})
 	uptimeGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "homething",
 		Name:      "uptime",
 		Help:      "uptime of the device",
-	}, []string{"id", "description", "version"})
+	}, []string{"broker", "id", "description", "version"})
 	rebootCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "homething",
 		Name:      "reboots",
 		Help:      "Number of times the device has rebooted",
-	}, []string{"id", "description"})
+	}, []string{"broker", "id", "description"})
 )
 
-func (d *devices) handleDeviceMessage(deviceId string, topic string, payload []byte) {
+// handleDeviceMessage handles a device/ message. retained is set for the retained messages the broker sends on
+// subscribing, which don't acknowledge commands: they were published before the commands were sent.
+func (d *devices) handleDeviceMessage(deviceId string, topic string, payload []byte, retained bool) {
+	if len(payload) == 0 {
+		// Retained messages are cleared with an empty payload when a device is removed.
+		return
+	}
 	switch topic {
 	case "info":
-		d.handleDeviceMessageInfo(deviceId, payload)
+		d.handleDeviceMessageInfo(deviceId, payload, retained)
 		break
 	case "diag":
-		d.handleDeviceMessageDiag(deviceId, payload)
+		d.handleDeviceMessageDiag(deviceId, payload, retained)
 		break
 	case "status":
-		d.handleDeviceMessageStatus(deviceId, payload)
+		d.handleDeviceMessageStatus(deviceId, payload, retained)
 		break
 	case "topics":
 		d.handleDeviceMessageTopics(deviceId, payload)
 		break
 	case "profile":
-		d.handleDeviceMessageProfile(deviceId, payload)
+		d.handleDeviceMessageProfile(deviceId, payload, retained)
+		break
+	case "ack":
+		if !retained {
+			d.handleAckMessage(deviceId, payload)
+		}
 		break
 	}
 }
 
-func (d *devices) handleDeviceMessageInfo(deviceId string, payload []byte) {
+func (d *devices) handleDeviceMessageInfo(deviceId string, payload []byte, retained bool) {
 	info := RawDeviceInfo{}
 	if json.Unmarshal(payload, &info) == nil {
+		d.dataLock.Lock()
 		if prev, ok := d.info[deviceId]; ok {
 			if prev.Description != info.Description {
-				matchTo := prometheus.Labels{"id": deviceId}
+				matchTo := prometheus.Labels{"broker": d.config.Broker, "id": deviceId}
 				uptimeGaugeVec.DeletePartialMatch(matchTo)
 				memoryGaugeVec.DeletePartialMatch(matchTo)
 				rebootCounterVec.DeletePartialMatch(matchTo)
 			}
 			if prev.Version != info.Version {
-				uptimeGaugeVec.DeletePartialMatch(prometheus.Labels{"id": deviceId})
+				uptimeGaugeVec.DeletePartialMatch(prometheus.Labels{"broker": d.config.Broker, "id": deviceId})
 			}
 		}
 		d.info[deviceId] = info
+		d.dataLock.Unlock()
 		now := time.Now()
-		d.sendUpdateMessage(deviceId, InfoUpdateMessage, info.toDeviceInfo(deviceId, &now))
+		d.sendUpdateMessage(deviceId, InfoUpdateMessage, info.toDeviceInfo(deviceId, &now, d.metadata.GetMetadata(deviceId)))
+		if !retained {
+			d.acknowledgeCommands(deviceId, infoEvent, "")
+		}
 	}
 }
 
-func (d *devices) handleDeviceMessageDiag(deviceId string, payload []byte) {
+func (d *devices) handleDeviceMessageDiag(deviceId string, payload []byte, retained bool) {
 	diag := DeviceDiag{}
 	if json.Unmarshal(payload, &diag) == nil {
 		now := time.Now()
 		diag.LastSeen = &now
 		reboot := false
+		d.dataLock.Lock()
 		if prev, ok := d.diag[deviceId]; ok && prev.Uptime > diag.Uptime {
 			reboot = true
 		}
 		d.diag[deviceId] = diag
-		if info, ok := d.info[deviceId]; ok {
-			uptimeGaugeVec.WithLabelValues(deviceId, info.Description, info.Version).Set(float64(diag.Uptime))
-			memoryGaugeVec.WithLabelValues(deviceId, info.Description, "free").Set(float64(diag.MemInfo.Free))
-			memoryGaugeVec.WithLabelValues(deviceId, info.Description, "low").Set(float64(diag.MemInfo.Low))
-			counter := rebootCounterVec.WithLabelValues(deviceId, info.Description)
+		info, known := d.info[deviceId]
+		d.dataLock.Unlock()
+		if known {
+			broker := d.config.Broker
+			uptimeGaugeVec.WithLabelValues(broker, deviceId, info.Description, info.Version).Set(float64(diag.Uptime))
+			memoryGaugeVec.WithLabelValues(broker, deviceId, info.Description, "free").Set(float64(diag.MemInfo.Free))
+			memoryGaugeVec.WithLabelValues(broker, deviceId, info.Description, "low").Set(float64(diag.MemInfo.Low))
+			counter := rebootCounterVec.WithLabelValues(broker, deviceId, info.Description)
 			if reboot {
 				counter.Inc()
 			}
 		}
 		d.sendUpdateMessage(deviceId, DiagUpdateMessage, diag)
+		if reboot && !retained {
+			d.acknowledgeCommands(deviceId, AckUptime, "")
+		}
 	}
 }
 
-func (d *devices) handleDeviceMessageStatus(deviceId string, payload []byte) {
+func (d *devices) handleDeviceMessageStatus(deviceId string, payload []byte, retained bool) {
 	status := string(payload)
+	d.dataLock.Lock()
+	previous := d.status[deviceId]
 	d.status[deviceId] = status
+	d.dataLock.Unlock()
 	d.sendUpdateMessage(deviceId, StatusUpdateMessage, status)
+	if retained || status == previous {
+		return
+	}
+	if status == "online" {
+		d.acknowledgeCommands(deviceId, AckStatus, "")
+	} else {
+		d.deviceOffline(deviceId)
+	}
 }
 
 func (d *devices) handleDeviceMessageTopics(deviceId string, payload []byte) {
@@ -162,16 +198,23 @@ func (d *devices) handleDeviceMessageTopics(deviceId string, payload []byte) {
 				Sub: rawTopicDescription.Sub,
 			}
 		}
+		d.dataLock.Lock()
 		d.topicInfo[deviceId] = topicsInfo
+		d.dataLock.Unlock()
 		d.sendUpdateMessage(deviceId, TopicsUpdateMessage, topicsInfo)
 	} else {
 		log.Printf("%s: Topics: json unmarshal failed %v\n", deviceId, err)
 	}
 }
 
-func (d *devices) handleDeviceMessageProfile(deviceId string, payload []byte) {
+func (d *devices) handleDeviceMessageProfile(deviceId string, payload []byte, retained bool) {
 	if profile, err := decodeProfile(payload); err == nil {
+		d.dataLock.Lock()
 		d.profile[deviceId] = profile
+		d.dataLock.Unlock()
+		if !retained {
+			d.acknowledgeCommands(deviceId, AckProfile, profile)
+		}
 	} else {
 		log.Printf("%s: Profile: json unmarshal failed %v\n", deviceId, err)
 	}
@@ -183,16 +226,20 @@ func (d *devices) sendUpdateMessage(deviceId string, updateType string, data any
 		Type: updateType,
 		Data: data,
 	}
+	// The clients are called without the lock held, so that a client can unregister itself while being notified.
 	d.lock.Lock()
-	for _, client := range d.updateClients {
+	clients := slices.Clone(d.updateClients)
+	d.lock.Unlock()
+	for _, client := range clients {
 		client.DeviceUpdated(event)
 	}
-	d.lock.Unlock()
 }
 
-func (d *RawDeviceInfo) toDeviceInfo(deviceId string, lastSeen *time.Time) DeviceInfo {
+func (d *RawDeviceInfo) toDeviceInfo(deviceId string, lastSeen *time.Time, metadata *DeviceMetadata) DeviceInfo {
+	namespace, _ := splitDeviceId(deviceId)
 	device := DeviceInfo{
 		Id:           deviceId,
+		Namespace:    namespace,
 		Description:  d.Description,
 		IPAddr:       d.IpAddr,
 		Version:      d.Version,
@@ -200,6 +247,7 @@ func (d *RawDeviceInfo) toDeviceInfo(deviceId string, lastSeen *time.Time) Devic
 		Memory:       d.Memory * 1024,
 		Capabilities: strings.Split(d.Capabilities, ","),
 		LastSeen:     lastSeen,
+		Metadata:     metadata,
 	}
 	return device
 }
@@ -207,20 +255,33 @@ func (d *RawDeviceInfo) toDeviceInfo(deviceId string, lastSeen *time.Time) Devic
 func (t *TopicsInfo) getPubTopicType(topic string) int {
 	entries := strings.Split(topic, "/")
 	if topicInfo, ok := t.Topics[entries[0]]; ok {
-		switch len(entries) {
-		case 1:
-			if topicType, ok := topicInfo.Pub[""]; ok {
-				return topicType
-			}
-			break
-		case 2:
-			if topicType, ok := topicInfo.Pub[entries[1]]; ok {
-				return topicType
-			}
-			break
-		default:
-			break
+		return topicInfo.Pub.getTopicType(entries)
+	}
+	return InvalidTopicType
+}
+
+func (t *TopicsInfo) getSubTopicType(topic string) int {
+	entries := strings.Split(topic, "/")
+	if topicInfo, ok := t.Topics[entries[0]]; ok {
+		return topicInfo.Sub.getTopicType(entries)
+	}
+	return InvalidTopicType
+}
+
+func (t TopicInfo) getTopicType(entries []string) int {
+	switch len(entries) {
+	case 1:
+		if topicType, ok := t[""]; ok {
+			return topicType
+		}
+		break
+	case 2:
+		if topicType, ok := t[entries[1]]; ok {
+			return topicType
 		}
+		break
+	default:
+		break
 	}
 	return InvalidTopicType
 }
@@ -229,6 +290,10 @@ func (t *TopicsInfo) isValidPubTopic(topic string) bool {
 	return t.getPubTopicType(topic) != -1
 }
 
+func (t *TopicsInfo) isValidSubTopic(topic string) bool {
+	return t.getSubTopicType(topic) != InvalidTopicType
+}
+
 func (t *TopicsInfo) convertPubTopicValue(topic string, data []byte) (any, error) {
 	topicType := t.getPubTopicType(topic)
 	if topicType == InvalidTopicType {
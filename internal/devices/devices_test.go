@@ -0,0 +1,993 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testDeviceId = "a1b2"
+
+const testTopics = `{
+	"descriptions": [
+		{"pub": {"temperature": 0, "humidity": 0}, "sub": {}},
+		{"pub": {"": 0}, "sub": {"": 0}}
+	],
+	"elements": [
+		{"name": "sensor", "index": 0},
+		{"name": "relay", "index": 1}
+	]
+}`
+
+type recordingClient struct {
+	lock   sync.Mutex
+	events []DeviceUpdateEvent
+}
+
+func (c *recordingClient) DeviceUpdated(event DeviceUpdateEvent) {
+	c.lock.Lock()
+	c.events = append(c.events, event)
+	c.lock.Unlock()
+}
+
+func (c *recordingClient) eventTypes() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	types := make([]string, 0, len(c.events))
+	for _, event := range c.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+type testDevice struct {
+	broker    *MemoryBroker
+	transport *MemoryTransport
+	devices   Devices
+}
+
+func newTestDevices(t *testing.T) *testDevice {
+	t.Helper()
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := NewMemoryBroker()
+	transport := broker.NewTransport()
+	d, err := NewDevices(transport, metadata, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDevice{broker: broker, transport: transport, devices: d}
+}
+
+// commandError drops the id of a command sent, for tests mixing ctrl commands with other calls.
+func commandError(_ string, err error) error {
+	return err
+}
+
+// publishDevice publishes a device's state as a homething device does when it starts.
+func publishDevice(t *testing.T, broker *MemoryBroker, deviceId string) {
+	t.Helper()
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	messages := []Message{
+		{Topic: "homething/" + deviceId + "/device/info", Retained: true,
+			Payload: []byte(`{"ip":"10.0.0.2","description":"Hall","device":"esp32","mem":80,"version":"v1.0.0","capabilities":"flash4MB,ota"}`)},
+		{Topic: "homething/" + deviceId + "/device/status", Retained: true, Payload: []byte("online")},
+		{Topic: "homething/" + deviceId + "/device/topics", Retained: true, Payload: []byte(testTopics)},
+		{Topic: "homething/" + deviceId + "/device/profile", Retained: true,
+			Payload: []byte(`{"version":"1.0","components":{"relay":[{"name":"relay","pin":5}]}}`)},
+		{Topic: "homething/" + deviceId + "/device/diag", Retained: true, Payload: []byte(`{"uptime":100,"mem":{"free":2048,"low":1024}}`)},
+		{Topic: "homething/" + deviceId + "/sensor/temperature", Retained: true, Payload: []byte("21.5")},
+		{Topic: "homething/" + deviceId + "/relay", Retained: true, Payload: []byte("on")},
+	}
+	for _, message := range messages {
+		if err := device.Publish(message.Topic, 0, message.Retained, message.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDevices_Info(t *testing.T) {
+	broker := NewMemoryBroker()
+	// Retained messages published before htManager connects must be picked up when it subscribes.
+	publishDevice(t, broker, testDeviceId)
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDevices(broker.NewTransport(), metadata, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := d.GetDeviceInfo(testDeviceId)
+	if info == nil {
+		t.Fatalf("GetDeviceInfo() = nil")
+	}
+	if info.LastSeen == nil {
+		t.Errorf("LastSeen = nil, want diag time")
+	}
+	info.LastSeen = nil
+	want := DeviceInfo{
+		Id:           testDeviceId,
+		Description:  "Hall",
+		IPAddr:       "10.0.0.2",
+		Version:      "v1.0.0",
+		DeviceType:   "esp32",
+		Memory:       80 * 1024,
+		Capabilities: []string{"flash4MB", "ota"},
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("GetDeviceInfo() = %+v, want %+v", *info, want)
+	}
+	if got := d.GetDevices(); len(got) != 1 || got[0].Id != testDeviceId {
+		t.Errorf("GetDevices() = %+v, want one device", got)
+	}
+	if status := d.GetDeviceStatus(testDeviceId); status == nil || *status != "online" {
+		t.Errorf("GetDeviceStatus() = %v, want online", status)
+	}
+	if diag := d.GetDeviceDiag(testDeviceId); diag == nil || diag.Uptime != 100 || diag.MemInfo.Free != 2048 {
+		t.Errorf("GetDeviceDiag() = %+v", diag)
+	}
+	wantProfile := "relay:\n- name: relay\n  pin: 5\n"
+	if profile := d.GetDeviceProfile(testDeviceId); profile == nil || *profile != wantProfile {
+		t.Errorf("GetDeviceProfile() = %v, want %q", profile, wantProfile)
+	}
+	if d.GetDeviceInfo("ffff") != nil {
+		t.Errorf("GetDeviceInfo() for unknown device != nil")
+	}
+}
+
+func TestDevices_Diag(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	client := &recordingClient{}
+	td.devices.RegisterUpdateNotificationClient(client)
+	device := td.broker.NewTransport()
+	device.Connect(nil)
+
+	reboots := rebootCounterVec.WithLabelValues("", testDeviceId, "Hall")
+	before := testutil.ToFloat64(reboots)
+	device.Publish("homething/"+testDeviceId+"/device/diag", 0, true, []byte(`{"uptime":200,"mem":{"free":2048,"low":1024}}`))
+	if got := testutil.ToFloat64(reboots) - before; got != 0 {
+		t.Errorf("reboots after uptime increase = %v, want 0", got)
+	}
+	device.Publish("homething/"+testDeviceId+"/device/diag", 0, true, []byte(`{"uptime":5,"mem":{"free":2048,"low":1024}}`))
+	if got := testutil.ToFloat64(reboots) - before; got != 1 {
+		t.Errorf("reboots after uptime reset = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(uptimeGaugeVec.WithLabelValues("", testDeviceId, "Hall", "v1.0.0")); got != 5 {
+		t.Errorf("uptime gauge = %v, want 5", got)
+	}
+	want := []string{DiagUpdateMessage, DiagUpdateMessage}
+	if got := client.eventTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	td.devices.UnregisterUpdateNotificationClient(client)
+	device.Publish("homething/"+testDeviceId+"/device/status", 0, true, []byte("offline"))
+	if got := client.eventTypes(); len(got) != 2 {
+		t.Errorf("events after unregister = %v, want no new events", got)
+	}
+	if status := td.devices.GetDeviceStatus(testDeviceId); status == nil || *status != "offline" {
+		t.Errorf("GetDeviceStatus() = %v, want offline", status)
+	}
+}
+
+func TestDevices_TopicValues(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	device := td.broker.NewTransport()
+	device.Connect(nil)
+
+	// Values for topics the device doesn't declare are ignored.
+	device.Publish("homething/"+testDeviceId+"/sensor/pressure", 0, false, []byte("1000"))
+	device.Publish("homething/"+testDeviceId+"/unknown", 0, false, []byte("1"))
+	device.Publish("homething/"+testDeviceId+"/sensor/humidity", 0, false, []byte("40"))
+
+	values := td.devices.GetDeviceTopicValues(testDeviceId)
+	if values == nil {
+		t.Fatalf("GetDeviceTopicValues() = nil")
+	}
+	want := TopicsValues{
+		"sensor": TopicValues{"temperature": "21.5", "humidity": "40"},
+		"relay":  TopicValues{"": "on"},
+	}
+	if !reflect.DeepEqual(*values, want) {
+		t.Errorf("GetDeviceTopicValues() = %v, want %v", *values, want)
+	}
+
+	// The returned values are a copy which isn't changed by later messages.
+	device.Publish("homething/"+testDeviceId+"/relay", 0, false, []byte("off"))
+	if got := (*values)["relay"][""]; got != "on" {
+		t.Errorf("copied value = %v, want on", got)
+	}
+	if got := (*td.devices.GetDeviceTopicValues(testDeviceId))["relay"][""]; got != "off" {
+		t.Errorf("value = %v, want off", got)
+	}
+	topics := td.devices.GetDeviceTopics(testDeviceId)
+	if topics == nil || len(topics.Topics) != 2 {
+		t.Errorf("GetDeviceTopics() = %+v, want 2 elements", topics)
+	}
+}
+
+func TestDevices_Commands(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	ctrlTopic := "homething/" + testDeviceId + "/device/ctrl"
+
+	tests := []struct {
+		name      string
+		command   func(d Devices) error
+		wantTopic string
+		want      string
+		wantErr   bool
+		errIs     error
+	}{
+		{
+			name:      "Reboot",
+			command:   func(d Devices) error { return commandError(d.RebootDevice(testDeviceId)) },
+			wantTopic: ctrlTopic,
+			want:      "restart",
+		},
+		{
+			name:      "Update",
+			command:   func(d Devices) error { return commandError(d.UpdateDevice(testDeviceId, "v1.2.0")) },
+			wantTopic: ctrlTopic,
+			want:      "update v1.2.0",
+		},
+		{
+			name:      "Set profile",
+			command:   func(d Devices) error { return commandError(d.SetDeviceProfile(testDeviceId, "relay:\n- pin: 4\n")) },
+			wantTopic: ctrlTopic,
+			want:      "setprofile\x00{\"version\":\"1.0\",\"components\":{\"relay\":[{\"pin\":4}]}}",
+		},
+		{
+			name:      "Set topic value",
+			command:   func(d Devices) error { return d.SetDeviceTopicValue(testDeviceId, "relay", "on") },
+			wantTopic: "homething/" + testDeviceId + "/relay",
+			want:      "on",
+		},
+		{
+			name:    "Set pub only topic value",
+			command: func(d Devices) error { return d.SetDeviceTopicValue(testDeviceId, "sensor/temperature", "1") },
+			wantErr: true,
+			errIs:   InvalidSubTopicError,
+		},
+		{
+			name:    "Set topic value unknown device",
+			command: func(d Devices) error { return d.SetDeviceTopicValue("ffff", "relay", "on") },
+			wantErr: true,
+			errIs:   DeviceNotFoundError,
+		},
+		{
+			name:    "Invalid profile",
+			command: func(d Devices) error { return commandError(d.SetDeviceProfile(testDeviceId, "relay: [")) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(td.broker.Messages("homething/" + testDeviceId + "/#"))
+			err := tt.command(td.devices)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("error = nil, want error")
+				}
+				if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+					t.Errorf("error = %v, want %v", err, tt.errIs)
+				}
+				if after := len(td.broker.Messages("homething/" + testDeviceId + "/#")); after != before {
+					t.Errorf("%d messages published, want none", after-before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			messages := td.broker.Messages(tt.wantTopic)
+			if len(messages) == 0 {
+				t.Fatalf("no message published to %s", tt.wantTopic)
+			}
+			last := messages[len(messages)-1]
+			if string(last.Payload) != tt.want || last.Retained {
+				t.Errorf("message = %q (retained %v), want %q", last.Payload, last.Retained, tt.want)
+			}
+			if last.QoS != DefaultQoS().Commands {
+				t.Errorf("QoS = %d, want %d", last.QoS, DefaultQoS().Commands)
+			}
+		})
+	}
+}
+
+func TestDevices_RemoveDevice(t *testing.T) {
+	homeAssistantCleanupTime = 10 * time.Millisecond
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	publishDevice(t, td.broker, "c3d4")
+	other := td.broker.NewTransport()
+	other.Connect(nil)
+	haTopic := "homeassistant/sensor/" + testDeviceId + "/temperature/config"
+	other.Publish(haTopic, 0, true, []byte(`{"name":"temperature"}`))
+	client := &recordingClient{}
+	td.devices.RegisterUpdateNotificationClient(client)
+
+	if err := td.devices.RemoveDevice(testDeviceId); err != nil {
+		t.Fatalf("RemoveDevice() error = %v", err)
+	}
+	for _, topic := range []string{
+		"homething/" + testDeviceId + "/device/info",
+		"homething/" + testDeviceId + "/device/diag",
+		"homething/" + testDeviceId + "/sensor/temperature",
+		"homething/" + testDeviceId + "/relay",
+	} {
+		if _, ok := td.broker.Retained(topic); ok {
+			t.Errorf("retained message for %s not cleared", topic)
+		}
+	}
+	for _, message := range td.broker.Messages("homething/" + testDeviceId + "/#") {
+		if len(message.Payload) == 0 && message.QoS != DefaultQoS().Retained {
+			t.Errorf("%s cleared with QoS %d, want %d", message.Topic, message.QoS, DefaultQoS().Retained)
+		}
+	}
+	// Home assistant topics are cleared from the subscription's message handler, without waiting.
+	deadline := time.Now().Add(time.Second)
+	for _, ok := td.broker.Retained(haTopic); ok && time.Now().Before(deadline); _, ok = td.broker.Retained(haTopic) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := td.broker.Retained(haTopic); ok {
+		t.Errorf("retained message for %s not cleared", haTopic)
+	}
+	if _, ok := td.broker.Retained("homething/c3d4/device/info"); !ok {
+		t.Errorf("retained message for other device cleared")
+	}
+	if td.devices.GetDeviceInfo(testDeviceId) != nil {
+		t.Errorf("GetDeviceInfo() after remove != nil")
+	}
+	if got := client.eventTypes(); !reflect.DeepEqual(got, []string{DeviceRemovedMessage}) {
+		t.Errorf("events = %v, want [%s]", got, DeviceRemovedMessage)
+	}
+
+	// The home assistant topics are only watched for the cleanup time.
+	time.Sleep(50 * time.Millisecond)
+	other.Publish(haTopic, 0, true, []byte(`{"name":"temperature"}`))
+	if _, ok := td.broker.Retained(haTopic); !ok {
+		t.Errorf("home assistant message cleared after cleanup time")
+	}
+
+	if err := td.devices.RemoveDevice(testDeviceId); !errors.Is(err, DeviceNotFoundError) {
+		t.Errorf("RemoveDevice() unknown device error = %v, want %v", err, DeviceNotFoundError)
+	}
+}
+
+func TestDevices_Metadata(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	client := &recordingClient{}
+	td.devices.RegisterUpdateNotificationClient(client)
+
+	metadata := DeviceMetadata{Tags: []string{"hall"}, Group: "ground"}
+	if err := td.devices.SetDeviceMetadata(testDeviceId, metadata); err != nil {
+		t.Fatalf("SetDeviceMetadata() error = %v", err)
+	}
+	if got := td.devices.GetDeviceMetadata(testDeviceId); got == nil || !reflect.DeepEqual(*got, metadata) {
+		t.Errorf("GetDeviceMetadata() = %v, want %v", got, metadata)
+	}
+	if info := td.devices.GetDeviceInfo(testDeviceId); info == nil || info.Metadata == nil || info.Metadata.Group != "ground" {
+		t.Errorf("GetDeviceInfo() metadata = %+v", info)
+	}
+	if got := client.eventTypes(); !reflect.DeepEqual(got, []string{InfoUpdateMessage}) {
+		t.Errorf("events = %v, want [%s]", got, InfoUpdateMessage)
+	}
+	if err := td.devices.SetDeviceMetadata("ffff", metadata); !errors.Is(err, DeviceNotFoundError) {
+		t.Errorf("SetDeviceMetadata() unknown device error = %v, want %v", err, DeviceNotFoundError)
+	}
+}
+
+func TestDevices_Reconnect(t *testing.T) {
+	td := newTestDevices(t)
+	td.transport.Drop()
+	// Messages published while disconnected are only seen if retained.
+	publishDevice(t, td.broker, testDeviceId)
+	if td.devices.GetDeviceInfo(testDeviceId) != nil {
+		t.Fatalf("device seen while disconnected")
+	}
+	if err := td.transport.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if td.devices.GetDeviceInfo(testDeviceId) == nil {
+		t.Fatalf("device not seen after reconnect")
+	}
+	if _, err := td.devices.RebootDevice(testDeviceId); err != nil {
+		t.Errorf("RebootDevice() after reconnect error = %v", err)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "homething/#", topic: "homething/a1/device/info", want: true},
+		{filter: "homething/#", topic: "other/a1", want: false},
+		{filter: "homeassistant/+/a1/#", topic: "homeassistant/sensor/a1/temp/config", want: true},
+		{filter: "homeassistant/+/a1/#", topic: "homeassistant/sensor/b2/temp/config", want: false},
+		{filter: "a/+", topic: "a/b", want: true},
+		{filter: "a/+", topic: "a/b/c", want: false},
+		{filter: "a/b", topic: "a", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("topicMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// publishDeviceInfo publishes only the info message of a device under the topic prefix.
+func publishDeviceInfo(t *testing.T, broker *MemoryBroker, prefix string, deviceId string, description string) {
+	t.Helper()
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	info := `{"ip":"10.0.0.2","description":"` + description + `","device":"esp32","mem":80,"version":"v1.0.0","capabilities":""}`
+	if err := device.Publish(prefix+"/"+deviceId+"/device/info", 0, true, []byte(info)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDevices_Namespaces(t *testing.T) {
+	broker := NewMemoryBroker()
+	publishDeviceInfo(t, broker, "homething", testDeviceId, "House")
+	publishDeviceInfo(t, broker, "lab/homething", testDeviceId, "Lab")
+	publishDeviceInfo(t, broker, "other", "c3d4", "Unmanaged")
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Namespaces: []Namespace{{Prefix: "homething"}, {Name: "lab", Prefix: "lab/homething/"}}}
+	d, err := NewDevices(broker.NewTransport(), metadata, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := DeviceQuery{}
+	deviceList, _, _ := query.Apply(d.GetDevices())
+	if got, want := deviceIds(deviceList), []string{testDeviceId, "lab:" + testDeviceId}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetDevices() = %v, want %v", got, want)
+	}
+	if info := d.GetDeviceInfo("lab:" + testDeviceId); info == nil || info.Description != "Lab" || info.Namespace != "lab" {
+		t.Errorf("GetDeviceInfo() = %+v, want lab device", info)
+	}
+	if info := d.GetDeviceInfo(testDeviceId); info == nil || info.Description != "House" || info.Namespace != "" {
+		t.Errorf("GetDeviceInfo() = %+v, want house device", info)
+	}
+
+	if _, err := d.RebootDevice("lab:" + testDeviceId); err != nil {
+		t.Fatalf("RebootDevice() error = %v", err)
+	}
+	if got := broker.Messages("+/+/+/device/ctrl"); len(got) != 1 || got[0].Topic != "lab/homething/"+testDeviceId+"/device/ctrl" {
+		t.Errorf("ctrl messages = %+v, want one to the lab namespace", got)
+	}
+	if _, err := d.RebootDevice("garage:" + testDeviceId); !errors.Is(err, DeviceNotFoundError) {
+		t.Errorf("RebootDevice() unknown namespace error = %v, want %v", err, DeviceNotFoundError)
+	}
+
+	if err := d.RemoveDevice("lab:" + testDeviceId); err != nil {
+		t.Fatalf("RemoveDevice() error = %v", err)
+	}
+	if _, ok := broker.Retained("lab/homething/" + testDeviceId + "/device/info"); ok {
+		t.Errorf("lab device info not cleared")
+	}
+	if _, ok := broker.Retained("homething/" + testDeviceId + "/device/info"); !ok {
+		t.Errorf("house device info cleared")
+	}
+}
+
+func TestNewNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []Namespace
+		wantErr    bool
+	}{
+		{name: "Default", namespaces: DefaultConfig().Namespaces},
+		{name: "Multiple", namespaces: []Namespace{{Prefix: "homething"}, {Name: "lab", Prefix: "lab/homething"}}},
+		{name: "None", namespaces: []Namespace{}, wantErr: true},
+		{name: "Empty prefix", namespaces: []Namespace{{Prefix: "/"}}, wantErr: true},
+		{name: "Wildcard prefix", namespaces: []Namespace{{Prefix: "homething/+"}}, wantErr: true},
+		{name: "Invalid name", namespaces: []Namespace{{Name: "a:b", Prefix: "homething"}}, wantErr: true},
+		{name: "Duplicate name", namespaces: []Namespace{{Prefix: "homething"}, {Prefix: "lab"}}, wantErr: true},
+		{name: "Duplicate prefix", namespaces: []Namespace{{Prefix: "homething"}, {Name: "lab", Prefix: "homething/"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newNamespaces(tt.namespaces)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, InvalidNamespaceError) {
+				t.Errorf("newNamespaces() error = %v, want %v", err, InvalidNamespaceError)
+			}
+		})
+	}
+}
+
+func TestDevices_Status(t *testing.T) {
+	broker := NewMemoryBroker()
+	publishDevice(t, broker, testDeviceId)
+	publishDeviceInfo(t, broker, "homething", "c3d4", "Never seen")
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := broker.NewTransport()
+	config := DefaultConfig()
+	config.SummaryInterval = 0
+	config.Version = "v1.2.3"
+	d, err := NewDevices(transport, metadata, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		payload, _ := broker.Retained(DefaultStatusTopic)
+		return string(payload)
+	}
+	if got := status(); got != "online" {
+		t.Errorf("status after connect = %q, want online", got)
+	}
+	transport.Drop()
+	if got := status(); got != "offline" {
+		t.Errorf("status after connection lost = %q, want offline", got)
+	}
+	transport.Reconnect()
+	if got := status(); got != "online" {
+		t.Errorf("status after reconnect = %q, want online", got)
+	}
+
+	d.(*devices).publishSummary()
+	payload, ok := broker.Retained(DefaultSummaryTopic)
+	if !ok {
+		t.Fatalf("summary not published")
+	}
+	summary := Summary{}
+	if err := json.Unmarshal(payload, &summary); err != nil {
+		t.Fatal(err)
+	}
+	summary.Time = time.Time{}
+	if want := (Summary{Version: "v1.2.3", Devices: 2, Online: 1, Offline: 1}); summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestDevices_Close(t *testing.T) {
+	broker := NewMemoryBroker()
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := broker.NewTransport()
+	d, err := NewDevices(transport, metadata, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if payload, _ := broker.Retained(DefaultStatusTopic); string(payload) != "offline" {
+		t.Errorf("status after close = %q, want offline", payload)
+	}
+	publishDevice(t, broker, testDeviceId)
+	if got := d.GetDevices(); len(got) != 0 {
+		t.Errorf("devices after close = %+v, want none", got)
+	}
+	d.Close()
+}
+
+func TestDevices_StatusDisabled(t *testing.T) {
+	broker := NewMemoryBroker()
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := broker.NewTransport()
+	if _, err := NewDevices(transport, metadata, Config{Namespaces: DefaultConfig().Namespaces}); err != nil {
+		t.Fatal(err)
+	}
+	transport.Drop()
+	if got := broker.Messages("htmanager/#"); len(got) != 0 {
+		t.Errorf("messages = %+v, want none", got)
+	}
+}
+
+func TestNewDevices_InvalidQoS(t *testing.T) {
+	config := DefaultConfig()
+	config.QoS.Commands = 3
+	if _, err := NewDevices(NewMemoryBroker().NewTransport(), nil, config); !errors.Is(err, InvalidQoSError) {
+		t.Errorf("NewDevices() error = %v, want %v", err, InvalidQoSError)
+	}
+}
+
+func TestClientId(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name   string
+		config MQTTConfig
+		want   string
+	}{
+		{name: "Configured", config: MQTTConfig{ClientId: "manager", PersistentSession: true}, want: "manager"},
+		{name: "Persistent session", config: MQTTConfig{PersistentSession: true}, want: "htManager-" + hostname},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientId(tt.config); got != tt.want {
+				t.Errorf("clientId() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if clientId(MQTTConfig{}) == clientId(MQTTConfig{}) {
+		t.Errorf("clientId() without persistent session isn't random")
+	}
+}
+
+// v3Transport hides MemoryTransport's PublishWithProperties, as a transport without MQTT v5 support.
+type v3Transport struct {
+	Transport
+}
+
+func TestDevices_CommandProperties(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	client := &recordingClient{}
+	td.devices.RegisterUpdateNotificationClient(client)
+
+	updateId, err := td.devices.UpdateDevice(testDeviceId, "v1.2.0")
+	if err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	if _, err := td.devices.RebootDevice(testDeviceId); err != nil {
+		t.Fatalf("RebootDevice() error = %v", err)
+	}
+	if commands := td.devices.GetDeviceCommands(testDeviceId); len(commands) != 2 || commands[0].Id != updateId {
+		t.Errorf("GetDeviceCommands() = %+v, want update %s first", commands, updateId)
+	}
+	messages := td.broker.Messages("homething/" + testDeviceId + "/device/ctrl")
+	if len(messages) != 2 || messages[0].Properties == nil || messages[1].Properties == nil {
+		t.Fatalf("messages = %+v, want 2 with properties", messages)
+	}
+	update, reboot := *messages[0].Properties, *messages[1].Properties
+	if update.ResponseTopic != DefaultResponseTopic || update.MessageExpiry != DefaultUpdateExpiry {
+		t.Errorf("update properties = %+v, want response topic and expiry", update)
+	}
+	if reboot.MessageExpiry != 0 {
+		t.Errorf("reboot expiry = %v, want none", reboot.MessageExpiry)
+	}
+	if string(update.CorrelationData) == string(reboot.CorrelationData) {
+		t.Errorf("correlation data %q used by both commands", update.CorrelationData)
+	}
+	if got := update.UserProperties[commandIdProperty]; got != string(update.CorrelationData) {
+		t.Errorf("command-id = %q, want %q", got, update.CorrelationData)
+	}
+
+	device := td.broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	replies := []PublishProperties{
+		{CorrelationData: []byte("unknown")},
+		{CorrelationData: update.CorrelationData},
+	}
+	for _, properties := range replies {
+		if err := device.PublishWithProperties(update.ResponseTopic, 0, false, []byte("updating"), properties); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.lock.Lock()
+	events := make([]DeviceUpdateEvent, 0)
+	for _, event := range client.events {
+		if event.Type == ResponseMessage {
+			events = append(events, event)
+		}
+	}
+	client.lock.Unlock()
+	want := []DeviceUpdateEvent{{
+		Id:   testDeviceId,
+		Type: ResponseMessage,
+		Data: CommandResponse{CommandId: string(update.CorrelationData), Command: "update", Payload: "updating"},
+	}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %+v, want %+v", events, want)
+	}
+}
+
+func TestDevices_CommandUserProperties(t *testing.T) {
+	broker := NewMemoryBroker()
+	publishDevice(t, broker, testDeviceId)
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.UserProperties = map[string]string{"site": "home", commandIdProperty: "configured"}
+	d, err := NewDevices(broker.NewTransport(), metadata, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RebootDevice(testDeviceId); err != nil {
+		t.Fatalf("RebootDevice() error = %v", err)
+	}
+	messages := broker.Messages("homething/" + testDeviceId + "/device/ctrl")
+	if len(messages) != 1 || messages[0].Properties == nil {
+		t.Fatalf("messages = %+v, want 1 with properties", messages)
+	}
+	properties := messages[0].Properties
+	if got := properties.UserProperties["site"]; got != "home" {
+		t.Errorf("site = %q, want home", got)
+	}
+	if got := properties.UserProperties[commandIdProperty]; got != string(properties.CorrelationData) {
+		t.Errorf("command-id = %q, want %q", got, properties.CorrelationData)
+	}
+}
+
+func TestDevices_CommandPropertiesUnsupported(t *testing.T) {
+	broker := NewMemoryBroker()
+	publishDevice(t, broker, testDeviceId)
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDevices(v3Transport{broker.NewTransport()}, metadata, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.UpdateDevice(testDeviceId, "v1.2.0"); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	messages := broker.Messages("homething/" + testDeviceId + "/device/ctrl")
+	if len(messages) != 1 || messages[0].Properties != nil {
+		t.Errorf("messages = %+v, want 1 without properties", messages)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		wantV5  bool
+		wantErr bool
+	}{
+		{name: "Default", version: 0},
+		{name: "MQTT v3", version: 3},
+		{name: "MQTT v5", version: 5, wantV5: true},
+		{name: "Unsupported", version: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewTransport(MQTTConfig{URL: "tcp://localhost:1883", ProtocolVersion: tt.version})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTransport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, ok := transport.(PropertiesPublisher); ok != tt.wantV5 {
+				t.Errorf("PropertiesPublisher = %v, want %v", ok, tt.wantV5)
+			}
+		})
+	}
+}
+
+func TestDevices_CommandTracking(t *testing.T) {
+	reboot := func(d Devices) error { return commandError(d.RebootDevice(testDeviceId)) }
+	update := func(d Devices) error { return commandError(d.UpdateDevice(testDeviceId, "v1.2.0")) }
+	setProfile := func(d Devices) error { return commandError(d.SetDeviceProfile(testDeviceId, "relay:\n- pin: 4\n")) }
+	info := func(version string) Message {
+		return Message{Topic: "device/info", Payload: []byte(`{"ip":"10.0.0.2","description":"Hall","version":"` + version + `"}`)}
+	}
+	var (
+		offline       = Message{Topic: "device/status", Payload: []byte("offline")}
+		online        = Message{Topic: "device/status", Payload: []byte("online")}
+		uptimeReset   = Message{Topic: "device/diag", Payload: []byte(`{"uptime":5,"mem":{"free":2048,"low":1024}}`)}
+		uptime        = Message{Topic: "device/diag", Payload: []byte(`{"uptime":200,"mem":{"free":2048,"low":1024}}`)}
+		profile       = Message{Topic: "device/profile", Payload: []byte(`{"version":"1.0","components":{"relay":[{"pin":4}]}}`)}
+		otherProfile  = Message{Topic: "device/profile", Payload: []byte(`{"version":"1.0","components":{"relay":[{"pin":5}]}}`)}
+		retained      = func(message Message) Message { message.Retained = true; return message }
+		messages      = func(messages ...Message) func(Command) []Message { return func(Command) []Message { return messages } }
+		ackWithId     = func(command Command) []Message { return []Message{{Topic: "device/ack", Payload: []byte(command.Id)}} }
+		restartWithV2 = messages(offline, info("v1.2.0"), online)
+	)
+
+	tests := []struct {
+		name      string
+		command   func(d Devices) error
+		messages  func(command Command) []Message
+		wantState CommandState
+		wantAckBy string
+	}{
+		{name: "Reboot acknowledged by status", command: reboot, messages: messages(offline, online),
+			wantState: CommandAcknowledged, wantAckBy: AckStatus},
+		{name: "Reboot not acknowledged by offline", command: reboot, messages: messages(offline),
+			wantState: CommandPending},
+		{name: "Reboot not acknowledged by online without offline", command: reboot, messages: messages(online),
+			wantState: CommandPending},
+		{name: "Reboot not acknowledged by retained status", command: reboot,
+			messages: messages(retained(offline), retained(online)), wantState: CommandPending},
+		{name: "Reboot acknowledged by uptime reset", command: reboot, messages: messages(uptimeReset),
+			wantState: CommandAcknowledged, wantAckBy: AckUptime},
+		{name: "Reboot not acknowledged by uptime increase", command: reboot, messages: messages(uptime),
+			wantState: CommandPending},
+		{name: "Reboot not acknowledged by retained uptime reset", command: reboot, messages: messages(retained(uptimeReset)),
+			wantState: CommandPending},
+		{name: "Reboot acknowledged by ack with name", command: reboot,
+			messages: messages(Message{Topic: "device/ack", Payload: []byte("restart")}), wantState: CommandAcknowledged, wantAckBy: AckTopic},
+		{name: "Reboot not acknowledged by retained ack", command: reboot,
+			messages: messages(retained(Message{Topic: "device/ack", Payload: []byte("restart")})), wantState: CommandPending},
+		{name: "Update acknowledged by restart with new version", command: update, messages: restartWithV2,
+			wantState: CommandAcknowledged, wantAckBy: AckStatus},
+		{name: "Update acknowledged by new version after restart", command: update,
+			messages: messages(offline, online, info("v1.2.0")), wantState: CommandAcknowledged, wantAckBy: AckStatus},
+		{name: "Update acknowledged by uptime reset with new version", command: update,
+			messages: messages(info("v1.2.0"), uptimeReset), wantState: CommandAcknowledged, wantAckBy: AckUptime},
+		{name: "Update not acknowledged by restart with same version", command: update,
+			messages: messages(offline, info("v1.0.0"), online), wantState: CommandPending},
+		{name: "Update not acknowledged by new version without restart", command: update,
+			messages: messages(info("v1.2.0")), wantState: CommandPending},
+		{name: "Set profile acknowledged by ack with id", command: setProfile, messages: ackWithId,
+			wantState: CommandAcknowledged, wantAckBy: AckTopic},
+		{name: "Set profile acknowledged by profile", command: setProfile, messages: messages(profile),
+			wantState: CommandAcknowledged, wantAckBy: AckProfile},
+		{name: "Set profile not acknowledged by another profile", command: setProfile, messages: messages(otherProfile),
+			wantState: CommandPending},
+		{name: "Set profile not acknowledged by retained profile", command: setProfile, messages: messages(retained(profile)),
+			wantState: CommandPending},
+		{name: "Set profile not acknowledged by restart", command: setProfile, messages: messages(offline, online),
+			wantState: CommandPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td := newTestDevices(t)
+			publishDevice(t, td.broker, testDeviceId)
+			if err := tt.command(td.devices); err != nil {
+				t.Fatal(err)
+			}
+			commands := td.devices.GetDeviceCommands(testDeviceId)
+			if len(commands) != 1 || commands[0].State != CommandPending {
+				t.Fatalf("GetDeviceCommands() = %+v, want one pending command", commands)
+			}
+			device := td.broker.NewTransport()
+			if err := device.Connect(nil); err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range tt.messages(commands[0]) {
+				message.Topic = "homething/" + testDeviceId + "/" + message.Topic
+				if message.Retained {
+					// As the broker sends the retained messages again when htManager reconnects.
+					td.devices.(*devices).routeMessage(message)
+				} else if err := device.Publish(message.Topic, 0, false, message.Payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			command := td.devices.GetDeviceCommands(testDeviceId)[0]
+			if command.State != tt.wantState || command.AcknowledgedBy != tt.wantAckBy {
+				t.Errorf("command = %+v, want %s by %q", command, tt.wantState, tt.wantAckBy)
+			}
+		})
+	}
+}
+
+func TestDevices_UpdatePending(t *testing.T) {
+	tests := []struct {
+		name           string
+		commandTimeout time.Duration
+		acknowledge    bool
+		wantErr        error
+	}{
+		{name: "Pending", commandTimeout: time.Minute, wantErr: UpdatePendingError},
+		{name: "Acknowledged", commandTimeout: time.Minute, acknowledge: true},
+		{name: "Without timeout", commandTimeout: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			publishDevice(t, broker, testDeviceId)
+			metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := DefaultConfig()
+			config.CommandTimeout = tt.commandTimeout
+			d, err := NewDevices(broker.NewTransport(), metadata, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			commandId, err := d.UpdateDevice(testDeviceId, "v1.1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.acknowledge {
+				d.(*devices).handleAckMessage(testDeviceId, []byte(commandId))
+			}
+			if _, err := d.UpdateDevice(testDeviceId, "v1.2.0"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("UpdateDevice() error = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := d.RebootDevice(testDeviceId); err != nil {
+				t.Errorf("RebootDevice() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDevices_UpdatePendingConcurrent(t *testing.T) {
+	td := newTestDevices(t)
+	publishDevice(t, td.broker, testDeviceId)
+	var wg sync.WaitGroup
+	var sent atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := td.devices.UpdateDevice(testDeviceId, "v1.2.0"); err == nil {
+				sent.Add(1)
+			} else if !errors.Is(err, UpdatePendingError) {
+				t.Errorf("UpdateDevice() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if sent.Load() != 1 {
+		t.Errorf("%d updates sent, want 1", sent.Load())
+	}
+}
+
+func TestDevices_CommandTimeout(t *testing.T) {
+	broker := NewMemoryBroker()
+	publishDevice(t, broker, testDeviceId)
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.CommandTimeout = 10 * time.Millisecond
+	d, err := NewDevices(broker.NewTransport(), metadata, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &recordingClient{}
+	d.RegisterUpdateNotificationClient(client)
+	if _, err := d.RebootDevice(testDeviceId); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for d.GetDeviceCommands(testDeviceId)[0].State == CommandPending && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if command := d.GetDeviceCommands(testDeviceId)[0]; command.State != CommandTimedOut {
+		t.Errorf("command = %+v, want timed out", command)
+	}
+	if got, want := client.eventTypes(), []string{CommandUpdateMessage, CommandUpdateMessage}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	// Devices which are removed have their commands forgotten.
+	if _, err := d.RebootDevice(testDeviceId); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveDevice(testDeviceId); err != nil {
+		t.Fatal(err)
+	}
+	if commands := d.GetDeviceCommands(testDeviceId); len(commands) != 0 {
+		t.Errorf("GetDeviceCommands() = %+v, want none", commands)
+	}
+}
@@ -1,10 +1,9 @@
 package devices
 
 import (
+	"errors"
 	"fmt"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"math/rand"
-	"regexp"
+	"log"
 	"sync"
 	"time"
 )
@@ -16,25 +15,54 @@ const (
 	ValueUpdateMessage   = "value"
 	StatusUpdateMessage  = "status"
 	DeviceRemovedMessage = "removed"
+	ResponseMessage      = "response"
+	CommandUpdateMessage = "command"
+)
+
+var (
+	DeviceNotFoundError = errors.New("device not found")
+	InvalidProfileError = errors.New("invalid profile")
+	// UpdatePendingError is an update sent to a device which hasn't acted on the previous one yet.
+	UpdatePendingError = errors.New("an update is already pending")
 )
 
 type DeviceInfo struct {
-	Id           string     `json:"id"`
-	LastSeen     *time.Time `json:"lastSeen,omitempty"`
-	Description  string     `json:"description"`
-	IPAddr       string     `json:"ip_addr"`
-	Version      string     `json:"version"`
-	DeviceType   string     `json:"deviceType"`
-	Memory       uint       `json:"memory"`
-	Capabilities []string   `json:"capabilities"`
+	Id           string          `json:"id" yaml:"id"`
+	Namespace    string          `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Broker       string          `json:"broker,omitempty" yaml:"broker,omitempty"`
+	LastSeen     *time.Time      `json:"lastSeen,omitempty" yaml:"lastSeen,omitempty"`
+	Description  string          `json:"description" yaml:"description"`
+	IPAddr       string          `json:"ip_addr" yaml:"ip_addr"`
+	Version      string          `json:"version" yaml:"version"`
+	DeviceType   string          `json:"deviceType" yaml:"deviceType"`
+	Memory       uint            `json:"memory" yaml:"memory"`
+	Capabilities []string        `json:"capabilities" yaml:"capabilities"`
+	Metadata     *DeviceMetadata `json:"metadata,omitempty" yaml:"metadata,omitempty"`
 }
 
 type DeviceUpdateEvent struct {
+	// Seq numbers the events in the order the web server got them, clients resume from it after reconnecting.
+	Seq  uint64 `json:"seq,omitempty"`
 	Id   string `json:"id"`
 	Type string `json:"type"`
 	Data any    `json:"data"`
 }
 
+// DeviceResult is the outcome of an operation applied to one of a set of devices.
+type DeviceResult struct {
+	Id    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// BrokerStatus is the health of the connection to an MQTT broker.
+type BrokerStatus struct {
+	Label     string `json:"label"`
+	Connected bool   `json:"connected"`
+	Devices   int    `json:"devices"`
+	Offline   int    `json:"offline"`
+	Error     string `json:"error,omitempty"`
+}
+
 type UpdateNotificationClient interface {
 	DeviceUpdated(event DeviceUpdateEvent)
 }
@@ -43,20 +71,33 @@ type Devices interface {
 	GetDevices() []DeviceInfo
 	RemoveDevice(deviceId string) error
 	GetDeviceInfo(deviceId string) *DeviceInfo
+	GetDeviceMetadata(deviceId string) *DeviceMetadata
+	SetDeviceMetadata(deviceId string, metadata DeviceMetadata) error
 	GetDeviceDiag(deviceId string) *DeviceDiag
 	GetDeviceStatus(deviceId string) *string
 	GetDeviceProfile(deviceId string) *string
-	SetDeviceProfile(deviceId string, profile string) error
+	// SetDeviceProfile, RebootDevice and UpdateDevice send a ctrl command and return its id in GetDeviceCommands.
+	SetDeviceProfile(deviceId string, profile string) (string, error)
 	GetDeviceTopics(deviceId string) *TopicsInfo
 	GetDeviceTopicValues(deviceId string) *TopicsValues
-	RebootDevice(deviceId string) error
-	UpdateDevice(deviceId string, version string) error
+	SetDeviceTopicValue(deviceId string, topic string, value string) error
+	RebootDevice(deviceId string) (string, error)
+	UpdateDevice(deviceId string, version string) (string, error)
+	// GetDeviceCommands returns the last ctrl commands sent to the device, oldest first.
+	GetDeviceCommands(deviceId string) []Command
+	GetBrokers() []BrokerStatus
 	RegisterUpdateNotificationClient(client UpdateNotificationClient)
 	UnregisterUpdateNotificationClient(client UpdateNotificationClient)
+	// Close marks htManager as offline and disconnects from the broker.
+	Close()
 }
 
 type devices struct {
-	client        mqtt.Client
+	transport     Transport
+	metadata      MetadataStore
+	config        Config
+	namespaces    []*namespace
+	dataLock      sync.RWMutex
 	info          map[string]RawDeviceInfo
 	diag          map[string]DeviceDiag
 	status        map[string]string
@@ -65,79 +106,150 @@ type devices struct {
 	topicValues   map[string]TopicsValues
 	lock          sync.Mutex
 	updateClients []UpdateNotificationClient
+	commandLock   sync.Mutex
+	commands      map[string][]*trackedCommand
+	closed        chan struct{}
+	closeOnce     sync.Once
 }
 
-var deviceTopicRegExp = regexp.MustCompile("homething/([0-9a-f]+)/device/(.*)")
-var topicsRegExp = regexp.MustCompile("homething/([0-9a-f]+)/(.*)")
-
-func NewDevices(connection string) Devices {
+// NewDevices creates the devices manager and connects it to the broker using transport.
+func NewDevices(transport Transport, metadata MetadataStore, config Config) (Devices, error) {
+	namespaces, err := newNamespaces(config.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.QoS.validate(); err != nil {
+		return nil, err
+	}
 	devices := &devices{
+		transport:   transport,
+		metadata:    metadata,
+		config:      config,
+		namespaces:  namespaces,
 		info:        map[string]RawDeviceInfo{},
 		diag:        map[string]DeviceDiag{},
 		status:      map[string]string{},
 		profile:     map[string]string{},
 		topicInfo:   map[string]TopicsInfo{},
 		topicValues: map[string]TopicsValues{},
+		commands:    map[string][]*trackedCommand{},
+		closed:      make(chan struct{}),
+	}
+	if setter, ok := transport.(DefaultHandlerSetter); ok {
+		setter.SetDefaultHandler(devices.routeMessage)
+	}
+	if config.StatusTopic != "" {
+		transport.SetWill(config.StatusTopic, config.QoS.Retained, true, []byte(managerOffline))
 	}
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(connection)
-	opts.SetClientID(fmt.Sprintf("htManager-%d", rand.Int()))
-	opts.SetDefaultPublishHandler(devices.handleMessage)
-	opts.SetAutoReconnect(true)
-	opts.OnConnect = devices.handleConnect
-	devices.client = mqtt.NewClient(opts)
-	if token := devices.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	if err := transport.Connect(devices.handleConnect); err != nil {
+		return nil, err
 	}
-	return devices
+	if config.SummaryTopic != "" && config.SummaryInterval > 0 {
+		go devices.publishSummaries()
+	}
+	return devices, nil
 }
 
-func (d *devices) handleConnect(client mqtt.Client) {
-	client.Subscribe("homething/#", 0, d.handleMessage)
+func (d *devices) handleConnect() {
+	for _, ns := range d.namespaces {
+		ns := ns
+		err := d.transport.Subscribe(ns.Prefix+"/#", d.config.QoS.Subscribe, func(msg Message) {
+			d.handleMessage(ns, msg)
+		})
+		if err != nil {
+			log.Printf("Failed to subscribe to %s: %s\n", ns.Prefix, err)
+		}
+	}
+	d.subscribeResponses()
+	d.publishStatus()
+}
+
+// routeMessage handles a message received before the subscription it matches was made again on reconnecting.
+func (d *devices) routeMessage(msg Message) {
+	for _, ns := range d.namespaces {
+		if topicMatches(ns.Prefix+"/#", msg.Topic) {
+			d.handleMessage(ns, msg)
+		}
+	}
+	if d.config.ResponseTopic != "" && topicMatches(d.config.ResponseTopic, msg.Topic) {
+		d.handleResponse(msg)
+	}
 }
 
-func (d *devices) handleMessage(client mqtt.Client, msg mqtt.Message) {
-	if matches := deviceTopicRegExp.FindStringSubmatch(msg.Topic()); len(matches) > 0 {
-		d.handleDeviceMessage(matches[1], matches[2], msg.Payload())
-	} else if matches := topicsRegExp.FindStringSubmatch(msg.Topic()); len(matches) > 0 {
-		d.handleTopicMessage(matches[1], matches[2], msg.Payload())
+func (d *devices) handleMessage(ns *namespace, msg Message) {
+	if matches := ns.deviceTopicRegExp.FindStringSubmatch(msg.Topic); len(matches) > 0 {
+		d.handleDeviceMessage(ns.deviceId(matches[1]), matches[2], msg.Payload, msg.Retained)
+	} else if matches := ns.topicsRegExp.FindStringSubmatch(msg.Topic); len(matches) > 0 {
+		d.handleTopicMessage(ns.deviceId(matches[1]), matches[2], msg.Payload)
 	} else {
-		fmt.Printf("Unmatched topic %s", msg.Topic())
+		fmt.Printf("Unmatched topic %s", msg.Topic)
 	}
 }
 
+func (d *devices) publish(topic string, qos byte, retained bool, payload []byte) error {
+	return d.transport.Publish(topic, qos, retained, payload)
+}
+
 func (d *devices) GetDevices() []DeviceInfo {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
 	deviceArray := make([]DeviceInfo, 0, len(d.info))
 	for deviceId, rawDevice := range d.info {
 		var lastSeen *time.Time
 		if diag, ok := d.diag[deviceId]; ok {
 			lastSeen = diag.LastSeen
 		}
-		deviceArray = append(deviceArray, rawDevice.toDeviceInfo(deviceId, lastSeen))
+		deviceArray = append(deviceArray, rawDevice.toDeviceInfo(deviceId, lastSeen, d.metadata.GetMetadata(deviceId)))
 	}
 	return deviceArray
 }
 
 func (d *devices) GetDeviceInfo(deviceId string) *DeviceInfo {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
 	if rawDevice, ok := d.info[deviceId]; ok {
 		var lastSeen *time.Time
 		if diag, ok := d.diag[deviceId]; ok {
 			lastSeen = diag.LastSeen
 		}
 
-		device := rawDevice.toDeviceInfo(deviceId, lastSeen)
+		device := rawDevice.toDeviceInfo(deviceId, lastSeen, d.metadata.GetMetadata(deviceId))
 		return &device
 	}
 	return nil
 }
 
+func (d *devices) GetDeviceMetadata(deviceId string) *DeviceMetadata {
+	if d.isDeviceKnown(deviceId) {
+		return d.metadata.GetMetadata(deviceId)
+	}
+	return nil
+}
+
+func (d *devices) SetDeviceMetadata(deviceId string, metadata DeviceMetadata) error {
+	if !d.isDeviceKnown(deviceId) {
+		return fmt.Errorf("%w: %s", DeviceNotFoundError, deviceId)
+	}
+	if err := d.metadata.SetMetadata(deviceId, metadata); err != nil {
+		return err
+	}
+	if info := d.GetDeviceInfo(deviceId); info != nil {
+		d.sendUpdateMessage(deviceId, InfoUpdateMessage, *info)
+	}
+	return nil
+}
+
 func (d *devices) isDeviceKnown(deviceId string) bool {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
 	_, ok := d.info[deviceId]
 	return ok
 }
 
 func (d *devices) GetDeviceDiag(deviceId string) *DeviceDiag {
-	if d.isDeviceKnown(deviceId) {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	if _, ok := d.info[deviceId]; ok {
 		if diag, ok := d.diag[deviceId]; ok {
 			return &diag
 		}
@@ -146,7 +258,9 @@ func (d *devices) GetDeviceDiag(deviceId string) *DeviceDiag {
 }
 
 func (d *devices) GetDeviceStatus(deviceId string) *string {
-	if d.isDeviceKnown(deviceId) {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	if _, ok := d.info[deviceId]; ok {
 		if status, ok := d.status[deviceId]; ok {
 			return &status
 		}
@@ -155,7 +269,9 @@ func (d *devices) GetDeviceStatus(deviceId string) *string {
 }
 
 func (d *devices) GetDeviceProfile(deviceId string) *string {
-	if d.isDeviceKnown(deviceId) {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	if _, ok := d.info[deviceId]; ok {
 		if profile, ok := d.profile[deviceId]; ok {
 			return &profile
 		}
@@ -163,24 +279,19 @@ func (d *devices) GetDeviceProfile(deviceId string) *string {
 	return nil
 }
 
-func (d *devices) SetDeviceProfile(deviceId string, profile string) error {
+func (d *devices) SetDeviceProfile(deviceId string, profile string) (string, error) {
 	profileBin, err := encodeProfile(profile)
 	if err != nil {
-		return fmt.Errorf("failed to encode profile: %s", err)
+		return "", fmt.Errorf("%w: %s", InvalidProfileError, err)
 	}
 	command := append([]byte("setprofile\x00"), profileBin...)
-	t := d.client.Publish(fmt.Sprintf("homething/%s/device/ctrl", deviceId), 0, false, command)
-	if !t.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("timeout waiting for response from broker")
-	}
-	if err := t.Error(); err != nil {
-		return err
-	}
-	return nil
+	return d.publishCtrl(deviceId, command, 0)
 }
 
 func (d *devices) GetDeviceTopics(deviceId string) *TopicsInfo {
-	if d.isDeviceKnown(deviceId) {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	if _, ok := d.info[deviceId]; ok {
 		if topics, ok := d.topicInfo[deviceId]; ok {
 			return &topics
 		}
@@ -189,34 +300,78 @@ func (d *devices) GetDeviceTopics(deviceId string) *TopicsInfo {
 }
 
 func (d *devices) GetDeviceTopicValues(deviceId string) *TopicsValues {
-	if d.isDeviceKnown(deviceId) {
+	d.dataLock.RLock()
+	defer d.dataLock.RUnlock()
+	if _, ok := d.info[deviceId]; ok {
 		if values, ok := d.topicValues[deviceId]; ok {
-			return &values
+			valuesCopy := values.copy()
+			return &valuesCopy
 		}
 	}
 	return nil
 }
 
-func (d *devices) RebootDevice(deviceId string) error {
-	t := d.client.Publish(fmt.Sprintf("homething/%s/device/ctrl", deviceId), 0, false, []byte("restart"))
-	if !t.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("timeout waiting for response from broker")
+func (d *devices) SetDeviceTopicValue(deviceId string, topic string, value string) error {
+	topics := d.GetDeviceTopics(deviceId)
+	if topics == nil {
+		return fmt.Errorf("%w: %s", DeviceNotFoundError, deviceId)
+	}
+	if !topics.isValidSubTopic(topic) {
+		return InvalidSubTopicError
 	}
-	if err := t.Error(); err != nil {
+	topicPath, err := d.deviceTopic(deviceId, topic)
+	if err != nil {
 		return err
 	}
-	return nil
+	return d.publish(topicPath, d.config.QoS.Commands, false, []byte(value))
 }
 
-func (d *devices) UpdateDevice(deviceId string, version string) error {
-	t := d.client.Publish(fmt.Sprintf("homething/%s/device/ctrl", deviceId), 0, false, []byte("update "+version))
-	if !t.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("timeout waiting for response from broker")
+func (d *devices) RebootDevice(deviceId string) (string, error) {
+	return d.publishCtrl(deviceId, []byte("restart"), 0)
+}
+
+func (d *devices) UpdateDevice(deviceId string, version string) (string, error) {
+	return d.publishCtrl(deviceId, []byte("update "+version), d.config.UpdateExpiry)
+}
+
+// publishCtrl sends a command to the device and tracks it until the device acts on it, it returns the command's id.
+// Over MQTT v5 the command expires after expiry and the device can reply to it.
+func (d *devices) publishCtrl(deviceId string, command []byte, expiry time.Duration) (string, error) {
+	topic, err := d.deviceTopic(deviceId, "device/ctrl")
+	if err != nil {
+		return "", err
 	}
-	if err := t.Error(); err != nil {
-		return err
+	commandId := newCommandId()
+	if err := d.trackCommand(commandId, deviceId, command); err != nil {
+		return "", err
 	}
-	return nil
+	if publisher, ok := d.transport.(PropertiesPublisher); ok {
+		properties := PublishProperties{
+			ResponseTopic:   d.config.ResponseTopic,
+			CorrelationData: []byte(commandId),
+			MessageExpiry:   expiry,
+			UserProperties:  map[string]string{},
+		}
+		for key, value := range d.config.UserProperties {
+			properties.UserProperties[key] = value
+		}
+		properties.UserProperties[commandIdProperty] = commandId
+		err = publisher.PublishWithProperties(topic, d.config.QoS.Commands, false, command, properties)
+	} else {
+		err = d.publish(topic, d.config.QoS.Commands, false, command)
+	}
+	if err != nil {
+		d.untrackCommand(deviceId, commandId)
+		return "", err
+	}
+	d.commandSent(deviceId, commandId)
+	return commandId, nil
+}
+
+func (d *devices) GetBrokers() []BrokerStatus {
+	status := BrokerStatus{Connected: d.transport.IsConnected()}
+	status.Devices, status.Offline = d.countDevices()
+	return []BrokerStatus{status}
 }
 
 func (d *devices) RegisterUpdateNotificationClient(client UpdateNotificationClient) {
@@ -237,8 +392,14 @@ func (d *devices) UnregisterUpdateNotificationClient(client UpdateNotificationCl
 }
 
 func (d *devices) RemoveDevice(deviceId string) error {
-	if !d.isDeviceKnown(deviceId) {
-		return fmt.Errorf("device %s not found", deviceId)
+	ns, hardwareId, err := d.resolve(deviceId)
+	if err != nil {
+		return err
+	}
+	d.dataLock.Lock()
+	if _, ok := d.info[deviceId]; !ok {
+		d.dataLock.Unlock()
+		return fmt.Errorf("%w: %s", DeviceNotFoundError, deviceId)
 	}
 	delete(d.info, deviceId)
 	delete(d.diag, deviceId)
@@ -247,47 +408,51 @@ func (d *devices) RemoveDevice(deviceId string) error {
 	delete(d.topicInfo, deviceId)
 	topicValues := d.topicValues[deviceId]
 	delete(d.topicValues, deviceId)
+	d.dataLock.Unlock()
+	d.removeCommands(deviceId)
 	for primaryTopic, topicValues := range topicValues {
 		for topic, _ := range topicValues {
-			var topicPath string
-			if topic == "" {
-				topicPath = fmt.Sprintf("homething/%s/%s", deviceId, primaryTopic)
-			} else {
-				topicPath = fmt.Sprintf("homething/%s/%s/%s", deviceId, primaryTopic, topic)
+			topicPath := ns.topic(hardwareId, primaryTopic)
+			if topic != "" {
+				topicPath += "/" + topic
 			}
 
-			t := d.client.Publish(topicPath, 0, true, []byte{})
-			if !t.WaitTimeout(10 * time.Second) {
-				return fmt.Errorf("timeout waiting for response from broker")
-			}
-			if err := t.Error(); err != nil {
+			if err := d.publish(topicPath, d.config.QoS.Retained, true, []byte{}); err != nil {
 				return err
 			}
 		}
 	}
 	for _, topic := range []string{"diag", "status", "profile", "topics", "info"} {
-		topicPath := fmt.Sprintf("homething/%s/device/%s", deviceId, topic)
-		t := d.client.Publish(topicPath, 0, true, []byte{})
-		if !t.WaitTimeout(10 * time.Second) {
-			return fmt.Errorf("timeout waiting for response from broker")
-		}
-		if err := t.Error(); err != nil {
+		topicPath := ns.topic(hardwareId, "device/"+topic)
+		if err := d.publish(topicPath, d.config.QoS.Retained, true, []byte{}); err != nil {
 			return err
 		}
 	}
-	d.cleanupHomeAssistant(deviceId)
+	d.cleanupHomeAssistant(hardwareId)
 	d.sendUpdateMessage(deviceId, DeviceRemovedMessage, nil)
 	return nil
 }
 
+// homeAssistantCleanupTime is how long retained home assistant discovery messages are removed for after a device is removed.
+var homeAssistantCleanupTime = 10 * time.Second
+
 func (d *devices) cleanupHomeAssistant(deviceId string) {
 	topic := fmt.Sprintf("homeassistant/+/%s/#", deviceId)
-	d.client.Subscribe(topic, 0, func(client mqtt.Client, message mqtt.Message) {
-		if message.Retained() && len(message.Payload()) > 0 {
-			d.client.Publish(message.Topic(), 0, true, []byte{})
+	err := d.transport.Subscribe(topic, d.config.QoS.Subscribe, func(message Message) {
+		if message.Retained && len(message.Payload) > 0 {
+			// Waiting for the broker to acknowledge a QoS 1 or 2 message in a message handler can deadlock.
+			go func() {
+				if err := d.publish(message.Topic, d.config.QoS.Retained, true, []byte{}); err != nil {
+					log.Printf("%s: failed to clear %s: %s\n", deviceId, message.Topic, err)
+				}
+			}()
 		}
 	})
-	time.AfterFunc(10*time.Second, func() {
-		d.client.Unsubscribe(topic)
+	if err != nil {
+		log.Printf("%s: failed to subscribe to home assistant topics: %s\n", deviceId, err)
+		return
+	}
+	time.AfterFunc(homeAssistantCleanupTime, func() {
+		d.transport.Unsubscribe(topic)
 	})
 }
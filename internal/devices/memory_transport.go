@@ -0,0 +1,207 @@
+package devices
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var NotConnectedError = errors.New("not connected")
+
+// MemoryBroker is an in-process MQTT broker with retained message support, it allows the devices manager to be
+// used without a real broker in tests. Messages are delivered synchronously to subscribers.
+type MemoryBroker struct {
+	lock     sync.Mutex
+	retained map[string][]byte
+	clients  []*MemoryTransport
+	messages []Message
+}
+
+// MemoryTransport is a client connection to a MemoryBroker.
+type MemoryTransport struct {
+	broker        *MemoryBroker
+	onConnect     func()
+	connected     bool
+	subscriptions map[string]MessageHandler
+	will          *Message
+}
+
+type delivery struct {
+	handler MessageHandler
+	message Message
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{retained: map[string][]byte{}}
+}
+
+func (b *MemoryBroker) NewTransport() *MemoryTransport {
+	t := &MemoryTransport{broker: b, subscriptions: map[string]MessageHandler{}}
+	b.lock.Lock()
+	b.clients = append(b.clients, t)
+	b.lock.Unlock()
+	return t
+}
+
+// Retained returns the retained message for the topic.
+func (b *MemoryBroker) Retained(topic string) ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// Messages returns every message published to the broker matching the topic filter.
+func (b *MemoryBroker) Messages(filter string) []Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	messages := make([]Message, 0)
+	for _, message := range b.messages {
+		if topicMatches(filter, message.Topic) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (b *MemoryBroker) publish(message Message) {
+	b.lock.Lock()
+	b.messages = append(b.messages, message)
+	if message.Retained {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message.Payload
+		}
+	}
+	// Subscribers receive the retained flag only for messages sent because of a new subscription.
+	message.Retained = false
+	deliveries := make([]delivery, 0)
+	for _, client := range b.clients {
+		if !client.connected {
+			continue
+		}
+		for filter, handler := range client.subscriptions {
+			if topicMatches(filter, message.Topic) {
+				deliveries = append(deliveries, delivery{handler: handler, message: message})
+			}
+		}
+	}
+	b.lock.Unlock()
+	for _, d := range deliveries {
+		d.handler(d.message)
+	}
+}
+
+// SetWill sets the message published by the broker when the connection is dropped.
+func (t *MemoryTransport) SetWill(topic string, qos byte, retained bool, payload []byte) {
+	t.will = &Message{Topic: topic, Payload: payload, Retained: retained, QoS: qos}
+}
+
+func (t *MemoryTransport) Connect(onConnect func()) error {
+	t.broker.lock.Lock()
+	t.onConnect = onConnect
+	t.connected = true
+	t.broker.lock.Unlock()
+	if onConnect != nil {
+		onConnect()
+	}
+	return nil
+}
+
+// Drop simulates the connection to the broker being lost, the will message is published and the
+// subscriptions are forgotten.
+func (t *MemoryTransport) Drop() {
+	t.broker.lock.Lock()
+	t.connected = false
+	t.subscriptions = map[string]MessageHandler{}
+	will := t.will
+	t.broker.lock.Unlock()
+	if will != nil {
+		t.broker.publish(*will)
+	}
+}
+
+// Reconnect simulates the client re-establishing a dropped connection.
+func (t *MemoryTransport) Reconnect() error {
+	return t.Connect(t.onConnect)
+}
+
+func (t *MemoryTransport) IsConnected() bool {
+	t.broker.lock.Lock()
+	defer t.broker.lock.Unlock()
+	return t.connected
+}
+
+func (t *MemoryTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if !t.IsConnected() {
+		return NotConnectedError
+	}
+	t.broker.publish(Message{Topic: topic, Payload: append([]byte(nil), payload...), Retained: retained, QoS: qos})
+	return nil
+}
+
+// PublishWithProperties publishes the message with its MQTT v5 properties, which are passed on to subscribers.
+func (t *MemoryTransport) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, properties PublishProperties) error {
+	if !t.IsConnected() {
+		return NotConnectedError
+	}
+	t.broker.publish(Message{Topic: topic, Payload: append([]byte(nil), payload...), Retained: retained, QoS: qos, Properties: &properties})
+	return nil
+}
+
+func (t *MemoryTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	t.broker.lock.Lock()
+	if !t.connected {
+		t.broker.lock.Unlock()
+		return NotConnectedError
+	}
+	t.subscriptions[topic] = handler
+	retained := make([]Message, 0)
+	for retainedTopic, payload := range t.broker.retained {
+		if topicMatches(topic, retainedTopic) {
+			retained = append(retained, Message{Topic: retainedTopic, Payload: payload, Retained: true})
+		}
+	}
+	t.broker.lock.Unlock()
+	sort.Slice(retained, func(i, j int) bool {
+		return retained[i].Topic < retained[j].Topic
+	})
+	for _, message := range retained {
+		handler(message)
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Unsubscribe(topic string) error {
+	t.broker.lock.Lock()
+	delete(t.subscriptions, topic)
+	t.broker.lock.Unlock()
+	return nil
+}
+
+func (t *MemoryTransport) Disconnect() {
+	t.broker.lock.Lock()
+	t.connected = false
+	t.subscriptions = map[string]MessageHandler{}
+	t.broker.lock.Unlock()
+}
+
+// topicMatches reports whether the topic matches the subscription filter, which may contain + and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for idx, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if idx >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[idx] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
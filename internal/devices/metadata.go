@@ -0,0 +1,97 @@
+package devices
+
+import (
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// DeviceMetadata is information about a device owned by htManager rather than reported by the device.
+type DeviceMetadata struct {
+	Tags     []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Group    string   `json:"group,omitempty" yaml:"group,omitempty"`
+	Location string   `json:"location,omitempty" yaml:"location,omitempty"`
+	Notes    string   `json:"notes,omitempty" yaml:"notes,omitempty"`
+	Owner    string   `json:"owner,omitempty" yaml:"owner,omitempty"`
+}
+
+type MetadataStore interface {
+	GetMetadata(deviceId string) *DeviceMetadata
+	SetMetadata(deviceId string, metadata DeviceMetadata) error
+}
+
+type fileMetadataStore struct {
+	path     string
+	lock     sync.Mutex
+	metadata map[string]DeviceMetadata
+}
+
+// NewMetadataStore loads the metadata saved in the YAML file at path, the file is created on the first change.
+func NewMetadataStore(path string) (MetadataStore, error) {
+	store := &fileMetadataStore{path: path, metadata: map[string]DeviceMetadata{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &store.metadata); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (m *DeviceMetadata) isEmpty() bool {
+	return len(m.Tags) == 0 && m.Group == "" && m.Location == "" && m.Notes == "" && m.Owner == ""
+}
+
+func (m *DeviceMetadata) HasTag(wanted string) bool {
+	return slices.Contains(m.Tags, wanted)
+}
+
+func (s *fileMetadataStore) GetMetadata(deviceId string) *DeviceMetadata {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if metadata, ok := s.metadata[deviceId]; ok {
+		return &metadata
+	}
+	return nil
+}
+
+// SetMetadata saves the change before applying it, so that the metadata isn't changed if it can't be saved.
+func (s *fileMetadataStore) SetMetadata(deviceId string, metadata DeviceMetadata) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	updated := make(map[string]DeviceMetadata, len(s.metadata)+1)
+	for id, value := range s.metadata {
+		updated[id] = value
+	}
+	if metadata.isEmpty() {
+		delete(updated, deviceId)
+	} else {
+		updated[deviceId] = metadata
+	}
+	if err := s.save(updated); err != nil {
+		return err
+	}
+	s.metadata = updated
+	return nil
+}
+
+func (s *fileMetadataStore) save(metadata map[string]DeviceMetadata) error {
+	data, err := yaml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,78 @@
+package devices
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata", "metadata.yaml")
+	store, err := NewMetadataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hall := DeviceMetadata{Tags: []string{"light"}, Group: "ground", Owner: "sam"}
+	tests := []struct {
+		name     string
+		deviceId string
+		metadata DeviceMetadata
+		want     map[string]*DeviceMetadata
+	}{
+		{name: "Set", deviceId: "01", metadata: hall, want: map[string]*DeviceMetadata{"01": &hall, "02": nil}},
+		{name: "Set another", deviceId: "02", metadata: DeviceMetadata{Notes: "spare"},
+			want: map[string]*DeviceMetadata{"01": &hall, "02": {Notes: "spare"}}},
+		{name: "Clear", deviceId: "02", metadata: DeviceMetadata{}, want: map[string]*DeviceMetadata{"01": &hall, "02": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.SetMetadata(tt.deviceId, tt.metadata); err != nil {
+				t.Fatalf("SetMetadata() error = %v", err)
+			}
+			// The file is read back by a new store, as on restart.
+			reloaded, err := NewMetadataStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for deviceId, want := range tt.want {
+				for _, s := range []MetadataStore{store, reloaded} {
+					if got := s.GetMetadata(deviceId); !reflect.DeepEqual(got, want) {
+						t.Errorf("GetMetadata(%s) = %v, want %v", deviceId, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataStore_SaveFails(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewMetadataStore(filepath.Join(dir, "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMetadata("01", DeviceMetadata{Group: "ground"}); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the temporary file makes the write fail.
+	if err := os.Mkdir(filepath.Join(dir, "metadata.yaml.tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMetadata("01", DeviceMetadata{Group: "attic"}); err == nil {
+		t.Fatal("SetMetadata() error = nil, want the write error")
+	}
+	if got := store.GetMetadata("01"); got == nil || got.Group != "ground" {
+		t.Errorf("GetMetadata() after a failed save = %v, want group ground", got)
+	}
+}
+
+func TestNewMetadataStore_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.yaml")
+	if err := os.WriteFile(path, []byte("01: [group"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMetadataStore(path); err == nil {
+		t.Error("NewMetadataStore() error = nil, want a YAML error")
+	}
+}
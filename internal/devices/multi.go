@@ -0,0 +1,409 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// brokerRetryInterval is the delay before connecting again to a broker which couldn't be reached at startup, it
+	// doubles after each attempt up to maxBrokerRetryInterval.
+	brokerRetryInterval    = 5 * time.Second
+	maxBrokerRetryInterval = 5 * time.Minute
+)
+
+var (
+	InvalidBrokerError     = errors.New("invalid broker")
+	BrokerUnavailableError = errors.New("broker unavailable")
+)
+
+// BrokerConfig is the configuration of one of the brokers managed by htManager. Devices connected to the broker
+// have ids of the form <label>:<device id>.
+type BrokerConfig struct {
+	Label      string `yaml:"label"`
+	MQTTConfig `yaml:",inline"`
+	Namespaces []Namespace `yaml:"namespaces"`
+	// UserProperties are added to the commands sent to this broker's devices over MQTT v5, on top of those given
+	// on the command line.
+	UserProperties map[string]string `yaml:"userProperties"`
+}
+
+// LoadBrokersConfig reads a YAML list of broker configurations, brokers without namespaces manage homething/.
+func LoadBrokersConfig(path string) ([]BrokerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]BrokerConfig, 0)
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for idx := range configs {
+		if len(configs[idx].Namespaces) == 0 {
+			configs[idx].Namespaces = DefaultConfig().Namespaces
+		}
+	}
+	return configs, nil
+}
+
+// BrokerConnection is a broker to be managed by NewMultiDevices.
+type BrokerConnection struct {
+	Label     string
+	Transport Transport
+	Config    Config
+}
+
+// brokerDevices holds the devices of a broker once connected to it, and the last error connecting to it until then.
+type brokerDevices struct {
+	label      string
+	connection BrokerConnection
+	lock       sync.RWMutex
+	devices    Devices
+	err        error
+}
+
+func (b *brokerDevices) get() (Devices, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.devices, b.err
+}
+
+type multiDevices struct {
+	brokers       []*brokerDevices
+	metadata      MetadataStore
+	retryInterval time.Duration
+	lock          sync.Mutex
+	updateClients []UpdateNotificationClient
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewMultiDevices manages the devices of several brokers as one. A broker which can't be connected to is reported
+// by GetBrokers rather than failing, so that the others can still be used, and connected to again in the
+// background until it succeeds.
+func NewMultiDevices(connections []BrokerConnection, metadata MetadataStore) (Devices, error) {
+	return newMultiDevices(connections, metadata, brokerRetryInterval)
+}
+
+func newMultiDevices(connections []BrokerConnection, metadata MetadataStore, retryInterval time.Duration) (Devices, error) {
+	if len(connections) == 0 {
+		return nil, fmt.Errorf("%w: no brokers configured", InvalidBrokerError)
+	}
+	labels := map[string]bool{}
+	for _, connection := range connections {
+		if connection.Label == "" || strings.ContainsAny(connection.Label, ":/") {
+			return nil, fmt.Errorf("%w: invalid label %q", InvalidBrokerError, connection.Label)
+		}
+		if labels[connection.Label] {
+			return nil, fmt.Errorf("%w: %q configured more than once", InvalidBrokerError, connection.Label)
+		}
+		labels[connection.Label] = true
+	}
+	multi := &multiDevices{metadata: metadata, retryInterval: retryInterval, closed: make(chan struct{})}
+	for _, connection := range connections {
+		broker := &brokerDevices{label: connection.Label, connection: connection}
+		multi.brokers = append(multi.brokers, broker)
+		if err := multi.connect(broker); err != nil {
+			log.Printf("%s: failed to connect to broker: %s\n", connection.Label, err)
+			go multi.retry(broker)
+		}
+	}
+	return multi, nil
+}
+
+func (m *multiDevices) connect(broker *brokerDevices) error {
+	prefix := broker.label + ":"
+	config := broker.connection.Config
+	config.Broker = broker.label
+	devices, err := NewDevices(broker.connection.Transport, &prefixedMetadataStore{store: m.metadata, prefix: prefix}, config)
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if err != nil {
+		broker.err = err
+		return err
+	}
+	// Close doesn't see devices connected once it has started.
+	select {
+	case <-m.closed:
+		devices.Close()
+		return nil
+	default:
+	}
+	broker.devices, broker.err = devices, nil
+	devices.RegisterUpdateNotificationClient(&brokerUpdateClient{multi: m, broker: broker})
+	return nil
+}
+
+// retry connects to a broker which couldn't be reached, until it succeeds or Close is called.
+func (m *multiDevices) retry(broker *brokerDevices) {
+	interval := m.retryInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-m.closed:
+			return
+		}
+		if err := m.connect(broker); err != nil {
+			interval = min(interval*2, maxBrokerRetryInterval)
+			log.Printf("%s: failed to connect to broker, retrying in %s: %s\n", broker.label, interval, err)
+			continue
+		}
+		log.Printf("%s: connected to broker\n", broker.label)
+		// The devices' first messages arrived before the events were forwarded.
+		if devices, _ := broker.get(); devices != nil {
+			client := &brokerUpdateClient{multi: m, broker: broker}
+			for _, info := range devices.GetDevices() {
+				client.DeviceUpdated(DeviceUpdateEvent{Id: info.Id, Type: InfoUpdateMessage, Data: info})
+			}
+		}
+		return
+	}
+}
+
+// resolve returns the broker the device is connected to, the broker's devices and the device's id on that broker.
+func (m *multiDevices) resolve(deviceId string) (*brokerDevices, Devices, string, error) {
+	label, brokerDeviceId, found := strings.Cut(deviceId, ":")
+	if found {
+		for _, broker := range m.brokers {
+			if broker.label == label {
+				devices, _ := broker.get()
+				if devices == nil {
+					return nil, nil, "", fmt.Errorf("%w: %s", BrokerUnavailableError, label)
+				}
+				return broker, devices, brokerDeviceId, nil
+			}
+		}
+	}
+	return nil, nil, "", fmt.Errorf("%w: %s", DeviceNotFoundError, deviceId)
+}
+
+// lookup is resolve for the getters, which return nil for unknown devices.
+func (m *multiDevices) lookup(deviceId string) (Devices, string) {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return nil, ""
+	}
+	return devices, brokerDeviceId
+}
+
+func (b *brokerDevices) qualify(info DeviceInfo) DeviceInfo {
+	info.Id = b.label + ":" + info.Id
+	info.Broker = b.label
+	return info
+}
+
+func (m *multiDevices) GetDevices() []DeviceInfo {
+	deviceArray := make([]DeviceInfo, 0)
+	for _, broker := range m.brokers {
+		devices, _ := broker.get()
+		if devices == nil {
+			continue
+		}
+		for _, info := range devices.GetDevices() {
+			deviceArray = append(deviceArray, broker.qualify(info))
+		}
+	}
+	return deviceArray
+}
+
+func (m *multiDevices) RemoveDevice(deviceId string) error {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return err
+	}
+	return devices.RemoveDevice(brokerDeviceId)
+}
+
+func (m *multiDevices) GetDeviceInfo(deviceId string) *DeviceInfo {
+	broker, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return nil
+	}
+	if info := devices.GetDeviceInfo(brokerDeviceId); info != nil {
+		qualified := broker.qualify(*info)
+		return &qualified
+	}
+	return nil
+}
+
+func (m *multiDevices) GetDeviceMetadata(deviceId string) *DeviceMetadata {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceMetadata(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) SetDeviceMetadata(deviceId string, metadata DeviceMetadata) error {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return err
+	}
+	return devices.SetDeviceMetadata(brokerDeviceId, metadata)
+}
+
+func (m *multiDevices) GetDeviceDiag(deviceId string) *DeviceDiag {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceDiag(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) GetDeviceStatus(deviceId string) *string {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceStatus(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) GetDeviceProfile(deviceId string) *string {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceProfile(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) SetDeviceProfile(deviceId string, profile string) (string, error) {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return "", err
+	}
+	return devices.SetDeviceProfile(brokerDeviceId, profile)
+}
+
+func (m *multiDevices) GetDeviceTopics(deviceId string) *TopicsInfo {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceTopics(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) GetDeviceTopicValues(deviceId string) *TopicsValues {
+	if devices, brokerDeviceId := m.lookup(deviceId); devices != nil {
+		return devices.GetDeviceTopicValues(brokerDeviceId)
+	}
+	return nil
+}
+
+func (m *multiDevices) SetDeviceTopicValue(deviceId string, topic string, value string) error {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return err
+	}
+	return devices.SetDeviceTopicValue(brokerDeviceId, topic, value)
+}
+
+func (m *multiDevices) RebootDevice(deviceId string) (string, error) {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return "", err
+	}
+	return devices.RebootDevice(brokerDeviceId)
+}
+
+func (m *multiDevices) UpdateDevice(deviceId string, version string) (string, error) {
+	_, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return "", err
+	}
+	return devices.UpdateDevice(brokerDeviceId, version)
+}
+
+func (m *multiDevices) GetDeviceCommands(deviceId string) []Command {
+	broker, devices, brokerDeviceId, err := m.resolve(deviceId)
+	if err != nil {
+		return []Command{}
+	}
+	commands := devices.GetDeviceCommands(brokerDeviceId)
+	for idx := range commands {
+		commands[idx].DeviceId = broker.label + ":" + commands[idx].DeviceId
+	}
+	return commands
+}
+
+func (m *multiDevices) GetBrokers() []BrokerStatus {
+	statuses := make([]BrokerStatus, 0, len(m.brokers))
+	for _, broker := range m.brokers {
+		status := BrokerStatus{Label: broker.label}
+		if devices, err := broker.get(); devices == nil {
+			status.Error = err.Error()
+		} else {
+			for _, brokerStatus := range devices.GetBrokers() {
+				status.Connected = brokerStatus.Connected
+				status.Devices += brokerStatus.Devices
+				status.Offline += brokerStatus.Offline
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (m *multiDevices) Close() {
+	m.closeOnce.Do(func() { close(m.closed) })
+	for _, broker := range m.brokers {
+		if devices, _ := broker.get(); devices != nil {
+			devices.Close()
+		}
+	}
+}
+
+func (m *multiDevices) RegisterUpdateNotificationClient(client UpdateNotificationClient) {
+	m.lock.Lock()
+	m.updateClients = append(m.updateClients, client)
+	m.lock.Unlock()
+}
+
+func (m *multiDevices) UnregisterUpdateNotificationClient(client UpdateNotificationClient) {
+	m.lock.Lock()
+	for idx, value := range m.updateClients {
+		if value == client {
+			m.updateClients[idx] = m.updateClients[len(m.updateClients)-1]
+			m.updateClients = m.updateClients[:len(m.updateClients)-1]
+		}
+	}
+	m.lock.Unlock()
+}
+
+// brokerUpdateClient forwards the events of one broker's devices with the device ids qualified by the broker label.
+type brokerUpdateClient struct {
+	multi  *multiDevices
+	broker *brokerDevices
+}
+
+func (c *brokerUpdateClient) DeviceUpdated(event DeviceUpdateEvent) {
+	event.Id = c.broker.label + ":" + event.Id
+	switch data := event.Data.(type) {
+	case DeviceInfo:
+		event.Data = c.broker.qualify(data)
+	case Command:
+		data.DeviceId = event.Id
+		event.Data = data
+	}
+	c.multi.lock.Lock()
+	clients := slices.Clone(c.multi.updateClients)
+	c.multi.lock.Unlock()
+	for _, client := range clients {
+		client.DeviceUpdated(event)
+	}
+}
+
+// prefixedMetadataStore keeps the metadata of each broker's devices under their qualified ids.
+type prefixedMetadataStore struct {
+	store  MetadataStore
+	prefix string
+}
+
+func (s *prefixedMetadataStore) GetMetadata(deviceId string) *DeviceMetadata {
+	return s.store.GetMetadata(s.prefix + deviceId)
+}
+
+func (s *prefixedMetadataStore) SetMetadata(deviceId string, metadata DeviceMetadata) error {
+	return s.store.SetMetadata(s.prefix+deviceId, metadata)
+}
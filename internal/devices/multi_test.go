@@ -0,0 +1,248 @@
+package devices
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type unreachableTransport struct {
+	*MemoryTransport
+}
+
+func (t unreachableTransport) Connect(onConnect func()) error {
+	return BrokerTimeoutError
+}
+
+// flakyTransport fails to connect the first failures times.
+type flakyTransport struct {
+	*MemoryTransport
+	failures atomic.Int32
+}
+
+func (t *flakyTransport) Connect(onConnect func()) error {
+	if t.failures.Add(-1) >= 0 {
+		return BrokerTimeoutError
+	}
+	return t.MemoryTransport.Connect(onConnect)
+}
+
+func TestMultiDevices(t *testing.T) {
+	house := NewMemoryBroker()
+	workshop := NewMemoryBroker()
+	publishDeviceInfo(t, house, "homething", testDeviceId, "Hall")
+	publishDeviceInfo(t, workshop, "homething", testDeviceId, "Bench")
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewMultiDevices([]BrokerConnection{
+		{Label: "house", Transport: house.NewTransport(), Config: DefaultConfig()},
+		{Label: "workshop", Transport: workshop.NewTransport(), Config: DefaultConfig()},
+		{Label: "garage", Transport: unreachableTransport{NewMemoryBroker().NewTransport()}, Config: DefaultConfig()},
+	}, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &recordingClient{}
+	d.RegisterUpdateNotificationClient(client)
+
+	query := DeviceQuery{}
+	deviceList, _, _ := query.Apply(d.GetDevices())
+	if got, want := deviceIds(deviceList), []string{"house:" + testDeviceId, "workshop:" + testDeviceId}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetDevices() = %v, want %v", got, want)
+	}
+	info := d.GetDeviceInfo("workshop:" + testDeviceId)
+	if info == nil || info.Description != "Bench" || info.Broker != "workshop" {
+		t.Errorf("GetDeviceInfo() = %+v, want workshop device", info)
+	}
+
+	// Commands are sent to the broker the device is connected to.
+	if _, err := d.RebootDevice("workshop:" + testDeviceId); err != nil {
+		t.Fatalf("RebootDevice() error = %v", err)
+	}
+	if got := len(workshop.Messages("homething/+/device/ctrl")); got != 1 {
+		t.Errorf("workshop ctrl messages = %d, want 1", got)
+	}
+	if got := len(house.Messages("homething/+/device/ctrl")); got != 0 {
+		t.Errorf("house ctrl messages = %d, want 0", got)
+	}
+
+	tests := []struct {
+		name     string
+		deviceId string
+		wantErr  error
+	}{
+		{name: "Unqualified id", deviceId: testDeviceId, wantErr: DeviceNotFoundError},
+		{name: "Unknown broker", deviceId: "shed:" + testDeviceId, wantErr: DeviceNotFoundError},
+		{name: "Unavailable broker", deviceId: "garage:" + testDeviceId, wantErr: BrokerUnavailableError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := d.RebootDevice(tt.deviceId); !errors.Is(err, tt.wantErr) {
+				t.Errorf("RebootDevice() error = %v, want %v", err, tt.wantErr)
+			}
+			if d.GetDeviceInfo(tt.deviceId) != nil {
+				t.Errorf("GetDeviceInfo() != nil")
+			}
+		})
+	}
+
+	// Metadata and events use the qualified id.
+	if err := d.SetDeviceMetadata("house:"+testDeviceId, DeviceMetadata{Group: "ground"}); err != nil {
+		t.Fatalf("SetDeviceMetadata() error = %v", err)
+	}
+	if got := metadata.GetMetadata("house:" + testDeviceId); got == nil || got.Group != "ground" {
+		t.Errorf("stored metadata = %+v, want group ground", got)
+	}
+	client.lock.Lock()
+	events := client.events
+	client.lock.Unlock()
+	if len(events) != 2 || events[0].Id != "workshop:"+testDeviceId || events[1].Id != "house:"+testDeviceId {
+		t.Fatalf("events = %+v, want workshop command and house info", events)
+	}
+	if command, ok := events[0].Data.(Command); !ok || command.DeviceId != "workshop:"+testDeviceId {
+		t.Errorf("event data = %+v, want qualified command", events[0].Data)
+	}
+	if eventInfo, ok := events[1].Data.(DeviceInfo); !ok || eventInfo.Id != "house:"+testDeviceId || eventInfo.Broker != "house" {
+		t.Errorf("event data = %+v, want qualified device info", events[1].Data)
+	}
+	if commands := d.GetDeviceCommands("workshop:" + testDeviceId); len(commands) != 1 || commands[0].DeviceId != "workshop:"+testDeviceId {
+		t.Errorf("GetDeviceCommands() = %+v, want qualified reboot", commands)
+	}
+
+	wantBrokers := []BrokerStatus{
+		{Label: "house", Connected: true, Devices: 1, Offline: 1},
+		{Label: "workshop", Connected: true, Devices: 1, Offline: 1},
+		{Label: "garage", Error: BrokerTimeoutError.Error()},
+	}
+	if got := d.GetBrokers(); !reflect.DeepEqual(got, wantBrokers) {
+		t.Errorf("GetBrokers() = %+v, want %+v", got, wantBrokers)
+	}
+}
+
+func TestMultiDevices_Metrics(t *testing.T) {
+	house := NewMemoryBroker()
+	workshop := NewMemoryBroker()
+	publishDeviceInfo(t, house, "homething", testDeviceId, "Sensor")
+	publishDeviceInfo(t, workshop, "homething", testDeviceId, "Sensor")
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewMultiDevices([]BrokerConnection{
+		{Label: "house", Transport: house.NewTransport(), Config: DefaultConfig()},
+		{Label: "workshop", Transport: workshop.NewTransport(), Config: DefaultConfig()},
+	}, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Devices with the same id on different brokers have their own series.
+	for broker, uptime := range map[*MemoryBroker]string{house: "100", workshop: "200"} {
+		device := broker.NewTransport()
+		device.Connect(nil)
+		device.Publish("homething/"+testDeviceId+"/device/diag", 0, true, []byte(`{"uptime":`+uptime+`,"mem":{"free":2048,"low":1024}}`))
+	}
+	for label, want := range map[string]float64{"house": 100, "workshop": 200} {
+		if got := testutil.ToFloat64(uptimeGaugeVec.WithLabelValues(label, testDeviceId, "Sensor", "v1.0.0")); got != want {
+			t.Errorf("%s uptime gauge = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestMultiDevices_Retry(t *testing.T) {
+	garage := NewMemoryBroker()
+	publishDeviceInfo(t, garage, "homething", testDeviceId, "Door")
+	metadata, err := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &flakyTransport{MemoryTransport: garage.NewTransport()}
+	transport.failures.Store(2)
+	d, err := newMultiDevices([]BrokerConnection{{Label: "garage", Transport: transport, Config: DefaultConfig()}}, metadata,
+		10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	client := &recordingClient{}
+	d.RegisterUpdateNotificationClient(client)
+	if got := d.GetBrokers(); got[0].Connected || got[0].Error != BrokerTimeoutError.Error() {
+		t.Errorf("GetBrokers() before connecting = %+v, want the connection error", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.GetDeviceInfo("garage:"+testDeviceId) == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := d.GetBrokers(); !got[0].Connected || got[0].Error != "" || got[0].Devices != 1 {
+		t.Errorf("GetBrokers() after retrying = %+v, want connected", got)
+	}
+	// Clients learn about the devices found on connecting.
+	client.lock.Lock()
+	events := client.events
+	client.lock.Unlock()
+	if len(events) == 0 || events[0].Id != "garage:"+testDeviceId || events[0].Type != InfoUpdateMessage {
+		t.Errorf("events = %+v, want info for the garage device", events)
+	}
+}
+
+func TestNewMultiDevices_InvalidLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+	}{
+		{name: "No brokers", labels: []string{}},
+		{name: "Empty label", labels: []string{""}},
+		{name: "Label with separator", labels: []string{"house:1"}},
+		{name: "Duplicate label", labels: []string{"house", "house"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connections := make([]BrokerConnection, 0)
+			for _, label := range tt.labels {
+				connections = append(connections, BrokerConnection{Label: label, Transport: NewMemoryBroker().NewTransport(), Config: DefaultConfig()})
+			}
+			if _, err := NewMultiDevices(connections, nil); !errors.Is(err, InvalidBrokerError) {
+				t.Errorf("NewMultiDevices() error = %v, want %v", err, InvalidBrokerError)
+			}
+		})
+	}
+}
+
+func TestLoadBrokersConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brokers.yaml")
+	data := `
+- label: house
+  url: tcp://house.local:1883
+- label: workshop
+  url: tcp://workshop.local:1883
+  protocolVersion: 5
+  namespaces:
+    - prefix: lab/homething
+  userProperties:
+    site: workshop
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configs, err := LoadBrokersConfig(path)
+	if err != nil {
+		t.Fatalf("LoadBrokersConfig() error = %v", err)
+	}
+	want := []BrokerConfig{
+		{Label: "house", MQTTConfig: MQTTConfig{URL: "tcp://house.local:1883"}, Namespaces: DefaultConfig().Namespaces},
+		{Label: "workshop", MQTTConfig: MQTTConfig{URL: "tcp://workshop.local:1883", ProtocolVersion: 5},
+			Namespaces: []Namespace{{Prefix: "lab/homething"}}, UserProperties: map[string]string{"site": "workshop"}},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("LoadBrokersConfig() = %+v, want %+v", configs, want)
+	}
+}
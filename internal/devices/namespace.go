@@ -0,0 +1,94 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const DefaultTopicPrefix = "homething"
+
+var InvalidNamespaceError = errors.New("invalid namespace")
+
+// Namespace is a topic prefix under which homething devices publish. Devices in a namespace with a name have
+// ids of the form <name>:<device id>, devices in the unnamed namespace keep their plain device id.
+type Namespace struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+}
+
+type namespace struct {
+	Namespace
+	deviceTopicRegExp *regexp.Regexp
+	topicsRegExp      *regexp.Regexp
+}
+
+func newNamespaces(configs []Namespace) ([]*namespace, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%w: no namespaces configured", InvalidNamespaceError)
+	}
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	namespaces := make([]*namespace, 0, len(configs))
+	for _, config := range configs {
+		config.Prefix = strings.Trim(config.Prefix, "/")
+		if config.Prefix == "" || strings.ContainsAny(config.Prefix, "+#") {
+			return nil, fmt.Errorf("%w: invalid prefix %q", InvalidNamespaceError, config.Prefix)
+		}
+		if strings.ContainsAny(config.Name, ":/") {
+			return nil, fmt.Errorf("%w: invalid name %q", InvalidNamespaceError, config.Name)
+		}
+		if names[config.Name] || prefixes[config.Prefix] {
+			return nil, fmt.Errorf("%w: %q/%q configured more than once", InvalidNamespaceError, config.Name, config.Prefix)
+		}
+		names[config.Name] = true
+		prefixes[config.Prefix] = true
+		prefix := regexp.QuoteMeta(config.Prefix)
+		namespaces = append(namespaces, &namespace{
+			Namespace:         config,
+			deviceTopicRegExp: regexp.MustCompile("^" + prefix + "/([0-9a-f]+)/device/(.*)$"),
+			topicsRegExp:      regexp.MustCompile("^" + prefix + "/([0-9a-f]+)/(.*)$"),
+		})
+	}
+	return namespaces, nil
+}
+
+func (n *namespace) deviceId(hardwareId string) string {
+	if n.Name == "" {
+		return hardwareId
+	}
+	return n.Name + ":" + hardwareId
+}
+
+func (n *namespace) topic(hardwareId string, subtopic string) string {
+	return fmt.Sprintf("%s/%s/%s", n.Prefix, hardwareId, subtopic)
+}
+
+// splitDeviceId returns the namespace name and the id the device publishes with.
+func splitDeviceId(deviceId string) (string, string) {
+	if name, hardwareId, found := strings.Cut(deviceId, ":"); found {
+		return name, hardwareId
+	}
+	return "", deviceId
+}
+
+// resolve returns the namespace of the device and its id within that namespace.
+func (d *devices) resolve(deviceId string) (*namespace, string, error) {
+	name, hardwareId := splitDeviceId(deviceId)
+	for _, ns := range d.namespaces {
+		if ns.Name == name {
+			return ns, hardwareId, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", DeviceNotFoundError, deviceId)
+}
+
+// deviceTopic returns the full topic of one of the device's subtopics.
+func (d *devices) deviceTopic(deviceId string, subtopic string) (string, error) {
+	ns, hardwareId, err := d.resolve(deviceId)
+	if err != nil {
+		return "", err
+	}
+	return ns.topic(hardwareId, subtopic), nil
+}
@@ -0,0 +1,98 @@
+package devices
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OfflineTimeout is how long since a device last sent its diag before it is considered offline.
+const OfflineTimeout = 45 * time.Second
+
+var InvalidSortFieldError = errors.New("invalid sort field")
+
+// DeviceQuery selects, sorts and pages the device list.
+type DeviceQuery struct {
+	Selector   DeviceSelector
+	Sort       string
+	Descending bool
+	Offset     int
+	// Limit is the maximum number of devices returned, 0 means no limit.
+	Limit int
+}
+
+// deviceSortFields maps the json field names of DeviceInfo to a comparison function.
+var deviceSortFields = map[string]func(a, b *DeviceInfo) int{
+	"id": func(a, b *DeviceInfo) int { return cmp.Compare(a.Id, b.Id) },
+	"description": func(a, b *DeviceInfo) int {
+		return cmp.Compare(strings.ToLower(a.Description), strings.ToLower(b.Description))
+	},
+	"namespace":  func(a, b *DeviceInfo) int { return cmp.Compare(a.Namespace, b.Namespace) },
+	"broker":     func(a, b *DeviceInfo) int { return cmp.Compare(a.Broker, b.Broker) },
+	"ip_addr":    func(a, b *DeviceInfo) int { return cmp.Compare(a.IPAddr, b.IPAddr) },
+	"version":    func(a, b *DeviceInfo) int { return cmp.Compare(a.Version, b.Version) },
+	"deviceType": func(a, b *DeviceInfo) int { return cmp.Compare(a.DeviceType, b.DeviceType) },
+	"memory":     func(a, b *DeviceInfo) int { return cmp.Compare(a.Memory, b.Memory) },
+	"lastSeen": func(a, b *DeviceInfo) int {
+		return cmp.Compare(lastSeenUnixNano(a), lastSeenUnixNano(b))
+	},
+	"group":    func(a, b *DeviceInfo) int { return cmp.Compare(a.metadata().Group, b.metadata().Group) },
+	"location": func(a, b *DeviceInfo) int { return cmp.Compare(a.metadata().Location, b.metadata().Location) },
+	"owner":    func(a, b *DeviceInfo) int { return cmp.Compare(a.metadata().Owner, b.metadata().Owner) },
+}
+
+func IsValidSortField(field string) bool {
+	_, ok := deviceSortFields[field]
+	return ok
+}
+
+// Apply returns the page of matching devices and the total number of devices that matched.
+// Devices are sorted by id unless another sort field is given, ties are broken by id.
+func (q *DeviceQuery) Apply(deviceList []DeviceInfo) ([]DeviceInfo, int, error) {
+	sortField := q.Sort
+	if sortField == "" {
+		sortField = "id"
+	}
+	compare, ok := deviceSortFields[sortField]
+	if !ok {
+		return nil, 0, InvalidSortFieldError
+	}
+	selected := q.Selector.Select(deviceList)
+	slices.SortStableFunc(selected, func(a, b DeviceInfo) int {
+		result := compare(&a, &b)
+		if result == 0 {
+			result = cmp.Compare(a.Id, b.Id)
+		}
+		if q.Descending {
+			result = -result
+		}
+		return result
+	})
+	total := len(selected)
+	start := min(max(q.Offset, 0), total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+	return selected[start:end], total, nil
+}
+
+func (i *DeviceInfo) IsOnline(now time.Time) bool {
+	return i.LastSeen != nil && now.Sub(*i.LastSeen) <= OfflineTimeout
+}
+
+func (i *DeviceInfo) metadata() *DeviceMetadata {
+	if i.Metadata == nil {
+		return &DeviceMetadata{}
+	}
+	return i.Metadata
+}
+
+func lastSeenUnixNano(i *DeviceInfo) int64 {
+	if i.LastSeen == nil {
+		return 0
+	}
+	return i.LastSeen.UnixNano()
+}
@@ -0,0 +1,70 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func deviceIds(deviceList []DeviceInfo) []string {
+	ids := make([]string, 0, len(deviceList))
+	for _, info := range deviceList {
+		ids = append(ids, info.Id)
+	}
+	return ids
+}
+
+func TestDeviceQuery_Apply(t *testing.T) {
+	now := time.Now()
+	stale := now.Add(-2 * OfflineTimeout)
+	deviceList := []DeviceInfo{
+		{Id: "03", Description: "Kitchen light", DeviceType: "esp8266", Version: "v1.1.0", LastSeen: &now,
+			Metadata: &DeviceMetadata{Tags: []string{"light"}, Group: "ground"}},
+		{Id: "01", Description: "Hall sensor", IPAddr: "192.168.1.20", DeviceType: "esp32", Version: "v1.0.0", LastSeen: &stale,
+			Capabilities: []string{"flash4MB"}},
+		{Id: "02", Description: "bedroom light", DeviceType: "esp8266", Version: "v1.0.0",
+			Metadata: &DeviceMetadata{Tags: []string{"light", "upstairs"}}},
+	}
+	online := true
+	offline := false
+
+	tests := []struct {
+		name      string
+		query     DeviceQuery
+		want      []string
+		wantTotal int
+		wantErr   error
+	}{
+		{name: "Default sort", query: DeviceQuery{}, want: []string{"01", "02", "03"}, wantTotal: 3},
+		{name: "Sort description", query: DeviceQuery{Sort: "description"}, want: []string{"02", "01", "03"}, wantTotal: 3},
+		{name: "Sort descending", query: DeviceQuery{Sort: "version", Descending: true}, want: []string{"03", "02", "01"}, wantTotal: 3},
+		{name: "Device type", query: DeviceQuery{Selector: DeviceSelector{DeviceType: "esp8266"}}, want: []string{"02", "03"}, wantTotal: 2},
+		{name: "Capability", query: DeviceQuery{Selector: DeviceSelector{Capability: "flash4MB"}}, want: []string{"01"}, wantTotal: 1},
+		{name: "Online", query: DeviceQuery{Selector: DeviceSelector{Online: &online}}, want: []string{"03"}, wantTotal: 1},
+		{name: "Offline", query: DeviceQuery{Selector: DeviceSelector{Online: &offline}}, want: []string{"01", "02"}, wantTotal: 2},
+		{name: "Tags", query: DeviceQuery{Selector: DeviceSelector{Tags: []string{"light", "upstairs"}}}, want: []string{"02"}, wantTotal: 1},
+		{name: "Group", query: DeviceQuery{Selector: DeviceSelector{Group: "ground"}}, want: []string{"03"}, wantTotal: 1},
+		{name: "Search description", query: DeviceQuery{Selector: DeviceSelector{Search: "LIGHT"}}, want: []string{"02", "03"}, wantTotal: 2},
+		{name: "Search IP", query: DeviceQuery{Selector: DeviceSelector{Search: "1.20"}}, want: []string{"01"}, wantTotal: 1},
+		{name: "Page", query: DeviceQuery{Offset: 1, Limit: 1}, want: []string{"02"}, wantTotal: 3},
+		{name: "Offset past end", query: DeviceQuery{Offset: 5}, want: []string{}, wantTotal: 3},
+		{name: "Invalid sort", query: DeviceQuery{Sort: "bogus"}, wantErr: InvalidSortFieldError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total, err := tt.query.Apply(deviceList)
+			if err != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ids := deviceIds(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Apply() = %v, want %v", ids, tt.want)
+			}
+			if total != tt.wantTotal {
+				t.Errorf("Apply() total = %v, want %v", total, tt.wantTotal)
+			}
+		})
+	}
+}
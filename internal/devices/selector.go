@@ -0,0 +1,102 @@
+package devices
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// DeviceSelector picks a set of devices, fields left empty match every device.
+type DeviceSelector struct {
+	Ids        []string `json:"ids,omitempty" yaml:"ids,omitempty"`
+	Namespace  *string  `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Broker     string   `json:"broker,omitempty" yaml:"broker,omitempty"`
+	DeviceType string   `json:"deviceType,omitempty" yaml:"deviceType,omitempty"`
+	Version    string   `json:"version,omitempty" yaml:"version,omitempty"`
+	Capability string   `json:"capability,omitempty" yaml:"capability,omitempty"`
+	Online     *bool    `json:"online,omitempty" yaml:"online,omitempty"`
+	Tags       []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Group      string   `json:"group,omitempty" yaml:"group,omitempty"`
+	Location   string   `json:"location,omitempty" yaml:"location,omitempty"`
+	Owner      string   `json:"owner,omitempty" yaml:"owner,omitempty"`
+	// Search is matched case-insensitively against the id, description and IP address.
+	Search string `json:"search,omitempty" yaml:"search,omitempty"`
+}
+
+func (s *DeviceSelector) IsEmpty() bool {
+	return len(s.Ids) == 0 && s.Namespace == nil && s.Broker == "" && s.DeviceType == "" && s.Version == "" && s.Capability == "" && s.Online == nil &&
+		!s.hasMetadataFilter() && s.Search == ""
+}
+
+func (s *DeviceSelector) hasMetadataFilter() bool {
+	return len(s.Tags) > 0 || s.Group != "" || s.Location != "" || s.Owner != ""
+}
+
+func (s *DeviceSelector) Matches(info *DeviceInfo) bool {
+	if len(s.Ids) > 0 && !slices.Contains(s.Ids, info.Id) {
+		return false
+	}
+	if s.Namespace != nil && *s.Namespace != info.Namespace {
+		return false
+	}
+	if s.Broker != "" && s.Broker != info.Broker {
+		return false
+	}
+	if s.DeviceType != "" && s.DeviceType != info.DeviceType {
+		return false
+	}
+	if s.Version != "" && s.Version != info.Version {
+		return false
+	}
+	if s.Capability != "" && !info.HasCapability(s.Capability) {
+		return false
+	}
+	if s.Online != nil && *s.Online != info.IsOnline(time.Now()) {
+		return false
+	}
+	if s.Search != "" && !info.matchesSearch(s.Search) {
+		return false
+	}
+	if s.hasMetadataFilter() {
+		metadata := info.Metadata
+		if metadata == nil {
+			return false
+		}
+		for _, tag := range s.Tags {
+			if !metadata.HasTag(tag) {
+				return false
+			}
+		}
+		if s.Group != "" && s.Group != metadata.Group {
+			return false
+		}
+		if s.Location != "" && s.Location != metadata.Location {
+			return false
+		}
+		if s.Owner != "" && s.Owner != metadata.Owner {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the devices in the list that match the selector.
+func (s *DeviceSelector) Select(deviceList []DeviceInfo) []DeviceInfo {
+	selected := make([]DeviceInfo, 0, len(deviceList))
+	for idx := range deviceList {
+		if s.Matches(&deviceList[idx]) {
+			selected = append(selected, deviceList[idx])
+		}
+	}
+	return selected
+}
+
+func (i *DeviceInfo) matchesSearch(search string) bool {
+	search = strings.ToLower(search)
+	for _, value := range []string{i.Id, i.Description, i.IPAddr} {
+		if strings.Contains(strings.ToLower(value), search) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package devices
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceSelector_Matches(t *testing.T) {
+	now := time.Now()
+	lab := "lab"
+	empty := ""
+	online := true
+	offline := false
+	info := DeviceInfo{Id: "lab:a1b2", Namespace: "lab", Broker: "house", Description: "Hall sensor", IPAddr: "10.0.0.7",
+		DeviceType: "esp32", Version: "v1.2.0", Capabilities: []string{"ota"}, LastSeen: &now,
+		Metadata: &DeviceMetadata{Tags: []string{"sensor", "hall"}, Group: "ground", Location: "hall", Owner: "sam"}}
+	withoutMetadata := info
+	withoutMetadata.Metadata = nil
+
+	tests := []struct {
+		name     string
+		selector DeviceSelector
+		info     *DeviceInfo
+		want     bool
+	}{
+		{name: "Empty", selector: DeviceSelector{}, info: &info, want: true},
+		{name: "Ids", selector: DeviceSelector{Ids: []string{"01", "lab:a1b2"}}, info: &info, want: true},
+		{name: "Other ids", selector: DeviceSelector{Ids: []string{"01"}}, info: &info, want: false},
+		{name: "Namespace", selector: DeviceSelector{Namespace: &lab}, info: &info, want: true},
+		{name: "Unnamed namespace", selector: DeviceSelector{Namespace: &empty}, info: &info, want: false},
+		{name: "Broker", selector: DeviceSelector{Broker: "workshop"}, info: &info, want: false},
+		{name: "Device type and version", selector: DeviceSelector{DeviceType: "esp32", Version: "v1.2.0"}, info: &info, want: true},
+		{name: "Other version", selector: DeviceSelector{Version: "v1.1.0"}, info: &info, want: false},
+		{name: "Capability", selector: DeviceSelector{Capability: "ota"}, info: &info, want: true},
+		{name: "Missing capability", selector: DeviceSelector{Capability: "flash4MB"}, info: &info, want: false},
+		{name: "Online", selector: DeviceSelector{Online: &online}, info: &info, want: true},
+		{name: "Offline", selector: DeviceSelector{Online: &offline}, info: &info, want: false},
+		{name: "Search", selector: DeviceSelector{Search: "HALL"}, info: &info, want: true},
+		{name: "Search miss", selector: DeviceSelector{Search: "kitchen"}, info: &info, want: false},
+		{name: "All tags", selector: DeviceSelector{Tags: []string{"hall", "sensor"}}, info: &info, want: true},
+		{name: "Missing tag", selector: DeviceSelector{Tags: []string{"hall", "light"}}, info: &info, want: false},
+		{name: "Group, location and owner", selector: DeviceSelector{Group: "ground", Location: "hall", Owner: "sam"}, info: &info, want: true},
+		{name: "Other owner", selector: DeviceSelector{Owner: "alex"}, info: &info, want: false},
+		{name: "Metadata filter without metadata", selector: DeviceSelector{Group: "ground"}, info: &withoutMetadata, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.selector.Matches(tt.info); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package devices
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	DefaultStatusTopic     = "htmanager/status"
+	DefaultSummaryTopic    = "htmanager/summary"
+	DefaultSummaryInterval = time.Minute
+
+	managerOnline  = "online"
+	managerOffline = "offline"
+)
+
+// Summary is published periodically so that other MQTT clients can monitor htManager and its devices.
+type Summary struct {
+	Version string    `json:"version"`
+	Devices int       `json:"devices"`
+	Online  int       `json:"online"`
+	Offline int       `json:"offline"`
+	Time    time.Time `json:"time"`
+}
+
+// publishStatus marks htManager as online, the broker publishes the will set in NewDevices when the connection is lost.
+func (d *devices) publishStatus() {
+	if d.config.StatusTopic == "" {
+		return
+	}
+	if err := d.publish(d.config.StatusTopic, d.config.QoS.Retained, true, []byte(managerOnline)); err != nil {
+		log.Printf("Failed to publish status: %s\n", err)
+	}
+}
+
+func (d *devices) publishSummaries() {
+	ticker := time.NewTicker(d.config.SummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.publishSummary()
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// Close publishes the offline status itself, the broker doesn't publish the will when htManager disconnects cleanly.
+func (d *devices) Close() {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		if d.config.StatusTopic != "" {
+			if err := d.publish(d.config.StatusTopic, d.config.QoS.Retained, true, []byte(managerOffline)); err != nil {
+				log.Printf("Failed to publish status: %s\n", err)
+			}
+		}
+		d.transport.Disconnect()
+	})
+}
+
+func (d *devices) publishSummary() {
+	total, offline := d.countDevices()
+	summary := Summary{
+		Version: d.config.Version,
+		Devices: total,
+		Online:  total - offline,
+		Offline: offline,
+		Time:    time.Now().UTC(),
+	}
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Failed to marshal summary: %s\n", err)
+		return
+	}
+	if err := d.publish(d.config.SummaryTopic, d.config.QoS.Retained, true, payload); err != nil {
+		log.Printf("Failed to publish summary: %s\n", err)
+	}
+}
+
+func (d *devices) countDevices() (int, int) {
+	total, offline := 0, 0
+	now := time.Now()
+	for _, info := range d.GetDevices() {
+		total++
+		if !info.IsOnline(now) {
+			offline++
+		}
+	}
+	return total, offline
+}
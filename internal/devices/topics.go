@@ -13,11 +13,10 @@ type ValueUpdateEvent struct {
 }
 
 func (d *devices) handleTopicMessage(deviceId string, topic string, payload []byte) {
+	d.dataLock.Lock()
 	topicsInfo, ok := d.topicInfo[deviceId]
-	if !ok {
-		return
-	}
-	if !topicsInfo.isValidPubTopic(topic) {
+	if !ok || !topicsInfo.isValidPubTopic(topic) {
+		d.dataLock.Unlock()
 		return
 	}
 	topicsValues, ok := d.topicValues[deviceId]
@@ -26,6 +25,7 @@ func (d *devices) handleTopicMessage(deviceId string, topic string, payload []by
 		d.topicValues[deviceId] = topicsValues
 	}
 	entries := topicsValues.setValue(topic, string(payload))
+	d.dataLock.Unlock()
 	if entries != nil {
 		d.sendUpdateMessage(deviceId, ValueUpdateMessage, ValueUpdateEvent{
 			TopicPath: entries,
@@ -54,3 +54,15 @@ func (t *TopicsValues) setValue(topic string, value any) []string {
 	}
 	return entries
 }
+
+func (t TopicsValues) copy() TopicsValues {
+	result := make(TopicsValues, len(t))
+	for primaryTopic, values := range t {
+		valuesCopy := make(TopicValues, len(values))
+		for topic, value := range values {
+			valuesCopy[topic] = value
+		}
+		result[primaryTopic] = valuesCopy
+	}
+	return result
+}
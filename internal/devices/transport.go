@@ -0,0 +1,190 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var BrokerTimeoutError = errors.New("timeout waiting for response from broker")
+
+const brokerTimeout = 10 * time.Second
+
+// Message is an MQTT message received from the broker.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+	QoS      byte
+	// Properties are only received over MQTT v5.
+	Properties *PublishProperties
+}
+
+// PublishProperties are the MQTT v5 properties of a published message.
+type PublishProperties struct {
+	// ResponseTopic and CorrelationData allow the receiver to reply to the message.
+	ResponseTopic   string
+	CorrelationData []byte
+	// MessageExpiry is how long the broker keeps the message for subscribers that are offline, forever if 0.
+	MessageExpiry  time.Duration
+	UserProperties map[string]string
+}
+
+// PropertiesPublisher is implemented by transports able to publish messages with MQTT v5 properties.
+type PropertiesPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload []byte, properties PublishProperties) error
+}
+
+// DefaultHandlerSetter is implemented by transports able to receive messages that no subscription handler matches,
+// such as the messages a broker queued for a persistent session, sent before htManager subscribes again.
+type DefaultHandlerSetter interface {
+	// SetDefaultHandler must be called before Connect.
+	SetDefaultHandler(handler MessageHandler)
+}
+
+// ReasonCodeError is an MQTT v5 reason code returned by the broker for a failed publish or subscription.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("broker returned reason code 0x%02x: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("broker returned reason code 0x%02x", e.Code)
+}
+
+type MessageHandler func(message Message)
+
+// Transport is the connection to the MQTT broker used by the devices manager.
+type Transport interface {
+	// SetWill sets the message published by the broker if the connection is lost, it must be called before Connect.
+	SetWill(topic string, qos byte, retained bool, payload []byte)
+	// Connect connects to the broker, onConnect is called every time the connection is (re-)established.
+	Connect(onConnect func()) error
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Subscribe(topic string, qos byte, handler MessageHandler) error
+	Unsubscribe(topic string) error
+	IsConnected() bool
+	Disconnect()
+}
+
+// MQTTConfig holds the settings used to connect to an MQTT broker.
+type MQTTConfig struct {
+	// URL of the broker, e.g. tcp://localhost:1883.
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// ClientId defaults to htManager-<hostname> for persistent sessions and a random id otherwise.
+	ClientId string `yaml:"clientId"`
+	// PersistentSession turns off clean session, so the broker keeps htManager's subscriptions and queues QoS 1
+	// and 2 messages while it is disconnected.
+	PersistentSession bool `yaml:"persistentSession"`
+	// StoreDir is where in-flight QoS 1 and 2 messages are kept until acknowledged, so they are resent after a
+	// restart. Kept in memory if empty.
+	StoreDir string `yaml:"storeDir"`
+	// ProtocolVersion is the MQTT version used, 3 (the default) or 5.
+	ProtocolVersion int `yaml:"protocolVersion"`
+}
+
+type mqttTransport struct {
+	opts   *mqtt.ClientOptions
+	client mqtt.Client
+}
+
+// NewMQTTTransport creates a transport using the paho MQTT v3 client to connect to the broker.
+func NewMQTTTransport(config MQTTConfig) Transport {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.URL)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetClientID(clientId(config))
+	opts.SetCleanSession(!config.PersistentSession)
+	if config.StoreDir != "" {
+		opts.SetStore(mqtt.NewFileStore(config.StoreDir))
+	}
+	opts.SetAutoReconnect(true)
+	return &mqttTransport{opts: opts}
+}
+
+func (t *mqttTransport) SetWill(topic string, qos byte, retained bool, payload []byte) {
+	t.opts.SetBinaryWill(topic, payload, qos, retained)
+}
+
+func (t *mqttTransport) SetDefaultHandler(handler MessageHandler) {
+	t.opts.SetDefaultPublishHandler(func(client mqtt.Client, message mqtt.Message) {
+		handler(Message{Topic: message.Topic(), Payload: message.Payload(), Retained: message.Retained(), QoS: message.Qos()})
+	})
+}
+
+func (t *mqttTransport) Connect(onConnect func()) error {
+	t.opts.OnConnect = func(client mqtt.Client) {
+		onConnect()
+	}
+	t.client = mqtt.NewClient(t.opts)
+	if err := waitForToken(t.client.Connect()); err != nil {
+		// Stops an attempt which timed out, so that it doesn't connect for a devices manager which has given up.
+		t.client.Disconnect(0)
+		return err
+	}
+	return nil
+}
+
+func (t *mqttTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return waitForToken(t.client.Publish(topic, qos, retained, payload))
+}
+
+func (t *mqttTransport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	return waitForToken(t.client.Subscribe(topic, qos, func(client mqtt.Client, message mqtt.Message) {
+		handler(Message{Topic: message.Topic(), Payload: message.Payload(), Retained: message.Retained(), QoS: message.Qos()})
+	}))
+}
+
+func (t *mqttTransport) Unsubscribe(topic string) error {
+	return waitForToken(t.client.Unsubscribe(topic))
+}
+
+func (t *mqttTransport) IsConnected() bool {
+	return t.client != nil && t.client.IsConnectionOpen()
+}
+
+func (t *mqttTransport) Disconnect() {
+	t.client.Disconnect(250)
+}
+
+// NewTransport creates the paho transport for config.ProtocolVersion.
+func NewTransport(config MQTTConfig) (Transport, error) {
+	switch config.ProtocolVersion {
+	case 0, 3:
+		return NewMQTTTransport(config), nil
+	case 5:
+		return NewMQTTv5Transport(config), nil
+	default:
+		return nil, fmt.Errorf("unsupported MQTT protocol version %d", config.ProtocolVersion)
+	}
+}
+
+func clientId(config MQTTConfig) string {
+	if config.ClientId != "" {
+		return config.ClientId
+	}
+	if config.PersistentSession {
+		// A persistent session is only resumed if the client id is the same as last time.
+		if hostname, err := os.Hostname(); err == nil {
+			return "htManager-" + hostname
+		}
+		return "htManager"
+	}
+	return fmt.Sprintf("htManager-%d", rand.Int())
+}
+
+func waitForToken(t mqtt.Token) error {
+	if !t.WaitTimeout(brokerTimeout) {
+		return BrokerTimeoutError
+	}
+	return t.Error()
+}
@@ -0,0 +1,269 @@
+package devices
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// persistentSessionExpiry is how long the broker keeps htManager's session after it disconnects.
+const persistentSessionExpiry = 7 * 24 * time.Hour
+
+type mqttV5Transport struct {
+	config    MQTTConfig
+	will      *paho.WillMessage
+	cancel    context.CancelFunc
+	connected atomic.Bool
+	lock      sync.Mutex
+	// manager is set once the first connection is up, so subscribing from onConnect can use it.
+	manager        *autopaho.ConnectionManager
+	subscriptions  map[string]MessageHandler
+	defaultHandler MessageHandler
+}
+
+// NewMQTTv5Transport creates a transport using the paho MQTT v5 client, it supports publish properties.
+func NewMQTTv5Transport(config MQTTConfig) Transport {
+	return &mqttV5Transport{config: config, subscriptions: map[string]MessageHandler{}}
+}
+
+func (t *mqttV5Transport) SetWill(topic string, qos byte, retained bool, payload []byte) {
+	t.will = &paho.WillMessage{Topic: topic, QoS: qos, Retain: retained, Payload: payload}
+}
+
+func (t *mqttV5Transport) SetDefaultHandler(handler MessageHandler) {
+	t.defaultHandler = handler
+}
+
+func (t *mqttV5Transport) Connect(onConnect func()) error {
+	serverUrl, err := url.Parse(t.config.URL)
+	if err != nil {
+		return err
+	}
+	clientConfig := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverUrl},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !t.config.PersistentSession,
+		ConnectUsername:               t.config.Username,
+		ConnectPassword:               []byte(t.config.Password),
+		WillMessage:                   t.will,
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+			t.lock.Lock()
+			t.manager = manager
+			t.lock.Unlock()
+			t.connected.Store(true)
+			onConnect()
+		},
+		OnConnectError: func(err error) {
+			t.connected.Store(false)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          clientId(t.config),
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){t.route},
+			OnClientError: func(err error) {
+				t.connected.Store(false)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				t.connected.Store(false)
+			},
+		},
+	}
+	if t.config.PersistentSession {
+		clientConfig.SessionExpiryInterval = uint32(persistentSessionExpiry.Seconds())
+	}
+	if t.config.StoreDir != "" {
+		clientStore, err := file.New(t.config.StoreDir, "client_", ".pkt")
+		if err != nil {
+			return err
+		}
+		serverStore, err := file.New(t.config.StoreDir, "server_", ".pkt")
+		if err != nil {
+			return err
+		}
+		clientConfig.Session = state.New(clientStore, serverStore)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, clientConfig)
+	if err != nil {
+		cancel()
+		return err
+	}
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, brokerTimeout)
+	defer awaitCancel()
+	if err := manager.AwaitConnection(awaitCtx); err != nil {
+		// Stop the manager, otherwise it keeps reconnecting in the background.
+		cancel()
+		t.lock.Lock()
+		t.manager = nil
+		t.lock.Unlock()
+		t.connected.Store(false)
+		return BrokerTimeoutError
+	}
+	t.lock.Lock()
+	t.manager = manager
+	t.cancel = cancel
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *mqttV5Transport) route(received paho.PublishReceived) (bool, error) {
+	packet := received.Packet
+	message := Message{Topic: packet.Topic, Payload: packet.Payload, Retained: packet.Retain, QoS: packet.QoS}
+	if packet.Properties != nil {
+		message.Properties = fromPahoProperties(packet.Properties)
+	}
+	t.lock.Lock()
+	handlers := make([]MessageHandler, 0, 1)
+	for filter, handler := range t.subscriptions {
+		if topicMatches(filter, packet.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	t.lock.Unlock()
+	if len(handlers) == 0 && t.defaultHandler != nil {
+		handlers = append(handlers, t.defaultHandler)
+	}
+	for _, handler := range handlers {
+		handler(message)
+	}
+	return len(handlers) > 0, nil
+}
+
+func (t *mqttV5Transport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return t.PublishWithProperties(topic, qos, retained, payload, PublishProperties{})
+}
+
+func (t *mqttV5Transport) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, properties PublishProperties) error {
+	ctx, cancel := context.WithTimeout(context.Background(), brokerTimeout)
+	defer cancel()
+	manager, err := t.connection()
+	if err != nil {
+		return err
+	}
+	response, err := manager.Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    payload,
+		Properties: toPahoProperties(properties),
+	})
+	if response != nil && response.ReasonCode >= 0x80 {
+		reasonCodeError := &ReasonCodeError{Code: response.ReasonCode}
+		if response.Properties != nil {
+			reasonCodeError.Reason = response.Properties.ReasonString
+		}
+		return reasonCodeError
+	}
+	return brokerError(err)
+}
+
+func (t *mqttV5Transport) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	t.lock.Lock()
+	t.subscriptions[topic] = handler
+	t.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), brokerTimeout)
+	defer cancel()
+	manager, err := t.connection()
+	if err != nil {
+		return err
+	}
+	suback, err := manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	if err != nil {
+		return brokerError(err)
+	}
+	for _, reasonCode := range suback.Reasons {
+		if reasonCode >= 0x80 {
+			return &ReasonCodeError{Code: reasonCode}
+		}
+	}
+	return nil
+}
+
+func (t *mqttV5Transport) Unsubscribe(topic string) error {
+	t.lock.Lock()
+	delete(t.subscriptions, topic)
+	t.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), brokerTimeout)
+	defer cancel()
+	manager, err := t.connection()
+	if err != nil {
+		return err
+	}
+	_, err = manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	return brokerError(err)
+}
+
+// connection returns the connection manager, or NotConnectedError before Connect succeeded.
+func (t *mqttV5Transport) connection() (*autopaho.ConnectionManager, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.manager == nil {
+		return nil, NotConnectedError
+	}
+	return t.manager, nil
+}
+
+func (t *mqttV5Transport) IsConnected() bool {
+	return t.connected.Load()
+}
+
+func (t *mqttV5Transport) Disconnect() {
+	t.lock.Lock()
+	manager, stop := t.manager, t.cancel
+	t.lock.Unlock()
+	if manager == nil || stop == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), brokerTimeout)
+	defer cancel()
+	manager.Disconnect(ctx)
+	stop()
+	t.connected.Store(false)
+}
+
+func brokerError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return BrokerTimeoutError
+	}
+	return err
+}
+
+func toPahoProperties(properties PublishProperties) *paho.PublishProperties {
+	pahoProperties := &paho.PublishProperties{
+		ResponseTopic:   properties.ResponseTopic,
+		CorrelationData: properties.CorrelationData,
+	}
+	if properties.MessageExpiry > 0 {
+		expiry := uint32(properties.MessageExpiry.Seconds())
+		pahoProperties.MessageExpiry = &expiry
+	}
+	for key, value := range properties.UserProperties {
+		pahoProperties.User.Add(key, value)
+	}
+	return pahoProperties
+}
+
+func fromPahoProperties(pahoProperties *paho.PublishProperties) *PublishProperties {
+	properties := &PublishProperties{
+		ResponseTopic:   pahoProperties.ResponseTopic,
+		CorrelationData: pahoProperties.CorrelationData,
+	}
+	if pahoProperties.MessageExpiry != nil {
+		properties.MessageExpiry = time.Duration(*pahoProperties.MessageExpiry) * time.Second
+	}
+	if len(pahoProperties.User) > 0 {
+		properties.UserProperties = map[string]string{}
+		for _, property := range pahoProperties.User {
+			properties.UserProperties[property.Key] = property.Value
+		}
+	}
+	return properties
+}
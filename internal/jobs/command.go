@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"htManager/internal/devices"
+)
+
+const (
+	RestartCommand    = "restart"
+	UpdateCommand     = "update"
+	SetProfileCommand = "setprofile"
+	SetTopicCommand   = "settopic"
+)
+
+var InvalidCommandError = errors.New("invalid command")
+
+// Command is an action that can be run against a device, the fields used depend on the command.
+type Command struct {
+	Command string `json:"command" yaml:"command"`
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	Profile string `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Topic   string `json:"topic,omitempty" yaml:"topic,omitempty"`
+	Value   string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+func (c *Command) Validate() error {
+	switch c.Command {
+	case RestartCommand:
+		return nil
+	case UpdateCommand:
+		if c.Version == "" {
+			return fmt.Errorf("%w: update requires a version", InvalidCommandError)
+		}
+	case SetProfileCommand:
+		if c.Profile == "" {
+			return fmt.Errorf("%w: setprofile requires a profile", InvalidCommandError)
+		}
+	case SetTopicCommand:
+		if c.Topic == "" {
+			return fmt.Errorf("%w: settopic requires a topic", InvalidCommandError)
+		}
+	default:
+		return fmt.Errorf("%w: unknown command %q", InvalidCommandError, c.Command)
+	}
+	return nil
+}
+
+// Execute runs the command against the device. It returns the id of the ctrl command sent for restart, update and
+// setprofile, which GetDeviceCommands tracks.
+func (c *Command) Execute(d devices.Devices, deviceId string) (string, error) {
+	switch c.Command {
+	case RestartCommand:
+		return d.RebootDevice(deviceId)
+	case UpdateCommand:
+		return d.UpdateDevice(deviceId, c.Version)
+	case SetProfileCommand:
+		return d.SetDeviceProfile(deviceId, c.Profile)
+	case SetTopicCommand:
+		return "", d.SetDeviceTopicValue(deviceId, c.Topic, c.Value)
+	default:
+		return "", fmt.Errorf("%w: unknown command %q", InvalidCommandError, c.Command)
+	}
+}
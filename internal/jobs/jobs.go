@@ -0,0 +1,314 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"htManager/internal/devices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+
+	ResultPending = "pending"
+	ResultRunning = "running"
+	ResultSuccess = "success"
+	ResultFailed  = "failed"
+)
+
+// maxFinishedJobs is the number of completed jobs kept for polling.
+const maxFinishedJobs = 100
+
+var (
+	NoDevicesSelectedError = errors.New("no devices selected")
+	// EmptySelectorError is a job without a selector which doesn't say it is meant for every device.
+	EmptySelectorError = errors.New("empty selector, set all to run the job on every device")
+	// ShuttingDownError is returned for jobs started after Close, and reported for devices a job hadn't started on.
+	ShuttingDownError = errors.New("htManager is shutting down")
+)
+
+type JobRequest struct {
+	Selector devices.DeviceSelector `json:"selector" yaml:"selector"`
+	// All must be set to run the job on every device, an empty selector is rejected otherwise.
+	All     bool `json:"all,omitempty" yaml:"all,omitempty"`
+	Command `yaml:",inline"`
+}
+
+// Validate checks the command, and that the job isn't run on every device by mistake.
+func (r *JobRequest) Validate() error {
+	if r.Selector.IsEmpty() && !r.All {
+		return EmptySelectorError
+	}
+	return r.Command.Validate()
+}
+
+type DeviceJobResult struct {
+	Id       string     `json:"id"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type Job struct {
+	Id       string                 `json:"id"`
+	Command  Command                `json:"command"`
+	Selector devices.DeviceSelector `json:"selector"`
+	State    string                 `json:"state"`
+	Created  time.Time              `json:"created"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Results  []DeviceJobResult      `json:"results"`
+}
+
+type JobNotificationClient interface {
+	JobUpdated(job Job)
+}
+
+type JobManager interface {
+	StartJob(request JobRequest) (*Job, error)
+	GetJob(jobId string) *Job
+	GetJobs() []Job
+	RegisterJobNotificationClient(client JobNotificationClient)
+	UnregisterJobNotificationClient(client JobNotificationClient)
+	// Close stops starting commands and waits for the commands already sent until ctx is done.
+	Close(ctx context.Context) error
+}
+
+type jobManagerImpl struct {
+	devices       devices.Devices
+	concurrency   int
+	lock          sync.Mutex
+	jobs          map[string]*Job
+	clientsLock   sync.Mutex
+	updateClients []JobNotificationClient
+	running       sync.WaitGroup
+	closing       chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewJobManager creates a job manager that runs commands on at most concurrency devices at a time per job.
+func NewJobManager(devices devices.Devices, concurrency int) JobManager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &jobManagerImpl{
+		devices:     devices,
+		concurrency: concurrency,
+		jobs:        map[string]*Job{},
+		closing:     make(chan struct{}),
+	}
+}
+
+func newJobId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (m *jobManagerImpl) StartJob(request JobRequest) (*Job, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	deviceList := request.Selector.Select(m.devices.GetDevices())
+	if len(deviceList) == 0 {
+		return nil, NoDevicesSelectedError
+	}
+	sort.Slice(deviceList, func(i, j int) bool {
+		return deviceList[i].Id < deviceList[j].Id
+	})
+	job := &Job{
+		Id:       newJobId(),
+		Command:  request.Command,
+		Selector: request.Selector,
+		State:    JobRunning,
+		Created:  time.Now(),
+		Results:  make([]DeviceJobResult, len(deviceList)),
+	}
+	for idx, info := range deviceList {
+		job.Results[idx] = DeviceJobResult{Id: info.Id, State: ResultPending}
+	}
+	m.lock.Lock()
+	// Checked under the lock so that Close doesn't miss a job started concurrently.
+	if m.isClosing() {
+		m.lock.Unlock()
+		return nil, ShuttingDownError
+	}
+	m.jobs[job.Id] = job
+	m.pruneJobs()
+	snapshot := job.copy()
+	m.running.Add(1)
+	m.lock.Unlock()
+
+	go m.runJob(job)
+	return &snapshot, nil
+}
+
+func (m *jobManagerImpl) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		m.lock.Lock()
+		close(m.closing)
+		m.lock.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *jobManagerImpl) isClosing() bool {
+	select {
+	case <-m.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *jobManagerImpl) runJob(job *Job) {
+	defer m.running.Done()
+	semaphore := make(chan struct{}, m.concurrency)
+	wg := sync.WaitGroup{}
+	for idx := range job.Results {
+		semaphore <- struct{}{}
+		if m.isClosing() {
+			<-semaphore
+			m.updateResult(job, idx, func(result *DeviceJobResult) {
+				now := time.Now()
+				result.Finished = &now
+				result.State = ResultFailed
+				result.Error = ShuttingDownError.Error()
+			})
+			continue
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			m.runDevice(job, idx)
+		}(idx)
+	}
+	wg.Wait()
+
+	m.lock.Lock()
+	now := time.Now()
+	job.State = JobCompleted
+	job.Finished = &now
+	snapshot := job.copy()
+	m.lock.Unlock()
+	m.sendUpdate(snapshot)
+}
+
+func (m *jobManagerImpl) runDevice(job *Job, idx int) {
+	m.updateResult(job, idx, func(result *DeviceJobResult) {
+		now := time.Now()
+		result.State = ResultRunning
+		result.Started = &now
+	})
+	_, err := job.Command.Execute(m.devices, job.Results[idx].Id)
+	m.updateResult(job, idx, func(result *DeviceJobResult) {
+		now := time.Now()
+		result.Finished = &now
+		if err != nil {
+			result.State = ResultFailed
+			result.Error = err.Error()
+		} else {
+			result.State = ResultSuccess
+		}
+	})
+}
+
+func (m *jobManagerImpl) updateResult(job *Job, idx int, update func(result *DeviceJobResult)) {
+	m.lock.Lock()
+	update(&job.Results[idx])
+	snapshot := job.copy()
+	m.lock.Unlock()
+	m.sendUpdate(snapshot)
+}
+
+// pruneJobs removes the oldest completed jobs, must be called with the lock held.
+func (m *jobManagerImpl) pruneJobs() {
+	finished := make([]*Job, 0)
+	for _, job := range m.jobs {
+		if job.State == JobCompleted {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Created.Before(finished[j].Created)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(m.jobs, job.Id)
+	}
+}
+
+func (m *jobManagerImpl) GetJob(jobId string) *Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if job, ok := m.jobs[jobId]; ok {
+		snapshot := job.copy()
+		return &snapshot
+	}
+	return nil
+}
+
+func (m *jobManagerImpl) GetJobs() []Job {
+	m.lock.Lock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job.copy())
+	}
+	m.lock.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.After(jobs[j].Created)
+	})
+	return jobs
+}
+
+func (m *jobManagerImpl) sendUpdate(job Job) {
+	m.clientsLock.Lock()
+	for _, client := range m.updateClients {
+		client.JobUpdated(job)
+	}
+	m.clientsLock.Unlock()
+}
+
+func (m *jobManagerImpl) RegisterJobNotificationClient(client JobNotificationClient) {
+	m.clientsLock.Lock()
+	m.updateClients = append(m.updateClients, client)
+	m.clientsLock.Unlock()
+}
+
+func (m *jobManagerImpl) UnregisterJobNotificationClient(client JobNotificationClient) {
+	m.clientsLock.Lock()
+	for idx, value := range m.updateClients {
+		if value == client {
+			m.updateClients[idx] = m.updateClients[len(m.updateClients)-1]
+			m.updateClients = m.updateClients[:len(m.updateClients)-1]
+			break
+		}
+	}
+	m.clientsLock.Unlock()
+}
+
+func (j *Job) copy() Job {
+	snapshot := *j
+	snapshot.Results = append([]DeviceJobResult(nil), j.Results...)
+	return snapshot
+}
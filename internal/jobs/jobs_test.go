@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"htManager/internal/devices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDevices implements the parts of devices.Devices used by jobs.
+type fakeDevices struct {
+	devices.Devices
+	deviceList []devices.DeviceInfo
+	running    atomic.Int32
+	maxRunning atomic.Int32
+	lock       sync.Mutex
+	rebooted   []string
+}
+
+func (f *fakeDevices) GetDevices() []devices.DeviceInfo {
+	return f.deviceList
+}
+
+func (f *fakeDevices) RebootDevice(deviceId string) (string, error) {
+	running := f.running.Add(1)
+	defer f.running.Add(-1)
+	for {
+		current := f.maxRunning.Load()
+		if running <= current || f.maxRunning.CompareAndSwap(current, running) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if deviceId == "bad" {
+		return "", errors.New("broker timeout")
+	}
+	f.lock.Lock()
+	f.rebooted = append(f.rebooted, deviceId)
+	f.lock.Unlock()
+	return "restart-" + deviceId, nil
+}
+
+func waitForJob(t *testing.T, manager JobManager, jobId string) *Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job := manager.GetJob(jobId); job != nil && job.State == JobCompleted {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not complete", jobId)
+	return nil
+}
+
+func TestJobManager_StartJob(t *testing.T) {
+	fake := &fakeDevices{deviceList: []devices.DeviceInfo{
+		{Id: "01", DeviceType: "esp8266"},
+		{Id: "02", DeviceType: "esp8266"},
+		{Id: "03", DeviceType: "esp8266"},
+		{Id: "04", DeviceType: "esp8266"},
+		{Id: "bad", DeviceType: "esp8266"},
+		{Id: "05", DeviceType: "esp32"},
+	}}
+	manager := NewJobManager(fake, 2)
+
+	job, err := manager.StartJob(JobRequest{
+		Selector: devices.DeviceSelector{DeviceType: "esp8266"},
+		Command:  Command{Command: RestartCommand},
+	})
+	if err != nil {
+		t.Fatalf("StartJob() error = %v", err)
+	}
+	job = waitForJob(t, manager, job.Id)
+
+	if len(job.Results) != 5 {
+		t.Fatalf("StartJob() results = %v, want 5 entries", job.Results)
+	}
+	for _, result := range job.Results {
+		wantState := ResultSuccess
+		if result.Id == "bad" {
+			wantState = ResultFailed
+		}
+		if result.State != wantState {
+			t.Errorf("result %s state = %s, want %s", result.Id, result.State, wantState)
+		}
+	}
+	if max := fake.maxRunning.Load(); max > 2 {
+		t.Errorf("max concurrent commands = %d, want <= 2", max)
+	}
+}
+
+func TestJobManager_Close(t *testing.T) {
+	fake := &fakeDevices{deviceList: []devices.DeviceInfo{{Id: "01"}, {Id: "02"}, {Id: "03"}, {Id: "04"}}}
+	manager := NewJobManager(fake, 1)
+	job, err := manager.StartJob(JobRequest{All: true, Command: Command{Command: RestartCommand}})
+	if err != nil {
+		t.Fatalf("StartJob() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := manager.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The device being restarted finishes, the job isn't started on the others.
+	job = manager.GetJob(job.Id)
+	if job.State != JobCompleted {
+		t.Fatalf("job state after Close() = %s, want %s", job.State, JobCompleted)
+	}
+	cancelled := 0
+	for _, result := range job.Results {
+		if result.State == ResultFailed && result.Error == ShuttingDownError.Error() {
+			cancelled++
+		} else if result.State != ResultSuccess {
+			t.Errorf("result %s = %+v, want success or shutting down", result.Id, result)
+		}
+	}
+	if cancelled < 3 {
+		t.Errorf("results after Close() = %+v, want at least 3 not started", job.Results)
+	}
+	if _, err := manager.StartJob(JobRequest{All: true, Command: Command{Command: RestartCommand}}); !errors.Is(err, ShuttingDownError) {
+		t.Errorf("StartJob() after Close() error = %v, want %v", err, ShuttingDownError)
+	}
+}
+
+func TestJobManager_StartJobErrors(t *testing.T) {
+	fake := &fakeDevices{deviceList: []devices.DeviceInfo{{Id: "01"}}}
+	manager := NewJobManager(fake, 2)
+
+	tests := []struct {
+		name    string
+		request JobRequest
+		wantErr error
+	}{
+		{name: "Unknown command", request: JobRequest{All: true, Command: Command{Command: "explode"}}, wantErr: InvalidCommandError},
+		{name: "Update without version", request: JobRequest{All: true, Command: Command{Command: UpdateCommand}}, wantErr: InvalidCommandError},
+		{name: "Empty selector", request: JobRequest{Command: Command{Command: RestartCommand}}, wantErr: EmptySelectorError},
+		{
+			name:    "Empty selector update",
+			request: JobRequest{Command: Command{Command: UpdateCommand, Version: "v1.2.0"}},
+			wantErr: EmptySelectorError,
+		},
+		{
+			name:    "No devices",
+			request: JobRequest{Selector: devices.DeviceSelector{Ids: []string{"99"}}, Command: Command{Command: RestartCommand}},
+			wantErr: NoDevicesSelectedError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := manager.StartJob(tt.request); !errors.Is(err, tt.wantErr) {
+				t.Errorf("StartJob() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package profiles
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/devices"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const templateExtension = ".yaml"
+
+var (
+	InvalidTemplateNameError = errors.New("invalid template name")
+	InvalidTemplateError     = errors.New("invalid template")
+	RenderFailedError        = errors.New("failed to render template")
+	TemplateNotFoundError    = errors.New("template not found")
+	DeviceNotFoundError      = errors.New("device not found")
+)
+
+var templateNameRegExp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// Template is a profile with placeholders that is rendered for a specific device.
+// Profile is a go text/template which is executed with TemplateData.
+type Template struct {
+	Name        string            `json:"name" yaml:"-"`
+	Description string            `json:"description" yaml:"description"`
+	Variables   map[string]string `json:"variables" yaml:"variables"`
+	Profile     string            `json:"profile" yaml:"profile"`
+}
+
+type TemplateData struct {
+	Device devices.DeviceInfo
+	Vars   map[string]string
+}
+
+type TemplateManager interface {
+	GetTemplates() []Template
+	GetTemplate(name string) *Template
+	SaveTemplate(template Template) error
+	DeleteTemplate(name string) error
+	RenderTemplate(name string, deviceId string, variables map[string]string) (string, error)
+	ApplyTemplate(name string, targets map[string]map[string]string) ([]devices.DeviceResult, error)
+}
+
+type templateManagerImpl struct {
+	Path    string
+	devices devices.Devices
+	lock    sync.Mutex
+}
+
+func NewTemplateManager(path string, devices devices.Devices) TemplateManager {
+	return &templateManagerImpl{Path: path, devices: devices}
+}
+
+func (m *templateManagerImpl) templatePath(name string) (string, error) {
+	if !templateNameRegExp.MatchString(name) {
+		return "", InvalidTemplateNameError
+	}
+	return filepath.Join(m.Path, name+templateExtension), nil
+}
+
+func (m *templateManagerImpl) GetTemplates() []Template {
+	files, err := os.ReadDir(m.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read contents of dir %s, error %s", m.Path, err)
+		}
+		return []Template{}
+	}
+	templates := make([]Template, 0, len(files))
+	for _, entry := range files {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), templateExtension) {
+			continue
+		}
+		if t := m.GetTemplate(strings.TrimSuffix(entry.Name(), templateExtension)); t != nil {
+			templates = append(templates, *t)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	return templates
+}
+
+func (m *templateManagerImpl) GetTemplate(name string) *Template {
+	path, err := m.templatePath(name)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read template %s, error %s", path, err)
+		}
+		return nil
+	}
+	t := Template{}
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		log.Printf("Failed to parse template %s, error %s", path, err)
+		return nil
+	}
+	t.Name = name
+	return &t
+}
+
+func (m *templateManagerImpl) SaveTemplate(t Template) error {
+	path, err := m.templatePath(t.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := parseTemplate(t); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(&t)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := os.MkdirAll(m.Path, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (m *templateManagerImpl) DeleteTemplate(name string) error {
+	path, err := m.templatePath(name)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return TemplateNotFoundError
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *templateManagerImpl) RenderTemplate(name string, deviceId string, variables map[string]string) (string, error) {
+	t := m.GetTemplate(name)
+	if t == nil {
+		return "", TemplateNotFoundError
+	}
+	info := m.devices.GetDeviceInfo(deviceId)
+	if info == nil {
+		return "", DeviceNotFoundError
+	}
+	return renderTemplate(*t, *info, variables)
+}
+
+func (m *templateManagerImpl) ApplyTemplate(name string, targets map[string]map[string]string) ([]devices.DeviceResult, error) {
+	t := m.GetTemplate(name)
+	if t == nil {
+		return nil, TemplateNotFoundError
+	}
+	deviceIds := make([]string, 0, len(targets))
+	for deviceId := range targets {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	sort.Strings(deviceIds)
+
+	results := make([]devices.DeviceResult, 0, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		result := devices.DeviceResult{Id: deviceId}
+		if err := m.applyToDevice(*t, deviceId, targets[deviceId]); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (m *templateManagerImpl) applyToDevice(t Template, deviceId string, variables map[string]string) error {
+	info := m.devices.GetDeviceInfo(deviceId)
+	if info == nil {
+		return DeviceNotFoundError
+	}
+	profile, err := renderTemplate(t, *info, variables)
+	if err != nil {
+		return err
+	}
+	_, err = m.devices.SetDeviceProfile(deviceId, profile)
+	return err
+}
+
+func parseTemplate(t Template) (*template.Template, error) {
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Parse(t.Profile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidTemplateError, err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate executes the template for the device, variables override the template defaults.
+// The result is checked to be a valid profile before being returned.
+func renderTemplate(t Template, info devices.DeviceInfo, variables map[string]string) (string, error) {
+	tmpl, err := parseTemplate(t)
+	if err != nil {
+		return "", err
+	}
+	data := TemplateData{Device: info, Vars: map[string]string{}}
+	for name, value := range t.Variables {
+		data.Vars[name] = value
+	}
+	for name, value := range variables {
+		data.Vars[name] = value
+	}
+	buffer := bytes.Buffer{}
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("%w: %s", RenderFailedError, err)
+	}
+	profile := buffer.String()
+	if err := yaml.Unmarshal([]byte(profile), map[string]devices.ProfileEntries{}); err != nil {
+		return "", fmt.Errorf("%w: rendered profile is invalid: %s", RenderFailedError, err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,76 @@
+package profiles
+
+import (
+	"errors"
+	"htManager/internal/devices"
+	"testing"
+)
+
+func Test_renderTemplate(t *testing.T) {
+	type args struct {
+		template  Template
+		info      devices.DeviceInfo
+		variables map[string]string
+	}
+
+	sensor := Template{
+		Name:      "sensor",
+		Variables: map[string]string{"room": "hall", "pin": "4"},
+		Profile:   "dht22:\n- name: {{.Vars.room}}\n  pin: {{.Vars.pin}}\n  id: \"{{.Device.Id}}\"\n",
+	}
+
+	info := devices.DeviceInfo{Id: "0123abcd", Description: "Hall sensor"}
+
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr error
+	}{
+		{
+			name: "Defaults",
+			args: args{template: sensor, info: info},
+			want: "dht22:\n- name: hall\n  pin: 4\n  id: \"0123abcd\"\n",
+		},
+		{
+			name: "Override variables",
+			args: args{template: sensor, info: info, variables: map[string]string{"room": "kitchen"}},
+			want: "dht22:\n- name: kitchen\n  pin: 4\n  id: \"0123abcd\"\n",
+		},
+		{
+			name: "Missing variable",
+			args: args{
+				template: Template{Name: "missing", Profile: "dht22:\n- name: {{.Vars.room}}\n"},
+				info:     info,
+			},
+			wantErr: RenderFailedError,
+		},
+		{
+			name: "Invalid profile",
+			args: args{
+				template: Template{Name: "invalid", Profile: "- {{.Vars.room}}\n", Variables: map[string]string{"room": "x"}},
+				info:     info,
+			},
+			wantErr: RenderFailedError,
+		},
+		{
+			name: "Invalid template",
+			args: args{
+				template: Template{Name: "invalid", Profile: "{{.Vars.room"},
+				info:     info,
+			},
+			wantErr: InvalidTemplateError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate(tt.args.template, tt.args.info, tt.args.variables)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("renderTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package scheduler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/jobs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxHistory is the number of schedule runs kept.
+const maxHistory = 500
+
+var (
+	InvalidScheduleError  = errors.New("invalid schedule")
+	ScheduleNotFoundError = errors.New("schedule not found")
+)
+
+// Schedule runs a bulk command job either repeatedly according to a cron expression or once at a given time.
+type Schedule struct {
+	Id       string          `json:"id" yaml:"id"`
+	Name     string          `json:"name" yaml:"name"`
+	Cron     string          `json:"cron,omitempty" yaml:"cron,omitempty"`
+	At       *time.Time      `json:"at,omitempty" yaml:"at,omitempty"`
+	TimeZone string          `json:"timeZone,omitempty" yaml:"timeZone,omitempty"`
+	Enabled  bool            `json:"enabled" yaml:"enabled"`
+	Job      jobs.JobRequest `json:"job" yaml:"job"`
+	NextRun  *time.Time      `json:"nextRun,omitempty" yaml:"-"`
+}
+
+// ScheduleRun records a job started by a schedule and its outcome once the job has completed.
+type ScheduleRun struct {
+	ScheduleId string     `json:"scheduleId" yaml:"scheduleId"`
+	Started    time.Time  `json:"started" yaml:"started"`
+	Finished   *time.Time `json:"finished,omitempty" yaml:"finished,omitempty"`
+	JobId      string     `json:"jobId,omitempty" yaml:"jobId,omitempty"`
+	Succeeded  int        `json:"succeeded" yaml:"succeeded"`
+	Failed     int        `json:"failed" yaml:"failed"`
+	Error      string     `json:"error,omitempty" yaml:"error,omitempty"`
+	// Missed is set when htManager wasn't running at the time of a one-off schedule, no job was started.
+	Missed bool `json:"missed,omitempty" yaml:"missed,omitempty"`
+}
+
+type Scheduler interface {
+	GetSchedules() []Schedule
+	GetSchedule(scheduleId string) *Schedule
+	CreateSchedule(schedule Schedule) (*Schedule, error)
+	UpdateSchedule(schedule Schedule) (*Schedule, error)
+	DeleteSchedule(scheduleId string) error
+	GetHistory(scheduleId string) []ScheduleRun
+	// Close stops starting jobs, it returns once a job being started has been recorded.
+	Close()
+}
+
+type schedulerState struct {
+	Schedules []Schedule    `yaml:"schedules"`
+	History   []ScheduleRun `yaml:"history"`
+}
+
+type schedulerImpl struct {
+	path      string
+	jobs      jobs.JobManager
+	lock      sync.Mutex
+	schedules map[string]*Schedule
+	next      map[string]time.Time
+	history   []ScheduleRun
+	changed   chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewScheduler loads the schedules stored in the YAML file at path and starts running them.
+func NewScheduler(path string, jobManager jobs.JobManager) (Scheduler, error) {
+	s := &schedulerImpl{
+		path:      path,
+		jobs:      jobManager,
+		schedules: map[string]*Schedule{},
+		next:      map[string]time.Time{},
+		history:   []ScheduleRun{},
+		changed:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		state := schedulerState{}
+		if err := yaml.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.History != nil {
+			s.history = state.History
+		}
+		now := time.Now()
+		missed := false
+		for idx := range state.Schedules {
+			schedule := state.Schedules[idx]
+			s.schedules[schedule.Id] = &schedule
+			// A one-off schedule whose time passed while htManager was down is disabled rather than run late.
+			if schedule.At != nil && schedule.Enabled && !schedule.At.After(now) {
+				log.Printf("Schedule %s (%s): missed its run at %s\n", schedule.Id, schedule.Name,
+					schedule.At.Format(time.RFC3339))
+				schedule.Enabled = false
+				s.addHistory(ScheduleRun{ScheduleId: schedule.Id, Started: *schedule.At, Finished: &now, Missed: true})
+				missed = true
+			}
+			if err := s.updateNextRun(&schedule, now); err != nil {
+				log.Printf("Schedule %s: %s\n", schedule.Id, err)
+			}
+		}
+		if missed {
+			s.save()
+		}
+	}
+	jobManager.RegisterJobNotificationClient(s)
+	go s.run()
+	return s, nil
+}
+
+func newScheduleId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// nextRun returns when the schedule should next run after the given time, or nil if it will not run again.
+func nextRun(schedule *Schedule, after time.Time) (*time.Time, error) {
+	if !schedule.Enabled {
+		return nil, nil
+	}
+	if schedule.At != nil {
+		if schedule.At.After(after) {
+			at := *schedule.At
+			return &at, nil
+		}
+		return nil, nil
+	}
+	spec := schedule.Cron
+	if schedule.TimeZone != "" {
+		spec = fmt.Sprintf("CRON_TZ=%s %s", schedule.TimeZone, spec)
+	}
+	cronSchedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidScheduleError, err)
+	}
+	next := cronSchedule.Next(after)
+	if next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+func validateSchedule(schedule *Schedule) error {
+	if (schedule.Cron == "") == (schedule.At == nil) {
+		return fmt.Errorf("%w: exactly one of cron or at must be given", InvalidScheduleError)
+	}
+	// A one-off schedule which has already run is disabled, and can still be edited.
+	if schedule.At != nil && schedule.Enabled && !schedule.At.After(time.Now()) {
+		return fmt.Errorf("%w: at %s is in the past", InvalidScheduleError, schedule.At.Format(time.RFC3339))
+	}
+	if schedule.TimeZone != "" {
+		if _, err := time.LoadLocation(schedule.TimeZone); err != nil {
+			return fmt.Errorf("%w: %s", InvalidScheduleError, err)
+		}
+	}
+	if err := schedule.Job.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", InvalidScheduleError, err)
+	}
+	enabled := *schedule
+	enabled.Enabled = true
+	_, err := nextRun(&enabled, time.Now())
+	return err
+}
+
+// updateNextRun must be called with the lock held.
+func (s *schedulerImpl) updateNextRun(schedule *Schedule, after time.Time) error {
+	next, err := nextRun(schedule, after)
+	if err != nil || next == nil {
+		delete(s.next, schedule.Id)
+		return err
+	}
+	s.next[schedule.Id] = *next
+	return nil
+}
+
+func (s *schedulerImpl) notifyChanged() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *schedulerImpl) run() {
+	defer close(s.stopped)
+	for {
+		s.lock.Lock()
+		var wakeup *time.Time
+		for _, next := range s.next {
+			if wakeup == nil || next.Before(*wakeup) {
+				wakeup = &next
+			}
+		}
+		s.lock.Unlock()
+
+		var timer <-chan time.Time
+		if wakeup != nil {
+			timer = time.After(time.Until(*wakeup))
+		}
+		select {
+		case <-timer:
+			s.runDue(time.Now())
+		case <-s.changed:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close doesn't unregister from the job manager, so that jobs completing during the shutdown are still recorded.
+func (s *schedulerImpl) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.stopped
+}
+
+func (s *schedulerImpl) runDue(now time.Time) {
+	s.lock.Lock()
+	due := make([]Schedule, 0)
+	for scheduleId, next := range s.next {
+		if next.After(now) {
+			continue
+		}
+		schedule := s.schedules[scheduleId]
+		due = append(due, *schedule)
+		if schedule.At != nil {
+			schedule.Enabled = false
+		}
+		if err := s.updateNextRun(schedule, now); err != nil {
+			log.Printf("Schedule %s: %s\n", scheduleId, err)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, schedule := range due {
+		run := ScheduleRun{ScheduleId: schedule.Id, Started: now}
+		if job, err := s.jobs.StartJob(schedule.Job); err != nil {
+			finished := time.Now()
+			run.Finished = &finished
+			run.Error = err.Error()
+			log.Printf("Schedule %s (%s): failed to start job: %s\n", schedule.Id, schedule.Name, err)
+		} else {
+			run.JobId = job.Id
+		}
+		s.lock.Lock()
+		s.addHistory(run)
+		// The job may have completed before the run was recorded.
+		if run.JobId != "" {
+			if job := s.jobs.GetJob(run.JobId); job != nil {
+				s.recordJobResult(*job)
+			}
+		}
+		s.save()
+		s.lock.Unlock()
+	}
+}
+
+// addHistory must be called with the lock held.
+func (s *schedulerImpl) addHistory(run ScheduleRun) {
+	s.history = append(s.history, run)
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+}
+
+func (s *schedulerImpl) JobUpdated(job jobs.Job) {
+	if job.State != jobs.JobCompleted {
+		return
+	}
+	s.lock.Lock()
+	if s.recordJobResult(job) {
+		s.save()
+	}
+	s.lock.Unlock()
+}
+
+// recordJobResult updates the run that started the job once it has completed, it must be called with the lock held.
+func (s *schedulerImpl) recordJobResult(job jobs.Job) bool {
+	if job.State != jobs.JobCompleted {
+		return false
+	}
+	for idx := range s.history {
+		run := &s.history[idx]
+		if run.JobId != job.Id || run.Finished != nil {
+			continue
+		}
+		run.Finished = job.Finished
+		for _, result := range job.Results {
+			if result.State == jobs.ResultSuccess {
+				run.Succeeded++
+			} else {
+				run.Failed++
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// save must be called with the lock held.
+func (s *schedulerImpl) save() {
+	state := schedulerState{Schedules: make([]Schedule, 0, len(s.schedules)), History: s.history}
+	for _, schedule := range s.schedules {
+		state.Schedules = append(state.Schedules, *schedule)
+	}
+	sort.Slice(state.Schedules, func(i, j int) bool {
+		return state.Schedules[i].Id < state.Schedules[j].Id
+	})
+	data, err := yaml.Marshal(&state)
+	if err != nil {
+		log.Printf("Failed to marshal schedules: %s\n", err)
+		return
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		log.Printf("Failed to save schedules: %s\n", err)
+		return
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Failed to save schedules: %s\n", err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		log.Printf("Failed to save schedules: %s\n", err)
+	}
+}
+
+// snapshot must be called with the lock held.
+func (s *schedulerImpl) snapshot(schedule *Schedule) Schedule {
+	result := *schedule
+	if next, ok := s.next[schedule.Id]; ok {
+		result.NextRun = &next
+	}
+	return result
+}
+
+func (s *schedulerImpl) GetSchedules() []Schedule {
+	s.lock.Lock()
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, s.snapshot(schedule))
+	}
+	s.lock.Unlock()
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	return schedules
+}
+
+func (s *schedulerImpl) GetSchedule(scheduleId string) *Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if schedule, ok := s.schedules[scheduleId]; ok {
+		result := s.snapshot(schedule)
+		return &result
+	}
+	return nil
+}
+
+func (s *schedulerImpl) CreateSchedule(schedule Schedule) (*Schedule, error) {
+	schedule.Id = newScheduleId()
+	return s.storeSchedule(schedule)
+}
+
+func (s *schedulerImpl) UpdateSchedule(schedule Schedule) (*Schedule, error) {
+	s.lock.Lock()
+	_, ok := s.schedules[schedule.Id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, ScheduleNotFoundError
+	}
+	return s.storeSchedule(schedule)
+}
+
+func (s *schedulerImpl) storeSchedule(schedule Schedule) (*Schedule, error) {
+	if err := validateSchedule(&schedule); err != nil {
+		return nil, err
+	}
+	schedule.NextRun = nil
+	s.lock.Lock()
+	s.schedules[schedule.Id] = &schedule
+	s.updateNextRun(&schedule, time.Now())
+	result := s.snapshot(&schedule)
+	s.save()
+	s.lock.Unlock()
+	s.notifyChanged()
+	return &result, nil
+}
+
+func (s *schedulerImpl) DeleteSchedule(scheduleId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.schedules[scheduleId]; !ok {
+		return ScheduleNotFoundError
+	}
+	delete(s.schedules, scheduleId)
+	delete(s.next, scheduleId)
+	s.save()
+	s.notifyChanged()
+	return nil
+}
+
+func (s *schedulerImpl) GetHistory(scheduleId string) []ScheduleRun {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	history := make([]ScheduleRun, 0)
+	for idx := len(s.history) - 1; idx >= 0; idx-- {
+		if scheduleId == "" || s.history[idx].ScheduleId == scheduleId {
+			history = append(history, s.history[idx])
+		}
+	}
+	return history
+}
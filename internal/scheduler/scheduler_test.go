@@ -0,0 +1,314 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeJobManager records the jobs started, which stay running until complete is called.
+type fakeJobManager struct {
+	jobs.JobManager
+	lock    sync.Mutex
+	started []jobs.JobRequest
+	jobList map[string]*jobs.Job
+	err     error
+}
+
+func (f *fakeJobManager) StartJob(request jobs.JobRequest) (*jobs.Job, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.started = append(f.started, request)
+	if f.jobList == nil {
+		f.jobList = map[string]*jobs.Job{}
+	}
+	job := &jobs.Job{Id: fmt.Sprintf("job-%d", len(f.started)), Command: request.Command, State: jobs.JobRunning}
+	f.jobList[job.Id] = job
+	result := *job
+	return &result, nil
+}
+
+func (f *fakeJobManager) GetJob(jobId string) *jobs.Job {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if job, ok := f.jobList[jobId]; ok {
+		result := *job
+		return &result
+	}
+	return nil
+}
+
+func (f *fakeJobManager) complete(jobId string, results ...string) jobs.Job {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	job := f.jobList[jobId]
+	finished := time.Date(2024, 3, 30, 12, 5, 0, 0, time.UTC)
+	job.State = jobs.JobCompleted
+	job.Finished = &finished
+	for idx, state := range results {
+		job.Results = append(job.Results, jobs.DeviceJobResult{Id: fmt.Sprint(idx), State: state})
+	}
+	return *job
+}
+
+func (f *fakeJobManager) RegisterJobNotificationClient(client jobs.JobNotificationClient) {
+}
+
+// newTestScheduler returns a scheduler whose run loop is stopped, so that the tests call runDue themselves.
+func newTestScheduler(t *testing.T, path string, jobManager jobs.JobManager) *schedulerImpl {
+	s, err := NewScheduler(path, jobManager)
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	s.Close()
+	return s.(*schedulerImpl)
+}
+
+func Test_nextRun(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("time zone data not available: %s", err)
+	}
+	after := time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC)
+	past := after.Add(-time.Hour)
+	future := after.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     *time.Time
+	}{
+		{
+			name:     "Cron UTC",
+			schedule: Schedule{Enabled: true, Cron: "0 3 * * *"},
+			want:     timePtr(time.Date(2024, 3, 31, 3, 0, 0, 0, time.UTC)),
+		},
+		{
+			name:     "Cron time zone",
+			schedule: Schedule{Enabled: true, Cron: "0 3 * * *", TimeZone: "Europe/London"},
+			want:     timePtr(time.Date(2024, 3, 31, 3, 0, 0, 0, london)),
+		},
+		{
+			name:     "Disabled",
+			schedule: Schedule{Enabled: false, Cron: "0 3 * * *"},
+		},
+		{
+			name:     "One-off in the future",
+			schedule: Schedule{Enabled: true, At: &future},
+			want:     &future,
+		},
+		{
+			name:     "One-off in the past",
+			schedule: Schedule{Enabled: true, At: &past},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextRun(&tt.schedule, after)
+			if err != nil {
+				t.Fatalf("nextRun() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+				t.Errorf("nextRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateSchedule(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	restart := jobs.JobRequest{All: true, Command: jobs.Command{Command: jobs.RestartCommand}}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		wantErr  error
+	}{
+		{name: "Cron", schedule: Schedule{Cron: "0 3 * * *", Job: restart}},
+		{name: "One-off", schedule: Schedule{At: &at, Enabled: true, Job: restart}},
+		{name: "One-off in the past", schedule: Schedule{At: &past, Enabled: true, Job: restart}, wantErr: InvalidScheduleError},
+		{name: "One-off which has run", schedule: Schedule{At: &past, Job: restart}},
+		{name: "Neither", schedule: Schedule{Job: restart}, wantErr: InvalidScheduleError},
+		{name: "Both", schedule: Schedule{Cron: "0 3 * * *", At: &at, Job: restart}, wantErr: InvalidScheduleError},
+		{name: "Bad cron", schedule: Schedule{Cron: "0 3 * *", Job: restart}, wantErr: InvalidScheduleError},
+		{name: "Bad time zone", schedule: Schedule{Cron: "0 3 * * *", TimeZone: "Nowhere/Town", Job: restart}, wantErr: InvalidScheduleError},
+		{name: "Bad command", schedule: Schedule{Cron: "0 3 * * *", Job: jobs.JobRequest{All: true, Command: jobs.Command{Command: "update"}}}, wantErr: InvalidScheduleError},
+		{name: "Empty selector", schedule: Schedule{Cron: "0 3 * * *", Job: jobs.JobRequest{Command: jobs.Command{Command: jobs.RestartCommand}}},
+			wantErr: jobs.EmptySelectorError},
+		{name: "Selector", schedule: Schedule{Cron: "0 3 * * *", Job: jobs.JobRequest{Selector: devices.DeviceSelector{Group: "attic"},
+			Command: jobs.Command{Command: jobs.RestartCommand}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSchedule(&tt.schedule); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestScheduler_runDue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.yaml")
+	jobManager := &fakeJobManager{}
+	s := newTestScheduler(t, path, jobManager)
+	restart := jobs.JobRequest{Selector: devices.DeviceSelector{Group: "attic"}, Command: jobs.Command{Command: jobs.RestartCommand}}
+	at := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	oneOff, err := s.CreateSchedule(Schedule{Name: "once", At: &at, Enabled: true, Job: restart})
+	if err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	nightly, err := s.CreateSchedule(Schedule{Name: "nightly", Cron: "0 3 * * *", Enabled: true, Job: restart})
+	if err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	nightlyRun := *s.GetSchedule(nightly.Id).NextRun
+
+	// Before either is due nothing runs.
+	s.runDue(at.Add(-time.Minute))
+	if len(jobManager.started) != 0 {
+		t.Fatalf("jobs started before due: %v", jobManager.started)
+	}
+
+	now := at
+	if nightlyRun.After(now) {
+		now = nightlyRun
+	}
+	s.runDue(now)
+	if len(jobManager.started) != 2 || !reflect.DeepEqual(jobManager.started[0], restart) {
+		t.Fatalf("started = %v, want two restart jobs", jobManager.started)
+	}
+	if got := s.GetSchedule(oneOff.Id); got.Enabled || got.NextRun != nil {
+		t.Errorf("one-off after its run: enabled = %v, next run = %v, want disabled", got.Enabled, got.NextRun)
+	}
+	if got := s.GetSchedule(nightly.Id); !got.Enabled || got.NextRun == nil || !got.NextRun.After(now) {
+		t.Errorf("cron schedule after its run: enabled = %v, next run = %v, want after %v", got.Enabled, got.NextRun, now)
+	}
+
+	// Running again at the same time doesn't start the jobs twice.
+	s.runDue(now)
+	if len(jobManager.started) != 2 {
+		t.Errorf("started %d jobs, want 2", len(jobManager.started))
+	}
+
+	history := s.GetHistory(oneOff.Id)
+	if len(history) != 1 || history[0].JobId == "" || history[0].Finished != nil || !history[0].Started.Equal(now) {
+		t.Fatalf("GetHistory() = %+v, want one running job started at %v", history, now)
+	}
+	s.JobUpdated(jobManager.complete(history[0].JobId, jobs.ResultSuccess, jobs.ResultSuccess, jobs.ResultFailed))
+	history = s.GetHistory(oneOff.Id)
+	if history[0].Finished == nil || history[0].Succeeded != 2 || history[0].Failed != 1 {
+		t.Errorf("GetHistory() after completion = %+v, want 2 succeeded and 1 failed", history[0])
+	}
+	if got := s.GetHistory(""); len(got) != 2 {
+		t.Errorf("GetHistory(\"\") returned %d runs, want 2", len(got))
+	}
+}
+
+func TestScheduler_runDueStartError(t *testing.T) {
+	jobManager := &fakeJobManager{err: jobs.EmptySelectorError}
+	s := newTestScheduler(t, filepath.Join(t.TempDir(), "schedules.yaml"), jobManager)
+	at := time.Now().Add(time.Hour)
+	schedule, err := s.CreateSchedule(Schedule{Name: "once", At: &at, Enabled: true,
+		Job: jobs.JobRequest{All: true, Command: jobs.Command{Command: jobs.RestartCommand}}})
+	if err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	s.runDue(at)
+	history := s.GetHistory(schedule.Id)
+	if len(history) != 1 || history[0].JobId != "" || history[0].Finished == nil || history[0].Error != jobs.EmptySelectorError.Error() {
+		t.Errorf("GetHistory() = %+v, want the start error", history)
+	}
+}
+
+func TestScheduler_SaveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.yaml")
+	jobManager := &fakeJobManager{}
+	s := newTestScheduler(t, path, jobManager)
+	at := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	restart := jobs.JobRequest{Selector: devices.DeviceSelector{Ids: []string{"01", "02"}}, Command: jobs.Command{Command: jobs.RestartCommand}}
+	update := jobs.JobRequest{All: true, Command: jobs.Command{Command: jobs.UpdateCommand, Version: "1.2.0"}}
+	if _, err := s.CreateSchedule(Schedule{Name: "once", At: &at, Enabled: true, Job: restart}); err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	if _, err := s.CreateSchedule(Schedule{Name: "weekly", Cron: "0 3 * * 1", TimeZone: "UTC", Enabled: true, Job: update}); err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	if _, err := s.CreateSchedule(Schedule{Name: "paused", Cron: "0 4 * * *", Job: update}); err != nil {
+		t.Fatalf("CreateSchedule() error = %v", err)
+	}
+	s.runDue(at)
+	s.JobUpdated(jobManager.complete("job-1", jobs.ResultSuccess))
+
+	reloaded := newTestScheduler(t, path, &fakeJobManager{})
+	if got, want := reloaded.GetSchedules(), s.GetSchedules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded schedules = %+v, want %+v", got, want)
+	}
+	got, want := reloaded.GetHistory(""), s.GetHistory("")
+	if len(got) != 1 || len(want) != 1 {
+		t.Fatalf("reloaded history = %+v, want %+v", got, want)
+	}
+	if got[0].JobId != want[0].JobId || !got[0].Started.Equal(want[0].Started) || !got[0].Finished.Equal(*want[0].Finished) ||
+		got[0].Succeeded != 1 || got[0].Failed != 0 {
+		t.Errorf("reloaded history = %+v, want %+v", got[0], want[0])
+	}
+}
+
+func TestNewScheduler_MissedOneOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.yaml")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	future := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	restart := jobs.JobRequest{All: true, Command: jobs.Command{Command: jobs.RestartCommand}}
+	state := schedulerState{Schedules: []Schedule{
+		{Id: "missed", Name: "missed", At: &past, Enabled: true, Job: restart},
+		{Id: "ran", Name: "ran", At: &past, Job: restart},
+		{Id: "pending", Name: "pending", At: &future, Enabled: true, Job: restart},
+	}}
+	data, err := yaml.Marshal(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobManager := &fakeJobManager{}
+	s := newTestScheduler(t, path, jobManager)
+	if got := s.GetSchedule("missed"); got.Enabled || got.NextRun != nil {
+		t.Errorf("missed schedule: enabled = %v, next run = %v, want disabled", got.Enabled, got.NextRun)
+	}
+	if got := s.GetSchedule("pending"); !got.Enabled || got.NextRun == nil || !got.NextRun.Equal(future) {
+		t.Errorf("pending schedule: enabled = %v, next run = %v, want %v", got.Enabled, got.NextRun, future)
+	}
+	history := s.GetHistory("")
+	if len(history) != 1 || history[0].ScheduleId != "missed" || !history[0].Missed || !history[0].Started.Equal(past) {
+		t.Fatalf("GetHistory() = %+v, want a missed run of the missed schedule", history)
+	}
+	s.runDue(time.Now())
+	if len(jobManager.started) != 0 {
+		t.Errorf("started = %v, want no job", jobManager.started)
+	}
+
+	// The missed run was saved, and isn't recorded again on the next start.
+	reloaded := newTestScheduler(t, path, jobManager)
+	if got := reloaded.GetSchedule("missed"); got.Enabled {
+		t.Errorf("reloaded missed schedule is enabled")
+	}
+	if got := reloaded.GetHistory(""); len(got) != 1 || !got[0].Missed {
+		t.Errorf("reloaded GetHistory() = %+v, want the missed run", got)
+	}
+}
@@ -0,0 +1,113 @@
+package simulator
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"htManager/internal/devices"
+	"sync"
+	"time"
+)
+
+// Connection is the MQTT connection used by a simulated device.
+type Connection interface {
+	Publish(topic string, retained bool, payload []byte) error
+	Subscribe(topic string, handler func(topic string, payload []byte)) error
+	Close()
+}
+
+// ConnectionFactory creates a connection for a device, the will message is published by the broker if the
+// connection is lost.
+type ConnectionFactory func(clientId string, willTopic string, willPayload []byte) (Connection, error)
+
+type mqttConnection struct {
+	client mqtt.Client
+}
+
+// NewMQTTConnectionFactory returns a factory connecting to the MQTT broker at the given url (e.g. tcp://localhost:1883).
+func NewMQTTConnectionFactory(broker string) ConnectionFactory {
+	return func(clientId string, willTopic string, willPayload []byte) (Connection, error) {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(broker)
+		opts.SetClientID(clientId)
+		opts.SetAutoReconnect(true)
+		opts.SetBinaryWill(willTopic, willPayload, 0, true)
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			return nil, token.Error()
+		}
+		return &mqttConnection{client: client}, nil
+	}
+}
+
+func (c *mqttConnection) Publish(topic string, retained bool, payload []byte) error {
+	t := c.client.Publish(topic, 0, retained, payload)
+	if !t.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timeout waiting for response from broker")
+	}
+	return t.Error()
+}
+
+func (c *mqttConnection) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	t := c.client.Subscribe(topic, 0, func(client mqtt.Client, message mqtt.Message) {
+		handler(message.Topic(), message.Payload())
+	})
+	if !t.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timeout waiting for response from broker")
+	}
+	return t.Error()
+}
+
+func (c *mqttConnection) Close() {
+	c.client.Disconnect(250)
+}
+
+type memoryConnection struct {
+	transport *devices.MemoryTransport
+	incoming  chan func()
+	// done stops the handling of messages, incoming isn't closed as the broker may still be delivering to it.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryConnectionFactory returns a factory connecting devices to an in-process broker, for use in tests.
+// Messages are handled on a separate goroutine, as they would be for a network connection, so that a device
+// publishing to a topic it is subscribed to does not deadlock.
+func NewMemoryConnectionFactory(broker *devices.MemoryBroker) ConnectionFactory {
+	return func(clientId string, willTopic string, willPayload []byte) (Connection, error) {
+		transport := broker.NewTransport()
+		transport.SetWill(willTopic, 0, true, willPayload)
+		if err := transport.Connect(nil); err != nil {
+			return nil, err
+		}
+		c := &memoryConnection{transport: transport, incoming: make(chan func(), 1024), done: make(chan struct{})}
+		go func() {
+			for {
+				select {
+				case handle := <-c.incoming:
+					handle()
+				case <-c.done:
+					return
+				}
+			}
+		}()
+		return c, nil
+	}
+}
+
+func (c *memoryConnection) Publish(topic string, retained bool, payload []byte) error {
+	return c.transport.Publish(topic, 0, retained, payload)
+}
+
+func (c *memoryConnection) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	return c.transport.Subscribe(topic, 0, func(message devices.Message) {
+		select {
+		case c.incoming <- func() { handler(message.Topic, message.Payload) }:
+		case <-c.done:
+		}
+	})
+}
+
+func (c *memoryConnection) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.transport.Disconnect()
+}
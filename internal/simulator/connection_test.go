@@ -0,0 +1,55 @@
+package simulator
+
+import (
+	"htManager/internal/devices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryConnection_CloseWhileDelivering(t *testing.T) {
+	broker := devices.NewMemoryBroker()
+	factory := NewMemoryConnectionFactory(broker)
+	publisher := broker.NewTransport()
+	if err := publisher.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				publisher.Publish("homething/5e000000/device/ctrl", 0, false, []byte("restart"))
+			}
+		}
+	}()
+	// Messages being delivered when a connection is closed must not be sent to it.
+	for i := 0; i < 50; i++ {
+		conn, err := factory("device", "homething/5e000000/device/status", []byte(statusOffline))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan struct{}, 1)
+		if err := conn.Subscribe("homething/5e000000/device/ctrl", func(string, []byte) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+		conn.Close()
+	}
+	close(stop)
+	wg.Wait()
+}
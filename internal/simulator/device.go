@@ -0,0 +1,330 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"htManager/internal/devices"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// ElementConfig describes one of the topics exposed by a device, an empty name in Pub or Sub refers to the
+// element topic itself.
+type ElementConfig struct {
+	Name string            `yaml:"name"`
+	Pub  devices.TopicInfo `yaml:"pub"`
+	Sub  devices.TopicInfo `yaml:"sub"`
+}
+
+type DeviceConfig struct {
+	Id           string          `yaml:"id"`
+	Description  string          `yaml:"description"`
+	IPAddr       string          `yaml:"ip"`
+	DeviceType   string          `yaml:"device"`
+	Version      string          `yaml:"version"`
+	Memory       uint            `yaml:"mem"`
+	Capabilities []string        `yaml:"capabilities"`
+	Profile      string          `yaml:"profile"`
+	Elements     []ElementConfig `yaml:"elements"`
+}
+
+// Failures controls the faults injected by a simulated device on each tick.
+type Failures struct {
+	// RebootChance is the probability of the device rebooting spontaneously.
+	RebootChance float64 `yaml:"rebootChance"`
+	// MemoryLeak is the number of bytes of free memory lost, the device reboots when it runs out.
+	MemoryLeak uint `yaml:"memoryLeak"`
+	// SilentChance is the probability of the device stopping sending diag messages for SilentFor.
+	SilentChance float64       `yaml:"silentChance"`
+	SilentFor    time.Duration `yaml:"silentFor"`
+}
+
+// Device simulates a homething device, publishing its state and responding to ctrl commands.
+type Device struct {
+	config      DeviceConfig
+	failures    Failures
+	factory     ConnectionFactory
+	random      *rand.Rand
+	lock        sync.Mutex
+	conn        Connection
+	uptime      time.Duration
+	memFree     uint
+	memLow      uint
+	profile     string
+	values      map[string]string
+	silentUntil time.Time
+	commands    []string
+}
+
+func NewDevice(config DeviceConfig, failures Failures, factory ConnectionFactory) *Device {
+	d := &Device{
+		config:   config,
+		failures: failures,
+		factory:  factory,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		profile:  config.Profile,
+		values:   map[string]string{},
+	}
+	for _, element := range config.Elements {
+		for pub := range element.Pub {
+			d.values[elementTopic(element.Name, pub)] = "0"
+		}
+	}
+	return d
+}
+
+func (d *Device) Id() string {
+	return d.config.Id
+}
+
+func (d *Device) topic(subtopic string) string {
+	return fmt.Sprintf("homething/%s/%s", d.config.Id, subtopic)
+}
+
+// Start connects the device and publishes its initial state.
+func (d *Device) Start() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	conn, err := d.factory(fmt.Sprintf("homething-%s", d.config.Id), d.topic("device/status"), []byte(statusOffline))
+	if err != nil {
+		return err
+	}
+	d.conn = conn
+	if err := conn.Subscribe(d.topic("device/ctrl"), d.handleCtrl); err != nil {
+		return err
+	}
+	for _, element := range d.config.Elements {
+		for sub := range element.Sub {
+			if err := conn.Subscribe(d.topic(elementTopic(element.Name, sub)), d.handleSub); err != nil {
+				return err
+			}
+		}
+	}
+	d.boot()
+	return nil
+}
+
+// Stop disconnects the device after publishing that it is offline.
+func (d *Device) Stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn == nil {
+		return
+	}
+	d.publish("device/status", true, []byte(statusOffline))
+	d.conn.Close()
+	d.conn = nil
+}
+
+// Commands returns the ctrl commands received by the device.
+func (d *Device) Commands() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string(nil), d.commands...)
+}
+
+func (d *Device) Version() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.config.Version
+}
+
+func (d *Device) Profile() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.profile
+}
+
+// Reboot restarts the device, resetting its uptime and memory.
+func (d *Device) Reboot() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.reboot()
+}
+
+// GoSilent stops the device publishing diag messages for the given duration.
+func (d *Device) GoSilent(duration time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.silentUntil = time.Now().Add(duration)
+}
+
+// Tick advances the device's clock, injects failures and publishes its diag and topic values.
+func (d *Device) Tick(elapsed time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn == nil {
+		return
+	}
+	d.uptime += elapsed
+	if d.failures.MemoryLeak > 0 {
+		if d.memFree <= d.failures.MemoryLeak {
+			log.Printf("%s: out of memory, rebooting\n", d.config.Id)
+			d.reboot()
+			return
+		}
+		d.memFree -= d.failures.MemoryLeak
+		d.memLow = min(d.memLow, d.memFree)
+	}
+	if d.failures.RebootChance > 0 && d.random.Float64() < d.failures.RebootChance {
+		log.Printf("%s: rebooting\n", d.config.Id)
+		d.reboot()
+		return
+	}
+	if d.failures.SilentChance > 0 && d.random.Float64() < d.failures.SilentChance {
+		log.Printf("%s: going silent for %s\n", d.config.Id, d.failures.SilentFor)
+		d.silentUntil = time.Now().Add(d.failures.SilentFor)
+	}
+	if time.Now().Before(d.silentUntil) {
+		return
+	}
+	d.publishDiag()
+	for _, element := range d.config.Elements {
+		for pub := range element.Pub {
+			d.setValue(elementTopic(element.Name, pub), fmt.Sprintf("%.1f", 15+d.random.Float64()*10))
+		}
+	}
+}
+
+// reboot must be called with the lock held.
+func (d *Device) reboot() {
+	d.publish("device/status", true, []byte(statusOffline))
+	d.boot()
+}
+
+// boot publishes the state of a freshly started device, it must be called with the lock held.
+func (d *Device) boot() {
+	d.uptime = 0
+	d.memFree = d.config.Memory * 1024 / 2
+	d.memLow = d.memFree
+	d.silentUntil = time.Time{}
+
+	info := devices.RawDeviceInfo{
+		IpAddr:       d.config.IPAddr,
+		Description:  d.config.Description,
+		Device:       d.config.DeviceType,
+		Memory:       d.config.Memory,
+		Version:      d.config.Version,
+		Capabilities: strings.Join(d.config.Capabilities, ","),
+	}
+	d.publishJSON("device/info", info)
+	d.publish("device/status", true, []byte(statusOnline))
+	d.publishTopics()
+	d.publishProfile()
+	d.publishDiag()
+	for topic, value := range d.values {
+		d.publish(topic, true, []byte(value))
+	}
+}
+
+func (d *Device) publishDiag() {
+	diag := devices.DeviceDiag{
+		Uptime:  uint(d.uptime.Seconds()),
+		MemInfo: devices.DeviceDiagMemInfo{Free: d.memFree, Low: d.memLow},
+		TaskInfo: []devices.DeviceDiagStackInfo{
+			{Name: "main", StackMinLeft: 1024},
+		},
+	}
+	d.publishJSON("device/diag", diag)
+}
+
+func (d *Device) publishTopics() {
+	topics := devices.RawTopicsInfo{
+		TopicDescription: []devices.TopicDescription{},
+		Topics:           []devices.RawElementTopicInfo{},
+	}
+	for idx, element := range d.config.Elements {
+		topics.TopicDescription = append(topics.TopicDescription, devices.TopicDescription{Pub: element.Pub, Sub: element.Sub})
+		topics.Topics = append(topics.Topics, devices.RawElementTopicInfo{Name: element.Name, Index: idx})
+	}
+	d.publishJSON("device/topics", topics)
+}
+
+func (d *Device) publishProfile() {
+	profile := devices.Profile{Version: "1.0", Profile: map[string]devices.ProfileEntries{}}
+	if err := yaml.Unmarshal([]byte(d.profile), profile.Profile); err != nil {
+		log.Printf("%s: invalid profile %s\n", d.config.Id, err)
+		return
+	}
+	d.publishJSON("device/profile", profile)
+}
+
+func (d *Device) setValue(topic string, value string) {
+	d.values[topic] = value
+	d.publish(topic, true, []byte(value))
+}
+
+func (d *Device) publishJSON(subtopic string, value any) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("%s: failed to marshal %s: %s\n", d.config.Id, subtopic, err)
+		return
+	}
+	d.publish(subtopic, true, payload)
+}
+
+func (d *Device) publish(subtopic string, retained bool, payload []byte) {
+	if d.conn == nil {
+		return
+	}
+	if err := d.conn.Publish(d.topic(subtopic), retained, payload); err != nil {
+		log.Printf("%s: failed to publish %s: %s\n", d.config.Id, subtopic, err)
+	}
+}
+
+func (d *Device) handleCtrl(topic string, payload []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	command, args, _ := bytes.Cut(payload, []byte{0})
+	d.commands = append(d.commands, string(command))
+	switch {
+	case string(command) == "restart":
+		d.reboot()
+	case strings.HasPrefix(string(command), "update "):
+		d.config.Version = strings.TrimPrefix(string(command), "update ")
+		d.reboot()
+	case string(command) == "setprofile":
+		profile := devices.Profile{}
+		if err := json.Unmarshal(args, &profile); err != nil {
+			log.Printf("%s: invalid setprofile payload: %s\n", d.config.Id, err)
+			return
+		}
+		profileYAML, err := yaml.Marshal(profile.Profile)
+		if err != nil {
+			log.Printf("%s: failed to convert profile: %s\n", d.config.Id, err)
+			return
+		}
+		d.profile = string(profileYAML)
+		d.reboot()
+	default:
+		log.Printf("%s: unknown command %q\n", d.config.Id, command)
+	}
+}
+
+// handleSub treats writes to a sub topic with the same name as a pub topic as setting its value.
+func (d *Device) handleSub(topic string, payload []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	subtopic := strings.TrimPrefix(topic, d.topic(""))
+	// The device sees its own publishes to the topic, so only changes are acted on.
+	if value, ok := d.values[subtopic]; ok && value != string(payload) {
+		d.setValue(subtopic, string(payload))
+	}
+}
+
+func elementTopic(name string, topic string) string {
+	if topic == "" {
+		return name
+	}
+	return name + "/" + topic
+}
@@ -0,0 +1,144 @@
+package simulator
+
+import (
+	"encoding/json"
+	"htManager/internal/devices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeConnection struct {
+	lock      sync.Mutex
+	published map[string][]byte
+	handlers  map[string]func(topic string, payload []byte)
+}
+
+func (c *fakeConnection) Publish(topic string, retained bool, payload []byte) error {
+	c.lock.Lock()
+	c.published[topic] = payload
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *fakeConnection) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	c.lock.Lock()
+	c.handlers[topic] = handler
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *fakeConnection) Close() {}
+
+func (c *fakeConnection) send(topic string, payload []byte) {
+	c.lock.Lock()
+	handler := c.handlers[topic]
+	c.lock.Unlock()
+	handler(topic, payload)
+}
+
+func (c *fakeConnection) diag(t *testing.T, deviceId string) devices.DeviceDiag {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	diag := devices.DeviceDiag{}
+	if err := json.Unmarshal(c.published["homething/"+deviceId+"/device/diag"], &diag); err != nil {
+		t.Fatalf("invalid diag: %s", err)
+	}
+	return diag
+}
+
+func (c *fakeConnection) value(topic string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return string(c.published[topic])
+}
+
+func newTestDevice(t *testing.T, failures Failures) (*Device, *fakeConnection) {
+	conn := &fakeConnection{published: map[string][]byte{}, handlers: map[string]func(string, []byte){}}
+	config := DefaultFleetConfig(1).Groups[0].Device
+	config.Id = "5e000000"
+	device := NewDevice(config, failures, func(clientId string, willTopic string, willPayload []byte) (Connection, error) {
+		return conn, nil
+	})
+	if err := device.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return device, conn
+}
+
+func TestDevice_Commands(t *testing.T) {
+	device, conn := newTestDevice(t, Failures{})
+	device.Tick(time.Minute)
+	if diag := conn.diag(t, "5e000000"); diag.Uptime != 60 {
+		t.Fatalf("uptime = %d, want 60", diag.Uptime)
+	}
+
+	conn.send("homething/5e000000/device/ctrl", []byte("update v2.0.0"))
+	if version := device.Version(); version != "v2.0.0" {
+		t.Errorf("version = %s, want v2.0.0", version)
+	}
+	if diag := conn.diag(t, "5e000000"); diag.Uptime != 0 {
+		t.Errorf("uptime after update = %d, want 0", diag.Uptime)
+	}
+
+	conn.send("homething/5e000000/device/ctrl", []byte("setprofile\x00{\"version\":\"1.0\",\"components\":{\"relay\":[{\"pin\":5}]}}"))
+	if profile := device.Profile(); profile != "relay:\n- pin: 5\n" {
+		t.Errorf("profile = %q", profile)
+	}
+	conn.send("homething/5e000000/relay/state", []byte("1"))
+	if value := conn.value("homething/5e000000/relay/state"); value != "1" {
+		t.Errorf("relay/state = %s, want 1", value)
+	}
+}
+
+func TestDevice_MemoryLeak(t *testing.T) {
+	device, conn := newTestDevice(t, Failures{MemoryLeak: 20 * 1024})
+	device.Tick(time.Minute)
+	if diag := conn.diag(t, "5e000000"); diag.MemInfo.Free != 20*1024 || diag.Uptime != 60 {
+		t.Fatalf("diag = %+v, want 20KiB free after a minute", diag)
+	}
+	device.Tick(time.Minute)
+	if diag := conn.diag(t, "5e000000"); diag.Uptime != 0 {
+		t.Errorf("uptime = %d, want reboot when out of memory", diag.Uptime)
+	}
+}
+
+func TestDevice_Failures(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   Failures
+		wantUptime uint
+		wantStatus string
+	}{
+		{name: "None", failures: Failures{}, wantUptime: 60, wantStatus: statusOnline},
+		{name: "Reboot", failures: Failures{RebootChance: 1}, wantUptime: 0, wantStatus: statusOnline},
+		// The diag published when the device started isn't updated while it is silent.
+		{name: "Silent", failures: Failures{SilentChance: 1, SilentFor: time.Hour}, wantUptime: 0, wantStatus: statusOnline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, conn := newTestDevice(t, tt.failures)
+			device.Tick(time.Minute)
+			if diag := conn.diag(t, "5e000000"); diag.Uptime != tt.wantUptime {
+				t.Errorf("uptime = %d, want %d", diag.Uptime, tt.wantUptime)
+			}
+			if status := conn.value("homething/5e000000/device/status"); status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDevice_SilentEnds(t *testing.T) {
+	device, conn := newTestDevice(t, Failures{})
+	device.GoSilent(50 * time.Millisecond)
+	device.Tick(time.Minute)
+	if diag := conn.diag(t, "5e000000"); diag.Uptime != 0 {
+		t.Fatalf("uptime while silent = %d, want the diag from boot", diag.Uptime)
+	}
+	time.Sleep(60 * time.Millisecond)
+	device.Tick(time.Minute)
+	if diag := conn.diag(t, "5e000000"); diag.Uptime != 120 {
+		t.Errorf("uptime after silence = %d, want 120", diag.Uptime)
+	}
+}
@@ -0,0 +1,171 @@
+package simulator
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFleetSize is the number of devices numbered by the four hex digits following the id prefixes.
+const maxFleetSize = 0x10000
+
+var InvalidFleetConfigError = errors.New("invalid fleet config")
+
+// GroupConfig describes Count identical devices. Device.Id is a hex prefix for the device ids, which are numbered
+// across the fleet, and Description and IPAddr may contain a %d which is replaced by the device's index in the fleet.
+type GroupConfig struct {
+	Count    int          `yaml:"count"`
+	Device   DeviceConfig `yaml:"device"`
+	Failures Failures     `yaml:"failures"`
+}
+
+type FleetConfig struct {
+	DiagInterval time.Duration `yaml:"diagInterval"`
+	Groups       []GroupConfig `yaml:"groups"`
+}
+
+// DefaultFleetConfig returns a fleet of count temperature sensors.
+func DefaultFleetConfig(count int) FleetConfig {
+	return FleetConfig{
+		DiagInterval: 30 * time.Second,
+		Groups: []GroupConfig{
+			{
+				Count: count,
+				Device: DeviceConfig{
+					Id:           "5e00",
+					Description:  "Simulated sensor %d",
+					IPAddr:       "10.0.0.%d",
+					DeviceType:   "esp8266",
+					Version:      "v1.0.0",
+					Memory:       80,
+					Capabilities: []string{"flash4MB"},
+					Profile:      "dht22:\n- name: temperature\n  pin: 4\n",
+					Elements: []ElementConfig{
+						{Name: "temperature", Pub: map[string]int{"temperature": 0, "humidity": 0}},
+						{Name: "relay", Pub: map[string]int{"state": 0}, Sub: map[string]int{"state": 0}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func LoadFleetConfig(path string) (FleetConfig, error) {
+	config := FleetConfig{DiagInterval: 30 * time.Second}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// Fleet is a set of simulated devices which are ticked together.
+type Fleet struct {
+	Devices      []*Device
+	diagInterval time.Duration
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+func NewFleet(config FleetConfig, factory ConnectionFactory) (*Fleet, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	fleet := &Fleet{diagInterval: config.DiagInterval, stop: make(chan struct{})}
+	index := 0
+	for _, group := range config.Groups {
+		for i := 0; i < group.Count; i++ {
+			// The number is shared by the groups, so that groups with the same prefix don't give the same ids.
+			deviceConfig := group.Device
+			deviceConfig.Id = fmt.Sprintf("%s%04x", group.Device.Id, index)
+			index++
+			deviceConfig.Description = expandIndex(group.Device.Description, index)
+			deviceConfig.IPAddr = expandIndex(group.Device.IPAddr, index)
+			fleet.Devices = append(fleet.Devices, NewDevice(deviceConfig, group.Failures, factory))
+		}
+	}
+	return fleet, nil
+}
+
+func (c *FleetConfig) validate() error {
+	total := 0
+	for _, group := range c.Groups {
+		if _, err := hex.DecodeString(group.Device.Id); err != nil {
+			return fmt.Errorf("%w: id prefix %q isn't an even number of hex digits", InvalidFleetConfigError, group.Device.Id)
+		}
+		if group.Count < 0 {
+			return fmt.Errorf("%w: negative count for %q", InvalidFleetConfigError, group.Device.Id)
+		}
+		total += group.Count
+	}
+	if total > maxFleetSize {
+		return fmt.Errorf("%w: %d devices, at most %d can be simulated", InvalidFleetConfigError, total, maxFleetSize)
+	}
+	return nil
+}
+
+func expandIndex(value string, index int) string {
+	if strings.Contains(value, "%d") {
+		return fmt.Sprintf(value, index)
+	}
+	return value
+}
+
+// Device returns the simulated device with the given id or nil.
+func (f *Fleet) Device(deviceId string) *Device {
+	for _, device := range f.Devices {
+		if device.Id() == deviceId {
+			return device
+		}
+	}
+	return nil
+}
+
+// Start connects all the devices and, if the diag interval is not zero, ticks them periodically until Stop is called.
+func (f *Fleet) Start() error {
+	for _, device := range f.Devices {
+		if err := device.Start(); err != nil {
+			return fmt.Errorf("%s: %w", device.Id(), err)
+		}
+	}
+	if f.diagInterval <= 0 {
+		return nil
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := time.NewTicker(f.diagInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.Tick(f.diagInterval)
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *Fleet) Tick(elapsed time.Duration) {
+	for _, device := range f.Devices {
+		device.Tick(elapsed)
+	}
+}
+
+func (f *Fleet) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+	for _, device := range f.Devices {
+		device.Stop()
+	}
+}
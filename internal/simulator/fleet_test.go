@@ -0,0 +1,45 @@
+package simulator
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewFleet(t *testing.T) {
+	group := func(prefix string, count int) GroupConfig {
+		return GroupConfig{Count: count, Device: DeviceConfig{Id: prefix, Description: "Sensor %d"}}
+	}
+	tests := []struct {
+		name    string
+		groups  []GroupConfig
+		want    []string
+		wantErr error
+	}{
+		{name: "One group", groups: []GroupConfig{group("5e00", 2)}, want: []string{"5e000000", "5e000001"}},
+		{name: "Same prefix", groups: []GroupConfig{group("5e00", 2), group("5e00", 1)},
+			want: []string{"5e000000", "5e000001", "5e000002"}},
+		{name: "Other prefix", groups: []GroupConfig{group("5e00", 1), group("a1", 1)}, want: []string{"5e000000", "a10001"}},
+		{name: "Not hex", groups: []GroupConfig{group("sim", 1)}, wantErr: InvalidFleetConfigError},
+		{name: "Odd length", groups: []GroupConfig{group("5e0", 1)}, wantErr: InvalidFleetConfigError},
+		{name: "Too many devices", groups: []GroupConfig{group("5e", maxFleetSize), group("5f", 1)}, wantErr: InvalidFleetConfigError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fleet, err := NewFleet(FleetConfig{Groups: tt.groups}, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewFleet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			ids := make([]string, 0, len(fleet.Devices))
+			for _, device := range fleet.Devices {
+				ids = append(ids, device.Id())
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,25 @@
 package updates
 
 import (
+	"errors"
+	"fmt"
 	"htManager/internal/devices"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 )
 
+var InvalidFirmwareNameError = errors.New("invalid firmware file name")
+
+// firmwareName matches the names of the OTA files, homething.<device type>.[app1.|app2.]<version>.ota
+var firmwareName = regexp.MustCompile(`^homething\.[\w-]+\.(app[12]\.)?[\w.+-]+\.ota$`)
+
 type UpdateManager interface {
 	AvailableUpdatesForDevice(deviceInfo *devices.DeviceInfo) []string
+	// SaveFirmware adds an OTA file to the updates path, replacing any file with the same name.
+	SaveFirmware(name string, r io.Reader) error
 }
 
 type updateManagerImpl struct {
@@ -30,6 +41,26 @@ func (u *updateManagerImpl) AvailableUpdatesForDevice(deviceInfo *devices.Device
 	return findMatches(files, deviceInfo)
 }
 
+func (u *updateManagerImpl) SaveFirmware(name string, r io.Reader) error {
+	if !firmwareName.MatchString(name) {
+		return fmt.Errorf("%w: %q", InvalidFirmwareNameError, name)
+	}
+	// Written to a temporary file first so that a partial upload never replaces a firmware.
+	file, err := os.CreateTemp(u.Path, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(u.Path, name))
+}
+
 func findMatches(files []os.DirEntry, deviceInfo *devices.DeviceInfo) []string {
 	expStr := `homething\.` + deviceInfo.DeviceType + `\.`
 	if deviceInfo.HasCapability(flash1MB) {
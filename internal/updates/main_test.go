@@ -5,6 +5,7 @@ import (
 	"htManager/internal/devices"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -108,3 +109,38 @@ func Test_findMatches(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateManager_SaveFirmware(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr error
+	}{
+		{name: "Firmware", file: "homething.esp32.v1.2.0.ota"},
+		{name: "1MB flash firmware", file: "homething.esp8266.app1.v1.2.0.ota"},
+		{name: "Not a firmware", file: "notes.txt", wantErr: InvalidFirmwareNameError},
+		{name: "Path", file: "../homething.esp32.v1.2.0.ota", wantErr: InvalidFirmwareNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := NewUpdateManager(dir)
+			err := u.SaveFirmware(tt.file, strings.NewReader("firmware"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SaveFirmware() error = %v, want %v", err, tt.wantErr)
+			}
+			entries, _ := os.ReadDir(dir)
+			names := make([]string, 0)
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			want := []string{}
+			if tt.wantErr == nil {
+				want = []string{tt.file}
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("files = %v, want %v", names, want)
+			}
+		})
+	}
+}
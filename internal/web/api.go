@@ -1,14 +1,17 @@
 package web
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"htManager/internal/devices"
+	"htManager/internal/jobs"
 	"htManager/internal/updates"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 type DeviceStatusResponse struct {
@@ -25,6 +28,17 @@ type DeviceTopicValues struct {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// ReasonCode is the MQTT v5 reason code returned by the broker, if the error came from it.
+	ReasonCode *byte `json:"reasonCode,omitempty"`
+}
+
+func newErrorResponse(err error) ErrorResponse {
+	response := ErrorResponse{Error: err.Error()}
+	var reasonCodeError *devices.ReasonCodeError
+	if errors.As(err, &reasonCodeError) {
+		response.ReasonCode = &reasonCodeError.Code
+	}
+	return response
 }
 
 type CommandResponse struct {
@@ -41,15 +55,30 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager updates.UpdateManager) {
+func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager updates.UpdateManager, jobManager jobs.JobManager, events *eventBuffer) {
 	group.GET("/devices", func(context *gin.Context) {
-		context.JSON(http.StatusOK, devices.GetDevices())
+		query, err := parseDeviceQuery(context)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		deviceList, total, err := query.Apply(devices.GetDevices())
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		context.Header("X-Total-Count", strconv.Itoa(total))
+		context.JSON(http.StatusOK, deviceList)
+	})
+
+	group.GET("/brokers", func(context *gin.Context) {
+		context.JSON(http.StatusOK, devices.GetBrokers())
 	})
 
 	group.DELETE("/devices/:deviceId", func(context *gin.Context) {
 		deviceId := context.Param("deviceId")
 		if err := devices.RemoveDevice(deviceId); err != nil {
-			context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			context.JSON(http.StatusInternalServerError, newErrorResponse(err))
 		} else {
 			context.JSON(http.StatusOK, map[string]string{})
 		}
@@ -95,8 +124,8 @@ func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager upda
 		deviceId := context.Param("deviceId")
 		if data, err := io.ReadAll(context.Request.Body); err == nil {
 			profile := string(data)
-			if err := devices.SetDeviceProfile(deviceId, profile); err != nil {
-				context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			if _, err := devices.SetDeviceProfile(deviceId, profile); err != nil {
+				context.JSON(http.StatusInternalServerError, newErrorResponse(err))
 			} else {
 				context.JSON(http.StatusOK, DeviceProfileResponse{Profile: profile})
 			}
@@ -109,15 +138,15 @@ func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager upda
 		deviceId := context.Param("deviceId")
 		switch context.Request.FormValue("command") {
 		case "restart":
-			if err := devices.RebootDevice(deviceId); err != nil {
-				context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			if _, err := devices.RebootDevice(deviceId); err != nil {
+				context.JSON(http.StatusInternalServerError, newErrorResponse(err))
 			} else {
 				context.JSON(http.StatusOK, CommandResponse{Status: "device reboot sent"})
 			}
 		case "update":
 			version := context.Request.FormValue("version")
-			if err := devices.UpdateDevice(deviceId, version); err != nil {
-				context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			if _, err := devices.UpdateDevice(deviceId, version); err != nil {
+				context.JSON(http.StatusInternalServerError, newErrorResponse(err))
 			} else {
 				context.JSON(http.StatusOK, CommandResponse{Status: "device update sent"})
 			}
@@ -126,6 +155,15 @@ func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager upda
 		}
 	})
 
+	group.GET("/devices/:deviceId/commands", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if info := devices.GetDeviceInfo(deviceId); info == nil {
+			context.Status(http.StatusNotFound)
+		} else {
+			context.JSON(http.StatusOK, devices.GetDeviceCommands(deviceId))
+		}
+	})
+
 	group.GET("/devices/:deviceId/update/versions", func(context *gin.Context) {
 		deviceId := context.Param("deviceId")
 		if info := devices.GetDeviceInfo(deviceId); info == nil {
@@ -158,6 +196,16 @@ func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager upda
 	})
 
 	group.GET("/ws", func(context *gin.Context) {
+		query, err := parseDeviceQuery(context)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		resumeFrom, resume, err := parseEventId(context.Query("resume"))
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
 		//upgrade get request to websocket protocol
 		ws, err := upgrader.Upgrade(context.Writer, context.Request, nil)
 		if err != nil {
@@ -166,7 +214,8 @@ func initAPI(group *gin.RouterGroup, devices devices.Devices, updateManager upda
 		}
 		defer ws.Close()
 		log.Println("Handing over to WebSocketConnection")
-		connection := WebSocketConnection{ws: ws, devices: devices}
+		connection := WebSocketConnection{ws: ws, devices: devices, jobs: jobManager, events: events, query: query,
+			resume: resume, resumeFrom: resumeFrom, closing: context.Request.Context().Done()}
 		connection.handleConnection()
 	})
 }
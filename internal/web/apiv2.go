@@ -0,0 +1,330 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"htManager/internal/profiles"
+	"htManager/internal/scheduler"
+	"htManager/internal/updates"
+	"io"
+	"net/http"
+)
+
+// apiV2Prefix is where the v2 API is served. Unlike the v1 routes, it answers every error with an APIError and
+// only accepts JSON request bodies, except for firmware uploads.
+const apiV2Prefix = "/api/v2"
+
+// maxRequestSize is the largest JSON request body accepted by the v2 API.
+const maxRequestSize = 1 << 20
+
+// Codes of the v2 API errors, each answered with its own status.
+const (
+	InvalidRequestCode    = "invalid_request"    // 400
+	UnauthorizedCode      = "unauthorized"       // 401
+	ForbiddenCode         = "forbidden"          // 403
+	NotFoundCode          = "not_found"          // 404
+	ConflictCode          = "conflict"           // 409
+	PayloadTooLargeCode   = "payload_too_large"  // 413
+	ValidationFailedCode  = "validation_failed"  // 422
+	InternalErrorCode     = "internal_error"     // 500
+	BrokerErrorCode       = "broker_error"       // 502
+	BrokerUnavailableCode = "broker_unavailable" // 503
+	BrokerTimeoutCode     = "broker_timeout"     // 504
+)
+
+var (
+	// InvalidRequestError is a request that couldn't be decoded.
+	InvalidRequestError = errors.New("invalid request")
+	// NotFoundError is a resource without a more specific not found error.
+	NotFoundError = errors.New("not found")
+)
+
+// APIError describes why a v2 API request failed, Code is meant for programs and Message for humans.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// ReasonCode is the MQTT v5 reason code returned by the broker, if the error came from it.
+	ReasonCode *byte `json:"reasonCode,omitempty"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type DevicesResponse struct {
+	Devices []devices.DeviceInfo `json:"devices"`
+	// Total is the number of matching devices before offset and limit.
+	Total int `json:"total"`
+}
+
+type CommandsResponse struct {
+	Commands []devices.Command `json:"commands"`
+}
+
+type BrokersResponse struct {
+	Brokers []devices.BrokerStatus `json:"brokers"`
+}
+
+type SetProfileRequest struct {
+	Profile string `json:"profile"`
+}
+
+// DeviceCommandResponse answers a command sent to a device, Command is set when the command is tracked until the
+// device acts on it.
+type DeviceCommandResponse struct {
+	Status  string           `json:"status"`
+	Command *devices.Command `json:"command,omitempty"`
+}
+
+// apiErrorStatus returns the status and code answering err.
+func apiErrorStatus(err error) (int, string) {
+	var maxBytesError *http.MaxBytesError
+	var reasonCodeError *devices.ReasonCodeError
+	switch {
+	case errors.Is(err, InvalidRequestError), errors.Is(err, devices.InvalidSortFieldError),
+		errors.Is(err, jobs.EmptySelectorError):
+		return http.StatusBadRequest, InvalidRequestCode
+	case errors.Is(err, ClientCertificateRequiredError):
+		return http.StatusUnauthorized, UnauthorizedCode
+	case errors.Is(err, FirmwareUploadDisabledError):
+		return http.StatusForbidden, ForbiddenCode
+	case errors.Is(err, NotFoundError),
+		errors.Is(err, devices.DeviceNotFoundError),
+		errors.Is(err, profiles.DeviceNotFoundError),
+		errors.Is(err, profiles.TemplateNotFoundError),
+		errors.Is(err, scheduler.ScheduleNotFoundError):
+		return http.StatusNotFound, NotFoundCode
+	case errors.Is(err, devices.UpdatePendingError):
+		return http.StatusConflict, ConflictCode
+	case errors.As(err, &maxBytesError):
+		return http.StatusRequestEntityTooLarge, PayloadTooLargeCode
+	case errors.Is(err, jobs.InvalidCommandError),
+		errors.Is(err, jobs.NoDevicesSelectedError),
+		errors.Is(err, devices.InvalidProfileError),
+		errors.Is(err, devices.InvalidSubTopicError),
+		errors.Is(err, profiles.InvalidTemplateNameError),
+		errors.Is(err, profiles.InvalidTemplateError),
+		errors.Is(err, profiles.RenderFailedError),
+		errors.Is(err, scheduler.InvalidScheduleError),
+		errors.Is(err, updates.InvalidFirmwareNameError):
+		return http.StatusUnprocessableEntity, ValidationFailedCode
+	case errors.As(err, &reasonCodeError):
+		return http.StatusBadGateway, BrokerErrorCode
+	case errors.Is(err, devices.BrokerUnavailableError), errors.Is(err, devices.NotConnectedError):
+		return http.StatusServiceUnavailable, BrokerUnavailableCode
+	case errors.Is(err, devices.BrokerTimeoutError):
+		return http.StatusGatewayTimeout, BrokerTimeoutCode
+	default:
+		return http.StatusInternalServerError, InternalErrorCode
+	}
+}
+
+func writeAPIError(context *gin.Context, err error) {
+	status, code := apiErrorStatus(err)
+	response := APIErrorResponse{Error: APIError{Code: code, Message: err.Error()}}
+	var reasonCodeError *devices.ReasonCodeError
+	if errors.As(err, &reasonCodeError) {
+		response.Error.ReasonCode = &reasonCodeError.Code
+	}
+	context.AbortWithStatusJSON(status, response)
+}
+
+// decodeJSON decodes the request body into value, rejecting unknown fields.
+func decodeJSON(context *gin.Context, value any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(context.Writer, context.Request.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &maxBytesError):
+		return err
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: missing JSON body", InvalidRequestError)
+	default:
+		return fmt.Errorf("%w: %s", InvalidRequestError, err)
+	}
+}
+
+// deviceDataNotFound returns the error answering a request for data of a device which isn't known, or which hasn't
+// sent it yet.
+func deviceDataNotFound(devicesManager devices.Devices, deviceId string, data string) error {
+	if devicesManager.GetDeviceInfo(deviceId) == nil {
+		return fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId)
+	}
+	return fmt.Errorf("%w: no %s for %s", NotFoundError, data, deviceId)
+}
+
+// sendDeviceCommand sends a command to a known device and answers with the command, tracked until the device acts on
+// it.
+func sendDeviceCommand(context *gin.Context, devicesManager devices.Devices, deviceId string, command jobs.Command) {
+	if devicesManager.GetDeviceInfo(deviceId) == nil {
+		writeAPIError(context, fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId))
+		return
+	}
+	if err := command.Validate(); err != nil {
+		writeAPIError(context, err)
+		return
+	}
+	commandId, err := command.Execute(devicesManager, deviceId)
+	if err != nil {
+		writeAPIError(context, err)
+		return
+	}
+	response := DeviceCommandResponse{Status: CommandSent}
+	commands := devicesManager.GetDeviceCommands(deviceId)
+	for idx := range commands {
+		if commandId != "" && commands[idx].Id == commandId {
+			response.Command = &commands[idx]
+		}
+	}
+	context.JSON(http.StatusAccepted, response)
+}
+
+func initAPIv2(group *gin.RouterGroup, devicesManager devices.Devices, updateManager updates.UpdateManager) {
+	group.GET("/devices", func(context *gin.Context) {
+		query, err := parseDeviceQuery(context)
+		if err != nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", InvalidRequestError, err))
+			return
+		}
+		deviceList, total, err := query.Apply(devicesManager.GetDevices())
+		if err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		context.JSON(http.StatusOK, DevicesResponse{Devices: deviceList, Total: total})
+	})
+
+	group.GET("/brokers", func(context *gin.Context) {
+		context.JSON(http.StatusOK, BrokersResponse{Brokers: devicesManager.GetBrokers()})
+	})
+
+	group.GET("/devices/:deviceId", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if info := devicesManager.GetDeviceInfo(deviceId); info == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId))
+		} else {
+			context.JSON(http.StatusOK, info)
+		}
+	})
+
+	group.DELETE("/devices/:deviceId", func(context *gin.Context) {
+		if err := devicesManager.RemoveDevice(context.Param("deviceId")); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.Status(http.StatusNoContent)
+		}
+	})
+
+	group.GET("/devices/:deviceId/diag", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if diag := devicesManager.GetDeviceDiag(deviceId); diag == nil {
+			writeAPIError(context, deviceDataNotFound(devicesManager, deviceId, "diag"))
+		} else {
+			context.JSON(http.StatusOK, diag)
+		}
+	})
+
+	group.GET("/devices/:deviceId/status", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if status := devicesManager.GetDeviceStatus(deviceId); status == nil {
+			writeAPIError(context, deviceDataNotFound(devicesManager, deviceId, "status"))
+		} else {
+			context.JSON(http.StatusOK, DeviceStatusResponse{Status: *status})
+		}
+	})
+
+	group.GET("/devices/:deviceId/profile", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if profile := devicesManager.GetDeviceProfile(deviceId); profile == nil {
+			writeAPIError(context, deviceDataNotFound(devicesManager, deviceId, "profile"))
+		} else {
+			context.JSON(http.StatusOK, DeviceProfileResponse{Profile: *profile})
+		}
+	})
+
+	group.PUT("/devices/:deviceId/profile", func(context *gin.Context) {
+		request := SetProfileRequest{}
+		if err := decodeJSON(context, &request); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		sendDeviceCommand(context, devicesManager, context.Param("deviceId"),
+			jobs.Command{Command: jobs.SetProfileCommand, Profile: request.Profile})
+	})
+
+	group.GET("/devices/:deviceId/commands", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if devicesManager.GetDeviceInfo(deviceId) == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId))
+		} else {
+			context.JSON(http.StatusOK, CommandsResponse{Commands: devicesManager.GetDeviceCommands(deviceId)})
+		}
+	})
+
+	group.POST("/devices/:deviceId/commands", func(context *gin.Context) {
+		command := jobs.Command{}
+		if err := decodeJSON(context, &command); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		sendDeviceCommand(context, devicesManager, context.Param("deviceId"), command)
+	})
+
+	group.GET("/devices/:deviceId/versions", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if info := devicesManager.GetDeviceInfo(deviceId); info == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId))
+		} else {
+			context.JSON(http.StatusOK, VersionsResponse{Versions: updateManager.AvailableUpdatesForDevice(info)})
+		}
+	})
+
+	group.GET("/devices/:deviceId/topics", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if topics := devicesManager.GetDeviceTopics(deviceId); topics == nil {
+			writeAPIError(context, deviceDataNotFound(devicesManager, deviceId, "topics"))
+		} else {
+			context.JSON(http.StatusOK, topics)
+		}
+	})
+
+	group.GET("/devices/:deviceId/topics/values", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if values := devicesManager.GetDeviceTopicValues(deviceId); values == nil {
+			writeAPIError(context, deviceDataNotFound(devicesManager, deviceId, "topic values"))
+		} else {
+			context.JSON(http.StatusOK, DeviceTopicValues{Values: values})
+		}
+	})
+
+	group.GET("/devices/:deviceId/metadata", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if devicesManager.GetDeviceInfo(deviceId) == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", devices.DeviceNotFoundError, deviceId))
+		} else if metadata := devicesManager.GetDeviceMetadata(deviceId); metadata == nil {
+			context.JSON(http.StatusOK, devices.DeviceMetadata{})
+		} else {
+			context.JSON(http.StatusOK, metadata)
+		}
+	})
+
+	group.PUT("/devices/:deviceId/metadata", func(context *gin.Context) {
+		metadata := devices.DeviceMetadata{}
+		if err := decodeJSON(context, &metadata); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		if err := devicesManager.SetDeviceMetadata(context.Param("deviceId"), metadata); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusOK, metadata)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func publishTestDevice(t *testing.T, broker *devices.MemoryBroker, deviceId string) {
+	t.Helper()
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	info := `{"ip":"10.0.0.2","description":"Hall","device":"esp32","mem":80,"version":"v1.0.0","capabilities":"ota"}`
+	if err := device.Publish("homething/"+deviceId+"/device/info", 0, true, []byte(info)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIv2(t *testing.T) {
+	router, broker := newTestRouter(t, ServerConfig{})
+	publishTestDevice(t, broker, "a1b2c3")
+	// The cases run in order against the same router.
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "Device", method: "GET", path: "/devices/a1b2c3", wantStatus: http.StatusOK},
+		{name: "Unknown device", method: "GET", path: "/devices/d4e5f6", wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+		{name: "No profile yet", method: "GET", path: "/devices/a1b2c3/profile", wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+		{name: "Invalid sort", method: "GET", path: "/devices?sort=colour", wantStatus: http.StatusBadRequest, wantCode: InvalidRequestCode},
+		{name: "Malformed body", method: "POST", path: "/devices/a1b2c3/commands", body: `{"command":`,
+			wantStatus: http.StatusBadRequest, wantCode: InvalidRequestCode},
+		{name: "Unknown field", method: "POST", path: "/devices/a1b2c3/commands", body: `{"command":"restart","delay":5}`,
+			wantStatus: http.StatusBadRequest, wantCode: InvalidRequestCode},
+		{name: "Unknown command", method: "POST", path: "/devices/a1b2c3/commands", body: `{"command":"explode"}`,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: ValidationFailedCode},
+		{name: "Command to unknown device", method: "POST", path: "/devices/d4e5f6/commands", body: `{"command":"restart"}`,
+			wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+		{name: "Update", method: "POST", path: "/devices/a1b2c3/commands", body: `{"command":"update","version":"v1.1.0"}`,
+			wantStatus: http.StatusAccepted},
+		{name: "Update pending", method: "POST", path: "/devices/a1b2c3/commands", body: `{"command":"update","version":"v1.2.0"}`,
+			wantStatus: http.StatusConflict, wantCode: ConflictCode},
+		{name: "Invalid profile", method: "PUT", path: "/devices/a1b2c3/profile", body: `{"profile":"relay: [pin"}`,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: ValidationFailedCode},
+		{name: "Unknown job", method: "GET", path: "/jobs/42", wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+		{name: "Job without devices", method: "POST", path: "/jobs", body: `{"command":"restart","selector":{"group":"attic"}}`,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: ValidationFailedCode},
+		{name: "Job without selector", method: "POST", path: "/jobs", body: `{"command":"restart"}`,
+			wantStatus: http.StatusBadRequest, wantCode: InvalidRequestCode},
+		{name: "Remove", method: "DELETE", path: "/devices/a1b2c3", wantStatus: http.StatusNoContent},
+		{name: "Remove unknown device", method: "DELETE", path: "/devices/a1b2c3", wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+		{name: "Unknown route", method: "GET", path: "/gadgets", wantStatus: http.StatusNotFound, wantCode: NotFoundCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(tt.method, apiV2Prefix+tt.path, strings.NewReader(tt.body))
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			response := APIErrorResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid error response %q: %s", recorder.Body, err)
+			}
+			if response.Error.Code != tt.wantCode || response.Error.Message == "" {
+				t.Errorf("error = %+v, want code %s", response.Error, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAPIv2_Commands(t *testing.T) {
+	router, broker := newTestRouter(t, ServerConfig{})
+	publishTestDevice(t, broker, "a1b2c3")
+	tests := []struct {
+		name        string
+		body        string
+		wantCommand string
+	}{
+		{name: "Restart", body: `{"command":"restart"}`, wantCommand: "restart"},
+		{name: "Restart again", body: `{"command":"restart"}`, wantCommand: "restart"},
+		{name: "Update", body: `{"command":"update","version":"v1.1.0"}`, wantCommand: "update"},
+	}
+	sent := map[string]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", apiV2Prefix+"/devices/a1b2c3/commands", strings.NewReader(tt.body))
+			router.ServeHTTP(recorder, request)
+			response := DeviceCommandResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusAccepted {
+				t.Fatalf("response = %d %s, want 202", recorder.Code, recorder.Body)
+			}
+			if response.Command == nil || response.Command.Name != tt.wantCommand || sent[response.Command.Id] {
+				t.Fatalf("command = %+v, want a new %s", response.Command, tt.wantCommand)
+			}
+			sent[response.Command.Id] = true
+		})
+	}
+}
+
+func TestWriteAPIError_Broker(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantReasonCode bool
+	}{
+		{
+			name:       "Timeout",
+			err:        fmt.Errorf("publish: %w", devices.BrokerTimeoutError),
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   BrokerTimeoutCode,
+		},
+		{
+			name:           "Reason code",
+			err:            &devices.ReasonCodeError{Code: 0x87},
+			wantStatus:     http.StatusBadGateway,
+			wantCode:       BrokerErrorCode,
+			wantReasonCode: true,
+		},
+		{
+			name:       "Not connected",
+			err:        devices.NotConnectedError,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   BrokerUnavailableCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			context, _ := gin.CreateTestContext(recorder)
+			writeAPIError(context, tt.err)
+			response := APIErrorResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != tt.wantStatus || response.Error.Code != tt.wantCode ||
+				(response.Error.ReasonCode != nil) != tt.wantReasonCode {
+				t.Errorf("writeAPIError() = %d %+v, want %d %s", recorder.Code, response.Error, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
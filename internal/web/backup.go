@@ -0,0 +1,45 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/backup"
+	"htManager/internal/devices"
+	"log"
+	"net/http"
+	"time"
+)
+
+type RestoreResponse struct {
+	Results []devices.DeviceResult `json:"results"`
+}
+
+func initBackupAPI(group *gin.RouterGroup, devices devices.Devices) {
+	group.GET("/backup", func(context *gin.Context) {
+		// The archive is built before answering, so that a failed export isn't sent as a truncated archive.
+		archive := bytes.Buffer{}
+		if err := backup.Export(devices, &archive); err != nil {
+			log.Printf("Failed to export backup: %s\n", err)
+			context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		filename := fmt.Sprintf("htmanager-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+		context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		context.Data(http.StatusOK, "application/gzip", archive.Bytes())
+	})
+
+	group.POST("/restore", func(context *gin.Context) {
+		selector, err := parseDeviceSelector(context)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		results, err := backup.Restore(devices, context.Request.Body, selector)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, RestoreResponse{Results: results})
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package web
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBufferSize is the number of events kept for clients resuming a stream.
+	eventBufferSize = 1000
+	// eventListenerSize is the number of events a stream can fall behind by before it is closed.
+	eventListenerSize = 256
+	// sseKeepAlive is the interval between comments sent to keep idle streams open through proxies.
+	sseKeepAlive = 30 * time.Second
+)
+
+// eventBuffer numbers the device events and passes them on to the web clients. It keeps the last events in a ring
+// so that clients can resume after reconnecting.
+type eventBuffer struct {
+	// instance tells the events of this htManager process from those before a restart, whose numbers start over.
+	instance string
+	lock     sync.Mutex
+	events   []devices.DeviceUpdateEvent
+	next     int
+	lastSeq  uint64
+	clients  map[devices.UpdateNotificationClient]bool
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	return &eventBuffer{instance: newInstanceId(), events: make([]devices.DeviceUpdateEvent, 0, size),
+		clients: map[devices.UpdateNotificationClient]bool{}}
+}
+
+func newInstanceId() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// eventId identifies an event, clients resume after the last one they got. It is written <instance>-<seq>.
+type eventId struct {
+	instance string
+	seq      uint64
+}
+
+func (id eventId) String() string {
+	return fmt.Sprintf("%s-%d", id.instance, id.seq)
+}
+
+// parseEventId parses the id of the event a client resumes from, ok is false if there is none. A bare sequence
+// number, without an instance, is from before a restart.
+func parseEventId(value string) (id eventId, ok bool, err error) {
+	if value == "" {
+		return eventId{}, false, nil
+	}
+	invalid := fmt.Errorf("invalid event id %q", value)
+	seq := value
+	if instance, after, found := strings.Cut(value, "-"); found {
+		if instance == "" {
+			return eventId{}, false, invalid
+		}
+		id.instance, seq = instance, after
+	}
+	if id.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return eventId{}, false, invalid
+	}
+	return id, true, nil
+}
+
+func (b *eventBuffer) DeviceUpdated(event devices.DeviceUpdateEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastSeq++
+	event.Seq = b.lastSeq
+	if len(b.events) < cap(b.events) {
+		b.events = append(b.events, event)
+	} else {
+		b.events[b.next] = event
+		b.next = (b.next + 1) % len(b.events)
+	}
+	// The clients only queue the event, they get the events in order.
+	for client := range b.clients {
+		client.DeviceUpdated(event)
+	}
+}
+
+// listen calls replay with the id of the last event and the buffered events, oldest first, then registers the client
+// for the events which follow. No event is sent in between, so the client neither misses one nor gets one twice.
+func (b *eventBuffer) listen(client devices.UpdateNotificationClient, replay func(last eventId, buffered []devices.DeviceUpdateEvent)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if replay != nil {
+		buffered := make([]devices.DeviceUpdateEvent, 0, len(b.events))
+		buffered = append(append(buffered, b.events[b.next:]...), b.events[:b.next]...)
+		replay(eventId{instance: b.instance, seq: b.lastSeq}, buffered)
+	}
+	b.clients[client] = true
+}
+
+func (b *eventBuffer) unlisten(client devices.UpdateNotificationClient) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.clients, client)
+}
+
+// eventsSince returns the buffered events after from, last is the id of the last event. complete is false if some of
+// them are no longer buffered, or if from is an event of another instance, as the numbering starts over when
+// htManager restarts.
+func eventsSince(buffered []devices.DeviceUpdateEvent, last eventId, from eventId) (events []devices.DeviceUpdateEvent, complete bool) {
+	if from.instance != last.instance {
+		return nil, false
+	}
+	idx, _ := slices.BinarySearchFunc(buffered, from.seq+1, func(event devices.DeviceUpdateEvent, seq uint64) int {
+		return cmp.Compare(event.Seq, seq)
+	})
+	events = buffered[idx:]
+	return events, from.seq == last.seq || (len(events) > 0 && events[0].Seq == from.seq+1)
+}
+
+// eventListener passes the events to a Server-Sent Events stream.
+type eventListener struct {
+	events chan devices.DeviceUpdateEvent
+	// closed is set when the listener fell behind and its channel was closed, it is guarded by the buffer's lock.
+	closed bool
+}
+
+func (l *eventListener) DeviceUpdated(event devices.DeviceUpdateEvent) {
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- event:
+	default:
+		// Too slow, the client can resume from the last event it got.
+		l.closed = true
+		close(l.events)
+	}
+}
+
+// eventFilter picks the events sent to a client by device id and event type, empty lists match every event.
+type eventFilter struct {
+	ids   []string
+	types []string
+}
+
+func (f eventFilter) matches(event devices.DeviceUpdateEvent) bool {
+	return (len(f.ids) == 0 || slices.Contains(f.ids, event.Id)) && (len(f.types) == 0 || slices.Contains(f.types, event.Type))
+}
+
+func initEventsAPI(group *gin.RouterGroup, events *eventBuffer) {
+	group.GET("/events", func(context *gin.Context) {
+		filter := eventFilter{ids: queryList(context, "id"), types: queryList(context, "type")}
+		lastEventId := context.GetHeader("Last-Event-ID")
+		if lastEventId == "" {
+			lastEventId = context.Query("lastEventId")
+		}
+		from, resume, err := parseEventId(lastEventId)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		listener := &eventListener{events: make(chan devices.DeviceUpdateEvent, eventListenerSize)}
+		var replay []devices.DeviceUpdateEvent
+		complete := true
+		events.listen(listener, func(last eventId, buffered []devices.DeviceUpdateEvent) {
+			// A new stream only gets the events which follow.
+			if resume {
+				replay, complete = eventsSince(buffered, last, from)
+			}
+		})
+		defer events.unlisten(listener)
+
+		context.Header("Content-Type", "text/event-stream")
+		context.Header("Cache-Control", "no-cache")
+		context.Header("X-Accel-Buffering", "no")
+		context.Status(http.StatusOK)
+		if !complete {
+			// Some events were missed, the client should reload the state it keeps.
+			fmt.Fprint(context.Writer, "event: gap\ndata: {}\n\n")
+		}
+		for _, event := range replay {
+			writeServerSentEvent(context, events.instance, filter, event)
+		}
+		context.Writer.Flush()
+
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-listener.events:
+				if !ok {
+					log.Printf("Closing slow event stream of %s\n", context.ClientIP())
+					return
+				}
+				writeServerSentEvent(context, events.instance, filter, event)
+			case <-keepAlive.C:
+				fmt.Fprint(context.Writer, ": keepalive\n\n")
+			case <-context.Request.Context().Done():
+				return
+			}
+			context.Writer.Flush()
+		}
+	})
+}
+
+func writeServerSentEvent(context *gin.Context, instance string, filter eventFilter, event devices.DeviceUpdateEvent) {
+	if !filter.matches(event) {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event: %s\n", err)
+		return
+	}
+	id := eventId{instance: instance, seq: event.Seq}
+	fmt.Fprintf(context.Writer, "id: %s\nevent: %s\ndata: %s\n\n", id, event.Type, data)
+}
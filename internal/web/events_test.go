@@ -0,0 +1,282 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"htManager/internal/devices"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEventId(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    eventId
+		wantOk  bool
+		wantErr bool
+	}{
+		{name: "None", value: ""},
+		{name: "Instance and seq", value: "3f9a1c2b-42", want: eventId{instance: "3f9a1c2b", seq: 42}, wantOk: true},
+		{name: "Seq from before instances", value: "42", want: eventId{seq: 42}, wantOk: true},
+		{name: "Invalid seq", value: "3f9a1c2b-x", wantErr: true},
+		{name: "Negative seq", value: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := parseEventId(tt.value)
+			if (err != nil) != tt.wantErr || ok != tt.wantOk || got != tt.want {
+				t.Errorf("parseEventId(%q) = %+v, %v, %v, want %+v, %v, error %v", tt.value, got, ok, err, tt.want, tt.wantOk, tt.wantErr)
+			}
+			if ok && tt.want.instance != "" && got.String() != tt.value {
+				t.Errorf("String() = %q, want %q", got.String(), tt.value)
+			}
+		})
+	}
+}
+
+func TestEventsSince(t *testing.T) {
+	// Events 1 and 2 are no longer buffered.
+	buffered := []devices.DeviceUpdateEvent{{Seq: 3}, {Seq: 4}, {Seq: 5}}
+	last := eventId{instance: "a", seq: 5}
+	tests := []struct {
+		name         string
+		from         eventId
+		wantSeqs     []uint64
+		wantComplete bool
+	}{
+		{name: "Missed some", from: eventId{instance: "a", seq: 3}, wantSeqs: []uint64{4, 5}, wantComplete: true},
+		{name: "Missed all buffered", from: eventId{instance: "a", seq: 2}, wantSeqs: []uint64{3, 4, 5}, wantComplete: true},
+		{name: "Up to date", from: eventId{instance: "a", seq: 5}, wantSeqs: []uint64{}, wantComplete: true},
+		{name: "No longer buffered", from: eventId{instance: "a", seq: 1}, wantSeqs: []uint64{3, 4, 5}},
+		{name: "Ahead", from: eventId{instance: "a", seq: 9}, wantSeqs: []uint64{}},
+		{name: "Other instance", from: eventId{instance: "b", seq: 3}, wantSeqs: []uint64{}},
+		{name: "Before instances", from: eventId{seq: 3}, wantSeqs: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, complete := eventsSince(buffered, last, tt.from)
+			seqs := make([]uint64, 0, len(events))
+			for _, event := range events {
+				seqs = append(seqs, event.Seq)
+			}
+			if !reflect.DeepEqual(seqs, tt.wantSeqs) || complete != tt.wantComplete {
+				t.Errorf("eventsSince() = %v, %v, want %v, %v", seqs, complete, tt.wantSeqs, tt.wantComplete)
+			}
+		})
+	}
+}
+
+// recordingListener records the events it is sent.
+type recordingListener struct {
+	events []devices.DeviceUpdateEvent
+}
+
+func (l *recordingListener) DeviceUpdated(event devices.DeviceUpdateEvent) {
+	l.events = append(l.events, event)
+}
+
+func TestEventBuffer_Listen(t *testing.T) {
+	buffer := newEventBuffer(3)
+	for i := 0; i < 5; i++ {
+		buffer.DeviceUpdated(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DiagUpdateMessage})
+	}
+	listener := &recordingListener{}
+	var last eventId
+	var buffered []uint64
+	buffer.listen(listener, func(lastId eventId, events []devices.DeviceUpdateEvent) {
+		last = lastId
+		for _, event := range events {
+			buffered = append(buffered, event.Seq)
+		}
+	})
+	if last != (eventId{instance: buffer.instance, seq: 5}) || !reflect.DeepEqual(buffered, []uint64{3, 4, 5}) {
+		t.Errorf("replay(%+v, %v), want seq 5 and events 3 to 5", last, buffered)
+	}
+	buffer.DeviceUpdated(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DiagUpdateMessage})
+	buffer.unlisten(listener)
+	buffer.DeviceUpdated(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DiagUpdateMessage})
+	if len(listener.events) != 1 || listener.events[0].Seq != 6 {
+		t.Errorf("listener got %+v, want event 6", listener.events)
+	}
+	if other := newEventBuffer(3); other.instance == buffer.instance {
+		t.Errorf("instance %s used twice", other.instance)
+	}
+}
+
+func TestEventListener_Slow(t *testing.T) {
+	listener := &eventListener{events: make(chan devices.DeviceUpdateEvent, 2)}
+	for seq := uint64(1); seq <= 4; seq++ {
+		listener.DeviceUpdated(devices.DeviceUpdateEvent{Seq: seq})
+	}
+	received := make([]uint64, 0)
+	for event := range listener.events {
+		received = append(received, event.Seq)
+	}
+	if !listener.closed || !reflect.DeepEqual(received, []uint64{1, 2}) {
+		t.Errorf("received %v, closed %v, want events 1 and 2 then closed", received, listener.closed)
+	}
+}
+
+type serverSentEvent struct {
+	id    string
+	event string
+}
+
+// openEventStream opens /api/events, lastEventId is sent as Last-Event-ID if set.
+func openEventStream(t *testing.T, url string, lastEventId string) (*bufio.Reader, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, "GET", url+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return bufio.NewReader(response.Body), cancel
+}
+
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) serverSentEvent {
+	t.Helper()
+	event := serverSentEvent{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.event != "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		}
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	server, broker := newTestServer(t)
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	publishStatus := func(status string) {
+		t.Helper()
+		if err := device.Publish("homething/a1b2c3/device/status", 0, false, []byte(status)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, cancel := openEventStream(t, server.URL, "")
+	// The stream is registered once the headers are sent.
+	publishStatus("online")
+	first := readServerSentEvent(t, stream)
+	cancel()
+	if first.event != devices.StatusUpdateMessage || !strings.HasSuffix(first.id, "-1") {
+		t.Fatalf("event = %+v, want status 1", first)
+	}
+
+	publishStatus("offline")
+	publishStatus("online")
+	tests := []struct {
+		name        string
+		lastEventId string
+		want        []serverSentEvent
+	}{
+		{name: "Resume", lastEventId: first.id, want: []serverSentEvent{
+			{id: strings.TrimSuffix(first.id, "1") + "2", event: devices.StatusUpdateMessage},
+			{id: strings.TrimSuffix(first.id, "1") + "3", event: devices.StatusUpdateMessage},
+		}},
+		{name: "Up to date", lastEventId: strings.TrimSuffix(first.id, "1") + "3", want: []serverSentEvent{}},
+		{name: "Other instance", lastEventId: "0000-1", want: []serverSentEvent{{event: "gap"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, cancel := openEventStream(t, server.URL, tt.lastEventId)
+			defer cancel()
+			received := make([]serverSentEvent, 0)
+			for range tt.want {
+				received = append(received, readServerSentEvent(t, stream))
+			}
+			if !reflect.DeepEqual(received, tt.want) {
+				t.Errorf("received %+v, want %+v", received, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocket_Resume(t *testing.T) {
+	server, broker := newTestServer(t)
+	publishTestDevice(t, broker, "a1b2c3")
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	ws := dialWebSocket(t, server, "")
+	init := readUntil(t, ws, ofType("init"))
+	ws.Close()
+	if init.Instance == "" {
+		t.Fatalf("init = %+v, want an instance", init)
+	}
+	// The client missed this status while disconnected.
+	if err := device.Publish("homething/a1b2c3/device/status", 0, false, []byte("online")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		resume      eventId
+		wantResumed bool
+	}{
+		{name: "Resume", resume: eventId{instance: init.Instance, seq: init.Seq}, wantResumed: true},
+		{name: "Other instance", resume: eventId{instance: "0000", seq: init.Seq}},
+		{name: "Before instances", resume: eventId{seq: init.Seq}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resume := tt.resume.String()
+			if tt.resume.instance == "" {
+				resume = fmt.Sprint(tt.resume.seq)
+			}
+			ws := dialWebSocket(t, server, "?resume="+resume)
+			replayed := make([]wsMessage, 0)
+			last := readUntil(t, ws, func(message wsMessage) bool {
+				replayed = append(replayed, message)
+				return message.Type == "init" || message.Type == "resumed"
+			})
+			if !tt.wantResumed {
+				if last.Type != "init" || len(replayed) != 1 {
+					t.Errorf("received %+v, want only init", replayed)
+				}
+				return
+			}
+			resumed := struct {
+				Seq      uint64 `json:"seq"`
+				Instance string `json:"instance"`
+			}{}
+			if err := json.Unmarshal(last.Data, &resumed); err != nil || last.Type != "resumed" {
+				t.Fatalf("received %+v, want resumed", last)
+			}
+			status := replayed[len(replayed)-2]
+			if status.Type != devices.StatusUpdateMessage || status.Id != "a1b2c3" || resumed.Instance != init.Instance ||
+				resumed.Seq != status.Seq || status.Seq <= init.Seq {
+				t.Errorf("received %+v, resumed %+v, want the status then resumed", replayed, resumed)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/updates"
+	"net/http"
+)
+
+// maxFirmwareSize is the largest OTA file accepted, well above the flash size of the devices.
+const maxFirmwareSize = 16 << 20
+
+// FirmwareUploadDisabledError is a firmware upload while ServerConfig.AllowFirmwareUpload isn't set.
+var FirmwareUploadDisabledError = errors.New("firmware upload is disabled, start htManager with -allow-firmware-upload")
+
+type FirmwareResponse struct {
+	Name string `json:"name"`
+}
+
+func initFirmwareAPI(group *gin.RouterGroup, updateManager updates.UpdateManager, allowUpload bool) {
+	group.PUT("/firmware/:name", func(context *gin.Context) {
+		if !allowUpload {
+			context.JSON(http.StatusForbidden, ErrorResponse{Error: FirmwareUploadDisabledError.Error()})
+			return
+		}
+		name := context.Param("name")
+		body := http.MaxBytesReader(context.Writer, context.Request.Body, maxFirmwareSize)
+		err := updateManager.SaveFirmware(name, body)
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case err == nil:
+			context.JSON(http.StatusCreated, FirmwareResponse{Name: name})
+		case errors.Is(err, updates.InvalidFirmwareNameError):
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		case errors.As(err, &maxBytesError):
+			context.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: err.Error()})
+		default:
+			context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		}
+	})
+}
+
+func initFirmwareAPIv2(group *gin.RouterGroup, updateManager updates.UpdateManager, allowUpload bool) {
+	group.PUT("/firmware/:name", func(context *gin.Context) {
+		if !allowUpload {
+			writeAPIError(context, FirmwareUploadDisabledError)
+			return
+		}
+		name := context.Param("name")
+		body := http.MaxBytesReader(context.Writer, context.Request.Body, maxFirmwareSize)
+		if err := updateManager.SaveFirmware(name, body); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusCreated, FirmwareResponse{Name: name})
+		}
+	})
+}
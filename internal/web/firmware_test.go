@@ -0,0 +1,55 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"htManager/internal/updates"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFirmwareAPI(t *testing.T) {
+	tests := []struct {
+		name       string
+		allow      bool
+		path       string
+		wantStatus int
+		wantSaved  bool
+	}{
+		{name: "Disabled", path: "/api/firmware/homething.esp32.v1.2.0.ota", wantStatus: http.StatusForbidden},
+		{name: "Disabled v2", path: "/api/v2/firmware/homething.esp32.v1.2.0.ota", wantStatus: http.StatusForbidden},
+		{name: "Allowed", allow: true, path: "/api/firmware/homething.esp32.v1.2.0.ota", wantStatus: http.StatusCreated, wantSaved: true},
+		{name: "Allowed v2", allow: true, path: "/api/v2/firmware/homething.esp32.v1.2.0.ota", wantStatus: http.StatusCreated, wantSaved: true},
+		{name: "Invalid name", allow: true, path: "/api/firmware/notes.txt", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := devices.NewDevices(devices.NewMemoryBroker().NewTransport(), metadata, devices.DefaultConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			updatesPath := t.TempDir()
+			router := newRouter(ServerConfig{AllowFirmwareUpload: tt.allow}, d, updates.NewUpdateManager(updatesPath), nil,
+				jobs.NewJobManager(d, 1), nil)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("PUT", tt.path, strings.NewReader("firmware")))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			_, err = os.Stat(filepath.Join(updatesPath, "homething.esp32.v1.2.0.ota"))
+			if saved := err == nil; saved != tt.wantSaved {
+				t.Errorf("saved = %v, want %v", saved, tt.wantSaved)
+			}
+		})
+	}
+}
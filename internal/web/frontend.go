@@ -2,6 +2,7 @@ package web
 
 import (
 	"embed"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"io/fs"
 	"net/http"
@@ -14,6 +15,10 @@ var content embed.FS
 
 func initFrontend(r *gin.Engine) {
 	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, apiV2Prefix+"/") {
+			writeAPIError(c, fmt.Errorf("%w: %s %s", NotFoundError, c.Request.Method, c.Request.URL.Path))
+			return
+		}
 		rootFS, _ := fs.Sub(content, "frontend/build")
 		path := strings.TrimPrefix(c.Request.URL.Path, "/")
 		_, err := rootFS.Open(path)
@@ -1,11 +1,16 @@
 export class DeviceList {
     constructor() {
         this.devices = [];
+        // The last command sent to each device, by device id, with whether the device has acted on it.
+        this.commands = {};
         this.selectedDevice = null;
         this.deviceListUpdated = null;
         this.deviceUpdated = null;
         this.connected = false;
         this.pending = null;
+        // The last event received, numbered by the htManager instance which sent it.
+        this.instance = null;
+        this.lastSeq = null;
         this.connectWS();
     }
 
@@ -22,6 +27,9 @@ export class DeviceList {
                 break;
             }
         }
+        if (deviceId in this.commands) {
+            deviceUpdated('command', this.commands[deviceId]);
+        }
         this.ws.send(JSON.stringify({'cmd': 'selectDevice', 'id': deviceId}));
     }
 
@@ -52,7 +60,9 @@ export class DeviceList {
         } else {
             protocol = "ws:";
         }
-        this.ws = new WebSocket(`${protocol}//${loc.host}/api/ws`);
+        // After reconnecting, get the events missed meanwhile instead of the whole device list.
+        let resume = this.instance !== null ? `?resume=${this.instance}-${this.lastSeq}` : '';
+        this.ws = new WebSocket(`${protocol}//${loc.host}/api/ws${resume}`);
         this.ws.onopen = () => {
             this.connected = true;
             if (this.pending != null) {
@@ -74,10 +84,20 @@ export class DeviceList {
 
     processWSMessage(event) {
         let msg = JSON.parse(event.data);
+        // Keep the highest seq, a resume mustn't skip an event which wasn't received yet.
+        if (msg.seq && (this.lastSeq === null || msg.seq > this.lastSeq)) {
+            this.lastSeq = msg.seq;
+        }
         switch (msg.type) {
             case 'init':
+                this.instance = msg.instance;
+                this.lastSeq = msg.seq;
                 this.handleInit(msg.data);
                 break
+            case 'resumed':
+                this.instance = msg.data.instance;
+                this.lastSeq = msg.data.seq;
+                break;
             case 'lastSeen':
                 this.handleLastSeen(msg);
                 break;
@@ -87,8 +107,17 @@ export class DeviceList {
             case 'topics':
             case 'values':
             case 'value':
+            case 'response':
+            case 'removed':
                 this.handleDeviceUpdate(msg);
                 break;
+            case 'command':
+                this.commands[msg.id] = msg.data;
+                this.handleDeviceUpdate(msg);
+                break;
+            case 'job':
+                // Jobs are only managed through the API, the device pages show the commands they send.
+                break;
             default:
                 console.log(`Unknown message ${msg.type}`);
                 break;
@@ -131,18 +160,24 @@ export class DeviceList {
         }
         if (msg.type === 'info') {
             let devices = [];
+            let known = false;
             this.devices.forEach((value) => {
                 if (value.id === msg.id) {
                     value = msg.data;
+                    known = true;
                 }
                 devices.push(value)
             });
+            if (!known) {
+                devices.push(msg.data);
+            }
             this.devices = devices;
             if (this.deviceListUpdated != null) {
                 this.deviceListUpdated(this.devices);
             }
         }
         if (msg.type === 'removed') {
+            delete this.commands[msg.id];
             let devices = [];
             this.devices.forEach((value) => {
                 if (value.id !== msg.id) {
@@ -121,6 +121,7 @@ export function Device({devices}) {
     const [topics, setTopics] = useState({});
     const [values, setValues] = useState({});
     const [status, setStatus] = useState("");
+    const [command, setCommand] = useState(null);
 
     let reboot = () => {
         const data = new URLSearchParams();
@@ -164,6 +165,9 @@ export function Device({devices}) {
                 case 'status':
                     setStatus(data);
                     break;
+                case 'command':
+                    setCommand(data);
+                    break;
                 default:
                     break;
             }
@@ -188,6 +192,9 @@ export function Device({devices}) {
                 <NameValuePair name="Uptime">{diag.uptime}<LastSeen lastSeen={diag.lastSeen}/></NameValuePair>
                 <NameValuePair name="Memory Free"><MemoryInfo free={diag.memInfo.free} low={diag.memInfo.low} total={info.memory}/> </NameValuePair>
                 <NameValuePair name="Status">{status}</NameValuePair>
+                <NameValuePair name="Last Command">{command && <Box direction="row" gap="xsmall" align="center">
+                    <Text>{command.command} {command.state}</Text><LastSeen lastSeen={command.acknowledged ?? command.sent}/>
+                </Box>}</NameValuePair>
                 <NameValuePair name="Publish Topics"><AllTopics alltopics={topics} values={values}></AllTopics></NameValuePair>
             </NameValueList>
         </PageContent>
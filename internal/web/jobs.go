@@ -0,0 +1,72 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/jobs"
+	"net/http"
+)
+
+type JobsResponse struct {
+	Jobs []jobs.Job `json:"jobs"`
+}
+
+func initJobsAPI(group *gin.RouterGroup, jobManager jobs.JobManager) {
+	group.GET("/jobs", func(context *gin.Context) {
+		context.JSON(http.StatusOK, JobsResponse{Jobs: jobManager.GetJobs()})
+	})
+
+	group.POST("/jobs", func(context *gin.Context) {
+		request := jobs.JobRequest{}
+		if err := context.BindJSON(&request); err != nil {
+			return
+		}
+		job, err := jobManager.StartJob(request)
+		switch {
+		case err == nil:
+			context.JSON(http.StatusAccepted, job)
+		case errors.Is(err, jobs.InvalidCommandError), errors.Is(err, jobs.NoDevicesSelectedError),
+			errors.Is(err, jobs.EmptySelectorError):
+			context.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		}
+	})
+
+	group.GET("/jobs/:jobId", func(context *gin.Context) {
+		if job := jobManager.GetJob(context.Param("jobId")); job == nil {
+			context.Status(http.StatusNotFound)
+		} else {
+			context.JSON(http.StatusOK, job)
+		}
+	})
+}
+
+func initJobsAPIv2(group *gin.RouterGroup, jobManager jobs.JobManager) {
+	group.GET("/jobs", func(context *gin.Context) {
+		context.JSON(http.StatusOK, JobsResponse{Jobs: jobManager.GetJobs()})
+	})
+
+	group.POST("/jobs", func(context *gin.Context) {
+		request := jobs.JobRequest{}
+		if err := decodeJSON(context, &request); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		if job, err := jobManager.StartJob(request); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusAccepted, job)
+		}
+	})
+
+	group.GET("/jobs/:jobId", func(context *gin.Context) {
+		jobId := context.Param("jobId")
+		if job := jobManager.GetJob(jobId); job == nil {
+			writeAPIError(context, fmt.Errorf("%w: job %s", NotFoundError, jobId))
+		} else {
+			context.JSON(http.StatusOK, job)
+		}
+	})
+}
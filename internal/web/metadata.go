@@ -0,0 +1,37 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"net/http"
+)
+
+func initMetadataAPI(group *gin.RouterGroup, devicesManager devices.Devices) {
+	group.GET("/devices/:deviceId/metadata", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if info := devicesManager.GetDeviceInfo(deviceId); info == nil {
+			context.Status(http.StatusNotFound)
+		} else if metadata := devicesManager.GetDeviceMetadata(deviceId); metadata == nil {
+			context.JSON(http.StatusOK, devices.DeviceMetadata{})
+		} else {
+			context.JSON(http.StatusOK, metadata)
+		}
+	})
+
+	group.PUT("/devices/:deviceId/metadata", func(context *gin.Context) {
+		deviceId := context.Param("deviceId")
+		if devicesManager.GetDeviceInfo(deviceId) == nil {
+			context.Status(http.StatusNotFound)
+			return
+		}
+		metadata := devices.DeviceMetadata{}
+		if err := context.BindJSON(&metadata); err != nil {
+			return
+		}
+		if err := devicesManager.SetDeviceMetadata(deviceId, metadata); err != nil {
+			context.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, metadata)
+		}
+	})
+}
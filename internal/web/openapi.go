@@ -0,0 +1,18 @@
+package web
+
+import (
+	_ "embed"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// openAPI describes the REST API, openapi_test.go checks that it lists the routes the server handles.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+func initOpenAPI(group *gin.RouterGroup) {
+	group.GET("/openapi.json", func(context *gin.Context) {
+		context.Data(http.StatusOK, "application/json", openAPI)
+	})
+}
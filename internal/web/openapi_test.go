@@ -0,0 +1,295 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// pathParam matches the gin path parameters, written {name} in OpenAPI.
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// newTestRouter returns a router serving devices connected to the returned broker.
+func newTestRouter(t *testing.T, config ServerConfig) (*gin.Engine, *devices.MemoryBroker) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := devices.NewMemoryBroker()
+	d, err := devices.NewDevices(broker.NewTransport(), metadata, devices.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRouter(config, d, nil, nil, jobs.NewJobManager(d, 1), nil), broker
+}
+
+func TestOpenAPI_Routes(t *testing.T) {
+	document := openAPIDocument{}
+	if err := json.Unmarshal(openAPI, &document); err != nil {
+		t.Fatalf("invalid openapi.json: %s", err)
+	}
+	documented := make([]string, 0)
+	for path, operations := range document.Paths {
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	handled := make([]string, 0)
+	router, _ := newTestRouter(t, ServerConfig{})
+	for _, route := range router.Routes() {
+		if path, ok := strings.CutPrefix(route.Path, "/api"); ok {
+			handled = append(handled, route.Method+" "+pathParam.ReplaceAllString(path, "{$1}"))
+		}
+	}
+	for _, route := range handled {
+		if !slices.Contains(documented, route) {
+			t.Errorf("%s is not in openapi.json", route)
+		}
+	}
+	for _, route := range documented {
+		if !slices.Contains(handled, route) {
+			t.Errorf("%s is in openapi.json but not handled", route)
+		}
+	}
+}
+
+func TestOpenAPI_References(t *testing.T) {
+	var document map[string]any
+	if err := json.Unmarshal(openAPI, &document); err != nil {
+		t.Fatalf("invalid openapi.json: %s", err)
+	}
+	var check func(value any)
+	check = func(value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			if ref, ok := value["$ref"].(string); ok {
+				var target any = document
+				for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					object, _ := target.(map[string]any)
+					target = object[name]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range value {
+				check(child)
+			}
+		case []any:
+			for _, child := range value {
+				check(child)
+			}
+		}
+	}
+	check(document)
+}
+
+// schemaValidator checks JSON values against the schemas of openapi.json.
+type schemaValidator struct {
+	t        *testing.T
+	document map[string]any
+}
+
+// resolve follows $ref, and merges allOf into a single schema.
+func (v *schemaValidator) resolve(schema map[string]any) map[string]any {
+	if ref, ok := schema["$ref"].(string); ok {
+		var target any = v.document
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, _ := target.(map[string]any)
+			target = object[name]
+		}
+		resolved, _ := target.(map[string]any)
+		return v.resolve(resolved)
+	}
+	parts, ok := schema["allOf"].([]any)
+	if !ok {
+		return schema
+	}
+	properties := map[string]any{}
+	required := []any{}
+	for _, part := range parts {
+		part := v.resolve(part.(map[string]any))
+		for name, property := range part["properties"].(map[string]any) {
+			properties[name] = property
+		}
+		if partRequired, ok := part["required"].([]any); ok {
+			required = append(required, partRequired...)
+		}
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+func (v *schemaValidator) validate(path string, schema map[string]any, value any) {
+	schema = v.resolve(schema)
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			v.t.Errorf("%s = %v, want an object", path, value)
+			return
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				v.t.Errorf("%s.%s is required but missing", path, name)
+			}
+		}
+		for name, child := range object {
+			if property, ok := properties[name].(map[string]any); ok {
+				v.validate(path+"."+name, property, child)
+			} else if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+				v.validate(path+"."+name, additional, child)
+			} else if len(properties) > 0 {
+				v.t.Errorf("%s.%s is not in the schema", path, name)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			v.t.Errorf("%s = %v, want an array", path, value)
+			return
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range array {
+				v.validate(fmt.Sprintf("%s[%d]", path, i), items, item)
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			v.t.Errorf("%s = %v, want a string", path, value)
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != float64(int64(number)) {
+			v.t.Errorf("%s = %v, want an integer", path, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			v.t.Errorf("%s = %v, want a number", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.t.Errorf("%s = %v, want a boolean", path, value)
+		}
+	}
+}
+
+// TestOpenAPI_Responses checks the responses of the server against the schemas documented for their status.
+func TestOpenAPI_Responses(t *testing.T) {
+	var document map[string]any
+	if err := json.Unmarshal(openAPI, &document); err != nil {
+		t.Fatalf("invalid openapi.json: %s", err)
+	}
+	validator := &schemaValidator{t: t, document: document}
+	router, broker := newTestRouter(t, ServerConfig{})
+	publishTestDevice(t, broker, "a1b2c3")
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	for topic, payload := range map[string]string{
+		"diag":   `{"uptime":100,"mem":{"free":2048,"low":1024},"tasks":[{"name":"main","stackMinLeft":512}]}`,
+		"topics": `{"descriptions":[{"pub":{"temperature":0},"sub":{}}],"elements":[{"name":"sensor","index":0}]}`,
+		"status": "online",
+	} {
+		if err := device.Publish("homething/a1b2c3/device/"+topic, 0, true, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := device.Publish("homething/a1b2c3/sensor/temperature", 0, false, []byte("21.5")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cases run in order against the same router, path defaults to the route of device a1b2c3.
+	tests := []struct {
+		method     string
+		route      string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{method: "GET", route: "/devices", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/info", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/diag", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/status", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/topics", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/topics/values", wantStatus: http.StatusOK},
+		{method: "PUT", route: "/devices/{deviceId}/metadata", body: `{"tags":["hall"],"group":"ground floor"}`, wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/metadata", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/profile", wantStatus: http.StatusNotFound},
+		{method: "GET", route: "/devices/{deviceId}/info", path: "/devices/d4e5f6/info", wantStatus: http.StatusNotFound},
+		{method: "GET", route: "/brokers", wantStatus: http.StatusOK},
+		{method: "POST", route: "/jobs", body: `{"selector":{"ids":["a1b2c3"]},"command":"restart"}`, wantStatus: http.StatusAccepted},
+		{method: "POST", route: "/jobs", body: `{"selector":{"ids":["a1b2c3"]},"command":"colour"}`, wantStatus: http.StatusBadRequest},
+		{method: "POST", route: "/jobs", body: `{"command":"restart"}`, wantStatus: http.StatusBadRequest},
+		{method: "POST", route: "/jobs", body: `{"command":"restart","all":true}`, wantStatus: http.StatusAccepted},
+		{method: "GET", route: "/jobs", wantStatus: http.StatusOK},
+		{method: "GET", route: "/devices/{deviceId}/commands", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}", path: "/v2/devices/d4e5f6", wantStatus: http.StatusNotFound},
+		{method: "GET", route: "/v2/devices/{deviceId}/diag", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}/status", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}/topics", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}/topics/values", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/devices/{deviceId}/profile", wantStatus: http.StatusNotFound},
+		{method: "GET", route: "/v2/devices/{deviceId}/metadata", wantStatus: http.StatusOK},
+		{method: "POST", route: "/v2/devices/{deviceId}/commands", body: `{"command":"restart"}`, wantStatus: http.StatusAccepted},
+		{method: "POST", route: "/v2/devices/{deviceId}/commands", body: `{"command":"update"}`, wantStatus: http.StatusUnprocessableEntity},
+		{method: "GET", route: "/v2/devices/{deviceId}/commands", wantStatus: http.StatusOK},
+		{method: "GET", route: "/v2/brokers", wantStatus: http.StatusOK},
+		{method: "POST", route: "/v2/jobs", body: `{"command":"restart"}`, wantStatus: http.StatusBadRequest},
+		{method: "GET", route: "/v2/jobs", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.route, func(t *testing.T) {
+			validator.t = t
+			path := tt.path
+			if path == "" {
+				path = strings.ReplaceAll(tt.route, "{deviceId}", "a1b2c3")
+			}
+			request := httptest.NewRequest(tt.method, "/api"+path, strings.NewReader(tt.body))
+			if tt.body != "" {
+				request.Header.Set("Content-Type", "application/json")
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			paths, _ := document["paths"].(map[string]any)
+			operations, _ := paths[tt.route].(map[string]any)
+			operation, _ := operations[strings.ToLower(tt.method)].(map[string]any)
+			responses, _ := operation["responses"].(map[string]any)
+			documented, ok := responses[fmt.Sprint(recorder.Code)].(map[string]any)
+			if !ok {
+				t.Fatalf("status %d is not in openapi.json", recorder.Code)
+			}
+			content, _ := validator.resolve(documented)["content"].(map[string]any)
+			media, ok := content["application/json"].(map[string]any)
+			if !ok {
+				return
+			}
+			var body any
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response %s: %s", recorder.Body, err)
+			}
+			validator.validate("response", media["schema"].(map[string]any), body)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/scheduler"
+	"net/http"
+)
+
+type SchedulesResponse struct {
+	Schedules []scheduler.Schedule `json:"schedules"`
+}
+
+type ScheduleHistoryResponse struct {
+	History []scheduler.ScheduleRun `json:"history"`
+}
+
+func scheduleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, scheduler.ScheduleNotFoundError):
+		return http.StatusNotFound
+	case errors.Is(err, scheduler.InvalidScheduleError):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func initSchedulesAPI(group *gin.RouterGroup, schedules scheduler.Scheduler) {
+	group.GET("/schedules", func(context *gin.Context) {
+		context.JSON(http.StatusOK, SchedulesResponse{Schedules: schedules.GetSchedules()})
+	})
+
+	group.POST("/schedules", func(context *gin.Context) {
+		schedule := scheduler.Schedule{}
+		if err := context.BindJSON(&schedule); err != nil {
+			return
+		}
+		if created, err := schedules.CreateSchedule(schedule); err != nil {
+			context.JSON(scheduleErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusCreated, created)
+		}
+	})
+
+	group.GET("/schedules/history", func(context *gin.Context) {
+		context.JSON(http.StatusOK, ScheduleHistoryResponse{History: schedules.GetHistory("")})
+	})
+
+	group.GET("/schedules/:scheduleId", func(context *gin.Context) {
+		if schedule := schedules.GetSchedule(context.Param("scheduleId")); schedule == nil {
+			context.Status(http.StatusNotFound)
+		} else {
+			context.JSON(http.StatusOK, schedule)
+		}
+	})
+
+	group.PUT("/schedules/:scheduleId", func(context *gin.Context) {
+		schedule := scheduler.Schedule{}
+		if err := context.BindJSON(&schedule); err != nil {
+			return
+		}
+		schedule.Id = context.Param("scheduleId")
+		if updated, err := schedules.UpdateSchedule(schedule); err != nil {
+			context.JSON(scheduleErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, updated)
+		}
+	})
+
+	group.DELETE("/schedules/:scheduleId", func(context *gin.Context) {
+		if err := schedules.DeleteSchedule(context.Param("scheduleId")); err != nil {
+			context.JSON(scheduleErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, map[string]string{})
+		}
+	})
+
+	group.GET("/schedules/:scheduleId/history", func(context *gin.Context) {
+		scheduleId := context.Param("scheduleId")
+		if schedules.GetSchedule(scheduleId) == nil {
+			context.Status(http.StatusNotFound)
+		} else {
+			context.JSON(http.StatusOK, ScheduleHistoryResponse{History: schedules.GetHistory(scheduleId)})
+		}
+	})
+}
+
+func initSchedulesAPIv2(group *gin.RouterGroup, schedules scheduler.Scheduler) {
+	group.GET("/schedules", func(context *gin.Context) {
+		context.JSON(http.StatusOK, SchedulesResponse{Schedules: schedules.GetSchedules()})
+	})
+
+	group.POST("/schedules", func(context *gin.Context) {
+		schedule := scheduler.Schedule{}
+		if err := decodeJSON(context, &schedule); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		if created, err := schedules.CreateSchedule(schedule); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusCreated, created)
+		}
+	})
+
+	group.GET("/schedules/history", func(context *gin.Context) {
+		context.JSON(http.StatusOK, ScheduleHistoryResponse{History: schedules.GetHistory("")})
+	})
+
+	group.GET("/schedules/:scheduleId", func(context *gin.Context) {
+		scheduleId := context.Param("scheduleId")
+		if schedule := schedules.GetSchedule(scheduleId); schedule == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", scheduler.ScheduleNotFoundError, scheduleId))
+		} else {
+			context.JSON(http.StatusOK, schedule)
+		}
+	})
+
+	group.PUT("/schedules/:scheduleId", func(context *gin.Context) {
+		schedule := scheduler.Schedule{}
+		if err := decodeJSON(context, &schedule); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		schedule.Id = context.Param("scheduleId")
+		if updated, err := schedules.UpdateSchedule(schedule); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusOK, updated)
+		}
+	})
+
+	group.DELETE("/schedules/:scheduleId", func(context *gin.Context) {
+		if err := schedules.DeleteSchedule(context.Param("scheduleId")); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.Status(http.StatusNoContent)
+		}
+	})
+
+	group.GET("/schedules/:scheduleId/history", func(context *gin.Context) {
+		scheduleId := context.Param("scheduleId")
+		if schedules.GetSchedule(scheduleId) == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", scheduler.ScheduleNotFoundError, scheduleId))
+		} else {
+			context.JSON(http.StatusOK, ScheduleHistoryResponse{History: schedules.GetHistory(scheduleId)})
+		}
+	})
+}
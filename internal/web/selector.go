@@ -0,0 +1,86 @@
+package web
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"strconv"
+	"strings"
+)
+
+// queryList returns all the values of a query parameter, which can be repeated and/or comma separated.
+func queryList(context *gin.Context, name string) []string {
+	values := make([]string, 0)
+	for _, value := range context.QueryArray(name) {
+		for _, entry := range strings.Split(value, ",") {
+			if entry != "" {
+				values = append(values, entry)
+			}
+		}
+	}
+	return values
+}
+
+func queryInt(context *gin.Context, name string) (int, error) {
+	value := context.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return result, nil
+}
+
+func parseDeviceSelector(context *gin.Context) (devices.DeviceSelector, error) {
+	selector := devices.DeviceSelector{
+		Ids:        queryList(context, "id"),
+		Broker:     context.Query("broker"),
+		DeviceType: context.Query("deviceType"),
+		Version:    context.Query("version"),
+		Capability: context.Query("capability"),
+		Tags:       queryList(context, "tag"),
+		Group:      context.Query("group"),
+		Location:   context.Query("location"),
+		Owner:      context.Query("owner"),
+		Search:     context.Query("search"),
+	}
+	// The unnamed namespace is selected with an empty value, e.g. ?namespace=
+	if value, ok := context.GetQuery("namespace"); ok {
+		selector.Namespace = &value
+	}
+	if value := context.Query("online"); value != "" {
+		online, err := strconv.ParseBool(value)
+		if err != nil {
+			return selector, fmt.Errorf("invalid online: %q", value)
+		}
+		selector.Online = &online
+	}
+	return selector, nil
+}
+
+// parseDeviceQuery builds a device query from the query string, sort takes a DeviceInfo field name
+// optionally prefixed with '-' to sort in descending order.
+func parseDeviceQuery(context *gin.Context) (devices.DeviceQuery, error) {
+	query := devices.DeviceQuery{}
+	selector, err := parseDeviceSelector(context)
+	if err != nil {
+		return query, err
+	}
+	query.Selector = selector
+	if sort := context.Query("sort"); sort != "" {
+		query.Sort = strings.TrimPrefix(sort, "-")
+		query.Descending = strings.HasPrefix(sort, "-")
+		if !devices.IsValidSortField(query.Sort) {
+			return query, fmt.Errorf("%w: %q", devices.InvalidSortFieldError, query.Sort)
+		}
+	}
+	if query.Offset, err = queryInt(context, "offset"); err != nil {
+		return query, err
+	}
+	if query.Limit, err = queryInt(context, "limit"); err != nil {
+		return query, err
+	}
+	return query, nil
+}
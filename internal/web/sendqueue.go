@@ -0,0 +1,138 @@
+package web
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"strings"
+	"sync"
+)
+
+// sendQueueSize is the number of messages a websocket client can fall behind by before it is disconnected.
+const sendQueueSize = 256
+
+var (
+	webSocketClientsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "htmanager",
+		Name:      "websocket_clients",
+		Help:      "Number of connected websocket clients",
+	})
+	coalescedMessagesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "htmanager",
+		Name:      "websocket_coalesced_messages_total",
+		Help:      "Number of websocket messages replaced by a newer one before being sent",
+	})
+	droppedMessagesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "htmanager",
+		Name:      "websocket_dropped_messages_total",
+		Help:      "Number of websocket messages not sent because the client was too slow and was disconnected",
+	})
+	evictedClientsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "htmanager",
+		Name:      "websocket_evicted_clients_total",
+		Help:      "Number of websocket clients disconnected for being too slow",
+	})
+)
+
+// sendQueue holds the messages waiting to be written to a websocket client. A message superseding a queued
+// message, e.g. a newer diag for the same device, replaces it, so a slow client gets the latest state rather than
+// every change. The replacement is queued last, so the clients get the events in the order of their seq and can
+// resume from the last one they got.
+type sendQueue struct {
+	lock     sync.Mutex
+	messages []any
+	// keys holds the position of the queued messages which can be replaced.
+	keys   map[string]int
+	ready  chan struct{}
+	closed bool
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{keys: map[string]int{}, ready: make(chan struct{}, 1)}
+}
+
+// push queues the message, it returns false if the queue is full.
+func (q *sendQueue) push(message any) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return true
+	}
+	key := coalesceKey(message)
+	if idx, ok := q.keys[key]; ok && key != "" {
+		// Only messages with a key follow the replaced one, moving it to the tail keeps the order of the others.
+		q.messages = append(q.messages[:idx], q.messages[idx+1:]...)
+		for other, position := range q.keys {
+			if position > idx {
+				q.keys[other] = position - 1
+			}
+		}
+		q.keys[key] = len(q.messages)
+		q.messages = append(q.messages, message)
+		coalescedMessagesCounter.Inc()
+		return true
+	}
+	if len(q.messages) >= sendQueueSize {
+		return false
+	}
+	if key == "" {
+		// Messages queued before one that can't be replaced mustn't be moved after it.
+		clear(q.keys)
+	} else {
+		q.keys[key] = len(q.messages)
+	}
+	q.messages = append(q.messages, message)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take returns the queued messages and empties the queue.
+func (q *sendQueue) take() []any {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	messages := q.messages
+	q.messages = nil
+	clear(q.keys)
+	return messages
+}
+
+// close discards the queued messages and ignores any new ones, it returns the number of messages discarded.
+func (q *sendQueue) close() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	dropped := len(q.messages)
+	q.closed = true
+	q.messages = nil
+	clear(q.keys)
+	return dropped
+}
+
+// coalesceKey returns the key of the state a message carries, messages with the same key supersede each other.
+// Messages which can't be replaced, such as device removals, have no key.
+func coalesceKey(message any) string {
+	switch message := message.(type) {
+	case devices.DeviceUpdateEvent:
+		switch message.Type {
+		case devices.InfoUpdateMessage, devices.DiagUpdateMessage, devices.StatusUpdateMessage, devices.TopicsUpdateMessage,
+			LastSeenEvents, ValuesEvents:
+			return message.Id + "/" + message.Type
+		case devices.ValueUpdateMessage:
+			if value, ok := message.Data.(devices.ValueUpdateEvent); ok {
+				return message.Id + "/value/" + strings.Join(value.TopicPath, "/")
+			}
+		case devices.CommandUpdateMessage:
+			if command, ok := message.Data.(devices.Command); ok {
+				return message.Id + "/command/" + command.Id
+			}
+		case "job":
+			if job, ok := message.Data.(jobs.Job); ok {
+				return "job/" + job.Id
+			}
+		}
+	}
+	return ""
+}
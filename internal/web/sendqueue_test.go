@@ -0,0 +1,165 @@
+package web
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		message any
+		want    string
+	}{
+		{name: "Diag", message: devices.DeviceUpdateEvent{Id: "a1", Type: devices.DiagUpdateMessage}, want: "a1/diag"},
+		{name: "Last seen", message: devices.DeviceUpdateEvent{Id: "a1", Type: LastSeenEvents}, want: "a1/lastSeen"},
+		{name: "Value", message: devices.DeviceUpdateEvent{Id: "a1", Type: devices.ValueUpdateMessage,
+			Data: devices.ValueUpdateEvent{TopicPath: []string{"relay", "0"}, Value: "on"}}, want: "a1/value/relay/0"},
+		{name: "Command", message: devices.DeviceUpdateEvent{Id: "a1", Type: devices.CommandUpdateMessage,
+			Data: devices.Command{Id: "c1"}}, want: "a1/command/c1"},
+		{name: "Job", message: devices.DeviceUpdateEvent{Id: "7", Type: "job", Data: jobs.Job{Id: "7"}}, want: "job/7"},
+		{name: "Removed", message: devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage}},
+		{name: "Response", message: devices.DeviceUpdateEvent{Id: "a1", Type: devices.ResponseMessage}},
+		{name: "Command result", message: WebSocketCommandResponse{Type: "result", RequestId: "r1"}},
+		{name: "Init", message: WebSocketInitMessage{Type: "init"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalesceKey(tt.message); got != tt.want {
+				t.Errorf("coalesceKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	diag := func(id string, uptime int) devices.DeviceUpdateEvent {
+		return devices.DeviceUpdateEvent{Id: id, Type: devices.DiagUpdateMessage, Data: uptime}
+	}
+	removed := devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage}
+	tests := []struct {
+		name   string
+		pushed []any
+		want   []any
+	}{
+		{name: "Newer state replaces older", pushed: []any{diag("a1", 1), diag("b2", 1), diag("a1", 2)},
+			want: []any{diag("b2", 1), diag("a1", 2)}},
+		{name: "Replaced twice", pushed: []any{diag("a1", 1), diag("b2", 1), diag("c3", 1), diag("a1", 2), diag("b2", 2), diag("a1", 3)},
+			want: []any{diag("c3", 1), diag("b2", 2), diag("a1", 3)}},
+		{name: "Not across a message without key", pushed: []any{diag("a1", 1), removed, diag("a1", 2)},
+			want: []any{diag("a1", 1), removed, diag("a1", 2)}},
+		{name: "Messages without key are kept", pushed: []any{removed, removed}, want: []any{removed, removed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := newSendQueue()
+			for _, message := range tt.pushed {
+				if !queue.push(message) {
+					t.Fatalf("push(%+v) = false", message)
+				}
+			}
+			select {
+			case <-queue.ready:
+			default:
+				t.Errorf("queue not ready")
+			}
+			if got := queue.take(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("take() = %+v, want %+v", got, tt.want)
+			}
+			if got := queue.take(); len(got) != 0 {
+				t.Errorf("take() after take = %+v, want nothing", got)
+			}
+		})
+	}
+}
+
+func TestSendQueue_SeqOrder(t *testing.T) {
+	queue := newSendQueue()
+	pushed := []devices.DeviceUpdateEvent{
+		{Id: "a1", Type: devices.DiagUpdateMessage},
+		{Id: "b2", Type: devices.StatusUpdateMessage},
+		{Id: "a1", Type: devices.ValueUpdateMessage, Data: devices.ValueUpdateEvent{TopicPath: []string{"relay", "0"}}},
+		{Id: "b2", Type: devices.DiagUpdateMessage},
+		{Id: "a1", Type: devices.DiagUpdateMessage},
+		{Id: "a1", Type: devices.ValueUpdateMessage, Data: devices.ValueUpdateEvent{TopicPath: []string{"relay", "0"}}},
+		{Id: "c3", Type: devices.StatusUpdateMessage},
+		{Id: "b2", Type: devices.StatusUpdateMessage},
+	}
+	for idx, event := range pushed {
+		event.Seq = uint64(idx + 1)
+		queue.push(event)
+	}
+	seqs := make([]uint64, 0)
+	for _, message := range queue.take() {
+		seqs = append(seqs, message.(devices.DeviceUpdateEvent).Seq)
+	}
+	if want := []uint64{4, 5, 6, 7, 8}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("seqs = %v, want %v", seqs, want)
+	}
+}
+
+func TestSendQueue_Full(t *testing.T) {
+	queue := newSendQueue()
+	for i := 0; i < sendQueueSize; i++ {
+		if !queue.push(devices.DeviceUpdateEvent{Id: fmt.Sprint(i), Type: devices.DiagUpdateMessage}) {
+			t.Fatalf("push() = false after %d messages", i)
+		}
+	}
+	// A message replacing a queued one still fits.
+	if !queue.push(devices.DeviceUpdateEvent{Id: "0", Type: devices.DiagUpdateMessage}) {
+		t.Errorf("push() = false, want the diag to replace the queued one")
+	}
+	queue.take()
+	for i := 0; i < sendQueueSize; i++ {
+		queue.push(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage})
+	}
+	if queue.push(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage}) {
+		t.Errorf("push() = true, want the queue full")
+	}
+	if dropped := queue.close(); dropped != sendQueueSize {
+		t.Errorf("close() = %d, want %d", dropped, sendQueueSize)
+	}
+	if !queue.push(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage}) || len(queue.take()) != 0 {
+		t.Errorf("closed queue kept a message")
+	}
+}
+
+func TestWebSocketConnection_Evict(t *testing.T) {
+	evicted := testutil.ToFloat64(evictedClientsCounter)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		// Without a writer, as for a client which doesn't read, the queue fills up.
+		connection := WebSocketConnection{ws: ws, queue: newSendQueue()}
+		for i := 0; i <= sendQueueSize; i++ {
+			connection.send(devices.DeviceUpdateEvent{Id: "a1", Type: devices.DeviceRemovedMessage})
+		}
+	}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Errorf("read a message, want the connection closed")
+	} else if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+		t.Errorf("connection not closed")
+	}
+	if got := testutil.ToFloat64(evictedClientsCounter); got != evicted+1 {
+		t.Errorf("evicted clients = %v, want %v", got, evicted+1)
+	}
+}
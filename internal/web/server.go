@@ -0,0 +1,204 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnixPrefix marks a listen address as the path of a unix socket.
+const UnixPrefix = "unix:"
+
+var (
+	InvalidServerConfigError = errors.New("invalid server config")
+	// ClientCertificateRequiredError is an API request over TLS without a certificate signed by the client CAs.
+	ClientCertificateRequiredError = errors.New("client certificate required")
+)
+
+// ServerConfig says where and how the web server listens.
+type ServerConfig struct {
+	// Addresses are host:port TCP addresses or unix:<path> unix sockets.
+	Addresses []string
+	// CertFile and KeyFile enable HTTPS on the TCP addresses, they are reloaded when either changes.
+	CertFile string
+	KeyFile  string
+	// RedirectAddress serves redirects from plain HTTP to the first HTTPS address.
+	RedirectAddress string
+	// ClientCAFile requires requests under /api over TLS to present a certificate signed by one of its CAs. This
+	// includes the requests and websocket of the frontend, so browsers need a certificate as well. Requests over
+	// unix sockets are trusted.
+	ClientCAFile string
+	// ShutdownTimeout is how long the requests being handled have to complete once the server shuts down.
+	ShutdownTimeout time.Duration
+	// AllowFirmwareUpload enables PUT /api/firmware/:name. Anyone who can reach the API can then have the devices
+	// run firmware of their choosing, so only enable it where the API is restricted, e.g. with ClientCAFile.
+	AllowFirmwareUpload bool
+}
+
+func (c *ServerConfig) validate() error {
+	if len(c.Addresses) == 0 {
+		return fmt.Errorf("%w: no listen address", InvalidServerConfigError)
+	}
+	for _, address := range c.Addresses {
+		if address == "" || address == UnixPrefix {
+			return fmt.Errorf("%w: invalid listen address %q", InvalidServerConfigError, address)
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("%w: both a certificate and a key are needed for HTTPS", InvalidServerConfigError)
+	}
+	if c.CertFile == "" && (c.RedirectAddress != "" || c.ClientCAFile != "") {
+		return fmt.Errorf("%w: the HTTPS redirect and client certificates need a certificate and a key", InvalidServerConfigError)
+	}
+	if c.RedirectAddress != "" && c.httpsPort() == "" {
+		return fmt.Errorf("%w: the HTTPS redirect needs a TCP listen address", InvalidServerConfigError)
+	}
+	return nil
+}
+
+// httpsPort returns the port of the first TCP address, which the HTTPS redirect points to.
+func (c *ServerConfig) httpsPort() string {
+	for _, address := range c.Addresses {
+		if strings.HasPrefix(address, UnixPrefix) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			return port
+		}
+	}
+	return ""
+}
+
+func (c *ServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	certificates, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: certificates.GetCertificate, MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile != "" {
+		data, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: no certificate in %s", InvalidServerConfigError, c.ClientCAFile)
+		}
+		// The handshake succeeds without a certificate so that the frontend's files and /ping are served,
+		// requireClientCertificate rejects the requests under /api, including those of the frontend.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// listen listens on a TCP address or a unix socket, replacing a socket left by a previous run.
+func listen(address string) (net.Listener, error) {
+	path, unix := strings.CutPrefix(address, UnixPrefix)
+	if !unix {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// requireClientCertificate rejects API requests made over TLS without a verified client certificate, whether they
+// come from the frontend or another client. Requests without TLS can only come over a unix socket once HTTPS is
+// enabled.
+func requireClientCertificate(context *gin.Context) {
+	state := context.Request.TLS
+	if state == nil || len(state.VerifiedChains) > 0 {
+		return
+	}
+	if strings.HasPrefix(context.Request.URL.Path, apiV2Prefix+"/") {
+		writeAPIError(context, ClientCertificateRequiredError)
+	} else {
+		context.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: ClientCertificateRequiredError.Error()})
+	}
+}
+
+// redirectHandler redirects requests to the same URL over HTTPS on port. 308 keeps the method and body of API
+// requests.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// certReloader serves the certificate in certFile and keyFile, reloading them when either is modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate checks the files on each handshake. A certificate which fails to load, e.g. while the key hasn't
+// been replaced yet, is logged and the previous one kept until either file is modified again.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.modified() {
+		if err := r.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %s\n", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) modified() bool {
+	certTime, keyTime := modTime(r.certFile), modTime(r.keyFile)
+	return !certTime.Equal(r.certTime) || !keyTime.Equal(r.keyTime)
+}
+
+// load must be called with lock held, except from newCertReloader. The modification times are recorded even when
+// the files fail to load, so that they aren't parsed again on every handshake.
+func (r *certReloader) load() error {
+	r.certTime, r.keyTime = modTime(r.certFile), modTime(r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
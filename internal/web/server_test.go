@@ -0,0 +1,330 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCertificate writes a certificate for 127.0.0.1 signed by parent, or self-signed without one.
+func newTestCertificate(t *testing.T, name string, isCA bool, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certificate := &testCertificate{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"),
+		keyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(certificate.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certificate.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestServer_ClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "ca", true, nil)
+	serverCert := newTestCertificate(t, "server", false, nil)
+	clientCert := newTestCertificate(t, "client", false, ca)
+	config := ServerConfig{Addresses: []string{"127.0.0.1:0"}, CertFile: serverCert.certFile, KeyFile: serverCert.keyFile,
+		ClientCAFile: ca.certFile}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, _ := newTestRouter(t, config)
+	listener, err := listen(config.Addresses[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router, TLSConfig: tlsConfig}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+	withCert := tls.Certificate{Certificate: [][]byte{clientCert.cert.Raw}, PrivateKey: clientCert.key}
+	tests := []struct {
+		name       string
+		path       string
+		clientCert bool
+		wantStatus int
+	}{
+		{name: "API without certificate", path: "/api/brokers", wantStatus: http.StatusUnauthorized},
+		{name: "API v2 without certificate", path: "/api/v2/brokers", wantStatus: http.StatusUnauthorized},
+		{name: "API with certificate", path: "/api/brokers", clientCert: true, wantStatus: http.StatusOK},
+		// The frontend uses the same routes, it needs a certificate too.
+		{name: "Frontend websocket without certificate", path: "/api/ws", wantStatus: http.StatusUnauthorized},
+		{name: "Frontend events without certificate", path: "/api/events", wantStatus: http.StatusUnauthorized},
+		{name: "Outside the API", path: "/ping", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := &tls.Config{RootCAs: roots}
+			if tt.clientCert {
+				clientConfig.Certificates = []tls.Certificate{withCert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			response, err := client.Get("https://" + listener.Addr().String() + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	first := newTestCertificate(t, "first", false, nil)
+	reloader, err := newCertReloader(first.certFile, first.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func() *x509.Certificate {
+		t.Helper()
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	if cert := certificate(); cert.Subject.CommonName != "first" {
+		t.Fatalf("certificate = %s, want first", cert.Subject.CommonName)
+	}
+
+	// Replace the files as a certificate renewal would, with later modification times.
+	second := newTestCertificate(t, "second", false, nil)
+	later := time.Now().Add(time.Minute)
+	for from, to := range map[string]string{second.certFile: first.certFile, second.keyFile: first.keyFile} {
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(to, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cert := certificate(); cert.Subject.CommonName != "second" {
+		t.Errorf("certificate = %s, want second after the files changed", cert.Subject.CommonName)
+	}
+
+	// A key which doesn't load keeps the current certificate.
+	if err := os.WriteFile(first.keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(first.keyFile, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if cert := certificate(); cert.Subject.CommonName != "second" {
+		t.Errorf("certificate = %s, want second with an invalid key", cert.Subject.CommonName)
+	}
+
+	// The failed pair isn't loaded again until the files change: replacing them while keeping the modification
+	// times seen by the failed reload goes unnoticed.
+	third := newTestCertificate(t, "third", false, nil)
+	for from, to := range map[string]string{third.certFile: first.certFile, third.keyFile: first.keyFile} {
+		modified := modTime(to)
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(to, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cert := certificate(); cert.Subject.CommonName != "second" {
+		t.Errorf("certificate = %s, want second until the files change again", cert.Subject.CommonName)
+	}
+	if err := os.Chtimes(first.keyFile, later.Add(2*time.Minute), later.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if cert := certificate(); cert.Subject.CommonName != "third" {
+		t.Errorf("certificate = %s, want third once the key changed", cert.Subject.CommonName)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   string
+		host   string
+		target string
+		want   string
+	}{
+		{name: "Port", port: "8443", host: "htmanager.lan:8080", target: "/api/devices?group=kitchen",
+			want: "https://htmanager.lan:8443/api/devices?group=kitchen"},
+		{name: "Default port", port: "443", host: "htmanager.lan", target: "/", want: "https://htmanager.lan/"},
+		{name: "IPv6", port: "8443", host: "[::1]:80", target: "/ping", want: "https://[::1]:8443/ping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", tt.target, nil)
+			request.Host = tt.host
+			redirectHandler(tt.port).ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusPermanentRedirect || recorder.Header().Get("Location") != tt.want {
+				t.Errorf("redirect = %d %s, want %s", recorder.Code, recorder.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ServerConfig
+		wantErr bool
+	}{
+		{name: "Plain HTTP", config: ServerConfig{Addresses: []string{":8080", "unix:/run/htmanager.sock"}}},
+		{name: "HTTPS", config: ServerConfig{Addresses: []string{":8443"}, CertFile: "cert.pem", KeyFile: "key.pem",
+			RedirectAddress: ":8080", ClientCAFile: "ca.pem"}},
+		{name: "No address", config: ServerConfig{}, wantErr: true},
+		{name: "Empty address", config: ServerConfig{Addresses: []string{""}}, wantErr: true},
+		{name: "Certificate without key", config: ServerConfig{Addresses: []string{":8443"}, CertFile: "cert.pem"}, wantErr: true},
+		{name: "Redirect without HTTPS", config: ServerConfig{Addresses: []string{":8080"}, RedirectAddress: ":80"}, wantErr: true},
+		{name: "Redirect to a unix socket", config: ServerConfig{Addresses: []string{"unix:/run/htmanager.sock"},
+			CertFile: "cert.pem", KeyFile: "key.pem", RedirectAddress: ":80"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, InvalidServerConfigError)) {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListen_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htmanager.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listen(UnixPrefix + path)
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	listener.Close()
+}
+
+func TestInitWebServer_Shutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	metadata, err := devices.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := devices.NewDevices(devices.NewMemoryBroker().NewTransport(), metadata, devices.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htmanager.sock")
+	config := ServerConfig{Addresses: []string{UnixPrefix + path}, ShutdownTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- InitWebServer(ctx, config, d, nil, nil, jobs.NewJobManager(d, 1), nil) }()
+
+	dialer := websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return net.Dial("unix", path) }}
+	var ws *websocket.Conn
+	for deadline := time.Now().Add(5 * time.Second); ws == nil; {
+		if ws, _, err = dialer.Dial("ws://htmanager/api/ws", nil); err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer ws.Close()
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("init message: %s", err)
+	}
+
+	// Don't echo the close frame: the server may already have closed the connection.
+	ws.SetCloseHandler(func(int, string) error { return nil })
+	cancel()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		_, _, err = ws.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("websocket error = %v, want going away", err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("InitWebServer() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("InitWebServer() didn't return after shutdown")
+	}
+}
@@ -0,0 +1,172 @@
+package web
+
+import (
+	"fmt"
+	"htManager/internal/devices"
+	"reflect"
+	"slices"
+)
+
+// Event types websocket clients can subscribe to.
+const (
+	InfoEvents     = "info"
+	StatusEvents   = "status"
+	DiagEvents     = "diag"
+	LastSeenEvents = "lastSeen"
+	TopicsEvents   = "topics"
+	// ValuesEvents are the device's topic values when subscribing, then each value as it changes.
+	ValuesEvents   = "values"
+	CommandEvents  = "command"
+	ResponseEvents = "response"
+	RemovedEvents  = "removed"
+)
+
+var subscribableEvents = []string{InfoEvents, StatusEvents, DiagEvents, LastSeenEvents, TopicsEvents, ValuesEvents,
+	CommandEvents, ResponseEvents, RemovedEvents}
+
+type eventTypes map[string]bool
+
+func (e eventTypes) has(eventType string) bool {
+	return e[eventType]
+}
+
+// eventType returns the event type a client subscribes to for a device update.
+func eventType(updateType string) string {
+	if updateType == devices.ValueUpdateMessage {
+		return ValuesEvents
+	}
+	return updateType
+}
+
+// parseEventTypes returns the event types of a request, all of them if there are none.
+func parseEventTypes(names []string) (eventTypes, error) {
+	if len(names) == 0 {
+		names = subscribableEvents
+	}
+	events := eventTypes{}
+	for _, name := range names {
+		if !slices.Contains(subscribableEvents, name) {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		events[name] = true
+	}
+	return events, nil
+}
+
+// subscription is a set of devices, picked by id or by selector, and the events a client wants for them.
+type subscription struct {
+	selector devices.DeviceSelector
+	events   eventTypes
+}
+
+func newSubscription(request WebSocketClientRequest) (*subscription, error) {
+	if (len(request.Ids) == 0) == (request.Selector == nil) {
+		return nil, fmt.Errorf("subscribe needs either ids or a selector")
+	}
+	events, err := parseEventTypes(request.Events)
+	if err != nil {
+		return nil, err
+	}
+	selector := devices.DeviceSelector{Ids: request.Ids}
+	if request.Selector != nil {
+		selector = *request.Selector
+	}
+	return &subscription{selector: selector, events: events}, nil
+}
+
+// byIds reports whether the subscription only picks devices by id, which doesn't need the device's info.
+func (s *subscription) byIds() bool {
+	selector := devices.DeviceSelector{Ids: s.selector.Ids}
+	return len(s.selector.Ids) > 0 && reflect.DeepEqual(s.selector, selector)
+}
+
+type subscriptions []*subscription
+
+// events returns the event types subscribed to for the device. info is only called for selector subscriptions, a
+// removed device only matches subscriptions by id.
+func (s subscriptions) events(deviceId string, info func() *devices.DeviceInfo) eventTypes {
+	events := eventTypes{}
+	var deviceInfo *devices.DeviceInfo
+	infoLoaded := false
+	for _, subscription := range s {
+		if subscription.byIds() {
+			if !slices.Contains(subscription.selector.Ids, deviceId) {
+				continue
+			}
+		} else {
+			if !infoLoaded {
+				deviceInfo, infoLoaded = info(), true
+			}
+			if deviceInfo == nil || !subscription.selector.Matches(deviceInfo) {
+				continue
+			}
+		}
+		for eventType := range subscription.events {
+			events[eventType] = true
+		}
+	}
+	return events
+}
+
+// remove unsubscribes from events: for the ids, or with the selector subscribed to, or everything if neither is
+// given.
+func (s subscriptions) remove(ids []string, selector *devices.DeviceSelector, events eventTypes) subscriptions {
+	result := make(subscriptions, 0, len(s))
+	for _, sub := range s {
+		switch {
+		case selector != nil:
+			if reflect.DeepEqual(sub.selector, *selector) {
+				sub.removeEvents(events)
+			}
+		case len(ids) > 0:
+			if sub.byIds() {
+				var split *subscription
+				sub, split = sub.splitIds(ids)
+				if split != nil {
+					split.removeEvents(events)
+					result = append(result, split)
+				}
+			}
+		default:
+			sub.removeEvents(events)
+		}
+		if sub != nil {
+			result = append(result, sub)
+		}
+	}
+	return slices.DeleteFunc(result, func(sub *subscription) bool {
+		return len(sub.events) == 0
+	})
+}
+
+func (s *subscription) removeEvents(events eventTypes) {
+	for eventType := range events {
+		delete(s.events, eventType)
+	}
+}
+
+// splitIds moves the ids out of the subscription into a new one with the same events. It returns the subscription
+// with the other ids, nil if there are none left, and the new subscription, nil if none of the ids were moved.
+func (s *subscription) splitIds(ids []string) (*subscription, *subscription) {
+	kept := make([]string, 0, len(s.selector.Ids))
+	moved := make([]string, 0)
+	for _, id := range s.selector.Ids {
+		if slices.Contains(ids, id) {
+			moved = append(moved, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	if len(moved) == 0 {
+		return s, nil
+	}
+	split := &subscription{selector: devices.DeviceSelector{Ids: moved}, events: eventTypes{}}
+	for eventType := range s.events {
+		split.events[eventType] = true
+	}
+	if len(kept) == 0 {
+		return nil, split
+	}
+	s.selector.Ids = kept
+	return s, split
+}
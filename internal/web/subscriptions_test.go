@@ -0,0 +1,245 @@
+package web
+
+import (
+	"htManager/internal/devices"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func events(names ...string) eventTypes {
+	events := eventTypes{}
+	for _, name := range names {
+		events[name] = true
+	}
+	return events
+}
+
+func TestParseEventTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    eventTypes
+		wantErr bool
+	}{
+		{name: "All", want: events(subscribableEvents...)},
+		{name: "Some", names: []string{DiagEvents, StatusEvents}, want: events(DiagEvents, StatusEvents)},
+		{name: "Unknown", names: []string{DiagEvents, "colour"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEventTypes(tt.names)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("parseEventTypes() = %v, %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSubscription(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   WebSocketClientRequest
+		wantByIds bool
+		wantErr   bool
+	}{
+		{name: "Ids", request: WebSocketClientRequest{Ids: []string{"a1"}}, wantByIds: true},
+		{name: "Selector", request: WebSocketClientRequest{Selector: &devices.DeviceSelector{Group: "attic"}}},
+		{name: "Selector with ids", request: WebSocketClientRequest{Selector: &devices.DeviceSelector{Ids: []string{"a1"}, Group: "attic"}}},
+		{name: "Neither", request: WebSocketClientRequest{}, wantErr: true},
+		{name: "Both", request: WebSocketClientRequest{Ids: []string{"a1"}, Selector: &devices.DeviceSelector{}}, wantErr: true},
+		{name: "Unknown event", request: WebSocketClientRequest{Ids: []string{"a1"}, Events: []string{"colour"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSubscription(tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSubscription() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.byIds() != tt.wantByIds {
+				t.Errorf("byIds() = %v, want %v", got.byIds(), tt.wantByIds)
+			}
+		})
+	}
+}
+
+func TestSubscriptions_Events(t *testing.T) {
+	subs := subscriptions{
+		{selector: devices.DeviceSelector{Ids: []string{"a1", "b2"}}, events: events(DiagEvents)},
+		{selector: devices.DeviceSelector{DeviceType: "esp32"}, events: events(StatusEvents)},
+	}
+	tests := []struct {
+		name     string
+		deviceId string
+		info     *devices.DeviceInfo
+		want     eventTypes
+	}{
+		{name: "By id", deviceId: "a1", info: &devices.DeviceInfo{Id: "a1", DeviceType: "esp8266"}, want: events(DiagEvents)},
+		{name: "By id and selector", deviceId: "b2", info: &devices.DeviceInfo{Id: "b2", DeviceType: "esp32"},
+			want: events(DiagEvents, StatusEvents)},
+		{name: "By selector", deviceId: "c3", info: &devices.DeviceInfo{Id: "c3", DeviceType: "esp32"}, want: events(StatusEvents)},
+		{name: "Removed device", deviceId: "b2", want: events(DiagEvents)},
+		{name: "Neither", deviceId: "c3", info: &devices.DeviceInfo{Id: "c3", DeviceType: "esp8266"}, want: events()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subs.events(tt.deviceId, func() *devices.DeviceInfo { return tt.info }); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptions_Remove(t *testing.T) {
+	attic := devices.DeviceSelector{Group: "attic"}
+	cellar := devices.DeviceSelector{Group: "cellar"}
+	// newSubscriptions returns new subscriptions each time, as remove changes them.
+	newSubscriptions := func() subscriptions {
+		return subscriptions{
+			{selector: devices.DeviceSelector{Ids: []string{"a1", "b2"}}, events: events(DiagEvents, StatusEvents)},
+			{selector: attic, events: events(StatusEvents)},
+		}
+	}
+	tests := []struct {
+		name     string
+		ids      []string
+		selector *devices.DeviceSelector
+		events   eventTypes
+		want     subscriptions
+	}{
+		{name: "Event of an id", ids: []string{"a1"}, events: events(DiagEvents), want: subscriptions{
+			{selector: devices.DeviceSelector{Ids: []string{"a1"}}, events: events(StatusEvents)},
+			{selector: devices.DeviceSelector{Ids: []string{"b2"}}, events: events(DiagEvents, StatusEvents)},
+			{selector: attic, events: events(StatusEvents)},
+		}},
+		{name: "All events of every id", ids: []string{"a1", "b2", "c3"}, events: events(subscribableEvents...), want: subscriptions{
+			{selector: attic, events: events(StatusEvents)},
+		}},
+		{name: "Unknown id", ids: []string{"c3"}, events: events(DiagEvents), want: newSubscriptions()},
+		{name: "Selector", selector: &attic, events: events(StatusEvents), want: subscriptions{
+			{selector: devices.DeviceSelector{Ids: []string{"a1", "b2"}}, events: events(DiagEvents, StatusEvents)},
+		}},
+		{name: "Other selector", selector: &cellar, events: events(StatusEvents), want: newSubscriptions()},
+		{name: "Event everywhere", events: events(StatusEvents), want: subscriptions{
+			{selector: devices.DeviceSelector{Ids: []string{"a1", "b2"}}, events: events(DiagEvents)},
+		}},
+		{name: "Everything", events: events(subscribableEvents...), want: subscriptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newSubscriptions().remove(tt.ids, tt.selector, tt.events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("remove() = %+v, want %+v", describe(got), describe(tt.want))
+			}
+		})
+	}
+}
+
+func TestSubscription_SplitIds(t *testing.T) {
+	tests := []struct {
+		name      string
+		ids       []string
+		wantKept  []string
+		wantMoved []string
+	}{
+		{name: "Some", ids: []string{"b2", "d4"}, wantKept: []string{"a1", "c3"}, wantMoved: []string{"b2"}},
+		{name: "All", ids: []string{"c3", "b2", "a1"}, wantMoved: []string{"a1", "b2", "c3"}},
+		{name: "None", ids: []string{"d4"}, wantKept: []string{"a1", "b2", "c3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := &subscription{selector: devices.DeviceSelector{Ids: []string{"a1", "b2", "c3"}}, events: events(DiagEvents)}
+			kept, moved := sub.splitIds(tt.ids)
+			if got := subscriptionIds(kept); !slices.Equal(got, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", got, tt.wantKept)
+			}
+			if got := subscriptionIds(moved); !slices.Equal(got, tt.wantMoved) {
+				t.Errorf("moved = %v, want %v", got, tt.wantMoved)
+			}
+			if moved != nil {
+				// The events are copied, so that removing some from one doesn't change the other.
+				moved.removeEvents(events(DiagEvents))
+				if !sub.events.has(DiagEvents) {
+					t.Errorf("events shared between the split subscriptions")
+				}
+			}
+		})
+	}
+}
+
+func subscriptionIds(sub *subscription) []string {
+	if sub == nil {
+		return nil
+	}
+	return sub.selector.Ids
+}
+
+func describe(subs subscriptions) []subscription {
+	result := make([]subscription, 0, len(subs))
+	for _, sub := range subs {
+		result = append(result, *sub)
+	}
+	return result
+}
+
+func TestWebSocket_Subscribe(t *testing.T) {
+	server, broker := newTestServer(t)
+	publishTestDevice(t, broker, "a1b2c3")
+	publishTestDevice(t, broker, "d4e5f6")
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	publishStatus := func(deviceId string, status string) {
+		t.Helper()
+		if err := device.Publish("homething/"+deviceId+"/device/status", 0, false, []byte(status)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := dialWebSocket(t, server, "")
+	readUntil(t, ws, ofType("init"))
+
+	// Subscribing needs protocol version 2.
+	subscribe := WebSocketClientRequest{Cmd: "subscribe", Ids: []string{"a1b2c3"}, Events: []string{StatusEvents}}
+	sendRequest(t, ws, subscribe)
+	if message := readUntil(t, ws, ofType("error")); message.Id != "" {
+		t.Errorf("error = %+v", message)
+	}
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "hello", Version: 0})
+	readUntil(t, ws, ofType("error"))
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "hello", Version: WebSocketProtocolVersion + 1})
+	hello := readUntil(t, ws, ofType("hello"))
+	if string(hello.Data) != `{"version":2}` {
+		t.Errorf("hello = %s, want version 2", hello.Data)
+	}
+
+	// Requests are handled in order, and hello is answered after the events queued before it: once the client gets
+	// hello, the requests sent before have been handled and it has got the events they caused.
+	barrier := func() []wsMessage {
+		t.Helper()
+		sendRequest(t, ws, WebSocketClientRequest{Cmd: "hello", Version: WebSocketProtocolVersion})
+		received := make([]wsMessage, 0)
+		readUntil(t, ws, func(message wsMessage) bool {
+			if message.Type == "hello" {
+				return true
+			}
+			received = append(received, message)
+			return false
+		})
+		return received
+	}
+	sendRequest(t, ws, subscribe)
+	barrier()
+	publishStatus("a1b2c3", "online")
+	publishStatus("d4e5f6", "online")
+	received := barrier()
+	if len(received) != 1 || received[0].Id != "a1b2c3" || received[0].Type != StatusEvents {
+		t.Errorf("received %+v, want the status of a1b2c3", received)
+	}
+
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "unsubscribe", Ids: []string{"a1b2c3"}})
+	barrier()
+	publishStatus("a1b2c3", "offline")
+	if received := barrier(); len(received) != 0 {
+		t.Errorf("received %+v after unsubscribing, want nothing", received)
+	}
+}
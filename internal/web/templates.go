@@ -0,0 +1,188 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"htManager/internal/devices"
+	"htManager/internal/profiles"
+	"net/http"
+)
+
+type TemplatesResponse struct {
+	Templates []profiles.Template `json:"templates"`
+}
+
+type RenderTemplateRequest struct {
+	DeviceId  string            `json:"deviceId"`
+	Variables map[string]string `json:"variables"`
+}
+
+// ApplyTemplateRequest lists the devices to apply the template to with their variables,
+// devices matching Selector are also included using Variables.
+type ApplyTemplateRequest struct {
+	Devices   map[string]map[string]string `json:"devices"`
+	Selector  *devices.DeviceSelector      `json:"selector,omitempty"`
+	Variables map[string]string            `json:"variables,omitempty"`
+}
+
+type ApplyTemplateResponse struct {
+	Results []devices.DeviceResult `json:"results"`
+}
+
+func templateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, profiles.TemplateNotFoundError), errors.Is(err, profiles.DeviceNotFoundError):
+		return http.StatusNotFound
+	case errors.Is(err, profiles.InvalidTemplateNameError),
+		errors.Is(err, profiles.InvalidTemplateError),
+		errors.Is(err, profiles.RenderFailedError):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (r *ApplyTemplateRequest) targets(devicesManager devices.Devices) map[string]map[string]string {
+	targets := make(map[string]map[string]string)
+	if r.Selector != nil {
+		for _, info := range r.Selector.Select(devicesManager.GetDevices()) {
+			targets[info.Id] = r.Variables
+		}
+	}
+	for deviceId, variables := range r.Devices {
+		merged := make(map[string]string)
+		for name, value := range targets[deviceId] {
+			merged[name] = value
+		}
+		for name, value := range variables {
+			merged[name] = value
+		}
+		targets[deviceId] = merged
+	}
+	return targets
+}
+
+func initTemplatesAPI(group *gin.RouterGroup, devicesManager devices.Devices, templateManager profiles.TemplateManager) {
+	group.GET("/templates", func(context *gin.Context) {
+		context.JSON(http.StatusOK, TemplatesResponse{Templates: templateManager.GetTemplates()})
+	})
+
+	group.GET("/templates/:name", func(context *gin.Context) {
+		if template := templateManager.GetTemplate(context.Param("name")); template == nil {
+			context.Status(http.StatusNotFound)
+		} else {
+			context.JSON(http.StatusOK, template)
+		}
+	})
+
+	group.PUT("/templates/:name", func(context *gin.Context) {
+		template := profiles.Template{}
+		if err := context.BindJSON(&template); err != nil {
+			return
+		}
+		template.Name = context.Param("name")
+		if err := templateManager.SaveTemplate(template); err != nil {
+			context.JSON(templateErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, template)
+		}
+	})
+
+	group.DELETE("/templates/:name", func(context *gin.Context) {
+		if err := templateManager.DeleteTemplate(context.Param("name")); err != nil {
+			context.JSON(templateErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, map[string]string{})
+		}
+	})
+
+	group.POST("/templates/:name/render", func(context *gin.Context) {
+		request := RenderTemplateRequest{}
+		if err := context.BindJSON(&request); err != nil {
+			return
+		}
+		profile, err := templateManager.RenderTemplate(context.Param("name"), request.DeviceId, request.Variables)
+		if err != nil {
+			context.JSON(templateErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, DeviceProfileResponse{Profile: profile})
+		}
+	})
+
+	group.POST("/templates/:name/apply", func(context *gin.Context) {
+		request := ApplyTemplateRequest{}
+		if err := context.BindJSON(&request); err != nil {
+			return
+		}
+		results, err := templateManager.ApplyTemplate(context.Param("name"), request.targets(devicesManager))
+		if err != nil {
+			context.JSON(templateErrorStatus(err), ErrorResponse{Error: err.Error()})
+		} else {
+			context.JSON(http.StatusOK, ApplyTemplateResponse{Results: results})
+		}
+	})
+}
+
+func initTemplatesAPIv2(group *gin.RouterGroup, devicesManager devices.Devices, templateManager profiles.TemplateManager) {
+	group.GET("/templates", func(context *gin.Context) {
+		context.JSON(http.StatusOK, TemplatesResponse{Templates: templateManager.GetTemplates()})
+	})
+
+	group.GET("/templates/:name", func(context *gin.Context) {
+		name := context.Param("name")
+		if template := templateManager.GetTemplate(name); template == nil {
+			writeAPIError(context, fmt.Errorf("%w: %s", profiles.TemplateNotFoundError, name))
+		} else {
+			context.JSON(http.StatusOK, template)
+		}
+	})
+
+	group.PUT("/templates/:name", func(context *gin.Context) {
+		template := profiles.Template{}
+		if err := decodeJSON(context, &template); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		template.Name = context.Param("name")
+		if err := templateManager.SaveTemplate(template); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusOK, template)
+		}
+	})
+
+	group.DELETE("/templates/:name", func(context *gin.Context) {
+		if err := templateManager.DeleteTemplate(context.Param("name")); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.Status(http.StatusNoContent)
+		}
+	})
+
+	group.POST("/templates/:name/render", func(context *gin.Context) {
+		request := RenderTemplateRequest{}
+		if err := decodeJSON(context, &request); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		if profile, err := templateManager.RenderTemplate(context.Param("name"), request.DeviceId, request.Variables); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusOK, DeviceProfileResponse{Profile: profile})
+		}
+	})
+
+	group.POST("/templates/:name/apply", func(context *gin.Context) {
+		request := ApplyTemplateRequest{}
+		if err := decodeJSON(context, &request); err != nil {
+			writeAPIError(context, err)
+			return
+		}
+		if results, err := templateManager.ApplyTemplate(context.Param("name"), request.targets(devicesManager)); err != nil {
+			writeAPIError(context, err)
+		} else {
+			context.JSON(http.StatusOK, ApplyTemplateResponse{Results: results})
+		}
+	})
+}
@@ -1,15 +1,101 @@
 package web
 
 import (
+	"context"
 	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"htManager/internal/profiles"
+	"htManager/internal/scheduler"
 	"htManager/internal/updates"
+	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func InitWebServer(devices devices.Devices, updateManager updates.UpdateManager) {
+// InitWebServer serves the web UI and API on the configured addresses until ctx is done or one of them fails. It
+// then stops accepting connections, closes websockets and event streams, and waits up to ShutdownTimeout for the
+// requests being handled.
+func InitWebServer(ctx context.Context, config ServerConfig, devices devices.Devices, updateManager updates.UpdateManager, templateManager profiles.TemplateManager, jobManager jobs.JobManager, schedules scheduler.Scheduler) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	r := newRouter(config, devices, updateManager, templateManager, jobManager, schedules)
+	// Requests' contexts are cancelled when serveCtx is, which ends websockets and event streams. Shutdown doesn't
+	// wait for hijacked connections, handlers tracks them along with the other requests.
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handlers := sync.WaitGroup{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		r.ServeHTTP(w, request)
+	})
+	baseContext := func(net.Listener) context.Context { return serveCtx }
+	servers := make([]*http.Server, 0, len(config.Addresses)+1)
+	errs := make(chan error, len(config.Addresses)+1)
+	for _, address := range config.Addresses {
+		listener, err := listen(address)
+		if err != nil {
+			for _, server := range servers {
+				server.Close()
+			}
+			return err
+		}
+		server := &http.Server{Handler: handler, BaseContext: baseContext}
+		servers = append(servers, server)
+		if tlsConfig != nil && !strings.HasPrefix(address, UnixPrefix) {
+			server.TLSConfig = tlsConfig
+			log.Printf("Serving HTTPS on %s\n", address)
+			go func() { errs <- server.ServeTLS(listener, "", "") }()
+		} else {
+			log.Printf("Serving HTTP on %s\n", address)
+			go func() { errs <- server.Serve(listener) }()
+		}
+	}
+	if config.RedirectAddress != "" {
+		server := &http.Server{Addr: config.RedirectAddress, Handler: redirectHandler(config.httpsPort())}
+		servers = append(servers, server)
+		log.Printf("Redirecting HTTP on %s to HTTPS\n", config.RedirectAddress)
+		go func() { errs <- server.ListenAndServe() }()
+	}
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down web server")
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelShutdown()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Closing connections still in use: %s\n", err)
+			server.Close()
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Printf("Requests still running after shutdown: %s\n", shutdownCtx.Err())
+	}
+	return err
+}
+
+func newRouter(config ServerConfig, devices devices.Devices, updateManager updates.UpdateManager, templateManager profiles.TemplateManager, jobManager jobs.JobManager, schedules scheduler.Scheduler) *gin.Engine {
 	r := gin.Default()
 	r.SetTrustedProxies(nil)
 	r.GET("/ping", func(c *gin.Context) {
@@ -20,8 +106,30 @@ func InitWebServer(devices devices.Devices, updateManager updates.UpdateManager)
 	r.GET("/metrics", func(c *gin.Context) {
 		promhttp.Handler().ServeHTTP(c.Writer, c.Request)
 	})
-	initAPI(r.Group("/api"), devices, updateManager)
+	api := r.Group("/api")
+	v2 := r.Group(apiV2Prefix)
+	if config.ClientCAFile != "" {
+		api.Use(requireClientCertificate)
+		v2.Use(requireClientCertificate)
+	}
+	events := newEventBuffer(eventBufferSize)
+	devices.RegisterUpdateNotificationClient(events)
+	initAPI(api, devices, updateManager, jobManager, events)
+	initEventsAPI(api, events)
+	initTemplatesAPI(api, devices, templateManager)
+	initBackupAPI(api, devices)
+	initMetadataAPI(api, devices)
+	initJobsAPI(api, jobManager)
+	initSchedulesAPI(api, schedules)
+	initFirmwareAPI(api, updateManager, config.AllowFirmwareUpload)
+	initOpenAPI(api)
+
+	initAPIv2(v2, devices, updateManager)
+	initJobsAPIv2(v2, jobManager)
+	initSchedulesAPIv2(v2, schedules)
+	initTemplatesAPIv2(v2, devices, templateManager)
+	initFirmwareAPIv2(v2, updateManager, config.AllowFirmwareUpload)
 
 	initFrontend(r)
-	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+	return r
 }
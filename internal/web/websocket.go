@@ -5,24 +5,78 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"htManager/internal/devices"
+	"htManager/internal/jobs"
 	"log"
+	"sync"
 	"time"
 )
 
 type WebSocketInitMessage struct {
-	Type string               `json:"type"`
-	Data []devices.DeviceInfo `json:"data"`
+	Type  string               `json:"type"`
+	Data  []devices.DeviceInfo `json:"data"`
+	Total int                  `json:"total"`
+	// Seq is the sequence number of the last event the device list includes, and Instance the htManager process which
+	// numbered it. A client resumes with <instance>-<seq>.
+	Seq      uint64 `json:"seq"`
+	Instance string `json:"instance"`
 }
 
+// WebSocketProtocolVersion is the latest version of the websocket protocol, clients ask for it with a hello
+// request. Version 1 sends device list updates to every client and everything about the selected device, version 2
+// only sends the events the client has subscribed to.
+const WebSocketProtocolVersion = 2
+
+const (
+	// pongWait is how long the client has to answer a ping, pings are sent every pingPeriod.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	writeWait  = 10 * time.Second
+)
+
 type WebSocketConnection struct {
 	ws             *websocket.Conn
 	devices        devices.Devices
+	jobs           jobs.JobManager
+	events         *eventBuffer
+	query          devices.DeviceQuery
+	lock           sync.Mutex
+	version        int
 	selectedDevice string
+	subscriptions  subscriptions
+	queue          *sendQueue
+	evictOnce      sync.Once
+	// commandRequests holds the request ids of the commands sent by the client, by device command id.
+	commandRequests map[string]string
+	// resume is set if the client reconnects and wants the events after resumeFrom instead of the device list.
+	resume     bool
+	resumeFrom eventId
+	// closing is done when the server shuts down.
+	closing <-chan struct{}
 }
 
 type WebSocketClientRequest struct {
 	Cmd string `json:"cmd"`
 	Id  string `json:"id"`
+	// Version is the protocol version asked for by hello.
+	Version int `json:"version,omitempty"`
+	// Ids or Selector pick the devices to subscribe to or unsubscribe from, and Events the event types, all of
+	// them if empty.
+	Ids      []string                `json:"ids,omitempty"`
+	Selector *devices.DeviceSelector `json:"selector,omitempty"`
+	Events   []string                `json:"events,omitempty"`
+	// RequestId is returned with the result and progress of a command.
+	RequestId string        `json:"requestId,omitempty"`
+	Command   *jobs.Command `json:"command,omitempty"`
+}
+
+type WebSocketHello struct {
+	Version int `json:"version"`
+}
+
+// WebSocketResumed follows the events replayed to a client which resumed, Seq is the last of them.
+type WebSocketResumed struct {
+	Seq      uint64 `json:"seq"`
+	Instance string `json:"instance"`
 }
 
 type LastSeenUpdate struct {
@@ -31,18 +85,28 @@ type LastSeenUpdate struct {
 
 func (c *WebSocketConnection) handleConnection() {
 	log.Println("Handle Connection starting...")
-	initMsg := WebSocketInitMessage{Type: "init", Data: c.devices.GetDevices()}
-	if bytes, err := json.Marshal(initMsg); err == nil {
-		if err := c.ws.WriteMessage(websocket.TextMessage, bytes); err != nil {
-			log.Printf("Failed to send init message: %s\n", err)
-		}
-	} else {
-		log.Printf("Failed to marshal init message: %s\n", err)
-	}
-	log.Println("Init message sent")
-
-	c.devices.RegisterUpdateNotificationClient(c)
-	defer func() { c.devices.UnregisterUpdateNotificationClient(c) }()
+	c.queue = newSendQueue()
+	c.commandRequests = map[string]string{}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.writeMessages(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	webSocketClientsGauge.Inc()
+	defer webSocketClientsGauge.Dec()
+	c.events.listen(c, c.start)
+	defer c.events.unlisten(c)
+	c.jobs.RegisterJobNotificationClient(c)
+	defer func() { c.jobs.UnregisterJobNotificationClient(c) }()
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	log.Println("Starting to receive ws messages...")
 	for {
 		//Read Message from client
@@ -57,95 +121,275 @@ func (c *WebSocketConnection) handleConnection() {
 			continue
 		}
 		switch request.Cmd {
+		case "hello":
+			c.hello(request)
+			break
 		case "selectDevice":
+			c.lock.Lock()
 			c.selectedDevice = request.Id
-			c.deviceSelected()
+			c.lock.Unlock()
+			c.deviceSelected(request.Id)
 			break
 		case "unselectDevice":
+			c.lock.Lock()
 			if c.selectedDevice == request.Id {
 				c.selectedDevice = ""
 			}
+			c.lock.Unlock()
+			break
+		case "subscribe":
+			c.subscribe(request)
+			break
+		case "unsubscribe":
+			c.unsubscribe(request)
+			break
+		case "command":
+			// Sending a command waits for the broker, the client can send other requests meanwhile.
+			go c.runCommand(request)
 			break
 		default:
 			log.Printf("Unknown request: %s", request.Cmd)
+			c.sendError(request, fmt.Errorf("unknown request %q", request.Cmd))
 		}
 	}
 	log.Println("Finished ws receive")
 }
 
-func (c *WebSocketConnection) deviceSelected() {
-	if diag := c.devices.GetDeviceDiag(c.selectedDevice); diag != nil {
-		c.sendUpdateMessage(devices.DeviceUpdateEvent{
-			Id:   c.selectedDevice,
-			Type: devices.DiagUpdateMessage,
-			Data: diag,
-		})
+// start sends the events the client missed if it resumes and they are still buffered, or else the device list. A
+// client resuming from before htManager restarted gets the device list.
+func (c *WebSocketConnection) start(last eventId, buffered []devices.DeviceUpdateEvent) {
+	if c.resume {
+		replay, complete := eventsSince(buffered, last, c.resumeFrom)
+		// Replaying more than the client can queue would disconnect it, the device list is cheaper then.
+		if complete && len(replay) < sendQueueSize {
+			for _, event := range replay {
+				c.send(event)
+			}
+			c.send(devices.DeviceUpdateEvent{Type: "resumed", Data: WebSocketResumed{Seq: last.seq, Instance: last.instance}})
+			return
+		}
 	}
-	if topics := c.devices.GetDeviceTopics(c.selectedDevice); topics != nil {
-		c.sendUpdateMessage(devices.DeviceUpdateEvent{
-			Id:   c.selectedDevice,
-			Type: devices.TopicsUpdateMessage,
-			Data: topics,
-		})
+	deviceList, total, err := c.query.Apply(c.devices.GetDevices())
+	if err != nil {
+		log.Printf("Failed to apply device query: %s\n", err)
+		deviceList = []devices.DeviceInfo{}
 	}
+	c.send(WebSocketInitMessage{Type: "init", Data: deviceList, Total: total, Seq: last.seq, Instance: last.instance})
+}
 
-	if values := c.devices.GetDeviceTopicValues(c.selectedDevice); values != nil {
-		c.sendUpdateMessage(devices.DeviceUpdateEvent{
-			Id:   c.selectedDevice,
-			Type: "values",
-			Data: values,
-		})
+func (c *WebSocketConnection) hello(request WebSocketClientRequest) {
+	if request.Version < 1 {
+		c.sendError(request, fmt.Errorf("invalid protocol version %d", request.Version))
+		return
 	}
+	version := min(request.Version, WebSocketProtocolVersion)
+	c.lock.Lock()
+	c.version = version
+	c.lock.Unlock()
+	c.send(devices.DeviceUpdateEvent{Id: request.Id, Type: "hello", Data: WebSocketHello{Version: version}})
 }
 
-func (c *WebSocketConnection) DeviceUpdated(event devices.DeviceUpdateEvent) {
-	if event.Id == c.selectedDevice {
-		if err := c.sendUpdateMessage(event); err != nil {
-			log.Printf("Error while sending ws message: %s", err)
-			return
+func (c *WebSocketConnection) subscribe(request WebSocketClientRequest) {
+	c.lock.Lock()
+	version := c.version
+	c.lock.Unlock()
+	if version < 2 {
+		c.sendError(request, fmt.Errorf("subscribe needs protocol version 2, send hello first"))
+		return
+	}
+	subscription, err := newSubscription(request)
+	if err != nil {
+		c.sendError(request, err)
+		return
+	}
+	c.lock.Lock()
+	c.subscriptions = append(c.subscriptions, subscription)
+	c.lock.Unlock()
+	for _, info := range c.devices.GetDevices() {
+		if subscription.selector.Matches(&info) {
+			c.sendSnapshot(info, subscription.events)
+		}
+	}
+}
+
+func (c *WebSocketConnection) unsubscribe(request WebSocketClientRequest) {
+	events, err := parseEventTypes(request.Events)
+	if err != nil {
+		c.sendError(request, err)
+		return
+	}
+	c.lock.Lock()
+	c.subscriptions = c.subscriptions.remove(request.Ids, request.Selector, events)
+	c.lock.Unlock()
+}
+
+// deviceSelected sends the state of the device the client has selected.
+func (c *WebSocketConnection) deviceSelected(deviceId string) {
+	if info := c.devices.GetDeviceInfo(deviceId); info != nil {
+		c.sendSnapshot(*info, eventTypes{DiagEvents: true, TopicsEvents: true, ValuesEvents: true})
+	}
+}
+
+// sendSnapshot sends the current state of the device for the event types.
+func (c *WebSocketConnection) sendSnapshot(info devices.DeviceInfo, events eventTypes) {
+	if events.has(InfoEvents) {
+		c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: devices.InfoUpdateMessage, Data: info})
+	}
+	if events.has(StatusEvents) {
+		if status := c.devices.GetDeviceStatus(info.Id); status != nil {
+			c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: devices.StatusUpdateMessage, Data: *status})
+		}
+	}
+	if events.has(DiagEvents) {
+		if diag := c.devices.GetDeviceDiag(info.Id); diag != nil {
+			c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: devices.DiagUpdateMessage, Data: diag})
+		}
+	}
+	if events.has(LastSeenEvents) && info.LastSeen != nil {
+		c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: LastSeenEvents, Data: LastSeenUpdate{LastSeen: info.LastSeen}})
+	}
+	if events.has(TopicsEvents) {
+		if topics := c.devices.GetDeviceTopics(info.Id); topics != nil {
+			c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: devices.TopicsUpdateMessage, Data: topics})
+		}
+	}
+	if events.has(ValuesEvents) {
+		if values := c.devices.GetDeviceTopicValues(info.Id); values != nil {
+			c.send(devices.DeviceUpdateEvent{Id: info.Id, Type: ValuesEvents, Data: values})
 		}
 	}
+}
+
+func (c *WebSocketConnection) sendError(request WebSocketClientRequest, err error) {
+	c.send(devices.DeviceUpdateEvent{Id: request.Id, Type: "error", Data: ErrorResponse{Error: err.Error()}})
+}
+
+func (c *WebSocketConnection) DeviceUpdated(event devices.DeviceUpdateEvent) {
+	c.lock.Lock()
+	version := c.version
+	selected := event.Id == c.selectedDevice
+	subscribed := c.subscriptions.events(event.Id, func() *devices.DeviceInfo {
+		return c.devices.GetDeviceInfo(event.Id)
+	})
+	c.lock.Unlock()
+	if command, ok := event.Data.(devices.Command); ok {
+		c.commandProgress(command)
+	}
+	if version >= 2 {
+		c.sendSubscribed(event, selected, subscribed)
+		return
+	}
+	if selected {
+		c.send(event)
+	}
 	switch event.Type {
-	case devices.InfoUpdateMessage:
-		if event.Id != c.selectedDevice {
-			if err := c.sendUpdateMessage(event); err != nil {
-				log.Printf("Error while sending ws message: %s", err)
-				return
-			}
+	case devices.InfoUpdateMessage, devices.CommandUpdateMessage:
+		if !selected {
+			c.send(event)
 		}
 		break
 	case devices.DiagUpdateMessage:
-		if diag, ok := event.Data.(devices.DeviceDiag); ok {
-			lastSeen := LastSeenUpdate{LastSeen: diag.LastSeen}
-			msg := devices.DeviceUpdateEvent{
-				Id:   event.Id,
-				Type: "lastSeen",
-				Data: lastSeen,
-			}
-			if err := c.sendUpdateMessage(msg); err != nil {
-				log.Printf("Error while sending ws message: %s", err)
-				return
-			}
+		if msg, ok := lastSeenEvent(event); ok {
+			c.send(msg)
 		}
 		break
 	case devices.DeviceRemovedMessage:
-		if err := c.sendUpdateMessage(event); err != nil {
-			log.Printf("Error while sending ws message: %s", err)
-			return
-		}
+		c.send(event)
 	default:
 		break
 	}
 }
 
-func (c *WebSocketConnection) sendUpdateMessage(updateMessage devices.DeviceUpdateEvent) error {
-	msg, err := json.Marshal(updateMessage)
-	if err != nil {
-		return err
+// sendSubscribed sends the event to a protocol version 2 client if it has subscribed to it.
+func (c *WebSocketConnection) sendSubscribed(event devices.DeviceUpdateEvent, selected bool, subscribed eventTypes) {
+	if selected || subscribed.has(eventType(event.Type)) {
+		c.send(event)
+	}
+	if event.Type == devices.DiagUpdateMessage && subscribed.has(LastSeenEvents) {
+		if msg, ok := lastSeenEvent(event); ok {
+			c.send(msg)
+		}
+	}
+}
+
+func lastSeenEvent(event devices.DeviceUpdateEvent) (devices.DeviceUpdateEvent, bool) {
+	diag, ok := event.Data.(devices.DeviceDiag)
+	if !ok {
+		return devices.DeviceUpdateEvent{}, false
 	}
-	if err := c.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-		log.Printf("Error while sending ws message: %s", err)
-		return err
+	return devices.DeviceUpdateEvent{
+		Id:   event.Id,
+		Type: LastSeenEvents,
+		Data: LastSeenUpdate{LastSeen: diag.LastSeen},
+	}, true
+}
+
+func (c *WebSocketConnection) JobUpdated(job jobs.Job) {
+	c.send(devices.DeviceUpdateEvent{
+		Id:   job.Id,
+		Type: "job",
+		Data: job,
+	})
+}
+
+// send queues the message for the writer goroutine, a client which has fallen too far behind is disconnected.
+func (c *WebSocketConnection) send(message any) {
+	if !c.queue.push(message) {
+		c.evictOnce.Do(c.evict)
+	}
+}
+
+func (c *WebSocketConnection) evict() {
+	dropped := c.queue.close() + 1
+	droppedMessagesCounter.Add(float64(dropped))
+	evictedClientsCounter.Inc()
+	log.Printf("Disconnecting slow websocket client %s, %d messages dropped\n", c.ws.RemoteAddr(), dropped)
+	// Ends the read loop, which stops the writer.
+	c.ws.Close()
+}
+
+// writeMessages is the only goroutine writing to the websocket, it sends the queued messages and keepalive pings.
+func (c *WebSocketConnection) writeMessages(stop chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.queue.ready:
+			for _, message := range c.queue.take() {
+				if err := c.write(message); err != nil {
+					log.Printf("Error while sending ws message: %s", err)
+					c.ws.Close()
+					return
+				}
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Printf("Error while sending ws ping: %s", err)
+				c.ws.Close()
+				return
+			}
+		case <-c.closing:
+			// Closing the connection ends the read loop, which stops the writer.
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			if err := c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+				log.Printf("Error while sending ws close: %s", err)
+			}
+			c.ws.Close()
+			c.queue.close()
+			return
+		case <-stop:
+			c.queue.close()
+			return
+		}
+	}
+}
+
+func (c *WebSocketConnection) write(message any) error {
+	msg, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to marshal ws message: %s", err)
+		return nil
 	}
-	return nil
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, msg)
 }
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"htManager/internal/devices"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsMessage holds the fields of the websocket messages the tests look at.
+type wsMessage struct {
+	Type      string           `json:"type"`
+	Id        string           `json:"id"`
+	RequestId string           `json:"requestId"`
+	Status    string           `json:"status"`
+	Seq       uint64           `json:"seq"`
+	Instance  string           `json:"instance"`
+	Command   *devices.Command `json:"command"`
+	Data      json.RawMessage  `json:"data"`
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *devices.MemoryBroker) {
+	t.Helper()
+	router, broker := newTestRouter(t, ServerConfig{})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, broker
+}
+
+// dialWebSocket connects to the server's websocket, query is added to its URL.
+func dialWebSocket(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws" + query
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func sendRequest(t *testing.T, ws *websocket.Conn, request WebSocketClientRequest) {
+	t.Helper()
+	if err := ws.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readUntil reads messages until one matches, and returns it.
+func readUntil(t *testing.T, ws *websocket.Conn, matches func(message wsMessage) bool) wsMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		message := wsMessage{}
+		if err := ws.ReadJSON(&message); err != nil {
+			t.Fatalf("reading websocket: %s", err)
+		}
+		if matches(message) {
+			return message
+		}
+	}
+}
+
+func ofType(messageType string) func(message wsMessage) bool {
+	return func(message wsMessage) bool { return message.Type == messageType }
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"fmt"
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+)
+
+// RemoveCommand removes a device, it is only available over the websocket.
+const RemoveCommand = "remove"
+
+// Command states reported to the websocket client which sent the command.
+const (
+	CommandSent   = "sent"
+	CommandFailed = "failed"
+)
+
+// WebSocketCommandResponse answers a command request, identified by the request id. A "result" message says whether
+// the command was sent, then "progress" messages follow the device acting on it.
+type WebSocketCommandResponse struct {
+	Type      string           `json:"type"`
+	RequestId string           `json:"requestId"`
+	Id        string           `json:"id"`
+	Status    string           `json:"status,omitempty"`
+	Error     *ErrorResponse   `json:"error,omitempty"`
+	Command   *devices.Command `json:"command,omitempty"`
+}
+
+// runCommand sends a command to a device, the outcome is reported with the request id.
+func (c *WebSocketConnection) runCommand(request WebSocketClientRequest) {
+	result := WebSocketCommandResponse{Type: "result", RequestId: request.RequestId, Id: request.Id}
+	commandId, err := c.executeCommand(request)
+	if err != nil {
+		errorResponse := newErrorResponse(err)
+		result.Status = CommandFailed
+		result.Error = &errorResponse
+		c.send(result)
+		return
+	}
+	result.Status = CommandSent
+	result.Command = c.trackCommand(request, commandId)
+	c.send(result)
+	if result.Command != nil {
+		c.checkTrackedCommand(*result.Command)
+	}
+}
+
+// executeCommand runs the request's command, it returns the id of the ctrl command sent if there is one.
+func (c *WebSocketConnection) executeCommand(request WebSocketClientRequest) (string, error) {
+	if request.Command == nil {
+		return "", fmt.Errorf("%w: missing command", jobs.InvalidCommandError)
+	}
+	if request.Command.Command == RemoveCommand {
+		return "", c.devices.RemoveDevice(request.Id)
+	}
+	if err := request.Command.Validate(); err != nil {
+		return "", err
+	}
+	return request.Command.Execute(c.devices, request.Id)
+}
+
+// trackCommand returns the command with the id the device was sent for the request, if it is tracked until the
+// device acts on it, and starts reporting its progress to the client.
+func (c *WebSocketConnection) trackCommand(request WebSocketClientRequest, commandId string) *devices.Command {
+	if commandId == "" {
+		return nil
+	}
+	for _, command := range c.devices.GetDeviceCommands(request.Id) {
+		if command.Id != commandId {
+			continue
+		}
+		if command.State == devices.CommandPending {
+			c.lock.Lock()
+			c.commandRequests[command.Id] = request.RequestId
+			c.lock.Unlock()
+		}
+		return &command
+	}
+	return nil
+}
+
+// checkTrackedCommand reports the progress of a command which the device acted on before it was tracked.
+func (c *WebSocketConnection) checkTrackedCommand(command devices.Command) {
+	for _, current := range c.devices.GetDeviceCommands(command.DeviceId) {
+		if current.Id == command.Id && current.State != devices.CommandPending {
+			c.commandProgress(current)
+		}
+	}
+}
+
+// commandProgress sends the progress of a command sent by the client, until the device has acted on it or it has
+// timed out.
+func (c *WebSocketConnection) commandProgress(command devices.Command) {
+	c.lock.Lock()
+	requestId, ok := c.commandRequests[command.Id]
+	if ok && command.State != devices.CommandPending {
+		delete(c.commandRequests, command.Id)
+	}
+	c.lock.Unlock()
+	if ok {
+		c.send(WebSocketCommandResponse{Type: "progress", RequestId: requestId, Id: command.DeviceId, Status: string(command.State), Command: &command})
+	}
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"testing"
+)
+
+func TestWebSocket_Command(t *testing.T) {
+	server, broker := newTestServer(t)
+	publishTestDevice(t, broker, "a1b2c3")
+	ws := dialWebSocket(t, server, "")
+	readUntil(t, ws, ofType("init"))
+
+	// Two restarts sent together are each reported with their own command.
+	restart := &jobs.Command{Command: jobs.RestartCommand}
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "command", Id: "a1b2c3", RequestId: "r1", Command: restart})
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "command", Id: "a1b2c3", RequestId: "r2", Command: restart})
+	commandIds := map[string]string{}
+	for len(commandIds) < 2 {
+		result := readUntil(t, ws, ofType("result"))
+		if result.Status != CommandSent || result.Command == nil || result.Command.State != devices.CommandPending {
+			t.Fatalf("result = %+v, want a pending command", result)
+		}
+		commandIds[result.RequestId] = result.Command.Id
+	}
+	if commandIds["r1"] == commandIds["r2"] {
+		t.Fatalf("both requests got command %s", commandIds["r1"])
+	}
+
+	// The device acknowledges the second command by its id.
+	device := broker.NewTransport()
+	if err := device.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Publish("homething/a1b2c3/device/ack", 0, false, []byte(commandIds["r2"])); err != nil {
+		t.Fatal(err)
+	}
+	progress := readUntil(t, ws, ofType("progress"))
+	if progress.RequestId != "r2" || progress.Command.Id != commandIds["r2"] || progress.Status != string(devices.CommandAcknowledged) {
+		t.Errorf("progress = %+v, want r2 acknowledged", progress)
+	}
+
+	tests := []struct {
+		name    string
+		request WebSocketClientRequest
+	}{
+		{name: "Missing command", request: WebSocketClientRequest{Cmd: "command", Id: "a1b2c3", RequestId: "r3"}},
+		{name: "Invalid command", request: WebSocketClientRequest{Cmd: "command", Id: "a1b2c3", RequestId: "r3",
+			Command: &jobs.Command{Command: jobs.UpdateCommand}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendRequest(t, ws, tt.request)
+			result := readUntil(t, ws, ofType("result"))
+			if result.RequestId != "r3" || result.Status != CommandFailed || result.Command != nil {
+				t.Errorf("result = %+v, want failed", result)
+			}
+		})
+	}
+
+	// Commands which aren't tracked are sent without a command.
+	sendRequest(t, ws, WebSocketClientRequest{Cmd: "command", Id: "a1b2c3", RequestId: "r4", Command: &jobs.Command{Command: RemoveCommand}})
+	if result := readUntil(t, ws, ofType("result")); result.Status != CommandSent || result.Command != nil {
+		t.Errorf("remove result = %+v, want sent without command", result)
+	}
+}
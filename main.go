@@ -1,23 +1,305 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"htManager/internal/broker"
+	"htManager/internal/cli"
 	"htManager/internal/devices"
+	"htManager/internal/jobs"
+	"htManager/internal/profiles"
+	"htManager/internal/scheduler"
 	"htManager/internal/updates"
 	"htManager/internal/web"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var mqttHost string
 var mqttPort int
 var updatesPath string
+var templatesPath string
+var metadataFile string
+var jobConcurrency int
+var schedulesFile string
+var embeddedBroker bool
+var brokerAddress string
+var brokerUsersFile string
+var topicPrefix string
+var namespaces string
+var brokersFile string
+var statusTopic string
+var summaryTopic string
+var summaryInterval time.Duration
+var mqttClientId string
+var persistentSession bool
+var storeDir string
+var qosSubscribe int
+var qosCommands int
+var qosRetained int
+var qos devices.QoSConfig
+var mqttVersion int
+var responseTopic string
+var updateExpiry time.Duration
+var userProperties = keyValues{}
+var commandTimeout time.Duration
+var listenAddresses string
+var tlsCert string
+var tlsKey string
+var httpRedirect string
+var clientCA string
+var allowFirmwareUpload bool
+var shutdownTimeout time.Duration
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		if err := cli.Run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.StringVar(&mqttHost, "host", "localhost", "hostname of the MQTT server to connect to.")
 	flag.StringVar(&updatesPath, "updates-path", ".", "Location of homething OTA files.")
+	flag.StringVar(&templatesPath, "templates-path", "templates", "Location of profile templates.")
+	flag.StringVar(&metadataFile, "metadata-file", "metadata.yaml", "File to store device metadata (tags, group, location...) in.")
+	flag.StringVar(&schedulesFile, "schedules-file", "schedules.yaml", "File to store scheduled maintenance actions and their history in.")
+	flag.StringVar(&topicPrefix, "topic-prefix", devices.DefaultTopicPrefix, "MQTT topic prefix devices publish under.")
+	flag.StringVar(&namespaces, "namespaces", "", "Additional namespaces to manage as a comma separated list of name=prefix, e.g. lab=lab/homething.")
 	flag.IntVar(&mqttPort, "port", 1883, "Port number of the MQTT server to connect to.")
+	flag.BoolVar(&embeddedBroker, "embedded-broker", false, "Run an MQTT broker inside htManager instead of connecting to one.")
+	flag.StringVar(&brokerAddress, "broker-address", ":1883", "Address the embedded MQTT broker listens on.")
+	flag.StringVar(&brokerUsersFile, "broker-users-file", "", "YAML file of user names and passwords allowed to connect to the embedded broker, anyone can connect if not set.")
+	flag.StringVar(&brokersFile, "brokers-file", "", "YAML file listing several MQTT brokers to manage devices on, instead of -host and -port.")
+	flag.StringVar(&statusTopic, "status-topic", devices.DefaultStatusTopic, "MQTT topic htManager publishes its online/offline status to, empty to disable.")
+	flag.StringVar(&summaryTopic, "summary-topic", devices.DefaultSummaryTopic, "MQTT topic htManager periodically publishes a summary of the devices to, empty to disable.")
+	flag.DurationVar(&summaryInterval, "summary-interval", devices.DefaultSummaryInterval, "Interval between summaries.")
+	flag.StringVar(&mqttClientId, "client-id", "", "MQTT client id, defaults to htManager-<hostname> with -persistent-session and a random id otherwise.")
+	flag.BoolVar(&persistentSession, "persistent-session", false, "Keep the MQTT session (subscriptions and queued messages) when disconnected.")
+	flag.StringVar(&storeDir, "store-dir", "", "Directory to keep in-flight QoS 1 and 2 messages in, kept in memory if not set.")
+	flag.IntVar(&qosSubscribe, "qos-subscribe", int(devices.DefaultQoS().Subscribe), "QoS of the subscriptions to device topics.")
+	flag.IntVar(&qosCommands, "qos-commands", int(devices.DefaultQoS().Commands), "QoS of commands and topic values sent to devices.")
+	flag.IntVar(&qosRetained, "qos-retained", int(devices.DefaultQoS().Retained), "QoS of retained messages cleared on device removal and of htManager's status.")
+	flag.IntVar(&mqttVersion, "mqtt-version", 3, "MQTT protocol version to connect with, 3 or 5.")
+	flag.StringVar(&responseTopic, "response-topic", devices.DefaultResponseTopic, "MQTT topic devices reply to commands on, MQTT v5 only, empty to disable.")
+	flag.Var(userProperties, "mqtt-user-property", "User property key=value added to the commands sent to devices, MQTT v5 only, can be repeated.")
+	flag.DurationVar(&updateExpiry, "update-expiry", devices.DefaultUpdateExpiry, "How long the broker keeps an update command for an offline device, MQTT v5 only, 0 for no expiry.")
+	flag.DurationVar(&commandTimeout, "command-timeout", devices.DefaultCommandTimeout, "How long a device has to act on a command before it is reported as timed out, 0 to never time out.")
+	flag.IntVar(&jobConcurrency, "job-concurrency", 4, "Number of devices a bulk command job runs against at once.")
+	flag.StringVar(&listenAddresses, "listen", ":8080", "Comma separated addresses to serve the web UI and API on, host:port or unix:<socket path>.")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file to serve HTTPS with, reloaded when it changes.")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file of -tls-cert.")
+	flag.StringVar(&httpRedirect, "http-redirect", "", "Address to redirect plain HTTP requests to HTTPS from, e.g. :80.")
+	flag.StringVar(&clientCA, "client-ca", "", "CA certificates file, API clients connecting over HTTPS, the web UI included, must present a certificate signed by one of them.")
+	flag.BoolVar(&allowFirmwareUpload, "allow-firmware-upload", false, "Accept OTA files uploaded to /api/firmware, anyone who can reach the API can then install firmware on the devices.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long requests, then commands sent by jobs, have to complete on SIGINT or SIGTERM.")
 	flag.Parse()
-	devicesManager := devices.NewDevices(fmt.Sprintf("tcp://%s:%d", mqttHost, mqttPort))
+	var err error
+	qos, err = parseQoS()
+	if err != nil {
+		log.Fatalf("Invalid QoS: %s", err)
+	}
+	metadataStore, err := devices.NewMetadataStore(metadataFile)
+	if err != nil {
+		log.Fatalf("Failed to load device metadata: %s", err)
+	}
+	var devicesManager devices.Devices
+	var mqttBroker *broker.Broker
+	if brokersFile != "" {
+		devicesManager, err = newMultiBrokerDevices(brokersFile, metadataStore)
+		if err != nil {
+			log.Fatalf("Failed to load brokers: %s", err)
+		}
+	} else {
+		devicesManager, mqttBroker = newSingleBrokerDevices(metadataStore)
+	}
 	updateManager := updates.NewUpdateManager(updatesPath)
-	web.InitWebServer(devicesManager, updateManager)
+	templateManager := profiles.NewTemplateManager(templatesPath, devicesManager)
+	jobManager := jobs.NewJobManager(devicesManager, jobConcurrency)
+	schedules, err := scheduler.NewScheduler(schedulesFile, jobManager)
+	if err != nil {
+		log.Fatalf("Failed to load schedules: %s", err)
+	}
+	serverConfig := web.ServerConfig{
+		Addresses:           strings.Split(listenAddresses, ","),
+		CertFile:            tlsCert,
+		KeyFile:             tlsKey,
+		RedirectAddress:     httpRedirect,
+		ClientCAFile:        clientCA,
+		ShutdownTimeout:     shutdownTimeout,
+		AllowFirmwareUpload: allowFirmwareUpload,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = web.InitWebServer(ctx, serverConfig, devicesManager, updateManager, templateManager, jobManager, schedules)
+	// A second signal kills htManager if shutting down takes too long.
+	stop()
+	if err != nil {
+		log.Printf("Web server failed: %s\n", err)
+	}
+	shutdown(devicesManager, jobManager, schedules, mqttBroker)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// shutdown stops the schedules, waits up to -shutdown-timeout for the commands jobs are sending and disconnects from
+// the brokers. The metadata and schedules are saved as they change, so there is nothing left to write.
+func shutdown(devicesManager devices.Devices, jobManager jobs.JobManager, schedules scheduler.Scheduler, mqttBroker *broker.Broker) {
+	schedules.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := jobManager.Close(ctx); err != nil {
+		log.Printf("Jobs still running at shutdown: %s\n", err)
+	}
+	devicesManager.Close()
+	if mqttBroker != nil {
+		if err := mqttBroker.Close(); err != nil {
+			log.Printf("Failed to stop MQTT broker: %s\n", err)
+		}
+	}
+	log.Println("Shut down")
+}
+
+// newSingleBrokerDevices connects to the broker given by -host and -port, or to the embedded broker which it also
+// returns.
+func newSingleBrokerDevices(metadataStore devices.MetadataStore) (devices.Devices, *broker.Broker) {
+	var transport devices.Transport
+	var mqttBroker *broker.Broker
+	if embeddedBroker {
+		config := broker.Config{Address: brokerAddress}
+		if brokerUsersFile != "" {
+			users, err := broker.LoadUsers(brokerUsersFile)
+			if err != nil {
+				log.Fatalf("Failed to load broker users: %s", err)
+			}
+			config.Users = users
+		}
+		var err error
+		mqttBroker, err = broker.NewBroker(config)
+		if err != nil {
+			log.Fatalf("Failed to start MQTT broker: %s", err)
+		}
+		transport = mqttBroker.Transport()
+	} else {
+		var err error
+		transport, err = devices.NewTransport(devices.MQTTConfig{
+			URL:               fmt.Sprintf("tcp://%s:%d", mqttHost, mqttPort),
+			ClientId:          mqttClientId,
+			PersistentSession: persistentSession,
+			StoreDir:          storeDir,
+			ProtocolVersion:   mqttVersion,
+		})
+		if err != nil {
+			log.Fatalf("Invalid MQTT configuration: %s", err)
+		}
+	}
+	devicesNamespaces, err := parseNamespaces(topicPrefix, namespaces)
+	if err != nil {
+		log.Fatalf("Invalid namespaces: %s", err)
+	}
+	devicesManager, err := devices.NewDevices(transport, metadataStore, newDevicesConfig(devicesNamespaces, nil))
+	if err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %s", err)
+	}
+	return devicesManager, mqttBroker
+}
+
+func newMultiBrokerDevices(path string, metadataStore devices.MetadataStore) (devices.Devices, error) {
+	configs, err := devices.LoadBrokersConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	connections := make([]devices.BrokerConnection, 0, len(configs))
+	for _, config := range configs {
+		transport, err := devices.NewTransport(config.MQTTConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", config.Label, err)
+		}
+		connections = append(connections, devices.BrokerConnection{
+			Label:     config.Label,
+			Transport: transport,
+			Config:    newDevicesConfig(config.Namespaces, config.UserProperties),
+		})
+	}
+	return devices.NewMultiDevices(connections, metadataStore)
+}
+
+// newDevicesConfig builds the configuration from the flags, brokerProperties are the user properties of a broker
+// in -brokers-file, added to those of -mqtt-user-property.
+func newDevicesConfig(namespaces []devices.Namespace, brokerProperties map[string]string) devices.Config {
+	properties := map[string]string{}
+	for key, value := range userProperties {
+		properties[key] = value
+	}
+	for key, value := range brokerProperties {
+		properties[key] = value
+	}
+	return devices.Config{
+		Namespaces:      namespaces,
+		QoS:             qos,
+		StatusTopic:     statusTopic,
+		SummaryTopic:    summaryTopic,
+		SummaryInterval: summaryInterval,
+		CommandTimeout:  commandTimeout,
+		ResponseTopic:   responseTopic,
+		UpdateExpiry:    updateExpiry,
+		UserProperties:  properties,
+		Version:         version,
+	}
+}
+
+// keyValues is a flag given as key=value, which can be repeated.
+type keyValues map[string]string
+
+func (k keyValues) String() string {
+	entries := make([]string, 0, len(k))
+	for key, value := range k {
+		entries = append(entries, key+"="+value)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (k keyValues) Set(entry string) error {
+	key, value, found := strings.Cut(entry, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", entry)
+	}
+	k[key] = value
+	return nil
+}
+
+// parseQoS checks the -qos- flags before converting them, a byte would wrap values such as 258 to a valid QoS.
+func parseQoS() (devices.QoSConfig, error) {
+	for name, value := range map[string]int{"qos-subscribe": qosSubscribe, "qos-commands": qosCommands, "qos-retained": qosRetained} {
+		if value < 0 || value > 2 {
+			return devices.QoSConfig{}, fmt.Errorf("%w: -%s %d", devices.InvalidQoSError, name, value)
+		}
+	}
+	return devices.QoSConfig{Subscribe: byte(qosSubscribe), Commands: byte(qosCommands), Retained: byte(qosRetained)}, nil
+}
+
+// parseNamespaces builds the namespaces from the unnamed namespace's prefix and a list of name=prefix.
+func parseNamespaces(prefix string, namespaces string) ([]devices.Namespace, error) {
+	result := []devices.Namespace{{Prefix: prefix}}
+	for _, entry := range strings.Split(namespaces, ",") {
+		if entry == "" {
+			continue
+		}
+		name, namespacePrefix, found := strings.Cut(entry, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("expected name=prefix, got %q", entry)
+		}
+		result = append(result, devices.Namespace{Name: name, Prefix: namespacePrefix})
+	}
+	return result, nil
 }